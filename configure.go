@@ -17,7 +17,24 @@ func configure(app *cli.App) {
 	app.Flags = s.RegisterWebFlags(app.Flags)
 	app.Flags = cs.RegisterProbeFlags(app.Flags)
 	app.Flags = cs.RegisterPprofFlags(app.Flags)
+	app.Flags = cs.RegisterPromFlags(app.Flags)
 	app.Flags = s.RegisterHLSFlags(app.Flags)
+	app.Flags = s.RegisterRunManagerFlags(app.Flags)
+	app.Flags = s.RegisterTranscoderFlags(app.Flags)
+	app.Flags = s.RegisterWorkerFlags(app.Flags)
+	app.Flags = s.RegisterWorkerPoolFlags(app.Flags)
+	app.Flags = s.RegisterInputProxyFlags(app.Flags)
+	app.Flags = s.RegisterDrainFlags(app.Flags)
+	app.Flags = s.RegisterHandoverFlags(app.Flags)
+	app.Flags = s.RegisterSessionStoreFlags(app.Flags)
+	app.Flags = s.RegisterPositionStoreFlags(app.Flags)
+	app.Flags = s.RegisterQuotaFlags(app.Flags)
+	app.Flags = s.RegisterSessionTimingFlags(app.Flags)
+	app.Flags = s.RegisterContentFlags(app.Flags)
+	app.Flags = s.RegisterURLSigningFlags(app.Flags)
+	app.Flags = s.RegisterJWTAuthFlags(app.Flags)
+	app.Flags = s.RegisterSourcePolicyFlags(app.Flags)
+	app.Flags = s.RegisterClusterFlags(app.Flags)
 	app.Action = run
 }
 
@@ -45,7 +62,18 @@ func cleanOutputDir(c *cli.Context) error {
 func run(c *cli.Context) (err error) {
 	s.ConfigureDebug(c)
 
-	if c.Bool(s.CleanOnStartupFlag) {
+	// Started by a hand-over: the output belongs to adopted runs
+	takingOver := s.TakingOver()
+
+	// Terminating FFmpeg left running by a crashed process, unless it is
+	// adopted
+	if !takingOver {
+		if err := s.ReapOrphans(c.String(s.OutputFlag)); err != nil {
+			log.WithError(err).Warn("failed to reap orphaned ffmpeg processes")
+		}
+	}
+
+	if c.Bool(s.CleanOnStartupFlag) && !takingOver {
 		if err := cleanOutputDir(c); err != nil {
 			log.WithError(err).Error("failed to clean output directory")
 			return err
@@ -54,41 +82,202 @@ func run(c *cli.Context) (err error) {
 
 	var servers []cs.Servable
 
-	// Setting ContentProbe
-	contentProbe := s.NewContentProbe(c)
+	// Setting SourcePolicy
+	sourcePolicy, err := s.NewSourcePolicy(c)
+	if err != nil {
+		return err
+	}
 
-	// Setting Probe
-	probe := cs.NewProbe(c)
-	if probe != nil {
-		servers = append(servers, probe)
-		defer probe.Close()
+	// Setting InputProxy
+	inputProxy, err := s.NewInputProxy(c, sourcePolicy)
+	if err != nil {
+		return err
+	}
+	if inputProxy != nil {
+		servers = append(servers, inputProxy)
+		defer inputProxy.Close()
 	}
 
-	// Setting Pprof
+	// Setting ContentProbe
+	contentProbe := s.NewContentProbe(c, inputProxy, sourcePolicy)
+
+	// Setting Pprof. Its port can not be passed on hand-over and stays
+	// bound by the previous process until it exits.
 	pprof := cs.NewPprof(c)
+	if pprof != nil && takingOver {
+		log.Warn("pprof is disabled after hand-over")
+		pprof = nil
+	}
 	if pprof != nil {
 		servers = append(servers, pprof)
 		defer pprof.Close()
 	}
 
+	// Setting Prom
+	prom := s.NewProm(c)
+	if prom != nil {
+		servers = append(servers, prom)
+		defer prom.Close()
+	}
+
 	// Setting TouchMap
 	touchMap := s.NewTouchMap()
 
 	// Setting HLSBuilder
 	hlsBuilder := s.NewHLSBuilder(c)
 
+	// Setting Transcoder
+	transcoder, err := s.NewTranscoder(c, inputProxy, sourcePolicy)
+	if err != nil {
+		return err
+	}
+
+	// Serving as remote transcoding worker
+	if c.Bool(s.WorkerModeFlag) {
+		probe := s.NewProbe(c, nil)
+		if probe != nil {
+			servers = append(servers, probe)
+			defer probe.Close()
+		}
+		worker, err := s.NewWorker(c, transcoder)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, worker)
+		defer worker.Close()
+		err = cs.NewServe(servers...).Serve()
+		if err != nil {
+			log.WithError(err).Error("got server error")
+		}
+		return err
+	}
+
+	// Setting SessionTimingConfig
+	timings, err := s.NewSessionTimingConfig(c)
+	if err != nil {
+		return err
+	}
+
 	// Setting RunManager
-	runManager := s.NewRunManager()
+	runManagerCfg := s.NewRunManagerConfig(c)
+	runManagerCfg.Transcoder = transcoder
+	runManagerCfg.InputProxy = inputProxy
+
+	// Setting WorkerPool
+	workerPool, err := s.NewWorkerPool(c, transcoder)
+	if err != nil {
+		return err
+	}
+	if workerPool != nil {
+		servers = append(servers, workerPool)
+		defer workerPool.Close()
+		runManagerCfg.Transcoder = workerPool
+	}
+
+	runManager := s.NewRunManager(runManagerCfg)
+
+	// Restoring runs left by a previous process
+	if runManagerCfg.CacheExpire > 0 && !c.Bool(s.CleanOnStartupFlag) && !takingOver {
+		if err := runManager.Restore(c.String(s.OutputFlag)); err != nil {
+			log.WithError(err).Warn("failed to restore runs")
+		}
+	}
+
+	// Setting SessionStore
+	sessionStore, err := s.NewSessionStore(c)
+	if err != nil {
+		return err
+	}
+	if sessionStore != nil {
+		defer sessionStore.Close()
+	}
+
+	// Setting Quota
+	quota, err := s.NewQuota(c)
+	if err != nil {
+		return err
+	}
 
 	// Setting SessionManager
-	sessionManager := s.NewSessionManager(runManager)
+	sessionManager := s.NewSessionManager(runManager, sessionStore, quota)
+
+	// Setting Metrics
+	if prom != nil {
+		if err := s.RegisterMetrics(runManager, sessionManager); err != nil {
+			return err
+		}
+	}
+
+	// Setting Handover
+	handover := s.NewHandover(c, runManager, sessionManager)
+	if handover != nil {
+		servers = append(servers, handover)
+		defer handover.Close()
+	}
+
+	// Taking over sessions and runs from the previous process
+	if takingOver {
+		if err := s.TakeOver(runManager, sessionManager, inputProxy); err != nil {
+			log.WithError(err).Error("failed to take over")
+			return err
+		}
+	}
+
+	// Setting Drainer
+	drainer := s.NewDrainer(c, sessionManager)
+	if drainer != nil {
+		servers = append(servers, drainer)
+		defer drainer.Close()
+	}
+
+	// Setting Probe
+	probe := s.NewProbe(c, drainer)
+	if probe != nil {
+		servers = append(servers, probe)
+		defer probe.Close()
+	}
+
+	// Setting Cluster
+	cluster, err := s.NewCluster(c)
+	if err != nil {
+		return err
+	}
+	if cluster != nil {
+		servers = append(servers, cluster)
+		defer cluster.Close()
+	}
+
+	// Setting PositionStore
+	positionStore, err := s.NewPositionStore(c)
+	if err != nil {
+		return err
+	}
+	if positionStore != nil {
+		defer positionStore.Close()
+	}
+
+	// Setting URLSigner
+	signer, err := s.NewURLSigner(c)
+	if err != nil {
+		return err
+	}
+
+	// Setting JWTAuth
+	auth, err := s.NewJWTAuth(c)
+	if err != nil {
+		return err
+	}
 
 	// Setting Web
-	web := s.NewWeb(c, contentProbe, hlsBuilder, sessionManager, touchMap)
+	web := s.NewWeb(c, contentProbe, hlsBuilder, sessionManager, touchMap, drainer, handover, cluster, positionStore, timings, signer, auth, sourcePolicy)
 	servers = append(servers, web)
 	defer web.Close()
 	defer runManager.CloseAll()
 
+	if handover != nil {
+		handover.AddListeners(web, probe, prom, inputProxy, workerPool)
+	}
+
 	// Setting Serve
 	serve := cs.NewServe(servers...)
 
@@ -99,5 +288,16 @@ func run(c *cli.Context) (err error) {
 		log.WithError(err).Error("got server error")
 		return err
 	}
+
+	// Letting in-flight requests finish, runs keep going in the new process
+	if handover.HandedOver() {
+		handover.Wait()
+		return nil
+	}
+
+	// Letting active sessions finish before closing runs
+	if drainer != nil {
+		drainer.Wait()
+	}
 	return err
 }
@@ -15,9 +15,209 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/content": {
+            "post": {
+                "description": "Probes media and returns the token of stateless /content URLs for it. The URLs of a source are the same for all viewers, so they can be cached by CDNs. Runs start on the first request.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "content"
+                ],
+                "summary": "Get stateless playback URLs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Source media URL (alternative to X-Source-Url header)",
+                        "name": "source_url",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Source media URL (takes priority over query param)",
+                        "name": "X-Source-Url",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/services.contentResponse"
+                        }
+                    },
+                    "307": {
+                        "description": "Redirect to the cluster node owning the content",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing or invalid source_url",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Source not allowed by the source policy",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Stateless URLs are disabled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/content/{hash}/seek-{t}/{file}": {
+            "get": {
+                "description": "Serves the master playlist, a variant playlist or a segment of the run transcoding the content from t, starting the run if needed. References in playlists carry the token. t must be a multiple of the seek quantum. Finished segments are immutable, growing playlists are cached for a second.",
+                "produces": [
+                    "application/vnd.apple.mpegurl"
+                ],
+                "tags": [
+                    "content"
+                ],
+                "summary": "Get stateless playlist or segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Content hash",
+                        "name": "hash",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Seek position in seconds",
+                        "name": "t",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "index.m3u8, a variant playlist or a segment",
+                        "name": "file",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token returned by POST /content",
+                        "name": "token",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached copy",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Playlist or segment data",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "304": {
+                        "description": "Cached copy is up to date",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "307": {
+                        "description": "Redirect to the cluster node owning the content",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Seek position not quantized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing or invalid token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found or stateless URLs are disabled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "503": {
+                        "description": "Node is handing over",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "504": {
+                        "description": "Timeout waiting for playlist or segment",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/runs": {
+            "get": {
+                "description": "Lists runs known to this node's run manager. Requires the admin token.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "List runs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer admin token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/services.runInfo"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid admin token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/session": {
             "post": {
-                "description": "Creates a new session, probes media, starts FFmpeg from position 0",
+                "description": "Creates a new session, probes media, starts FFmpeg from position 0, or from the viewer's stored position if resume is set",
                 "produces": [
                     "application/json"
                 ],
@@ -37,6 +237,78 @@ const docTemplate = `{
                         "description": "Source media URL (takes priority over query param)",
                         "name": "X-Source-Url",
                         "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Source request header as Name: value (repeatable), e.g. Authorization, Cookie, User-Agent, Referer",
+                        "name": "X-Source-Header",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer ID positions are stored for (alternative to X-Viewer-Id header)",
+                        "name": "viewer_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer ID positions are stored for (takes priority over query param)",
+                        "name": "X-Viewer-Id",
+                        "in": "header"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Start at the viewer's stored position",
+                        "name": "resume",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token quotas are counted for, signed with the quota token secret; the client IP without a valid one (alternative to X-Token header)",
+                        "name": "token",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Seconds of inactivity after which the run is released, within the admin bounds",
+                        "name": "inactivity_release",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Seconds of inactivity after which the session is removed, within the admin bounds",
+                        "name": "inactivity_expiry",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Seconds a run released by the session is kept alive for reuse, within the admin bounds",
+                        "name": "run_grace_period",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Granularity seek positions are rounded down to in seconds, within the admin bounds",
+                        "name": "seek_quantum",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Duration of HLS segments in seconds, within the admin bounds",
+                        "name": "segment_duration",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer API token, required with JWT authentication",
+                        "name": "Authorization",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -46,8 +318,32 @@ const docTemplate = `{
                             "$ref": "#/definitions/services.sessionCreateResponse"
                         }
                     },
+                    "307": {
+                        "description": "Redirect to the cluster node owning the content",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "400": {
-                        "description": "Missing or invalid source_url",
+                        "description": "Missing or invalid source_url, or timings out of bounds",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Source not allowed by the source policy or the API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "429": {
+                        "description": "Session or run quota exceeded",
                         "schema": {
                             "type": "string"
                         }
@@ -57,6 +353,12 @@ const docTemplate = `{
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "503": {
+                        "description": "Node is draining or handing over",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
@@ -70,7 +372,364 @@ const docTemplate = `{
                 "tags": [
                     "session"
                 ],
-                "summary": "Close session",
+                "summary": "Close session",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "sessionId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "boolean"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Session not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "get": {
+                "description": "Returns the state of a session held by this node and its run. Requires the admin token.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Describe session",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "sessionId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Bearer admin token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/services.sessionInfo"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid admin token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Session not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/session/{sessionId}/events": {
+            "get": {
+                "description": "Streams session state changes as server-sent events: state, seek, run_started, run_stopped, segment_ready, progress, run_error, expiring and closed. Each event carries a JSON object. The stream does not keep the session alive.",
+                "produces": [
+                    "text/event-stream"
+                ],
+                "tags": [
+                    "session"
+                ],
+                "summary": "Stream session events",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "sessionId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Event stream",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Session not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/session/{sessionId}/position": {
+            "post": {
+                "description": "Stores the viewer's playback position in movie time, a session created with resume=true by the same viewer starts there. Players send it periodically, it also keeps the session alive.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "session"
+                ],
+                "summary": "Report playback position",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "sessionId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "number",
+                        "description": "Playback position in seconds",
+                        "name": "t",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "boolean"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing or invalid t parameter, or session without viewer ID",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Session not found or positions disabled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Failed to save position",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/session/{sessionId}/seek": {
+            "get": {
+                "description": "Returns the current quantized seek position of the session",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "session"
+                ],
+                "summary": "Get current seek offset",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "sessionId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "number",
+                                "format": "float64"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Session not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Stops current FFmpeg run and starts new one from target position. Seek times are quantized to 30s boundaries.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "session"
+                ],
+                "summary": "Seek to position",
                 "parameters": [
                     {
                         "type": "string",
@@ -78,6 +737,31 @@ const docTemplate = `{
                         "name": "sessionId",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "number",
+                        "description": "Target seek time in seconds",
+                        "name": "t",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -90,25 +774,61 @@ const docTemplate = `{
                             }
                         }
                     },
+                    "400": {
+                        "description": "Missing or invalid t parameter",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "404": {
                         "description": "Session not found",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "429": {
+                        "description": "Run quota exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Seek failed",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
         },
-        "/session/{sessionId}/seek": {
+        "/session/{sessionId}/sign": {
             "post": {
-                "description": "Stops current FFmpeg run and starts new one from target position. Seek times are quantized to 30s boundaries.",
+                "description": "Returns a fresh signature of all URLs of the session. Clients renew it before the one they use expires.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "session"
                 ],
-                "summary": "Seek to position",
+                "summary": "Renew session URL signature",
                 "parameters": [
                     {
                         "type": "string",
@@ -118,37 +838,53 @@ const docTemplate = `{
                         "required": true
                     },
                     {
-                        "type": "number",
-                        "description": "Target seek time in seconds",
-                        "name": "t",
+                        "type": "integer",
+                        "description": "Expiry of the current signature",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Current signature of the session",
+                        "name": "signature",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "boolean"
-                            }
+                            "$ref": "#/definitions/services.signedQueryResponse"
                         }
                     },
-                    "400": {
-                        "description": "Missing or invalid t parameter",
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired signature, or session of another subject",
                         "schema": {
                             "type": "string"
                         }
                     },
                     "404": {
-                        "description": "Session not found",
+                        "description": "Session not found or URL signing disabled",
                         "schema": {
                             "type": "string"
                         }
                     },
-                    "500": {
-                        "description": "Seek failed",
+                    "410": {
+                        "description": "Session lifetime exceeded",
                         "schema": {
                             "type": "string"
                         }
@@ -158,7 +894,7 @@ const docTemplate = `{
         },
         "/session/{sessionId}/{segment}": {
             "get": {
-                "description": "Returns a .ts or .vtt segment. Waits for file to appear if FFmpeg hasn't produced it yet. Auto-restarts FFmpeg if it was stopped.",
+                "description": "Returns a .ts or .vtt segment once FFmpeg finalized it. With chunked segments enabled, a segment FFmpeg is still writing is streamed with chunked transfer encoding and not cached. Auto-restarts FFmpeg if it was stopped. Segments carry a strong ETag and must be revalidated, a seek reuses their names.",
                 "produces": [
                     "video/mp2t"
                 ],
@@ -180,6 +916,30 @@ const docTemplate = `{
                         "name": "segment",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached copy",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication unless the URL is signed (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -189,12 +949,36 @@ const docTemplate = `{
                             "type": "file"
                         }
                     },
+                    "304": {
+                        "description": "Cached copy is up to date",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "404": {
                         "description": "Session not found",
                         "schema": {
                             "type": "string"
                         }
                     },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "504": {
                         "description": "Timeout waiting for segment",
                         "schema": {
@@ -206,7 +990,7 @@ const docTemplate = `{
         },
         "/session/{sessionId}/{stream}.m3u8": {
             "get": {
-                "description": "Returns master playlist (index.m3u8) or variant EVENT playlist. Query params are appended to all file references for auth forwarding.",
+                "description": "Returns master playlist (index.m3u8) or variant EVENT playlist. Query params are appended to all file references for auth forwarding, with URL signing each reference gets its own signature. Playlists carry a strong ETag and must be revalidated.",
                 "produces": [
                     "application/vnd.apple.mpegurl"
                 ],
@@ -228,6 +1012,30 @@ const docTemplate = `{
                         "name": "stream",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached copy",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Expiry of the URL signature as unix time, required with URL signing",
+                        "name": "expires",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "URL signature, required with URL signing",
+                        "name": "signature",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "API token, required with JWT authentication unless the URL is signed (alternative to Authorization header)",
+                        "name": "access_token",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -237,12 +1045,36 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "304": {
+                        "description": "Cached copy is up to date",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Missing, invalid or expired URL signature, or session of another subject",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "404": {
                         "description": "Session or playlist not found",
                         "schema": {
                             "type": "string"
                         }
                     },
+                    "410": {
+                        "description": "Session lifetime exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "504": {
                         "description": "Timeout waiting for playlist",
                         "schema": {
@@ -251,9 +1083,137 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/sessions": {
+            "get": {
+                "description": "Lists sessions held by this node with their runs. Requires the admin token.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "List sessions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Bearer admin token",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/services.sessionInfo"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid admin token",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "services.SessionTimings": {
+            "type": "object",
+            "properties": {
+                "inactivity_expiry": {
+                    "type": "integer"
+                },
+                "inactivity_release": {
+                    "type": "integer"
+                },
+                "run_grace_period": {
+                    "type": "integer"
+                },
+                "seek_quantum": {
+                    "type": "integer"
+                },
+                "segment_duration": {
+                    "type": "integer"
+                }
+            }
+        },
+        "services.contentResponse": {
+            "type": "object",
+            "properties": {
+                "duration": {
+                    "type": "number"
+                },
+                "hash": {
+                    "type": "string"
+                },
+                "seek_quantum": {
+                    "description": "seek positions of URLs are multiples of it",
+                    "type": "integer"
+                },
+                "token": {
+                    "type": "string"
+                },
+                "url": {
+                    "description": "master playlist from position 0",
+                    "type": "string"
+                }
+            }
+        },
+        "services.runInfo": {
+            "type": "object",
+            "properties": {
+                "complete": {
+                    "type": "boolean"
+                },
+                "hash_dir": {
+                    "type": "string"
+                },
+                "idle_since": {
+                    "type": "string"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "low_priority": {
+                    "type": "boolean"
+                },
+                "pid": {
+                    "type": "integer"
+                },
+                "produced_duration": {
+                    "type": "number"
+                },
+                "ref_count": {
+                    "type": "integer"
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "seek_time": {
+                    "type": "number"
+                },
+                "segments": {
+                    "description": "finalized segments per stream",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "speculative": {
+                    "type": "boolean"
+                },
+                "stitched_to": {
+                    "type": "string"
+                }
+            }
+        },
         "services.sessionCreateResponse": {
             "type": "object",
             "properties": {
@@ -262,6 +1222,71 @@ const docTemplate = `{
                 },
                 "id": {
                     "type": "string"
+                },
+                "offset": {
+                    "description": "quantized seek position the session starts at",
+                    "type": "number"
+                },
+                "query": {
+                    "description": "Query signs all URLs of the session until QueryExpires, empty\nwithout URL signing",
+                    "type": "string"
+                },
+                "query_expires": {
+                    "type": "integer"
+                },
+                "timings": {
+                    "$ref": "#/definitions/services.SessionTimings"
+                }
+            }
+        },
+        "services.sessionInfo": {
+            "type": "object",
+            "properties": {
+                "deadline": {
+                    "type": "string"
+                },
+                "duration": {
+                    "type": "number"
+                },
+                "hash_dir": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "last_access": {
+                    "type": "string"
+                },
+                "playhead": {
+                    "type": "number"
+                },
+                "run": {
+                    "$ref": "#/definitions/services.runInfo"
+                },
+                "run_key": {
+                    "type": "string"
+                },
+                "seek_time": {
+                    "type": "number"
+                },
+                "source_url": {
+                    "type": "string"
+                },
+                "subject": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.signedQueryResponse": {
+            "type": "object",
+            "properties": {
+                "expires": {
+                    "description": "unix time the query expires at",
+                    "type": "integer"
+                },
+                "query": {
+                    "description": "expires and signature params for session URLs",
+                    "type": "string"
                 }
             }
         }
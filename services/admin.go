@@ -0,0 +1,248 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin API: GET /sessions, GET /session/{id} and GET /runs describe what
+// the node is doing. It is enabled by --admin-token and requires
+// "Authorization: Bearer <token>".
+
+type runInfo struct {
+	Key              string         `json:"key"`
+	HashDir          string         `json:"hash_dir"`
+	SeekTime         float64        `json:"seek_time"`
+	Pid              int            `json:"pid,omitempty"`
+	RefCount         int            `json:"ref_count"`
+	Running          bool           `json:"running"`
+	Complete         bool           `json:"complete"`
+	Speculative      bool           `json:"speculative"`
+	LowPriority      bool           `json:"low_priority"`
+	IdleSince        *time.Time     `json:"idle_since,omitempty"`
+	StitchedTo       string         `json:"stitched_to,omitempty"`
+	ProducedDuration float64        `json:"produced_duration"`
+	Segments         map[string]int `json:"segments"` // finalized segments per stream
+}
+
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	SourceURL  string    `json:"source_url"`
+	HashDir    string    `json:"hash_dir"`
+	Duration   float64   `json:"duration"`
+	SeekTime   float64   `json:"seek_time"`
+	Playhead   float64   `json:"playhead"`
+	LastAccess time.Time `json:"last_access"`
+	Subject    string    `json:"subject,omitempty"`
+	Deadline   time.Time `json:"deadline,omitzero"`
+	RunKey     string    `json:"run_key,omitempty"`
+	Run        *runInfo  `json:"run,omitempty"`
+}
+
+func (r *TranscodeRun) info() *runInfo {
+	r.mu.Lock()
+	info := &runInfo{
+		Key:         r.key,
+		HashDir:     r.hashDir,
+		SeekTime:    r.seekTime,
+		RefCount:    r.refCount,
+		Complete:    r.complete,
+		LowPriority: r.lowPriority,
+		Segments:    map[string]int{},
+	}
+	if r.running && r.proc != nil {
+		info.Pid = r.proc.Pid()
+	}
+	if r.stitch != nil {
+		info.StitchedTo = r.stitch.next.key
+	}
+	r.mu.Unlock()
+
+	info.Running = r.IsRunning()
+	info.ProducedDuration = r.ProducedDuration()
+	files, _ := filepath.Glob(filepath.Join(r.outputDir, "*.m3u8.ffmpeg"))
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".ffmpeg")
+		if p, err := r.readRunPlaylist(name); err == nil {
+			info.Segments[strings.TrimSuffix(name, ".m3u8")] = len(p.segments)
+		}
+	}
+	return info
+}
+
+func (mr *managedRun) info() *runInfo {
+	info := mr.run.info()
+	info.Speculative = mr.speculative
+	if !mr.idleSince.IsZero() {
+		idleSince := mr.idleSince
+		info.IdleSince = &idleSince
+	}
+	return info
+}
+
+// Runs describes all runs known to the manager, ordered by key.
+func (m *RunManager) Runs() []*runInfo {
+	m.mu.Lock()
+	runs := make([]managedRun, 0, len(m.runs))
+	for _, mr := range m.runs {
+		runs = append(runs, *mr)
+	}
+	m.mu.Unlock()
+
+	res := make([]*runInfo, 0, len(runs))
+	for _, mr := range runs {
+		res = append(res, mr.info())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// runInfo describes a run acquired from the manager.
+func (m *RunManager) runInfo(run *TranscodeRun) *runInfo {
+	m.mu.Lock()
+	mr, ok := m.runs[run.key]
+	var snapshot managedRun
+	if ok && mr.run == run {
+		snapshot = *mr
+	}
+	m.mu.Unlock()
+	if snapshot.run == nil {
+		return run.info()
+	}
+	return snapshot.info()
+}
+
+func (s *Session) info() *sessionInfo {
+	s.mu.Lock()
+	info := &sessionInfo{
+		ID:         s.id,
+		SourceURL:  s.sourceURL,
+		HashDir:    s.hashDir,
+		Duration:   s.duration,
+		SeekTime:   s.seekTime,
+		Playhead:   s.playhead,
+		LastAccess: s.lastAccess,
+		Subject:    s.subject,
+		Deadline:   s.deadline,
+	}
+	run := s.run
+	s.mu.Unlock()
+	if run != nil {
+		info.RunKey = run.key
+		info.Run = s.runMgr.runInfo(run)
+	}
+	return info
+}
+
+// Sessions returns all sessions held by this node.
+func (m *SessionManager) Sessions() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].id < res[j].id
+	})
+	return res
+}
+
+// authorizeAdmin checks the admin token and answers 401 if it is missing
+// or wrong.
+func (s *Web) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// adminSessionsHandler handles GET /sessions
+// @Summary List sessions
+// @Description Lists sessions held by this node with their runs. Requires the admin token.
+// @Tags admin
+// @Produce json
+// @Param Authorization header string true "Bearer admin token"
+// @Success 200 {array} sessionInfo
+// @Failure 401 {string} string "Missing or invalid admin token"
+// @Router /sessions [get]
+func (s *Web) adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	sessions := s.sessionManager.Sessions()
+	res := make([]*sessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		res = append(res, sess.info())
+	}
+	writeAdminJSON(w, res)
+}
+
+// adminSessionHandler handles GET /session/{id}
+// @Summary Describe session
+// @Description Returns the state of a session held by this node and its run. Requires the admin token.
+// @Tags admin
+// @Produce json
+// @Param sessionId path string true "Session ID"
+// @Param Authorization header string true "Bearer admin token"
+// @Success 200 {object} sessionInfo
+// @Failure 401 {string} string "Missing or invalid admin token"
+// @Failure 404 {string} string "Session not found"
+// @Router /session/{sessionId} [get]
+func (s *Web) adminSessionHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	// Not looked up in the session store, describing must not start runs
+	sess := s.sessionManager.Get(id)
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, sess.info())
+}
+
+// adminRunsHandler handles GET /runs
+// @Summary List runs
+// @Description Lists runs known to this node's run manager. Requires the admin token.
+// @Tags admin
+// @Produce json
+// @Param Authorization header string true "Bearer admin token"
+// @Success 200 {array} runInfo
+// @Failure 401 {string} string "Missing or invalid admin token"
+// @Router /runs [get]
+func (s *Web) adminRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	writeAdminJSON(w, s.sessionManager.runMgr.Runs())
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWebAdminAPI(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.adminToken = "secret"
+	web.buildHandler()
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d", w.Code)
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		web.handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, path := range []string{"/sessions", "/session/" + resp.ID, "/runs"} {
+		if w := admin(path, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without token: status = %d", path, w.Code)
+		}
+		if w := admin(path, "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with wrong token: status = %d", path, w.Code)
+		}
+	}
+
+	var sessions []sessionInfo
+	if err := json.Unmarshal(admin("/sessions", "secret").Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != resp.ID || sessions[0].Run == nil {
+		t.Fatalf("sessions: got %+v", sessions)
+	}
+
+	w = admin("/session/"+resp.ID, "secret")
+	var sess sessionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil {
+		t.Fatal(err)
+	}
+	if sess.SourceURL != "sim://host/movie.mkv?duration=20" || sess.RunKey == "" || sess.Run.RefCount != 1 {
+		t.Errorf("session: got %s", w.Body.String())
+	}
+	if w := admin("/session/unknown", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status = %d", w.Code)
+	}
+
+	var runs []runInfo
+	if err := json.Unmarshal(admin("/runs", "secret").Body.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Key != sess.RunKey {
+		t.Errorf("runs: got %+v", runs)
+	}
+
+	// Disabled without a token
+	web.adminToken = ""
+	web.buildHandler()
+	if w := admin("/runs", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled admin API: status = %d", w.Code)
+	}
+}
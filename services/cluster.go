@@ -0,0 +1,391 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	ClusterNodesFlag     = "cluster-nodes"
+	ClusterNodesFileFlag = "cluster-nodes-file"
+	ClusterSelfFlag      = "cluster-self"
+	ClusterModeFlag      = "cluster-mode"
+	ClusterSecretFlag    = "cluster-secret"
+)
+
+const (
+	clusterModeRedirect   = "redirect"
+	clusterModeProxy      = "proxy"
+	clusterVirtualNodes   = 100
+	clusterReloadInterval = 5 * time.Second
+	// clusterForwardedHeader marks proxied requests with the cluster
+	// secret, the receiving node serves them even if its membership view
+	// differs.
+	clusterForwardedHeader = "X-Cluster-Forwarded"
+	// clusterRouteKeyLen is the length of the content hash prefix used for
+	// routing. Session IDs start with it, so session requests are routed
+	// without any lookup.
+	clusterRouteKeyLen = 16
+	// clusterSessionIDRandom is the number of random bytes of session IDs
+	// following the route key.
+	clusterSessionIDRandom = 16
+)
+
+func RegisterClusterFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.StringFlag{
+			Name:   ClusterNodesFlag,
+			Usage:  "comma-separated base URLs of all cluster nodes, content is routed to nodes by hash",
+			EnvVar: "CLUSTER_NODES",
+		},
+		cli.StringFlag{
+			Name:   ClusterNodesFileFlag,
+			Usage:  "file with base URLs of all cluster nodes, one per line, reloaded on change",
+			EnvVar: "CLUSTER_NODES_FILE",
+		},
+		cli.StringFlag{
+			Name:   ClusterSelfFlag,
+			Usage:  "base URL of this node as listed in cluster nodes",
+			EnvVar: "CLUSTER_SELF",
+		},
+		cli.StringFlag{
+			Name:   ClusterModeFlag,
+			Usage:  "how requests for content owned by another node are handled (redirect, proxy)",
+			Value:  clusterModeRedirect,
+			EnvVar: "CLUSTER_MODE",
+		},
+		cli.StringFlag{
+			Name:   ClusterSecretFlag,
+			Usage:  "secret shared by cluster nodes, proxied requests carrying it are served without routing",
+			EnvVar: "CLUSTER_SECRET",
+		},
+	)
+}
+
+// hashRing maps keys to nodes by consistent hashing. Every node is placed
+// on the ring clusterVirtualNodes times, so adding or removing a node only
+// moves its own share of keys.
+type hashRing struct {
+	points []uint64
+	nodes  []string
+}
+
+func ringHash(s string) uint64 {
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func newHashRing(nodes []string) *hashRing {
+	type point struct {
+		hash uint64
+		node string
+	}
+	points := make([]point, 0, len(nodes)*clusterVirtualNodes)
+	for _, n := range nodes {
+		for i := 0; i < clusterVirtualNodes; i++ {
+			points = append(points, point{ringHash(n + "#" + strconv.Itoa(i)), n})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node < points[j].node
+		}
+		return points[i].hash < points[j].hash
+	})
+	r := &hashRing{
+		points: make([]uint64, len(points)),
+		nodes:  make([]string, len(points)),
+	}
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.nodes[i] = p.node
+	}
+	return r
+}
+
+// owner returns the node owning key, or "" for an empty ring.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// parseClusterNodes parses node base URLs separated by commas or newlines.
+// Blank lines and lines starting with # are ignored.
+func parseClusterNodes(data string) ([]string, error) {
+	var nodes []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(data, ",", "\n")))
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		n, err := normalizeClusterNode(l)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[n] {
+			seen[n] = true
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func normalizeClusterNode(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", errors.Errorf("invalid cluster node %q, expected base URL like http://host:port", s)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// Cluster routes content to the node owning its hash, so runs for the same
+// content are shared instead of duplicated across nodes. Requests for
+// content owned by another node are redirected or proxied there.
+//
+// Cluster is a Servable: Serve reloads the membership file until Close.
+type Cluster struct {
+	self   string
+	mode   string
+	secret string
+	file   string
+	proxy  *httputil.ReverseProxy
+
+	mu      sync.RWMutex
+	ring    *hashRing
+	modTime time.Time
+	done    chan struct{}
+	once    sync.Once
+}
+
+type clusterOwnerKey struct{}
+
+// NewCluster returns nil if no cluster membership is configured.
+func NewCluster(c *cli.Context) (*Cluster, error) {
+	if c.String(ClusterNodesFlag) == "" && c.String(ClusterNodesFileFlag) == "" {
+		return nil, nil
+	}
+	if c.String(ClusterSelfFlag) == "" {
+		return nil, errors.Errorf("--%s is required with cluster nodes", ClusterSelfFlag)
+	}
+	self, err := normalizeClusterNode(c.String(ClusterSelfFlag))
+	if err != nil {
+		return nil, err
+	}
+	mode := c.String(ClusterModeFlag)
+	if mode != clusterModeRedirect && mode != clusterModeProxy {
+		return nil, errors.Errorf("unknown cluster mode %q", mode)
+	}
+	secret := c.String(ClusterSecretFlag)
+	if mode == clusterModeProxy && secret == "" {
+		return nil, errors.Errorf("--%s is required in %s mode", ClusterSecretFlag, clusterModeProxy)
+	}
+	cl := newCluster(self, mode, secret)
+	if f := c.String(ClusterNodesFileFlag); f != "" {
+		cl.file = f
+		if err := cl.reload(); err != nil {
+			return nil, err
+		}
+	} else {
+		nodes, err := parseClusterNodes(c.String(ClusterNodesFlag))
+		if err != nil {
+			return nil, err
+		}
+		cl.setNodes(nodes)
+	}
+	return cl, nil
+}
+
+func newCluster(self string, mode string, secret string) *Cluster {
+	cl := &Cluster{
+		self:   self,
+		mode:   mode,
+		secret: secret,
+		ring:   newHashRing(nil),
+		done:   make(chan struct{}),
+	}
+	cl.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(clusterOwnerKey{}).(*url.URL))
+			pr.SetXForwarded()
+			pr.Out.Header.Set(clusterForwardedHeader, cl.secret)
+		},
+		// Growing segments are streamed as they are written
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithError(err).WithField("url", r.URL.String()).Warn("cluster: failed to proxy request")
+			http.Error(w, "owner node unavailable", http.StatusBadGateway)
+		},
+	}
+	return cl
+}
+
+func (s *Cluster) setNodes(nodes []string) {
+	found := false
+	for _, n := range nodes {
+		if n == s.self {
+			found = true
+		}
+	}
+	if !found {
+		log.WithField("self", s.self).Warn("cluster: this node is not a member, all content is routed to other nodes")
+	}
+	ring := newHashRing(nodes)
+	s.mu.Lock()
+	s.ring = ring
+	s.mu.Unlock()
+	log.WithField("nodes", len(nodes)).Info("cluster: membership loaded")
+}
+
+// reload rereads the membership file if it changed.
+func (s *Cluster) reload() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat cluster nodes file")
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read cluster nodes file")
+	}
+	nodes, err := parseClusterNodes(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return err
+	}
+	s.setNodes(nodes)
+	s.mu.Lock()
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Cluster) Serve() error {
+	if s.file == "" {
+		<-s.done
+		return nil
+	}
+	ticker := time.NewTicker(clusterReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				// Keep routing by the last good membership
+				log.WithError(err).Warn("cluster: failed to reload membership")
+			}
+		}
+	}
+}
+
+func (s *Cluster) Close() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Owner returns the base URL of the node owning the route key.
+func (s *Cluster) Owner(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.owner(key)
+}
+
+// clusterRouteKey returns the route key of a content hash.
+func clusterRouteKey(hash string) string {
+	return hash[:clusterRouteKeyLen]
+}
+
+// SessionID returns a new session ID for content with the given route key.
+// A nil Cluster returns "", leaving the ID to the session manager.
+func (s *Cluster) SessionID(key string) string {
+	if s == nil {
+		return ""
+	}
+	b := make([]byte, clusterSessionIDRandom)
+	_, _ = rand.Read(b)
+	return key + hex.EncodeToString(b)
+}
+
+// sessionRouteKey returns the route key a session ID starts with.
+func sessionRouteKey(id string) (string, bool) {
+	if len(id) != clusterRouteKeyLen+2*clusterSessionIDRandom {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id[:clusterRouteKeyLen], true
+}
+
+// forwarded reports whether the request was proxied by a cluster node. The
+// header is set by clients too, so it is trusted only with the secret.
+func (s *Cluster) forwarded(r *http.Request) bool {
+	h := r.Header.Get(clusterForwardedHeader)
+	return s.secret != "" && subtle.ConstantTimeCompare([]byte(h), []byte(s.secret)) == 1
+}
+
+// Route redirects or proxies the request to the node owning the route key
+// and returns true, or returns false if it is to be served locally. A nil
+// Cluster serves everything locally.
+func (s *Cluster) Route(w http.ResponseWriter, r *http.Request, key string) bool {
+	if s == nil || s.forwarded(r) {
+		return false
+	}
+	owner := s.Owner(key)
+	if owner == "" || owner == s.self {
+		return false
+	}
+	target, err := url.Parse(owner)
+	if err != nil {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"owner": owner,
+		"path":  r.URL.Path,
+	}).Debug("cluster: routing request to owner")
+	if s.mode == clusterModeProxy {
+		s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clusterOwnerKey{}, target)))
+		return true
+	}
+	// 307 keeps the method and body of POST requests, CORS headers are
+	// set by the caller
+	http.Redirect(w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	r := newHashRing(nodes)
+	counts := map[string]int{}
+	owners := map[string]string{}
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = r.owner(key)
+		counts[owners[key]]++
+	}
+	for _, n := range nodes {
+		if share := float64(counts[n]) / keys; share < 0.2 || share > 0.47 {
+			t.Errorf("node %s owns %.2f of keys", n, share)
+		}
+	}
+
+	// Removing a node only moves its own keys
+	r2 := newHashRing(nodes[:2])
+	for key, owner := range owners {
+		if owner != "http://c:8080" && r2.owner(key) != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, r2.owner(key))
+		}
+	}
+
+	if newHashRing(nil).owner("key") != "" {
+		t.Error("empty ring should have no owner")
+	}
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	nodes, err := parseClusterNodes("http://a:8080/, http://b:8080\n# comment\n\nhttp://a:8080\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(nodes, " ") != "http://a:8080 http://b:8080" {
+		t.Errorf("got %v", nodes)
+	}
+	if _, err := parseClusterNodes("a:8080"); err == nil {
+		t.Error("node without scheme should be rejected")
+	}
+}
+
+func TestClusterReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nodes")
+	if err := os.WriteFile(file, []byte("http://a:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cl := newCluster("http://a:8080", clusterModeRedirect, "")
+	cl.file = file
+	if err := cl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cl.Owner("key") != "http://a:8080" {
+		t.Fatal("single node should own everything")
+	}
+	if err := os.WriteFile(file, []byte("http://b:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cl.Owner("key") != "http://b:8080" {
+		t.Error("changed membership should be reloaded")
+	}
+}
+
+const testClusterSecret = "cluster-secret"
+
+// newTestCluster starts two simulated nodes routing to each other.
+func newTestCluster(t *testing.T, mode string) (a, b *Web, aURL, bURL string) {
+	t.Helper()
+	a = newSimulatedWeb(t)
+	b = newSimulatedWeb(t)
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.handler.ServeHTTP(w, r) }))
+	bs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { b.handler.ServeHTTP(w, r) }))
+	t.Cleanup(as.Close)
+	t.Cleanup(bs.Close)
+	for _, n := range []struct {
+		web  *Web
+		self string
+	}{{a, as.URL}, {b, bs.URL}} {
+		n.web.cluster = newCluster(n.self, mode, testClusterSecret)
+		n.web.cluster.setNodes([]string{as.URL, bs.URL})
+	}
+	return a, b, as.URL, bs.URL
+}
+
+// sourceOwnedBy returns a simulated source URL owned by node.
+func sourceOwnedBy(t *testing.T, cl *Cluster, node string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		src := fmt.Sprintf("sim://host/movie-%d.mkv?duration=20", i)
+		u, _ := url.Parse(src)
+		if cl.Owner(clusterRouteKey(contentHash(u))) == node {
+			return src
+		}
+	}
+	t.Fatal("no source owned by node")
+	return ""
+}
+
+func TestClusterRedirect(t *testing.T) {
+	a, _, aURL, bURL := newTestCluster(t, clusterModeRedirect)
+	src := sourceOwnedBy(t, a.cluster, bURL)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Post(aURL+"/session?source_url="+url.QueryEscape(src), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(res.Header.Get("Location"), bURL+"/session?") {
+		t.Fatalf("create: status = %d, location = %s", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	// Owned content is served locally
+	src = sourceOwnedBy(t, a.cluster, aURL)
+	res, err = client.Post(aURL+"/session?source_url="+url.QueryEscape(src), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp sessionCreateResponse
+	_ = json.NewDecoder(res.Body).Decode(&resp)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || a.sessionManager.Get(resp.ID) == nil {
+		t.Fatalf("local create: status = %d", res.StatusCode)
+	}
+	u, _ := url.Parse(src)
+	if !strings.HasPrefix(resp.ID, clusterRouteKey(contentHash(u))) {
+		t.Error("session ID should start with the route key")
+	}
+}
+
+func TestClusterProxy(t *testing.T) {
+	a, b, aURL, bURL := newTestCluster(t, clusterModeProxy)
+	src := sourceOwnedBy(t, a.cluster, bURL)
+
+	res, err := http.Post(aURL+"/session?source_url="+url.QueryEscape(src), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp sessionCreateResponse
+	_ = json.NewDecoder(res.Body).Decode(&resp)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("create: status = %d", res.StatusCode)
+	}
+	if b.sessionManager.Get(resp.ID) == nil || a.sessionManager.Get(resp.ID) != nil {
+		t.Fatal("session should be created on the owner only")
+	}
+
+	res, err = http.Get(aURL + "/session/" + resp.ID + "/v0-720.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("variant through non-owner: status = %d", res.StatusCode)
+	}
+}
+
+func TestClusterForwardedHeader(t *testing.T) {
+	a, b, aURL, bURL := newTestCluster(t, clusterModeProxy)
+	src := sourceOwnedBy(t, a.cluster, bURL)
+
+	for _, tt := range []struct {
+		forwarded string
+		local     bool
+	}{
+		{"", false},
+		{"http://evil", false},
+		{testClusterSecret, true},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, aURL+"/session?source_url="+url.QueryEscape(src), nil)
+		if tt.forwarded != "" {
+			req.Header.Set(clusterForwardedHeader, tt.forwarded)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp sessionCreateResponse
+		_ = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%q: status = %d", tt.forwarded, res.StatusCode)
+		}
+		if local := a.sessionManager.Get(resp.ID) != nil; local != tt.local || local == (b.sessionManager.Get(resp.ID) != nil) {
+			t.Errorf("%q: served locally = %v, want %v", tt.forwarded, local, tt.local)
+		}
+	}
+}
+
+func TestClusterSessionID(t *testing.T) {
+	cl := newCluster("http://a:8080", clusterModeRedirect, "")
+	key := strings.Repeat("ab", clusterRouteKeyLen/2)
+	id := cl.SessionID(key)
+	if len(id) != clusterRouteKeyLen+32 {
+		t.Fatalf("session ID %q should carry 16 random bytes", id)
+	}
+	if got, ok := sessionRouteKey(id); !ok || got != key {
+		t.Errorf("route key = %q, %v", got, ok)
+	}
+	for _, id := range []string{key + strings.Repeat("0", 16), strings.Repeat("z", len(id))} {
+		if _, ok := sessionRouteKey(id); ok {
+			t.Errorf("%q should have no route key", id)
+		}
+	}
+}
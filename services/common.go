@@ -2,7 +2,9 @@ package services
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
 	"sort"
@@ -66,6 +68,14 @@ func DistributeByHash(dirs []string, hash string) (string, error) {
 	return "", errors.Wrapf(err, "failed to distribute infohash=%v", hash)
 }
 
+// contentHash identifies the content of a source URL. Only the path is
+// used, so the same content requested with different credentials shares
+// its output dir.
+func contentHash(u *url.URL) string {
+	h := sha1.Sum([]byte(u.Path))
+	return hex.EncodeToString(h[:])
+}
+
 func GetDir(location string, hash string) (string, error) {
 	if strings.HasSuffix(location, "*") {
 		prefix := strings.TrimSuffix(location, "*")
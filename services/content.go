@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Stateless playback: /content/{hash}/seek-{t}/{file}?token=... serves the
+// output of the run at (content, t) without a session. The token carries
+// the source URL signed with a secret, so it is the same for every viewer
+// of the content and identical segments get identical, cacheable URLs.
+// Each request holds the run only while it is served; the run grace period
+// keeps it alive between the requests of players.
+
+const (
+	ContentSecretFlag = "content-secret"
+)
+
+const (
+	contentTokenParam = "token"
+)
+
+var contentPathPattern = regexp.MustCompile(`^/content/([0-9a-f]{40})/seek-([0-9]+)/([^/]+)$`)
+
+func RegisterContentFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   ContentSecretFlag,
+		Usage:  "secret signing the source URLs of stateless /content URLs, empty disables them",
+		Value:  "",
+		EnvVar: "CONTENT_SECRET",
+	})
+}
+
+// contentToken returns the token of a source URL: the URL and its HMAC, both
+// base64url encoded and joined by a dot.
+func contentToken(secret []byte, sourceURL string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sourceURL))
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(sourceURL)) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// parseContentToken returns the source URL of a token signed with secret.
+func parseContentToken(secret []byte, token string) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("malformed token")
+	}
+	sourceURL, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errors.Wrap(err, "malformed token")
+	}
+	if !hmac.Equal([]byte(contentToken(secret, string(sourceURL))), []byte(payload+"."+sig)) {
+		return "", errors.New("invalid token signature")
+	}
+	return string(sourceURL), nil
+}
+
+// contentPath returns the URL path of a file of the run at seekTime.
+func contentPath(hash string, seekTime float64, name string) string {
+	return fmt.Sprintf("/content/%s/seek-%.0f/%s", hash, seekTime, name)
+}
+
+type contentResponse struct {
+	Hash        string  `json:"hash"`
+	Token       string  `json:"token"`
+	Duration    float64 `json:"duration"`
+	SeekQuantum int     `json:"seek_quantum"` // seek positions of URLs are multiples of it
+	URL         string  `json:"url"`          // master playlist from position 0
+}
+
+// contentCreateHandler handles POST /content?source_url=...
+// @Summary Get stateless playback URLs
+// @Description Probes media and returns the token of stateless /content URLs for it. The URLs of a source are the same for all viewers, so they can be cached by CDNs. Runs start on the first request.
+// @Tags content
+// @Produce json
+// @Param source_url query string false "Source media URL (alternative to X-Source-Url header)"
+// @Param X-Source-Url header string false "Source media URL (takes priority over query param)"
+// @Success 200 {object} contentResponse
+// @Success 307 {string} string "Redirect to the cluster node owning the content"
+// @Failure 400 {string} string "Missing or invalid source_url"
+// @Failure 403 {string} string "Source not allowed by the source policy"
+// @Failure 404 {string} string "Stateless URLs are disabled"
+// @Failure 500 {string} string "Internal error"
+// @Router /content [post]
+func (s *Web) contentCreateHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.contentSecret) == 0 {
+		http.Error(w, "stateless urls are disabled", http.StatusNotFound)
+		return
+	}
+	sourceURL := getSourceURL(r)
+	if sourceURL == "" {
+		http.Error(w, "missing source_url", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		http.Error(w, "invalid source_url", http.StatusBadRequest)
+		return
+	}
+	if !s.checkSource(w, r, sourceURL) {
+		return
+	}
+	hash := contentHash(u)
+	if s.cluster.Route(w, r, clusterRouteKey(hash)) {
+		return
+	}
+	contentDir, ok := s.contentDir(w, hash)
+	if !ok {
+		return
+	}
+	_, duration, ok := s.contentHLS(w, sourceURL, contentDir)
+	if !ok {
+		return
+	}
+	token := contentToken(s.contentSecret, sourceURL)
+	resp, err := json.Marshal(contentResponse{
+		Hash:        hash,
+		Token:       token,
+		Duration:    duration,
+		SeekQuantum: s.defaultTimings().SeekQuantum,
+		URL:         contentPath(hash, 0, "index.m3u8") + "?" + contentTokenParam + "=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// defaultTimings returns the timings of content served without sessions.
+func (s *Web) defaultTimings() SessionTimings {
+	if s.timings == nil {
+		return SessionTimings{}.withDefaults()
+	}
+	return s.timings.Defaults
+}
+
+// contentDir returns the output dir of content, creating it if needed.
+// Errors are written to w.
+func (s *Web) contentDir(w http.ResponseWriter, hash string) (string, bool) {
+	dir, err := GetDir(s.output, hash)
+	if err != nil {
+		http.Error(w, "failed to get output dir", http.StatusInternalServerError)
+		return "", false
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, "failed to create output dir", http.StatusInternalServerError)
+		return "", false
+	}
+	return dir, true
+}
+
+// contentHLS probes the source and returns its HLS layout with the default
+// segment duration. Errors are written to w.
+func (s *Web) contentHLS(w http.ResponseWriter, sourceURL string, contentDir string) (*HLS, float64, bool) {
+	pr, err := s.contentProbe.Get(sourceURL, nil, contentDir)
+	if err != nil {
+		log.WithError(err).Error("content: failed to probe media")
+		http.Error(w, "failed to probe media", http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	return s.hlsBuilder.Build(sourceURL, nil, pr, s.defaultTimings().SegmentDuration, 0), getDuration(pr), true
+}
+
+// contentHandler handles GET /content/{hash}/seek-{t}/{file}?token=...
+// @Summary Get stateless playlist or segment
+// @Description Serves the master playlist, a variant playlist or a segment of the run transcoding the content from t, starting the run if needed. References in playlists carry the token. t must be a multiple of the seek quantum. Finished segments are immutable, growing playlists are cached for a second.
+// @Tags content
+// @Produce application/vnd.apple.mpegurl
+// @Param hash path string true "Content hash"
+// @Param t path int true "Seek position in seconds"
+// @Param file path string true "index.m3u8, a variant playlist or a segment"
+// @Param token query string true "Token returned by POST /content"
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Success 200 {file} binary "Playlist or segment data"
+// @Success 304 {string} string "Cached copy is up to date"
+// @Success 307 {string} string "Redirect to the cluster node owning the content"
+// @Failure 400 {string} string "Seek position not quantized"
+// @Failure 403 {string} string "Missing or invalid token"
+// @Failure 404 {string} string "Not found or stateless URLs are disabled"
+// @Failure 503 {string} string "Node is handing over"
+// @Failure 504 {string} string "Timeout waiting for playlist or segment"
+// @Router /content/{hash}/seek-{t}/{file} [get]
+func (s *Web) contentHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	m := contentPathPattern.FindStringSubmatch(r.URL.Path)
+	if len(s.contentSecret) == 0 || r.Method != http.MethodGet || m == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	hash, name := m[1], m[3]
+	if s.cluster.Route(w, r, clusterRouteKey(hash)) {
+		return
+	}
+	if s.handover.InProgress() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "node is handing over", http.StatusServiceUnavailable)
+		return
+	}
+
+	sourceURL, err := parseContentToken(s.contentSecret, r.URL.Query().Get(contentTokenParam))
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil || contentHash(u) != hash {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	timings := s.defaultTimings()
+	seekTime, _ := strconv.ParseFloat(m[2], 64)
+	if timings.quantize(seekTime) != seekTime {
+		http.Error(w, fmt.Sprintf("seek position must be a multiple of %ds", timings.SeekQuantum), http.StatusBadRequest)
+		return
+	}
+
+	contentDir, ok := s.contentDir(w, hash)
+	if !ok {
+		return
+	}
+	h, duration, ok := s.contentHLS(w, sourceURL, contentDir)
+	if !ok {
+		return
+	}
+	if duration > 0 && seekTime >= duration {
+		http.Error(w, "seek position beyond duration", http.StatusNotFound)
+		return
+	}
+
+	if name == "index.m3u8" {
+		data := h.MasterPlaylist()
+		tag := fmt.Sprintf("#EXTM3U\n#EXT-X-SESSION-OFFSET:%.0f\n", seekTime)
+		data = bytes.Replace(data, []byte("#EXTM3U\n"), []byte(tag), 1)
+		data = enrichPlaylistData(data, stripQueryParam(r.URL.RawQuery, jwtQueryParam))
+		writePlaylist(w, r, data, cacheContentMaster)
+		return
+	}
+	isPlaylist := strings.HasSuffix(name, ".m3u8")
+	if !isPlaylist && !strings.HasSuffix(name, ".ts") && !strings.HasSuffix(name, ".vtt") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	hashDir := layoutDir(contentDir, timings.SegmentDuration, 0)
+	if err := os.MkdirAll(hashDir, 0755); err != nil {
+		http.Error(w, "failed to create output dir", http.StatusInternalServerError)
+		return
+	}
+	s.touchContent(hashDir)
+
+	// A session living for this request holds the run while it is served
+	sess := NewSession(SessionConfig{
+		ID:        "content-" + hash,
+		SourceURL: sourceURL,
+		HashDir:   hashDir,
+		HLS:       h,
+		Duration:  duration,
+		RunMgr:    s.sessionManager.runMgr,
+		Timings:   timings,
+	})
+	if err := sess.Start(seekTime); err != nil {
+		sess.logger.WithError(err).Error("content: failed to start run")
+		http.Error(w, "failed to start transcoding", http.StatusInternalServerError)
+		return
+	}
+	defer sess.Stop()
+
+	if isPlaylist {
+		s.sessionPlaylistHandler(w, r, sess, name)
+	} else {
+		s.sessionSegmentHandler(w, r, sess, name)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	u "net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 
@@ -44,17 +46,36 @@ func RegisterContentProberFlags(f []cli.Flag) []cli.Flag {
 	})
 }
 
+// Prober probes media content.
+type Prober interface {
+	Probe(ctx context.Context, input string, headers http.Header) (*cp.ProbeReply, error)
+}
+
+// NewProber returns the remote content prober if its host is configured,
+// the simulated prober for the simulated transcoder, or local ffprobe
+// reading through the input proxy if it is enabled.
+func NewProber(c *cli.Context, inputProxy *InputProxy, policy *SourcePolicy) Prober {
+	if c.String(TranscoderFlag) == TranscoderSimulated {
+		return &SimulatedProber{}
+	}
+	if c.String(contentProberHostFlag) != "" {
+		return &RemoteProber{
+			host: c.String(contentProberHostFlag),
+			port: c.Int(contentProberPortFlag),
+		}
+	}
+	return &FFProbe{inputProxy: inputProxy, policy: policy}
+}
+
 type ContentProbe struct {
 	*lazymap.LazyMap[*cp.ProbeReply]
-	host    string
-	port    int
+	prober  Prober
 	timeout int
 }
 
-func NewContentProbe(c *cli.Context) *ContentProbe {
+func NewContentProbe(c *cli.Context, inputProxy *InputProxy, policy *SourcePolicy) *ContentProbe {
 	return &ContentProbe{
-		host:    c.String(contentProberHostFlag),
-		port:    c.Int(contentProberPortFlag),
+		prober:  NewProber(c, inputProxy, policy),
 		timeout: c.Int(contentProberTimeoutFlag),
 		LazyMap: lazymap.New[*cp.ProbeReply](&lazymap.Config{
 			Expire:      30 * time.Minute,
@@ -63,13 +84,13 @@ func NewContentProbe(c *cli.Context) *ContentProbe {
 	}
 }
 
-func (s *ContentProbe) Get(input string, out string) (*cp.ProbeReply, error) {
+func (s *ContentProbe) Get(input string, headers http.Header, out string) (*cp.ProbeReply, error) {
 	return s.LazyMap.Get(input+out, func() (*cp.ProbeReply, error) {
-		return s.get(input, out)
+		return s.get(input, headers, out)
 	})
 }
 
-func (s *ContentProbe) get(input string, out string) (pr *cp.ProbeReply, err error) {
+func (s *ContentProbe) get(input string, headers http.Header, out string) (pr *cp.ProbeReply, err error) {
 	probeFilePath := out + "/index.json"
 
 	// Check if the file already exists
@@ -92,12 +113,7 @@ func (s *ContentProbe) get(input string, out string) (pr *cp.ProbeReply, err err
 	// File does not exist, proceed with probing
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.timeout)*time.Second)
 	defer cancel()
-	if s.host == "" {
-		pr, err = s.localProbe(ctx, input)
-	} else {
-
-		pr, err = s.remoteProbe(ctx, input)
-	}
+	pr, err = s.prober.Probe(ctx, input, headers)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to probe")
@@ -118,7 +134,18 @@ func (s *ContentProbe) get(input string, out string) (pr *cp.ProbeReply, err err
 	return
 }
 
-func (s *ContentProbe) remoteProbe(ctx context.Context, input string) (*cp.ProbeReply, error) {
+// RemoteProber probes content with the content-prober gRPC service.
+type RemoteProber struct {
+	host string
+	port int
+}
+
+// Source headers can't be passed to the content prober service and are
+// ignored.
+func (s *RemoteProber) Probe(ctx context.Context, input string, headers http.Header) (*cp.ProbeReply, error) {
+	if len(headers) > 0 {
+		log.Warn("content prober service does not support source headers, probing without them")
+	}
 	addr := fmt.Sprintf("%s:%d", s.host, s.port)
 	conn, err := grpc.Dial(addr, grpc.WithInsecure())
 	if err != nil {
@@ -145,19 +172,47 @@ func (s *ContentProbe) remoteProbe(ctx context.Context, input string) (*cp.Probe
 
 }
 
-func (s *ContentProbe) localProbe(ctx context.Context, input string) (*cp.ProbeReply, error) {
+// FFProbe probes content with the local ffprobe binary.
+type FFProbe struct {
+	inputProxy *InputProxy
+	policy     *SourcePolicy
+}
+
+func (s *FFProbe) Probe(ctx context.Context, input string, headers http.Header) (*cp.ProbeReply, error) {
 	done := make(chan error)
 	ffprobe, err := exec.LookPath("ffprobe")
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to find ffprobe")
 	}
+	proxied := false
+	if s.inputProxy != nil {
+		in, err := s.inputProxy.URL(input, headers)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to proxy input")
+		}
+		proxied = in != input
+		input = in
+	}
+	if !proxied {
+		if err := s.policy.Check(ctx, input); err != nil {
+			return nil, errors.Wrap(err, "source not allowed")
+		}
+	}
 	parsedURL, err := u.Parse(input)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to parse url")
 	}
-	cmdText := fmt.Sprintf("%s -show_format -show_streams -print_format json '%s'", ffprobe, parsedURL.String())
+	params := []string{"-show_format", "-show_streams", "-print_format", "json"}
+	if s.policy != nil {
+		params = append(params, "-protocol_whitelist", s.policy.protocolWhitelist(proxied))
+	}
+	if len(headers) > 0 {
+		params = append(params, "-headers", formatFFmpegHeaders(headers))
+	}
+	params = append(params, parsedURL.String())
+	cmdText := fmt.Sprintf("%s %s", ffprobe, strings.Join(redactParams(params), " "))
 	log.WithField("cmd", cmdText).Info("running ffprobe command")
-	cmd := exec.Command(ffprobe, "-show_format", "-show_streams", "-print_format", "json", parsedURL.String())
+	cmd := exec.Command(ffprobe, params...)
 	var bufOut bytes.Buffer
 	var bufErr bytes.Buffer
 	cmd.Stdout = &bufOut
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestContentToken(t *testing.T) {
+	secret := []byte("secret")
+	token := contentToken(secret, "http://host/movie.mkv")
+	if token != contentToken(secret, "http://host/movie.mkv") {
+		t.Error("tokens of a source should be identical")
+	}
+	if u, err := parseContentToken(secret, token); err != nil || u != "http://host/movie.mkv" {
+		t.Errorf("parse: got %q, %v", u, err)
+	}
+	forged := contentToken([]byte("other"), "http://host/movie.mkv")
+	for _, tok := range []string{"", "abc", forged, token[:len(token)-2]} {
+		if _, err := parseContentToken(secret, tok); err == nil {
+			t.Errorf("token %q should be rejected", tok)
+		}
+	}
+}
+
+func TestWebContent(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.contentSecret = []byte("secret")
+
+	w := serveTestRequest(web, http.MethodPost, "/content?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp contentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Duration != 200 || resp.SeekQuantum != seekQuantum {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	query := "?token=" + url.QueryEscape(resp.Token)
+	base := "/content/" + resp.Hash + "/seek-60/"
+
+	w = serveTestRequest(web, http.MethodGet, base+"index.m3u8"+query)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720.m3u8"+query) || !strings.Contains(w.Body.String(), "#EXT-X-SESSION-OFFSET:60") {
+		t.Fatalf("master: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	w = serveTestRequest(web, http.MethodGet, base+"v0-720.m3u8"+query)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720-0.ts"+query) {
+		t.Fatalf("variant: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	w = serveTestRequest(web, http.MethodGet, base+"v0-720-1.ts"+query)
+	if w.Code != http.StatusOK || w.Body.Len() == 0 || w.Body.Bytes()[0] != 0x47 {
+		t.Fatalf("segment: status = %d, len=%d", w.Code, w.Body.Len())
+	}
+
+	// Requests map onto one run, released once served
+	rm := web.sessionManager.runMgr
+	rm.mu.Lock()
+	mr, ok := rm.runs[runKey(web.output+"/"+resp.Hash, 60)]
+	n := len(rm.runs)
+	rm.mu.Unlock()
+	if !ok || n != 1 {
+		t.Fatalf("expected one run at 60s, got %d runs", n)
+	}
+	if mr.run.RefCount() != 0 {
+		t.Errorf("run should be released after requests, refCount = %d", mr.run.RefCount())
+	}
+
+	other := contentToken(web.contentSecret, "sim://host/other.mkv")
+	for path, code := range map[string]int{
+		base + "v0-720.m3u8": http.StatusForbidden,
+		base + "v0-720.m3u8?token=" + url.QueryEscape(other):       http.StatusForbidden,
+		"/content/" + resp.Hash + "/seek-45/v0-720.m3u8" + query:   http.StatusBadRequest,
+		"/content/" + resp.Hash + "/seek-300/v0-720.m3u8" + query:  http.StatusNotFound,
+		"/content/" + resp.Hash + "/seek-60/x/v0-720.m3u8" + query: http.StatusNotFound,
+	} {
+		if w := serveTestRequest(web, http.MethodGet, path); w.Code != code {
+			t.Errorf("%s: status = %d, want %d", path, w.Code, code)
+		}
+	}
+
+	web.contentSecret = nil
+	if w := serveTestRequest(web, http.MethodGet, base+"v0-720.m3u8"+query); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d, want 404", w.Code)
+	}
+}
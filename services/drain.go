@@ -0,0 +1,151 @@
+package services
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	DrainTimeoutFlag = "drain-timeout"
+)
+
+const (
+	drainCheckInterval = time.Second
+)
+
+func RegisterDrainFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.IntFlag{
+		Name:   DrainTimeoutFlag,
+		Usage:  "on SIGTERM, SIGUSR1 or POST /drain stop accepting sessions and wait up to this many seconds for active sessions before shutting down (0 shuts down immediately)",
+		Value:  0,
+		EnvVar: "DRAIN_TIMEOUT",
+	})
+}
+
+// Drainer implements drain mode for rolling deploys. Once draining, the node
+// refuses new sessions and fails readiness probes, while existing sessions
+// keep playing until they become inactive or the deadline passes.
+//
+// Drainer is a Servable: Serve returns once draining is over, which makes
+// Serve shut the process down.
+type Drainer struct {
+	timeout        time.Duration
+	sessionManager *SessionManager
+
+	mu       sync.Mutex
+	draining bool
+	deadline time.Time
+	start    chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func NewDrainer(c *cli.Context, sessionManager *SessionManager) *Drainer {
+	if c.Int(DrainTimeoutFlag) == 0 {
+		return nil
+	}
+	return newDrainer(time.Duration(c.Int(DrainTimeoutFlag))*time.Second, sessionManager)
+}
+
+func newDrainer(timeout time.Duration, sessionManager *SessionManager) *Drainer {
+	return &Drainer{
+		timeout:        timeout,
+		sessionManager: sessionManager,
+		start:          make(chan struct{}),
+		closed:         make(chan struct{}),
+	}
+}
+
+// Draining returns true once drain mode was entered. A nil Drainer never
+// drains.
+func (s *Drainer) Draining() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Drain enters drain mode. Calling it again has no effect.
+func (s *Drainer) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return
+	}
+	s.draining = true
+	s.deadline = time.Now().Add(s.timeout)
+	close(s.start)
+	log.WithFields(log.Fields{
+		"deadline": s.deadline,
+		"sessions": s.sessionManager.ActiveSessions(),
+	}).Info("drainer: draining")
+}
+
+func (s *Drainer) Serve() error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	select {
+	case <-sigs:
+		s.Drain()
+	case <-s.start:
+	case <-s.closed:
+		return nil
+	}
+	s.Wait()
+	return nil
+}
+
+// Wait blocks until no session is active, the deadline passes or another
+// SIGINT/SIGTERM is received. It enters drain mode if needed.
+func (s *Drainer) Wait() {
+	s.Drain()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		if s.drained() {
+			return
+		}
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Warn("drainer: interrupted, shutting down now")
+			return
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Drainer) drained() bool {
+	active := s.sessionManager.ActiveSessions()
+	if active == 0 {
+		log.Info("drainer: no active sessions left")
+		return true
+	}
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+	if time.Now().After(deadline) {
+		log.WithField("sessions", active).Warn("drainer: deadline passed with active sessions")
+		return true
+	}
+	return false
+}
+
+func (s *Drainer) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDrainRefusesNewSessions(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.drainer = newDrainer(time.Minute, web.sessionManager)
+	probe := &Probe{drainer: web.drainer}
+
+	create := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20"), nil)
+		web.handler.ServeHTTP(w, r)
+		return w
+	}
+	readiness := func() int {
+		w := httptest.NewRecorder()
+		probe.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+		return w.Code
+	}
+
+	if w := create(); w.Code != http.StatusOK {
+		t.Fatalf("create before drain: status = %d", w.Code)
+	}
+	if code := readiness(); code != http.StatusOK {
+		t.Errorf("readiness before drain: got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	probe.handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if w.Code != http.StatusAccepted || !web.drainer.Draining() {
+		t.Fatalf("POST /drain: status = %d", w.Code)
+	}
+
+	if w := create(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("create while draining: got %d, want 503", w.Code)
+	}
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining: got %d, want 503", code)
+	}
+	if n := web.sessionManager.ActiveSessions(); n != 1 {
+		t.Errorf("existing session should stay active, got %d", n)
+	}
+}
+
+func TestDrainWait(t *testing.T) {
+	sm, _ := newTestManager(t)
+	s, _ := sm.Create(SessionConfig{SourceURL: "http://example.com/v.mkv", HashDir: t.TempDir()})
+
+	// Deadline passes while a session is active
+	d := newDrainer(50*time.Millisecond, sm)
+	start := time.Now()
+	d.Wait()
+	if time.Since(start) > 5*time.Second {
+		t.Error("wait should end at the deadline")
+	}
+
+	// Returns as soon as no session is active
+	d = newDrainer(time.Hour, sm)
+	sm.Close(s.id)
+	done := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait should end when no session is active")
+	}
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session events: GET /session/{id}/events streams state changes of a
+// session and its run as server-sent events, so players learn when a seek
+// produced playable segments instead of polling playlists.
+
+const (
+	eventState        = "state"         // sent first, current session state
+	eventSeek         = "seek"          // session seeked
+	eventRunStarted   = "run_started"   // FFmpeg started
+	eventRunStopped   = "run_stopped"   // FFmpeg exited or was stopped
+	eventSegmentReady = "segment_ready" // first segments after a seek are playable
+	eventProgress     = "progress"      // media time transcoded so far
+	eventRunError     = "run_error"     // FFmpeg failed, not "error" which EventSource uses for connection errors
+	eventExpiring     = "expiring"      // session expires soon without access
+	eventClosed       = "closed"        // session closed, the stream ends
+)
+
+const (
+	eventBufferSize        = 32
+	eventProgressInterval  = time.Second
+	eventKeepAliveInterval = 15 * time.Second
+	// sessionExpiryWarning is how long before expiry inactive sessions are
+	// warned.
+	sessionExpiryWarning = time.Minute
+)
+
+type sessionEvent struct {
+	Type string
+	Data any
+}
+
+type sessionStateEvent struct {
+	SeekTime float64 `json:"seek_time"`
+	Duration float64 `json:"duration"`
+	Running  bool    `json:"running"`
+	RunKey   string  `json:"run_key,omitempty"`
+}
+
+type seekEvent struct {
+	SeekTime float64 `json:"seek_time"`
+}
+
+type runEvent struct {
+	RunKey   string  `json:"run_key"`
+	SeekTime float64 `json:"seek_time"`
+	Pid      int     `json:"pid,omitempty"`
+	Complete bool    `json:"complete,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type progressEvent struct {
+	SeekTime float64 `json:"seek_time"`
+	Produced float64 `json:"produced"` // media time transcoded from seek_time
+	Position float64 `json:"position"` // movie time transcoded up to
+	Duration float64 `json:"duration"`
+}
+
+type expiringEvent struct {
+	ExpiresIn float64 `json:"expires_in"` // seconds
+}
+
+// eventHub fans events out to subscribers. Slow subscribers miss events
+// instead of blocking the publisher. The zero value is ready to use.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan sessionEvent]struct{}
+}
+
+// subscribe returns a channel receiving published events and a function
+// ending the subscription.
+func (h *eventHub) subscribe() (<-chan sessionEvent, func()) {
+	ch := make(chan sessionEvent, eventBufferSize)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan sessionEvent]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(typ string, data any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- sessionEvent{Type: typ, Data: data}:
+		default:
+		}
+	}
+}
+
+// sessionEventStream follows the run a session currently holds. Run events
+// are relayed, readiness and progress are derived from the run's playlists.
+type sessionEventStream struct {
+	sess *Session
+
+	run            *TranscodeRun
+	runEvents      <-chan sessionEvent
+	unsubscribeRun func()
+	watch          *fileSubscription
+	ready          bool
+	produced       float64
+}
+
+// follow switches to the session's current run if it changed. The run was
+// usually started before, so run_started is returned if it is running.
+func (st *sessionEventStream) follow() []sessionEvent {
+	run := st.sess.currentRun()
+	if run == st.run {
+		return nil
+	}
+	st.close()
+	st.run = run
+	st.ready = false
+	st.produced = 0
+	if run == nil {
+		st.watch = watchFiles()
+		return nil
+	}
+	st.runEvents, st.unsubscribeRun = run.events.subscribe()
+	var files []string
+	for _, stream := range st.sess.h.Streams() {
+		if name := stream.GetPlaylistName(); !isSubtitlePlaylist(name) {
+			files = append(files, run.playlistFiles(name)...)
+		}
+	}
+	st.watch = watchFiles(files...)
+	if run.IsRunning() {
+		return []sessionEvent{{eventRunStarted, runEvent{RunKey: run.key, SeekTime: run.seekTime}}}
+	}
+	return nil
+}
+
+// poll returns segment_ready once the run produced playable segments and,
+// if progress is set, a progress event if more media was transcoded.
+func (st *sessionEventStream) poll(progress bool) []sessionEvent {
+	res := st.follow()
+	if st.run == nil {
+		return res
+	}
+	produced := st.run.ProducedDuration()
+	if produced > 0 && !st.ready {
+		st.ready = true
+		res = append(res, sessionEvent{eventSegmentReady, seekEvent{SeekTime: st.run.seekTime}})
+	}
+	if progress && produced != st.produced {
+		st.produced = produced
+		res = append(res, sessionEvent{eventProgress, progressEvent{
+			SeekTime: st.run.seekTime,
+			Produced: produced,
+			Position: st.run.seekTime + produced,
+			Duration: st.sess.duration,
+		}})
+	}
+	return res
+}
+
+func (st *sessionEventStream) close() {
+	if st.unsubscribeRun != nil {
+		st.unsubscribeRun()
+		st.unsubscribeRun = nil
+	}
+	st.runEvents = nil
+	if st.watch != nil {
+		st.watch.Close()
+		st.watch = nil
+	}
+}
+
+func writeSessionEvent(w http.ResponseWriter, ev sessionEvent) error {
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// sessionEventsHandler handles GET /session/{id}/events
+// @Summary Stream session events
+// @Description Streams session state changes as server-sent events: state, seek, run_started, run_stopped, segment_ready, progress, run_error, expiring and closed. Each event carries a JSON object. The stream does not keep the session alive.
+// @Tags session
+// @Produce text/event-stream
+// @Param sessionId path string true "Session ID"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
+// @Success 200 {string} string "Event stream"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
+// @Failure 404 {string} string "Session not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
+// @Router /session/{sessionId}/events [get]
+func (s *Web) sessionEventsHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := sess.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Disable response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	st := &sessionEventStream{sess: sess}
+	defer st.close()
+	st.follow()
+
+	// Session state is read after the stream followed the run, later
+	// changes are published as events
+	info := sess.info()
+	state := sessionStateEvent{
+		SeekTime: info.SeekTime,
+		Duration: info.Duration,
+		RunKey:   info.RunKey,
+	}
+	if info.Run != nil {
+		state.Running = info.Run.Running
+	}
+	if writeSessionEvent(w, sessionEvent{eventState, state}) != nil {
+		return
+	}
+	if sess.IsClosed() {
+		_ = writeSessionEvent(w, sessionEvent{eventClosed, struct{}{}})
+		return
+	}
+
+	ticker := time.NewTicker(eventProgressInterval)
+	defer ticker.Stop()
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	// write writes an event and returns false if the stream ends
+	write := func(ev sessionEvent) bool {
+		if writeSessionEvent(w, ev) != nil {
+			return false
+		}
+		switch ev.Type {
+		case eventSeek:
+			// Announce readiness after every seek, also one keeping the run
+			st.ready = false
+		case eventClosed:
+			flusher.Flush()
+			return false
+		}
+		return true
+	}
+
+	progress := true
+	for {
+		// Session events are published while the session is locked, so a
+		// seek is written before the events of the run it switched to
+	drain:
+		for {
+			select {
+			case ev := <-events:
+				if !write(ev) {
+					return
+				}
+			default:
+				break drain
+			}
+		}
+		for _, ev := range st.poll(progress) {
+			if !write(ev) {
+				return
+			}
+		}
+		progress = false
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.streamsDone:
+			return
+		case ev := <-events:
+			if !write(ev) {
+				return
+			}
+		case ev := <-st.runEvents:
+			if !write(ev) {
+				return
+			}
+		case <-st.watch.C:
+		case <-ticker.C:
+			progress = true
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	typ  string
+	data map[string]any
+}
+
+// readEvents parses a server-sent event stream into events.
+func readEvents(t *testing.T, res *http.Response) <-chan testEvent {
+	t.Helper()
+	ch := make(chan testEvent, 100)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(res.Body)
+		var ev testEvent
+		for scanner.Scan() {
+			l := scanner.Text()
+			switch {
+			case strings.HasPrefix(l, "event: "):
+				ev.typ = strings.TrimPrefix(l, "event: ")
+			case strings.HasPrefix(l, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(l, "data: ")), &ev.data)
+			case l == "" && ev.typ != "":
+				ch <- ev
+				ev = testEvent{}
+			}
+		}
+	}()
+	return ch
+}
+
+// nextEvent skips events until one of type typ arrives.
+func nextEvent(t *testing.T, ch <-chan testEvent, typ string) testEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				t.Fatalf("stream ended before %s event", typ)
+			}
+			if ev.typ == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+}
+
+func TestWebSessionEvents(t *testing.T) {
+	web := newSimulatedWeb(t)
+	srv := httptest.NewServer(web.handler)
+	t.Cleanup(srv.Close)
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d", w.Code)
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/session/" + resp.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events: status = %d, content type = %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	events := readEvents(t, res)
+
+	if ev := nextEvent(t, events, eventState); ev.data["duration"] != 200.0 {
+		t.Errorf("state: got %v", ev.data)
+	}
+	nextEvent(t, events, eventSegmentReady)
+
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+resp.ID+"/seek?t=65"); w.Code != http.StatusOK {
+		t.Fatalf("seek: status = %d", w.Code)
+	}
+	if ev := nextEvent(t, events, eventSeek); ev.data["seek_time"] != 60.0 {
+		t.Errorf("seek: got %v", ev.data)
+	}
+	if ev := nextEvent(t, events, eventSegmentReady); ev.data["seek_time"] != 60.0 {
+		t.Errorf("segment ready after seek: got %v", ev.data)
+	}
+	if ev := nextEvent(t, events, eventProgress); ev.data["position"].(float64) <= 60 {
+		t.Errorf("progress: got %v", ev.data)
+	}
+
+	// Seeking within the same quantum keeps the run
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+resp.ID+"/seek?t=70"); w.Code != http.StatusOK {
+		t.Fatalf("seek: status = %d", w.Code)
+	}
+	nextEvent(t, events, eventSeek)
+	nextEvent(t, events, eventSegmentReady)
+
+	// Expiry warning is published once per period of inactivity
+	sess := web.sessionManager.Get(resp.ID)
+	sess.mu.Lock()
+	sess.lastAccess = time.Now().Add(-sessionInactivityExpiry + sessionExpiryWarning/2)
+	sess.mu.Unlock()
+	web.sessionManager.checkInactivity()
+	web.sessionManager.checkInactivity()
+	if ev := nextEvent(t, events, eventExpiring); ev.data["expires_in"].(float64) <= 0 {
+		t.Errorf("expiring: got %v", ev.data)
+	}
+
+	if w := serveTestRequest(web, http.MethodDelete, "/session/"+resp.ID); w.Code != http.StatusOK {
+		t.Fatalf("close: status = %d", w.Code)
+	}
+	nextEvent(t, events, eventClosed)
+	for ev := range events {
+		if ev.typ == eventExpiring {
+			t.Error("expiry warning should be published once")
+		}
+	}
+}
+
+func TestEventHubDropsForSlowSubscribers(t *testing.T) {
+	var h eventHub
+	ch, unsubscribe := h.subscribe()
+	for i := 0; i < eventBufferSize+10; i++ {
+		h.publish(eventProgress, i)
+	}
+	if len(ch) != eventBufferSize {
+		t.Errorf("buffered %d events, want %d", len(ch), eventBufferSize)
+	}
+	unsubscribe()
+	h.publish(eventProgress, 0)
+	if len(ch) != eventBufferSize {
+		t.Error("unsubscribed channel should not receive events")
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests waiting for playlists and segments subscribe to the files they
+// wait for instead of polling them. One inotify instance is shared by the
+// process; run dirs are watched while someone waits on them, and
+// subscribers are woken when a playlist is updated or a segment is written.
+// Without inotify (other platforms, watch limit reached) subscriptions say
+// so and waiters fall back to polling.
+
+const (
+	// watchSafetyInterval is how often waiters recheck even without events,
+	// e.g. after a seek switched the run they wait on.
+	watchSafetyInterval = 2 * time.Second
+)
+
+// fileSubscription receives a value on C whenever one of its files changes
+// or its directory is removed.
+type fileSubscription struct {
+	C        chan struct{}
+	files    map[string]map[string]bool // dir → file names
+	watching bool
+	w        *fileWatcher
+}
+
+// pollInterval returns how often a waiter should recheck: poll if the
+// files are not watched, otherwise watchSafetyInterval.
+func (s *fileSubscription) pollInterval(poll time.Duration) time.Duration {
+	if s.watching {
+		return watchSafetyInterval
+	}
+	return poll
+}
+
+func (s *fileSubscription) notify() {
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
+
+func (s *fileSubscription) Close() {
+	if s.w != nil {
+		s.w.remove(s)
+	}
+}
+
+// watchFiles subscribes to changes of files given by path.
+func watchFiles(paths ...string) *fileSubscription {
+	sub := &fileSubscription{
+		C:     make(chan struct{}, 1),
+		files: make(map[string]map[string]bool),
+	}
+	for _, p := range paths {
+		dir := filepath.Clean(filepath.Dir(p))
+		if sub.files[dir] == nil {
+			sub.files[dir] = make(map[string]bool)
+		}
+		sub.files[dir][filepath.Base(p)] = true
+	}
+	w := defaultFileWatcher()
+	if w == nil || len(paths) == 0 {
+		return sub
+	}
+	sub.w = w
+	sub.watching = w.add(sub)
+	return sub
+}
+
+type fileWatcher struct {
+	n *inotify
+
+	mu   sync.Mutex
+	dirs map[string]*watchedDir
+	byWd map[int32]*watchedDir
+}
+
+type watchedDir struct {
+	path string
+	wd   int32
+	subs map[*fileSubscription]struct{}
+}
+
+var fileWatcherInstance struct {
+	once sync.Once
+	w    *fileWatcher
+}
+
+// defaultFileWatcher returns the process-wide watcher, or nil if file
+// notifications are not available.
+func defaultFileWatcher() *fileWatcher {
+	fileWatcherInstance.once.Do(func() {
+		n, err := newInotify()
+		if err != nil {
+			log.WithError(err).Warn("fileWatcher: falling back to polling")
+			return
+		}
+		w := &fileWatcher{
+			n:    n,
+			dirs: make(map[string]*watchedDir),
+			byWd: make(map[int32]*watchedDir),
+		}
+		go w.loop()
+		fileWatcherInstance.w = w
+	})
+	return fileWatcherInstance.w
+}
+
+// add registers sub and returns true if all its dirs are watched.
+func (w *fileWatcher) add(sub *fileSubscription) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	all := true
+	for dir := range sub.files {
+		d, ok := w.dirs[dir]
+		if !ok {
+			wd, err := w.n.add(dir)
+			if err != nil {
+				// The run dir may not exist yet
+				all = false
+				continue
+			}
+			d = &watchedDir{path: dir, wd: wd, subs: make(map[*fileSubscription]struct{})}
+			w.dirs[dir] = d
+			w.byWd[wd] = d
+		}
+		d.subs[sub] = struct{}{}
+	}
+	return all
+}
+
+// remove unregisters sub and stops watching dirs nobody waits on.
+func (w *fileWatcher) remove(sub *fileSubscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for dir := range sub.files {
+		d, ok := w.dirs[dir]
+		if !ok {
+			continue
+		}
+		delete(d.subs, sub)
+		if len(d.subs) == 0 {
+			w.n.remove(d.wd)
+			delete(w.dirs, dir)
+			delete(w.byWd, d.wd)
+		}
+	}
+}
+
+func (w *fileWatcher) loop() {
+	err := w.n.read(func(wd int32, name string, removed bool) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		d, ok := w.byWd[wd]
+		if !ok {
+			return
+		}
+		for sub := range d.subs {
+			if removed || sub.files[d.path][name] {
+				sub.notify()
+			}
+		}
+		if removed {
+			// Subscribers recheck and find the files gone
+			delete(w.dirs, d.path)
+			delete(w.byWd, wd)
+		}
+	})
+	log.WithError(err).Error("fileWatcher: stopped")
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+type inotify struct {
+	fd int
+	f  *os.File
+}
+
+func newInotify() (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init inotify")
+	}
+	// Non-blocking, so reads go through the runtime poller
+	return &inotify{fd: fd, f: os.NewFile(uintptr(fd), "inotify")}, nil
+}
+
+func (n *inotify) add(dir string) (int32, error) {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to watch %s", dir)
+	}
+	return int32(wd), nil
+}
+
+func (n *inotify) remove(wd int32) {
+	_, _ = syscall.InotifyRmWatch(n.fd, uint32(wd))
+}
+
+// read calls handle for every event until reading fails. removed is set
+// when the watch is gone, e.g. because the directory was deleted.
+func (n *inotify) read(handle func(wd int32, name string, removed bool)) error {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		l, err := n.f.Read(buf)
+		if err != nil {
+			return err
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= l; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			start := off + syscall.SizeofInotifyEvent
+			name := string(buf[start : start+nameLen])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			handle(wd, name, mask&syscall.IN_IGNORED != 0)
+			off = start + nameLen
+		}
+	}
+}
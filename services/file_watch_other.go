@@ -0,0 +1,23 @@
+//go:build !linux
+
+package services
+
+import (
+	"github.com/pkg/errors"
+)
+
+type inotify struct{}
+
+func newInotify() (*inotify, error) {
+	return nil, errors.New("file notifications are not supported on this platform")
+}
+
+func (n *inotify) add(dir string) (int32, error) {
+	return 0, errors.New("not supported")
+}
+
+func (n *inotify) remove(wd int32) {}
+
+func (n *inotify) read(handle func(wd int32, name string, removed bool)) error {
+	return errors.New("not supported")
+}
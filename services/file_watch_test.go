@@ -0,0 +1,84 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitNotified(sub *fileSubscription) bool {
+	select {
+	case <-sub.C:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	sub := watchFiles(filepath.Join(dir, "v0.m3u8.ffmpeg"))
+	if !sub.watching {
+		t.Skip("file notifications not available")
+	}
+	if sub.pollInterval(time.Second) != watchSafetyInterval {
+		t.Error("watched subscription should only poll as a safety net")
+	}
+
+	// Files not subscribed to don't wake the subscriber
+	if err := os.WriteFile(filepath.Join(dir, "a0.m3u8.ffmpeg"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.C:
+		t.Error("unexpected notification for another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "v0.m3u8.ffmpeg"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitNotified(sub) {
+		t.Fatal("subscriber should be notified of playlist update")
+	}
+
+	// Removing the dir wakes subscribers so they can recheck
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !waitNotified(sub) {
+		t.Fatal("subscriber should be notified of removed dir")
+	}
+	sub.Close()
+}
+
+func TestWatchFilesRemovesWatch(t *testing.T) {
+	dir := t.TempDir()
+	sub := watchFiles(filepath.Join(dir, "v0-720-0.ts"), filepath.Join(dir, "v0-720.m3u8.ffmpeg"))
+	if !sub.watching {
+		t.Skip("file notifications not available")
+	}
+	other := watchFiles(filepath.Join(dir, "v0-720.m3u8.ffmpeg"))
+	w := sub.w
+	watched := func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		_, ok := w.dirs[filepath.Clean(dir)]
+		return ok
+	}
+	sub.Close()
+	if !watched() {
+		t.Error("dir should stay watched while subscribed")
+	}
+	other.Close()
+	if watched() {
+		t.Error("dir should not be watched without subscribers")
+	}
+
+	missing := watchFiles(filepath.Join(dir, "missing", "v0.m3u8.ffmpeg"))
+	defer missing.Close()
+	if missing.watching || missing.pollInterval(time.Second) != time.Second {
+		t.Error("subscription to a missing dir should fall back to polling")
+	}
+}
@@ -0,0 +1,820 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Hand-over upgrades the binary without interrupting playback. On SIGUSR2
+// the serving process:
+//
+//  1. stops its reapers and answers session requests with 503 + Retry-After
+//  2. writes its sessions and runs, including FFmpeg pids, to a state file
+//  3. starts the current executable with the same arguments, passing the
+//     listening sockets and the state file
+//
+// The new process adopts the sessions, the runs and their running FFmpeg
+// process groups, then reports readiness. The old process finishes its
+// in-flight requests and exits without stopping any FFmpeg. If the new
+// process fails to take over, the old one resumes serving.
+
+const (
+	HandoverFlag        = "handover"
+	handoverPidFileFlag = "handover-pid-file"
+)
+
+const (
+	handoverStateEnv     = "HANDOVER_STATE"
+	handoverListenersEnv = "HANDOVER_LISTENERS"
+	handoverReadyFDEnv   = "HANDOVER_READY_FD"
+)
+
+const (
+	handoverReadyTimeout    = 30 * time.Second
+	handoverShutdownTimeout = mediaWaitTimeout + segmentStallTimeout // let waiting media requests finish
+	adoptedPollInterval     = 500 * time.Millisecond
+)
+
+// Names of the listening sockets passed on hand-over.
+const (
+	listenerWeb            = "web"
+	listenerProbe          = "probe"
+	listenerProm           = "prom"
+	listenerInputProxy     = "input-proxy"
+	listenerWorkerRegistry = "worker-registry"
+)
+
+func RegisterHandoverFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.BoolFlag{
+		Name:   HandoverFlag,
+		Usage:  "on SIGUSR2 start the current binary and hand over listening sockets, sessions and running FFmpeg processes to it",
+		EnvVar: "HANDOVER",
+	}, cli.StringFlag{
+		Name:   handoverPidFileFlag,
+		Usage:  "write the pid of the serving process to this file, updated on hand-over",
+		EnvVar: "HANDOVER_PID_FILE",
+	})
+}
+
+// HandoverListener is a server whose listening socket is passed to the new
+// process on hand-over.
+type HandoverListener interface {
+	handoverListener() (name string, ln net.Listener)
+}
+
+// handoverShutdowner is a HandoverListener that finishes in-flight requests
+// before the old process exits.
+type handoverShutdowner interface {
+	shutdown(ctx context.Context) error
+}
+
+// handoverState is what the new process needs to continue serving.
+type handoverState struct {
+	Runs     []handoverRun     `json:"runs"`
+	Sessions []handoverSession `json:"sessions"`
+}
+
+type handoverRun struct {
+	Key         string        `json:"key"`
+	HashDir     string        `json:"hash_dir"`
+	SeekTime    float64       `json:"seek_time"`
+	SourceURL   string        `json:"source_url"`
+	Job         *workerJob    `json:"job,omitempty"`
+	Pid         int           `json:"pid,omitempty"`
+	StartTime   uint64        `json:"start_time,omitempty"`
+	RefCount    int           `json:"ref_count"`
+	Complete    bool          `json:"complete,omitempty"`
+	LowPriority bool          `json:"low_priority,omitempty"`
+	Speculative bool          `json:"speculative,omitempty"`
+	IdleSince   time.Time     `json:"idle_since"`
+	Grace       time.Duration `json:"grace,omitempty"`
+	StitchNext  string        `json:"stitch_next,omitempty"`
+	StitchEnd   float64       `json:"stitch_end,omitempty"`
+}
+
+type handoverSession struct {
+	ID          string         `json:"id"`
+	SourceURL   string         `json:"source_url"`
+	HashDir     string         `json:"hash_dir"`
+	Job         *workerJob     `json:"job,omitempty"`
+	Duration    float64        `json:"duration"`
+	SeekTime    float64        `json:"seek_time"`
+	LastAccess  time.Time      `json:"last_access"`
+	RunKey      string         `json:"run_key,omitempty"`
+	SeekHistory []float64      `json:"seek_history,omitempty"`
+	Playhead    float64        `json:"playhead"`
+	PositionKey string         `json:"position_key,omitempty"`
+	QuotaID     string         `json:"quota_id,omitempty"`
+	Timings     SessionTimings `json:"timings"`
+	Subject     string         `json:"subject,omitempty"`
+	Deadline    time.Time      `json:"deadline,omitzero"`
+}
+
+// Handover hands the serving process over to a new one on SIGUSR2.
+type Handover struct {
+	runManager     *RunManager
+	sessionManager *SessionManager
+	pidFile        string
+
+	mu         sync.Mutex
+	listeners  []HandoverListener
+	inProgress bool
+	handedOver bool
+	finished   chan struct{}
+	closed     chan struct{}
+	once       sync.Once
+}
+
+func NewHandover(c *cli.Context, runManager *RunManager, sessionManager *SessionManager) *Handover {
+	if !c.Bool(HandoverFlag) {
+		return nil
+	}
+	s := &Handover{
+		runManager:     runManager,
+		sessionManager: sessionManager,
+		pidFile:        c.String(handoverPidFileFlag),
+		finished:       make(chan struct{}),
+		closed:         make(chan struct{}),
+	}
+	s.writePidFile()
+	return s
+}
+
+// AddListeners registers servers whose sockets are passed to the new process.
+func (s *Handover) AddListeners(ls ...HandoverListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, ls...)
+}
+
+// InProgress returns true from the start of a hand-over until it fails or
+// the process exits. A nil Handover never hands over.
+func (s *Handover) InProgress() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inProgress
+}
+
+// HandedOver returns true once a new process took over.
+func (s *Handover) HandedOver() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handedOver
+}
+
+func (s *Handover) Serve() error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			if err := s.handOver(); err != nil {
+				log.WithError(err).Error("handover: failed, keeping on serving")
+				continue
+			}
+			s.shutdown()
+			return nil
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+// Wait blocks until in-flight requests finished after a hand-over.
+func (s *Handover) Wait() {
+	<-s.finished
+}
+
+func (s *Handover) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (s *Handover) writePidFile() {
+	if s.pidFile == "" {
+		return
+	}
+	if err := os.WriteFile(s.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.WithError(err).Warn("handover: failed to write pid file")
+	}
+}
+
+func (s *Handover) setInProgress(v bool) {
+	s.mu.Lock()
+	s.inProgress = v
+	s.mu.Unlock()
+}
+
+func (s *Handover) handOver() (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to locate executable")
+	}
+	log.WithField("executable", exe).Info("handover: starting")
+
+	s.setInProgress(true)
+	s.runManager.detach()
+	s.sessionManager.detach()
+	defer func() {
+		if err != nil {
+			s.runManager.attach()
+			s.sessionManager.attach()
+			s.setInProgress(false)
+			s.writePidFile()
+		}
+	}()
+
+	statePath, err := writeHandoverState(&handoverState{
+		Runs:     s.runManager.exportState(),
+		Sessions: s.sessionManager.exportState(),
+	})
+	if err != nil {
+		return err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var specs []string
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, l := range listeners {
+		name, ln := l.handoverListener()
+		if ln == nil {
+			continue
+		}
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			_ = os.Remove(statePath)
+			return errors.Wrapf(err, "failed to get %s socket", name)
+		}
+		defer f.Close()
+		specs = append(specs, fmt.Sprintf("%s:%d", name, len(files)))
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		_ = os.Remove(statePath)
+		return errors.Wrap(err, "failed to create ready pipe")
+	}
+	defer readyR.Close()
+	readyFD := len(files)
+	files = append(files, readyW)
+
+	env := handoverEnv(os.Environ(),
+		handoverStateEnv+"="+statePath,
+		handoverListenersEnv+"="+strings.Join(specs, ","),
+		handoverReadyFDEnv+"="+strconv.Itoa(readyFD),
+	)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	_ = readyW.Close()
+	if err != nil {
+		_ = os.Remove(statePath)
+		return errors.Wrap(err, "failed to start new process")
+	}
+	if err := waitHandoverReady(readyR, handoverReadyTimeout); err != nil {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		_ = os.Remove(statePath)
+		return errors.Wrap(err, "new process did not take over")
+	}
+	log.WithField("pid", proc.Pid).Info("handover: new process took over")
+	_ = proc.Release()
+
+	s.mu.Lock()
+	s.handedOver = true
+	s.mu.Unlock()
+	return nil
+}
+
+// shutdown stops accepting connections and waits for in-flight requests.
+func (s *Handover) shutdown() {
+	defer close(s.finished)
+	ctx, cancel := context.WithTimeout(context.Background(), handoverShutdownTimeout)
+	defer cancel()
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, l := range listeners {
+		if sh, ok := l.(handoverShutdowner); ok {
+			if err := sh.shutdown(ctx); err != nil {
+				log.WithError(err).Warn("handover: in-flight requests interrupted")
+			}
+		}
+	}
+}
+
+func writeHandoverState(st *handoverState) (string, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode state")
+	}
+	// Holds source headers, readable by the owner only
+	f, err := os.CreateTemp("", "content-transcoder-handover-*.json")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create state file")
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		_ = os.Remove(f.Name())
+		return "", errors.Wrap(err, "failed to write state file")
+	}
+	return f.Name(), nil
+}
+
+// handoverEnv replaces hand-over variables left from a previous hand-over.
+func handoverEnv(environ []string, vars ...string) []string {
+	res := make([]string, 0, len(environ)+len(vars))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == handoverStateEnv || name == handoverListenersEnv || name == handoverReadyFDEnv {
+			continue
+		}
+		res = append(res, kv)
+	}
+	return append(res, vars...)
+}
+
+func waitHandoverReady(r io.Reader, timeout time.Duration) error {
+	res := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := r.Read(b); err != nil {
+			res <- errors.Wrap(err, "new process exited")
+			return
+		}
+		res <- nil
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timeout")
+	}
+}
+
+// TakingOver returns true if the process was started by a hand-over.
+func TakingOver() bool {
+	return os.Getenv(handoverStateEnv) != ""
+}
+
+// TakeOver restores sessions and runs handed over by the previous process
+// and tells it to stop serving. Source URLs of runs are registered with the
+// input proxy first, so adopted FFmpeg processes can reconnect to it.
+func TakeOver(runManager *RunManager, sessionManager *SessionManager, inputProxy *InputProxy) error {
+	// Sockets are opened before the variables are cleared below
+	inheritedListeners()
+
+	path := os.Getenv(handoverStateEnv)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read hand-over state")
+	}
+	_ = os.Remove(path)
+	var st handoverState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return errors.Wrap(err, "failed to decode hand-over state")
+	}
+	if inputProxy != nil {
+		for _, r := range st.Runs {
+			if r.Job == nil {
+				continue
+			}
+			if _, err := inputProxy.URL(r.Job.SourceURL, r.Job.SourceHeaders); err != nil {
+				log.WithError(err).WithField("runKey", r.Key).Warn("handover: failed to register run source")
+			}
+		}
+	}
+	adopted := runManager.adopt(st.Runs)
+	sessionManager.adopt(st.Sessions)
+	log.WithFields(log.Fields{
+		"sessions": len(st.Sessions),
+		"runs":     len(st.Runs),
+		"adopted":  adopted,
+	}).Info("handover: took over")
+
+	fd, err := strconv.Atoi(os.Getenv(handoverReadyFDEnv))
+	if err != nil {
+		return errors.Wrap(err, "invalid ready fd")
+	}
+	ready := os.NewFile(uintptr(fd), "handover-ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte{'\n'}); err != nil {
+		return errors.Wrap(err, "failed to report readiness")
+	}
+	for _, name := range []string{handoverStateEnv, handoverListenersEnv, handoverReadyFDEnv} {
+		_ = os.Unsetenv(name)
+	}
+	return nil
+}
+
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// inheritedListeners returns the sockets passed by the previous process
+// that are not used yet.
+func inheritedListeners() map[string]net.Listener {
+	inherited.once.Do(func() {
+		inherited.listeners = parseInheritedListeners(os.Getenv(handoverListenersEnv))
+	})
+	return inherited.listeners
+}
+
+// parseInheritedListeners opens sockets described as "name:fd,...".
+func parseInheritedListeners(spec string) map[string]net.Listener {
+	res := make(map[string]net.Listener)
+	for _, item := range strings.Split(spec, ",") {
+		name, fdStr, ok := strings.Cut(item, ":")
+		if !ok {
+			continue
+		}
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			continue
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			log.WithError(err).WithField("listener", name).Warn("handover: failed to inherit socket")
+			continue
+		}
+		res[name] = ln
+	}
+	return res
+}
+
+// listen returns the socket the previous process passed on hand-over, or
+// binds addr.
+func listen(name string, addr string) (net.Listener, error) {
+	lns := inheritedListeners()
+	inherited.mu.Lock()
+	ln, ok := lns[name]
+	delete(lns, name)
+	inherited.mu.Unlock()
+	if ok {
+		log.WithField("listener", name).Info("handover: using inherited socket")
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// adoptedProcess is a FFmpeg process group started by a previous process.
+// It is not a child, so its exit is detected by polling and success is
+// derived from the playlists.
+type adoptedProcess struct {
+	pid       int
+	startTime uint64
+	dir       string
+	ended     func() bool
+	done      chan struct{}
+	err       error
+}
+
+func adoptProcess(pid int, startTime uint64, dir string, ended func() bool) (*adoptedProcess, error) {
+	if !processAlive(pid, startTime) {
+		return nil, errors.Errorf("process %d is gone", pid)
+	}
+	p := &adoptedProcess{
+		pid:       pid,
+		startTime: startTime,
+		dir:       dir,
+		ended:     ended,
+		done:      make(chan struct{}),
+	}
+	go p.watch()
+	return p, nil
+}
+
+func (p *adoptedProcess) watch() {
+	defer close(p.done)
+	ticker := time.NewTicker(adoptedPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if processAlive(p.pid, p.startTime) {
+			continue
+		}
+		removeFFmpegPid(p.dir)
+		if !p.ended() {
+			p.err = errors.Errorf("adopted process %d exited", p.pid)
+		}
+		return
+	}
+}
+
+func (p *adoptedProcess) Pid() int {
+	return p.pid
+}
+
+func (p *adoptedProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *adoptedProcess) SetLowPriority(low bool) error {
+	nice := 0
+	if low {
+		nice = prewarmNiceness
+	}
+	return syscall.Setpriority(syscall.PRIO_PGRP, p.pid, nice)
+}
+
+// Stop sends SIGTERM to the process group and escalates to SIGKILL after
+// runGracefulStopTimeout.
+func (p *adoptedProcess) Stop() {
+	_ = syscall.Kill(-p.pid, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(runGracefulStopTimeout):
+		_ = syscall.Kill(-p.pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// processStat returns the state and start time of a process from
+// /proc/{pid}/stat.
+func processStat(pid int) (byte, uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name may contain spaces and parentheses
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, 0, errors.New("unexpected stat format")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// Fields after the name start with state (3rd), starttime is the 22nd
+	if len(fields) < 20 {
+		return 0, 0, errors.New("unexpected stat format")
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fields[0][0], startTime, nil
+}
+
+// processAlive returns true if pid is running and, when startTime is set,
+// was not reused by another process.
+func processAlive(pid int, startTime uint64) bool {
+	state, st, err := processStat(pid)
+	if err != nil || state == 'Z' || state == 'X' {
+		return false
+	}
+	return startTime == 0 || st == startTime
+}
+
+// playlistsEnded returns true if FFmpeg finished all media playlists.
+func (r *TranscodeRun) playlistsEnded() bool {
+	entries, err := os.ReadDir(r.outputDir)
+	if err != nil {
+		return false
+	}
+	found := false
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".m3u8.ffmpeg") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".ffmpeg")
+		if isSubtitlePlaylist(name) {
+			continue
+		}
+		p, err := r.readRunPlaylist(name)
+		if err != nil || !p.ended {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func hlsJob(h *HLS) *workerJob {
+	if h == nil || h.cfg == nil {
+		return nil
+	}
+	return newWorkerJob(&TranscodeJob{HLS: h})
+}
+
+func (j *workerJob) handoverHLS() *HLS {
+	if j == nil {
+		return nil
+	}
+	return j.HLS()
+}
+
+// detach stops the reaper from touching runs and makes CloseAll leave them
+// running, so they can be handed over.
+func (m *RunManager) detach() {
+	m.mu.Lock()
+	m.detached = true
+	m.mu.Unlock()
+}
+
+func (m *RunManager) attach() {
+	m.mu.Lock()
+	m.detached = false
+	m.mu.Unlock()
+}
+
+func (m *RunManager) isDetached() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.detached
+}
+
+func (m *RunManager) exportState() []handoverRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]handoverRun, 0, len(m.runs))
+	for key, mr := range m.runs {
+		r := mr.run
+		r.mu.Lock()
+		st := handoverRun{
+			Key:         key,
+			HashDir:     r.hashDir,
+			SeekTime:    r.seekTime,
+			SourceURL:   r.sourceURL,
+			Job:         hlsJob(r.h),
+			RefCount:    r.refCount,
+			Complete:    r.complete,
+			LowPriority: r.lowPriority,
+			Speculative: mr.speculative,
+			IdleSince:   mr.idleSince,
+			Grace:       mr.grace,
+		}
+		// Only OS processes survive the hand-over, others are resumed
+		if r.running && r.proc != nil && r.proc.Pid() > 0 {
+			st.Pid = r.proc.Pid()
+			if _, startTime, err := processStat(st.Pid); err == nil {
+				st.StartTime = startTime
+			}
+		}
+		if r.stitch != nil {
+			st.StitchNext = r.stitch.next.key
+			st.StitchEnd = r.stitch.end
+		}
+		r.mu.Unlock()
+		res = append(res, st)
+	}
+	return res
+}
+
+// adopt registers handed over runs and returns the number of adopted
+// FFmpeg processes. Runs whose process is gone are resumed on demand.
+func (m *RunManager) adopt(runs []handoverRun) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	adopted := 0
+	for _, st := range runs {
+		run := m.newRun(st.Key, st.HashDir, st.SeekTime, st.SourceURL, st.Job.handoverHLS())
+		run.refCount = st.RefCount
+		run.complete = st.Complete
+		run.lowPriority = st.LowPriority
+		if st.Pid > 0 {
+			p, err := adoptProcess(st.Pid, st.StartTime, run.outputDir, run.playlistsEnded)
+			if err != nil {
+				run.logger.WithError(err).Warn("runManager: unable to adopt ffmpeg")
+			} else {
+				run.ctx, run.cancel = context.WithCancel(run.runCtx)
+				run.done = make(chan struct{})
+				run.proc = p
+				run.running = true
+				go run.wait(run.ctx, p)
+				adopted++
+				run.logger.WithField("pid", st.Pid).Info("runManager: adopted ffmpeg")
+			}
+		}
+		m.runs[st.Key] = &managedRun{
+			run:         run,
+			idleSince:   st.IdleSince,
+			grace:       st.Grace,
+			speculative: st.Speculative && run.running,
+		}
+	}
+	for _, st := range runs {
+		if st.StitchNext == "" {
+			continue
+		}
+		next, ok := m.runs[st.StitchNext]
+		if !ok {
+			continue
+		}
+		m.runs[st.Key].run.stitch = &runStitch{next: next.run, end: st.StitchEnd}
+	}
+	return adopted
+}
+
+// detach stops the reaper from touching sessions and makes CloseAll keep
+// them, so they can be handed over.
+func (m *SessionManager) detach() {
+	m.mu.Lock()
+	m.detached = true
+	m.mu.Unlock()
+}
+
+func (m *SessionManager) attach() {
+	m.mu.Lock()
+	m.detached = false
+	m.mu.Unlock()
+}
+
+func (m *SessionManager) isDetached() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.detached
+}
+
+func (m *SessionManager) exportState() []handoverSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]handoverSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		s.mu.Lock()
+		st := handoverSession{
+			ID:          s.id,
+			SourceURL:   s.sourceURL,
+			HashDir:     s.hashDir,
+			Job:         hlsJob(s.h),
+			Duration:    s.duration,
+			SeekTime:    s.seekTime,
+			LastAccess:  s.lastAccess,
+			SeekHistory: s.seekHistory,
+			Playhead:    s.playhead,
+			PositionKey: s.positionKey,
+			QuotaID:     s.quotaID,
+			Timings:     s.timings,
+			Subject:     s.subject,
+			Deadline:    s.deadline,
+		}
+		if s.run != nil {
+			st.RunKey = s.run.key
+		}
+		s.mu.Unlock()
+		res = append(res, st)
+	}
+	return res
+}
+
+// adopt registers handed over sessions. Run references are taken over with
+// the runs' reference counts.
+func (m *SessionManager) adopt(sessions []handoverSession) {
+	m.runMgr.mu.Lock()
+	defer m.runMgr.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range sessions {
+		s := NewSession(SessionConfig{
+			ID:        st.ID,
+			SourceURL: st.SourceURL,
+			HashDir:   st.HashDir,
+			HLS:       st.Job.handoverHLS(),
+			Duration:  st.Duration,
+			RunMgr:    m.runMgr,
+
+			PositionKey: st.PositionKey,
+			QuotaID:     st.QuotaID,
+			Quota:       m.quota,
+			Timings:     st.Timings,
+			Subject:     st.Subject,
+			Deadline:    st.Deadline,
+		})
+		s.seekTime = st.SeekTime
+		s.lastAccess = st.LastAccess
+		s.seekHistory = st.SeekHistory
+		s.playhead = st.Playhead
+		if mr, ok := m.runMgr.runs[st.RunKey]; ok {
+			s.run = mr.run
+		}
+		m.quota.adopt(s.quotaID, s.id, st.RunKey)
+		m.sessions[s.id] = s
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Owned by the parsed listener, like a descriptor passed on exec
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns := parseInheritedListeners(fmt.Sprintf("%s:%d,bad,probe:x", listenerWeb, fd))
+	if len(lns) != 1 {
+		t.Fatalf("expected one inherited listener, got %d", len(lns))
+	}
+	inherited := lns[listenerWeb]
+	defer inherited.Close()
+	if inherited.Addr().String() != ln.Addr().String() {
+		t.Errorf("inherited listener should share the address, got %s want %s", inherited.Addr(), ln.Addr())
+	}
+}
+
+func startTestProcess(t *testing.T) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep not available")
+	}
+	go cmd.Wait()
+	t.Cleanup(func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	return cmd
+}
+
+func waitRunStopped(t *testing.T, run *TranscodeRun) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for run.IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("adopted run should stop once its process exits")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRunManagerAdoptProcess(t *testing.T) {
+	for _, ended := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ended=%v", ended), func(t *testing.T) {
+			cmd := startTestProcess(t)
+			_, startTime, err := processStat(cmd.Process.Pid)
+			if err != nil {
+				t.Skip("no /proc")
+			}
+			dir := t.TempDir()
+			rm := NewRunManager(RunManagerConfig{})
+			t.Cleanup(rm.CloseAll)
+			key := runKey(dir, 0)
+			if n := rm.adopt([]handoverRun{{
+				Key:       key,
+				HashDir:   dir,
+				Pid:       cmd.Process.Pid,
+				StartTime: startTime,
+				RefCount:  1,
+			}}); n != 1 {
+				t.Fatalf("expected one adopted process, got %d", n)
+			}
+			run := rm.runs[key].run
+			if !run.IsRunning() || run.RefCount() != 1 {
+				t.Fatal("adopted run should be running with its references")
+			}
+			writeRunPlaylist(t, run, "v0-720.m3u8", 3, ended)
+
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			waitRunStopped(t, run)
+			run.mu.Lock()
+			complete := run.complete
+			run.mu.Unlock()
+			if complete != ended {
+				t.Errorf("complete: got %v, want %v", complete, ended)
+			}
+		})
+	}
+}
+
+func TestRunManagerAdoptReusedPid(t *testing.T) {
+	cmd := startTestProcess(t)
+	_, startTime, err := processStat(cmd.Process.Pid)
+	if err != nil {
+		t.Skip("no /proc")
+	}
+	dir := t.TempDir()
+	rm := NewRunManager(RunManagerConfig{})
+	t.Cleanup(rm.CloseAll)
+	key := runKey(dir, 0)
+	if n := rm.adopt([]handoverRun{{Key: key, HashDir: dir, Pid: cmd.Process.Pid, StartTime: startTime + 1}}); n != 0 {
+		t.Fatal("a process with another start time must not be adopted")
+	}
+	if rm.runs[key].run.IsRunning() {
+		t.Error("run should be registered as stopped")
+	}
+}
+
+func TestSessionManagerHandoverState(t *testing.T) {
+	sm, rm, h := newTestPrewarmManager(t, RunManagerConfig{})
+	dir := t.TempDir()
+	s, _ := sm.Create(SessionConfig{ID: "sess-1", SourceURL: "sim://host/movie.mkv", HashDir: dir, HLS: h, Duration: 600})
+	if err := s.Start(60); err != nil {
+		t.Fatal(err)
+	}
+	rm.detach()
+	sm.detach()
+	data, err := json.Marshal(&handoverState{
+		Runs:     rm.exportState(),
+		Sessions: sm.exportState(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Detached managers leave sessions and runs to the new process
+	sm.CloseAll()
+	rm.CloseAll()
+	if s.IsClosed() || !s.IsRunning() {
+		t.Error("detached managers should not close sessions or stop runs")
+	}
+	s.currentRun().Stop()
+
+	var st handoverState
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	rm2 := NewRunManager(RunManagerConfig{Transcoder: rm.cfg.Transcoder})
+	sm2 := NewSessionManager(rm2, nil, nil)
+	t.Cleanup(func() {
+		sm2.CloseAll()
+		rm2.CloseAll()
+	})
+	rm2.adopt(st.Runs)
+	sm2.adopt(st.Sessions)
+
+	s2 := sm2.Get("sess-1")
+	if s2 == nil {
+		t.Fatal("session should be taken over")
+	}
+	if s2.SeekTime() != 60 || s2.duration != 600 || s2.h == nil {
+		t.Errorf("session state not restored: seek %v, duration %v", s2.SeekTime(), s2.duration)
+	}
+	run := s2.currentRun()
+	if run == nil || run.key != runKey(dir, 60) || run.RefCount() != 1 {
+		t.Fatal("session should hold its run with the handed over reference")
+	}
+	// In-process runs can not be adopted and start again on demand
+	if err := s2.EnsureRunning(); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.IsRunning() {
+		t.Error("taken over session should restart its run")
+	}
+}
@@ -2,8 +2,10 @@ package services
 
 import (
 	"fmt"
+	"net/http"
 	u "net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -103,6 +105,8 @@ const (
 
 type HLS struct {
 	in      string
+	headers http.Header // source request headers
+	probe   *cp.ProbeReply
 	primary []*HLSStream
 	video   []*HLSStream
 	audio   []*HLSStream
@@ -117,6 +121,9 @@ func (h *HLS) GetFFmpegParams(out string) ([]string, error) {
 		return nil, errors.Wrap(err, "Unable to parse url")
 	}
 	if h.primary[0].s.GetCodecType() == "video" {
+		if h.HeightLimit() > 0 && h.cfg.disableVideoTranscoding {
+			return nil, errors.Errorf("video transcoding is disabled, can not scale down to %vp", h.HeightLimit())
+		}
 		if h.primary[0].s.GetCodecName() != "h264" {
 			if h.cfg.disableVideoTranscoding {
 				return nil, errors.Errorf("video transcoding is disabled")
@@ -130,8 +137,11 @@ func (h *HLS) GetFFmpegParams(out string) ([]string, error) {
 	// if h.sm == Online {
 	// 	params = append(params, "-re")
 	// }
+	params = append(params, "-fix_sub_duration")
+	if len(h.headers) > 0 {
+		params = append(params, "-headers", formatFFmpegHeaders(h.headers))
+	}
 	params = append(params,
-		"-fix_sub_duration",
 		"-i", parsedURL.String(),
 		// "-err_detect", "ignore_err",
 		// "-reconnect_at_eof", "1",
@@ -150,6 +160,47 @@ func (h *HLS) GetFFmpegParams(out string) ([]string, error) {
 	return params, nil
 }
 
+// WithInput returns a copy of the layout reading from another input URL.
+// Source headers are kept, so redirects to the origin still carry them.
+func (h *HLS) WithInput(in string) *HLS {
+	c := *h
+	c.in = in
+	return &c
+}
+
+// SegmentDuration returns the duration of segments in seconds.
+func (h *HLS) SegmentDuration() int {
+	return h.cfg.segmentDuration()
+}
+
+// HeightLimit returns the height video is scaled down to for a resolution
+// limit, 0 if the limit does not change the output.
+func (h *HLS) HeightLimit() uint {
+	if h.cfg.maxHeight == 0 {
+		return 0
+	}
+	for _, v := range h.video {
+		if uint(v.s.GetHeight()) > h.cfg.maxHeight {
+			return h.cfg.maxHeight
+		}
+	}
+	return 0
+}
+
+// SourceHeaders returns the request headers used to read the source.
+func (h *HLS) SourceHeaders() http.Header {
+	return h.headers
+}
+
+// Streams returns all output streams in the order they are passed to FFmpeg.
+func (h *HLS) Streams() []*HLSStream {
+	streams := make([]*HLSStream, 0, len(h.primary)+len(h.audio)+len(h.subs))
+	streams = append(streams, h.primary...)
+	streams = append(streams, h.audio...)
+	streams = append(streams, h.subs...)
+	return streams
+}
+
 type HLSStream struct {
 	index int
 	st    StreamType
@@ -222,7 +273,7 @@ func (h *HLSStream) GetFFmpegParams(out string) []string {
 	params := []string{
 		"-map", fmt.Sprintf("0:%v:%v", h.st, h.index),
 		"-f", "segment",
-		"-segment_time", "4",
+		"-segment_time", strconv.Itoa(h.cfg.segmentDuration()),
 		"-segment_list_type", "hls",
 		"-segment_list", h.GetPlaylistPath(out),
 		"-muxdelay", "0",
@@ -243,6 +294,15 @@ func (h *HLSStream) GetFFmpegParams(out string) []string {
 
 	return params
 }
+
+// GetSegmentName returns the filename of the segment with the given number.
+func (h *HLSStream) GetSegmentName(num int) string {
+	if h.r != nil {
+		return fmt.Sprintf("%v%v-%v-%v.%v", h.st, h.index, h.r.Height, num, h.GetSegmentExtension())
+	}
+	return fmt.Sprintf("%v%v-%v.%v", h.st, h.index, num, h.GetSegmentExtension())
+}
+
 func (h *HLSStream) GetSegmentExtension() string {
 	if h.st == Subtitle {
 		return "vtt"
@@ -331,6 +391,7 @@ func (s *HLS) getRenditions(height uint) []Rendition {
 func NewHLS(in string, probe *cp.ProbeReply, cfg *HLSConfig) *HLS {
 	h := &HLS{
 		in:    in,
+		probe: probe,
 		video: []*HLSStream{},
 		audio: []*HLSStream{},
 		subs:  []*HLSStream{},
@@ -341,16 +402,22 @@ func NewHLS(in string, probe *cp.ProbeReply, cfg *HLSConfig) *HLS {
 	si := 0
 	for _, s := range probe.GetStreams() {
 		if s.GetCodecType() == "video" && s.GetCodecName() != "mjpeg" && s.GetCodecName() != "png" && vi < 1 {
+			height := uint(s.GetHeight())
+			limited := cfg.maxHeight > 0 && height > cfg.maxHeight
+			if limited {
+				height = cfg.maxHeight
+			}
 			if cfg.sm == Online {
-				h.video = append(h.video, NewHLSStream(vi, Video, s, &Rendition{Height: uint(s.GetHeight())}, cfg, false))
+				// Scaling down to the limit requires transcoding
+				h.video = append(h.video, NewHLSStream(vi, Video, s, &Rendition{Height: height}, cfg, limited))
 			} else if cfg.sm == MultiBitrate {
-				rs := h.getRenditions(uint(s.GetHeight()))
+				rs := h.getRenditions(height)
 				for ri := range rs {
 					h.video = append(h.video, NewHLSStream(vi, Video, s, &rs[ri], cfg, true))
 				}
 				if len(h.video) == 0 {
 					h.video = append(h.video, NewHLSStream(vi, Video, s, &Rendition{
-						Height: uint(s.GetHeight()),
+						Height: height,
 					}, cfg, true))
 				}
 			}
@@ -374,6 +441,12 @@ func NewHLS(in string, probe *cp.ProbeReply, cfg *HLSConfig) *HLS {
 }
 
 func (s *HLS) MakeMasterPlaylist(out string) error {
+	return os.WriteFile(out+"/index.m3u8", s.MasterPlaylist(), 0644)
+}
+
+// MasterPlaylist returns the master playlist referencing the variant
+// playlists by name.
+func (s *HLS) MasterPlaylist() []byte {
 	var res strings.Builder
 	res.WriteString("#EXTM3U\n")
 	for _, a := range s.audio {
@@ -398,7 +471,7 @@ func (s *HLS) MakeMasterPlaylist(out string) error {
 		res.WriteString(p.GetPlaylistName())
 		res.WriteRune('\n')
 	}
-	return os.WriteFile(out+"/index.m3u8", []byte(res.String()), 0644)
+	return []byte(res.String())
 }
 
 type HLSBuilder struct {
@@ -410,6 +483,15 @@ type HLSConfig struct {
 	sm                      StreamMode
 	aacCodec                string
 	disableVideoTranscoding bool
+	segDuration             int  // seconds, zero uses sessionSegDuration
+	maxHeight               uint // video height limit, zero is unlimited
+}
+
+func (c *HLSConfig) segmentDuration() int {
+	if c == nil || c.segDuration <= 0 {
+		return sessionSegDuration
+	}
+	return c.segDuration
 }
 
 func NewHLSBuilder(c *cli.Context) *HLSBuilder {
@@ -419,10 +501,16 @@ func NewHLSBuilder(c *cli.Context) *HLSBuilder {
 	}
 }
 
-func (s *HLSBuilder) Build(in string, probe *cp.ProbeReply) *HLS {
-	return NewHLS(in, probe, &HLSConfig{
+// Build returns the HLS layout of a source transcoded into segments of
+// segDuration seconds.
+func (s *HLSBuilder) Build(in string, headers http.Header, probe *cp.ProbeReply, segDuration int, maxHeight uint) *HLS {
+	h := NewHLS(in, probe, &HLSConfig{
 		sm:                      Online,
 		aacCodec:                s.aacCodec,
 		disableVideoTranscoding: s.disableVideoTranscoding,
+		segDuration:             segDuration,
+		maxHeight:               maxHeight,
 	})
+	h.headers = headers
+	return h
 }
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// HTTP caching of playlists and segments. Finished segments never change,
+// but session URLs are reused after a seek for the segments of another run,
+// so only stateless content URLs (see content.go) may be cached without
+// revalidation. Everything else is revalidated with strong ETags.
+
+const (
+	// cacheImmutable is used for finished segments of content URLs
+	cacheImmutable = "public, max-age=31536000, immutable"
+	// cacheContentPlaylist lets edge caches collapse requests for growing
+	// playlists of content URLs, well below the segment duration
+	cacheContentPlaylist = "public, max-age=1"
+	// cacheContentMaster is used for master playlists of content URLs,
+	// they only change with the HLS layout
+	cacheContentMaster = "public, max-age=3600"
+	// cacheRevalidate is used for session URLs
+	cacheRevalidate = "private, no-cache"
+	// cacheNoStore is used for segments still being written
+	cacheNoStore = "no-store"
+)
+
+// contentRequest returns true for requests of stateless content URLs.
+func contentRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/content/")
+}
+
+// contentETag returns a strong ETag of data.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// fileETag returns a strong ETag of a file that is not written anymore. A
+// file written again, e.g. by a new run after the old one was cleaned up,
+// gets a new modification time.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatch reports whether an If-None-Match header matches etag. Weak
+// validators match too, as If-None-Match uses weak comparison.
+func etagMatch(header string, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writePlaylist writes a playlist with an ETag of its content, answering
+// 304 if the client already has it.
+func writePlaylist(w http.ResponseWriter, r *http.Request, data []byte, cacheControl string) {
+	etag := contentETag(data)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Write(data)
+}
+
+// serveSegmentFile serves a finished segment. http.ServeFile answers
+// conditional and range requests with the ETag set here.
+func serveSegmentFile(w http.ResponseWriter, r *http.Request, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	cacheControl := cacheRevalidate
+	if contentRequest(r) {
+		cacheControl = cacheImmutable
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeFile(w, r, path)
+}
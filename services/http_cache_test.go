@@ -0,0 +1,89 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`*`, true},
+		{`"abcd"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatch(%q): got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestWebCacheHeaders(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.contentSecret = []byte("secret")
+
+	get := func(path string, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		web.handler.ServeHTTP(w, r)
+		return w
+	}
+	// check fetches path and revalidates it with its ETag
+	check := func(path string, cacheControl string) {
+		t.Helper()
+		w := get(path, "")
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" || w.Header().Get("Cache-Control") != cacheControl {
+			t.Fatalf("%s: status = %d, etag = %q, cache control = %q", path, w.Code, etag, w.Header().Get("Cache-Control"))
+		}
+		if w := get(path, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: revalidation status = %d, want 304", path, w.Code)
+		}
+		if w := get(path, `"stale"`); w.Code != http.StatusOK {
+			t.Errorf("%s: stale revalidation status = %d, want 200", path, w.Code)
+		}
+	}
+
+	src := url.QueryEscape("sim://host/movie.mkv?duration=20")
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+src)
+	var sess sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil {
+		t.Fatal(err)
+	}
+	check("/session/"+sess.ID+"/v0-720-1.ts", cacheRevalidate)
+	check("/session/"+sess.ID+"/index.m3u8", cacheRevalidate)
+
+	w = serveTestRequest(web, http.MethodPost, "/content?source_url="+src)
+	var content contentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &content); err != nil {
+		t.Fatal(err)
+	}
+	base := "/content/" + content.Hash + "/seek-0/"
+	query := "?token=" + url.QueryEscape(content.Token)
+	check(base+"v0-720-1.ts"+query, cacheImmutable)
+	check(base+"index.m3u8"+query, cacheContentMaster)
+	// The playlist of the finished run does not change anymore
+	rm := web.sessionManager.runMgr
+	rm.mu.Lock()
+	run := rm.runs[runKey(web.output+"/"+content.Hash, 0)].run
+	rm.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for run.IsRunning() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(base+"v0-720.m3u8"+query, cacheContentPlaylist)
+}
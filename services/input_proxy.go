@@ -0,0 +1,745 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	u "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	InputCacheFlag     = "input-cache"
+	inputCacheHostFlag = "input-cache-host"
+	inputCachePortFlag = "input-cache-port"
+)
+
+const (
+	inputCacheDir          = "input-cache"
+	inputCacheChunkSize    = 1 << 20 // bytes fetched from the origin per request
+	inputCacheFetchTimeout = 5 * time.Minute
+	inputSniffLen          = 2048 // bytes of a source checked for playlists
+)
+
+// playlistSignatures start sources FFmpeg reads as playlists, opening the
+// URLs they list on its own.
+var playlistSignatures = [][]byte{
+	[]byte("#EXTM3U"),          // HLS
+	[]byte("ffconcat version"), // concat
+}
+
+func RegisterInputProxyFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.BoolFlag{
+		Name:   InputCacheFlag,
+		Usage:  "read sources through a local range-caching proxy shared by all runs of a source",
+		EnvVar: "INPUT_CACHE",
+	}, cli.StringFlag{
+		Name:   inputCacheHostFlag,
+		Usage:  "input cache proxy listening host",
+		Value:  "127.0.0.1",
+		EnvVar: "INPUT_CACHE_HOST",
+	}, cli.IntFlag{
+		Name:   inputCachePortFlag,
+		Usage:  "input cache proxy listening port (0 picks a free port)",
+		Value:  0,
+		EnvVar: "INPUT_CACHE_PORT",
+	})
+}
+
+// InputProxy is a local HTTP proxy FFmpeg and ffprobe read sources through.
+// Byte ranges fetched from the origin are stored in {hashDir}/input-cache,
+// so seeks, restarts and concurrent runs of the same content are served from
+// disk and the origin sees each byte once. Without the cache, requests are
+// streamed through, so the source policy still applies to every connection.
+type InputProxy struct {
+	output    string
+	chunkSize int64
+	cache     bool
+	// refusePlaylists keeps FFmpeg from reading sources that would make it
+	// connect to hosts the source policy has not checked
+	refusePlaylists bool
+	client          *http.Client
+	ln              net.Listener
+	srv             *http.Server
+
+	mu      sync.Mutex
+	sources map[string]*inputSource
+}
+
+// inputSource is the cache of a single source. The data file is sparse;
+// the chunks file holds one byte per chunk, set once the chunk is on disk.
+type inputSource struct {
+	hash      string
+	dir       string
+	chunkSize int64
+
+	mu          sync.Mutex
+	url         string
+	headers     http.Header
+	opened      bool
+	opening     chan struct{} // closed once a pending open ends
+	readers     int           // requests being served
+	released    bool          // dropped from the proxy, close once unread
+	direct      bool          // origin does not support ranges, stream it through
+	headChecked bool          // the start of the source is no playlist
+	size        int64
+	contentType string
+	chunks      []bool
+	pending     map[int64]chan struct{}
+	data        *os.File
+	marks       *os.File
+}
+
+type inputSourceMeta struct {
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// NewInputProxy returns nil if the input cache is disabled and the source
+// policy does not restrict hosts. Origins are only fetched from if the
+// source policy allows them; FFmpeg would resolve hosts and follow
+// redirects on its own.
+func NewInputProxy(c *cli.Context, policy *SourcePolicy) (*InputProxy, error) {
+	if !c.Bool(InputCacheFlag) && !policy.restrictsHosts() {
+		return nil, nil
+	}
+	addr := fmt.Sprintf("%s:%d", c.String(inputCacheHostFlag), c.Int(inputCachePortFlag))
+	// Bind right away: URLs handed out before Serve() must point to a
+	// known address.
+	ln, err := listen(listenerInputProxy, addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to bind address")
+	}
+	p := newInputProxy(ln, c.String(OutputFlag), inputCacheChunkSize)
+	p.cache = c.Bool(InputCacheFlag)
+	p.refusePlaylists = policy.restrictsHosts()
+	p.client = policy.httpClient(inputCacheFetchTimeout)
+	return p, nil
+}
+
+func newInputProxy(ln net.Listener, output string, chunkSize int64) *InputProxy {
+	p := &InputProxy{
+		output:    output,
+		chunkSize: chunkSize,
+		cache:     true,
+		client:    &http.Client{Timeout: inputCacheFetchTimeout},
+		ln:        ln,
+		sources:   make(map[string]*inputSource),
+	}
+	p.srv = &http.Server{Handler: http.HandlerFunc(p.handle)}
+	return p
+}
+
+func (s *InputProxy) Serve() error {
+	log.Infof("serving InputProxy at %v", s.ln.Addr())
+	err := s.srv.Serve(s.ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *InputProxy) handoverListener() (string, net.Listener) {
+	if s == nil {
+		return listenerInputProxy, nil
+	}
+	return listenerInputProxy, s.ln
+}
+
+func (s *InputProxy) Close() {
+	log.Info("closing InputProxy")
+	_ = s.srv.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, src := range s.sources {
+		src.close()
+	}
+}
+
+// URL returns the proxied URL of a source. Only http(s) sources are
+// proxied, other inputs are returned unchanged. Origin fetches use the
+// latest source URL and headers, so refreshed credentials are picked up.
+func (s *InputProxy) URL(sourceURL string, headers http.Header) (string, error) {
+	parsed, err := u.Parse(sourceURL)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse url")
+	}
+	hash, ok := inputSourceHash(parsed)
+	if !ok {
+		return sourceURL, nil
+	}
+	s.mu.Lock()
+	src, ok := s.sources[hash]
+	if !ok {
+		hashDir, err := GetDir(s.output, hash)
+		if err != nil {
+			s.mu.Unlock()
+			return "", errors.Wrap(err, "failed to get output dir")
+		}
+		src = &inputSource{
+			hash:      hash,
+			dir:       filepath.Join(hashDir, inputCacheDir),
+			chunkSize: s.chunkSize,
+			pending:   make(map[int64]chan struct{}),
+		}
+		s.sources[hash] = src
+	}
+	s.mu.Unlock()
+
+	src.mu.Lock()
+	src.url = sourceURL
+	src.headers = headers
+	src.mu.Unlock()
+
+	name := path.Base(parsed.Path)
+	if name == "/" || name == "." {
+		name = "source"
+	}
+	return fmt.Sprintf("http://%s/%s/%s", s.ln.Addr(), hash, u.PathEscape(name)), nil
+}
+
+// inputSourceHash returns the hash a source is proxied under, false if it
+// is not proxied.
+func inputSourceHash(parsed *u.URL) (string, bool) {
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", false
+	}
+	return contentHash(parsed), true
+}
+
+// Release drops a source once the requests reading it end, closing its
+// cache files. Cached chunks stay on disk and are used again if the source
+// is requested later.
+func (s *InputProxy) Release(hash string) {
+	s.mu.Lock()
+	src, ok := s.sources[hash]
+	delete(s.sources, hash)
+	s.mu.Unlock()
+	if ok {
+		src.release()
+	}
+}
+
+func (s *InputProxy) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s.mu.Lock()
+	src, ok := s.sources[hash]
+	if ok {
+		src.addReader()
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "source not found", http.StatusNotFound)
+		return
+	}
+	defer src.doneReader()
+	logger := log.WithFields(log.Fields{
+		"hash":  hash,
+		"range": r.Header.Get("Range"),
+	})
+	if !s.cache {
+		if err := s.streamDirect(w, r, src); err != nil && r.Context().Err() == nil {
+			logger.WithError(err).Warn("inputProxy: failed to stream source")
+		}
+		return
+	}
+	if err := src.open(r.Context(), s.client); err != nil {
+		logger.WithError(err).Error("inputProxy: failed to open source")
+		http.Error(w, "failed to open source", http.StatusBadGateway)
+		return
+	}
+	if src.direct {
+		if err := s.streamDirect(w, r, src); err != nil && r.Context().Err() == nil {
+			logger.WithError(err).Warn("inputProxy: failed to stream source")
+		}
+		return
+	}
+	if s.refusePlaylists {
+		if err := src.checkHead(r.Context(), s.client); err != nil {
+			logger.WithError(err).Warn("inputProxy: source refused")
+			http.Error(w, "source refused", http.StatusForbidden)
+			return
+		}
+	}
+	start, end, ok := parseByteRange(r.Header.Get("Range"), src.size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", src.size))
+		http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", src.contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, src.size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := src.copyRange(r.Context(), s.client, w, start, end); err != nil && r.Context().Err() == nil {
+		logger.WithError(err).Warn("inputProxy: failed to serve range")
+	}
+}
+
+// streamDirect passes a request on to the origin without the cache, or an
+// origin that does not support ranges, and streams the response back. The origin is fetched with
+// the proxy's client, so the source policy applies to it and its redirects.
+func (s *InputProxy) streamDirect(w http.ResponseWriter, r *http.Request, src *inputSource) error {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, src.sourceURL(), nil)
+	if err != nil {
+		http.Error(w, "failed to create origin request", http.StatusInternalServerError)
+		return err
+	}
+	src.mu.Lock()
+	for name, values := range src.headers {
+		req.Header[name] = values
+	}
+	src.mu.Unlock()
+	if v := r.Header.Get("Range"); v != "" {
+		req.Header.Set("Range", v)
+	}
+	// Streams last as long as the source is read, the request context ends
+	// them
+	client := *s.client
+	client.Timeout = 0
+	res, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "failed to open source", http.StatusBadGateway)
+		return errors.Wrap(err, "origin request failed")
+	}
+	defer res.Body.Close()
+	// Every response is checked, ranges are not cached
+	head, err := io.ReadAll(io.LimitReader(res.Body, inputSniffLen))
+	if err != nil {
+		http.Error(w, "failed to read source", http.StatusBadGateway)
+		return errors.Wrap(err, "failed to read origin response")
+	}
+	if s.refusePlaylists && isPlaylistData(head) {
+		http.Error(w, "source refused", http.StatusForbidden)
+		return errPlaylistSource
+	}
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges"} {
+		if v := res.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+var errPlaylistSource = errors.New("playlist sources are not allowed by the source policy")
+
+// isPlaylistData reports whether the start of a source is a playlist.
+func isPlaylistData(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	for _, sig := range playlistSignatures {
+		if bytes.HasPrefix(head, sig) {
+			return true
+		}
+	}
+	// DASH manifests start with an XML declaration
+	return bytes.Contains(head, []byte("<MPD"))
+}
+
+// parseByteRange returns the inclusive byte range requested by a single
+// range header. Multiple ranges are answered with the whole content.
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	if header == "" || strings.Contains(header, ",") {
+		return 0, size - 1, size > 0
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		end = min(e, size-1)
+	}
+	return start, end, true
+}
+
+func (s *inputSource) sourceURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.url
+}
+
+func (s *inputSource) metaPath() string {
+	return filepath.Join(s.dir, "meta.json")
+}
+
+// open loads the cache from disk, or sets it up from the first chunk of the
+// origin response. The origin is fetched without holding the lock, so the
+// source URL can be updated meanwhile; concurrent callers wait for a single
+// pending open.
+func (s *inputSource) open(ctx context.Context, client *http.Client) error {
+	for {
+		s.mu.Lock()
+		if s.opened {
+			s.mu.Unlock()
+			return nil
+		}
+		if ch := s.opening; ch != nil {
+			s.mu.Unlock()
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		ch := make(chan struct{})
+		s.opening = ch
+		url, headers := s.url, s.headers
+		s.mu.Unlock()
+
+		err := s.load(client, url, headers)
+
+		s.mu.Lock()
+		s.opening = nil
+		close(ch)
+		s.mu.Unlock()
+		return err
+	}
+}
+
+// load does the work of open and publishes the result under the lock.
+func (s *inputSource) load(client *http.Client, url string, headers http.Header) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	meta := &inputSourceMeta{}
+	var first []byte
+	if data, err := os.ReadFile(s.metaPath()); err == nil && json.Unmarshal(data, meta) == nil && meta.Size > 0 {
+		log.WithField("dir", s.dir).Info("inputProxy: using existing cache")
+	} else {
+		res, err := fetchRange(client, url, headers, 0, s.chunkSize-1)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusPartialContent {
+			log.WithField("status", res.StatusCode).Warn("inputProxy: origin does not support ranges, not caching")
+			s.mu.Lock()
+			s.direct = true
+			s.opened = true
+			s.mu.Unlock()
+			return nil
+		}
+		meta.Size, err = parseContentRangeSize(res.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		meta.ContentType = res.Header.Get("Content-Type")
+		first, err = io.ReadAll(io.LimitReader(res.Body, s.chunkSize))
+		if err != nil {
+			return errors.Wrap(err, "failed to read first chunk")
+		}
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	f, err := openInputCacheFiles(s.dir, meta, s.chunkSize)
+	if err != nil {
+		return err
+	}
+	if first != nil {
+		if err := f.store(0, s.chunkSize, first); err != nil {
+			f.close()
+			return err
+		}
+		f.chunks[0] = true
+		data, err := json.Marshal(meta)
+		if err != nil {
+			f.close()
+			return err
+		}
+		if err := writeFileAtomic(s.metaPath(), data); err != nil {
+			f.close()
+			return errors.Wrap(err, "failed to write cache meta")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = f.data
+	s.marks = f.marks
+	s.chunks = f.chunks
+	s.size = meta.Size
+	s.contentType = meta.ContentType
+	s.opened = true
+	return nil
+}
+
+// inputCacheFiles are the open cache files of a source.
+type inputCacheFiles struct {
+	data   *os.File
+	marks  *os.File
+	chunks []bool
+}
+
+func openInputCacheFiles(dir string, meta *inputSourceMeta, chunkSize int64) (*inputCacheFiles, error) {
+	n := (meta.Size + chunkSize - 1) / chunkSize
+	data, err := os.OpenFile(filepath.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cache data")
+	}
+	if err := data.Truncate(meta.Size); err != nil {
+		data.Close()
+		return nil, errors.Wrap(err, "failed to size cache data")
+	}
+	marks, err := os.OpenFile(filepath.Join(dir, "chunks"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		data.Close()
+		return nil, errors.Wrap(err, "failed to open cache chunks")
+	}
+	present := make([]byte, n)
+	if _, err := marks.ReadAt(present, 0); err != nil && err != io.EOF {
+		data.Close()
+		marks.Close()
+		return nil, errors.Wrap(err, "failed to read cache chunks")
+	}
+	chunks := make([]bool, n)
+	for i, b := range present {
+		chunks[i] = b == 1
+	}
+	return &inputCacheFiles{data: data, marks: marks, chunks: chunks}, nil
+}
+
+// store writes a chunk to the data file and marks it as present.
+func (f *inputCacheFiles) store(idx int64, chunkSize int64, data []byte) error {
+	if _, err := f.data.WriteAt(data, idx*chunkSize); err != nil {
+		return errors.Wrap(err, "failed to write cache data")
+	}
+	if _, err := f.marks.WriteAt([]byte{1}, idx); err != nil {
+		return errors.Wrap(err, "failed to write cache chunks")
+	}
+	return nil
+}
+
+func (f *inputCacheFiles) close() {
+	_ = f.data.Close()
+	_ = f.marks.Close()
+}
+
+// store writes a chunk of the opened source to disk.
+func (s *inputSource) store(idx int64, data []byte) error {
+	f := &inputCacheFiles{data: s.data, marks: s.marks}
+	return f.store(idx, s.chunkSize, data)
+}
+
+func (s *inputSource) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *inputSource) closeLocked() {
+	if s.data != nil {
+		_ = s.data.Close()
+		_ = s.marks.Close()
+		s.data = nil
+		s.marks = nil
+	}
+}
+
+func (s *inputSource) addReader() {
+	s.mu.Lock()
+	s.readers++
+	s.mu.Unlock()
+}
+
+func (s *inputSource) doneReader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers--
+	if s.released && s.readers == 0 {
+		s.closeLocked()
+	}
+}
+
+// release closes the cache files once no request reads the source.
+func (s *inputSource) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.released = true
+	if s.readers == 0 {
+		s.closeLocked()
+	}
+}
+
+// checkHead returns errPlaylistSource if the cached source is a playlist.
+func (s *inputSource) checkHead(ctx context.Context, client *http.Client) error {
+	s.mu.Lock()
+	checked := s.headChecked
+	s.mu.Unlock()
+	if checked || s.size == 0 {
+		return nil
+	}
+	if err := s.ensureChunk(ctx, client, 0); err != nil {
+		return err
+	}
+	head := make([]byte, min(inputSniffLen, s.size))
+	if _, err := s.data.ReadAt(head, 0); err != nil {
+		return errors.Wrap(err, "failed to read cache data")
+	}
+	if isPlaylistData(head) {
+		return errPlaylistSource
+	}
+	s.mu.Lock()
+	s.headChecked = true
+	s.mu.Unlock()
+	return nil
+}
+
+// ensureChunk returns once the chunk is on disk. Concurrent readers of the
+// same chunk share a single origin request.
+func (s *inputSource) ensureChunk(ctx context.Context, client *http.Client, idx int64) error {
+	for {
+		s.mu.Lock()
+		if s.chunks[idx] {
+			s.mu.Unlock()
+			return nil
+		}
+		if ch, ok := s.pending[idx]; ok {
+			s.mu.Unlock()
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		ch := make(chan struct{})
+		s.pending[idx] = ch
+		url, headers := s.url, s.headers
+		s.mu.Unlock()
+
+		err := s.fetchChunk(client, url, headers, idx)
+
+		s.mu.Lock()
+		delete(s.pending, idx)
+		if err == nil {
+			s.chunks[idx] = true
+		}
+		close(ch)
+		s.mu.Unlock()
+		return err
+	}
+}
+
+func (s *inputSource) fetchChunk(client *http.Client, url string, headers http.Header, idx int64) error {
+	start := idx * s.chunkSize
+	end := min(start+s.chunkSize, s.size) - 1
+	res, err := fetchRange(client, url, headers, start, end)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return errors.Errorf("unexpected origin status %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, end-start+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to read chunk")
+	}
+	if int64(len(data)) != end-start+1 {
+		return errors.Errorf("short chunk: got %d bytes, expected %d", len(data), end-start+1)
+	}
+	return s.store(idx, data)
+}
+
+// copyRange writes the inclusive byte range to w, fetching missing chunks
+// as it goes so the client can start reading right away.
+func (s *inputSource) copyRange(ctx context.Context, client *http.Client, w io.Writer, start, end int64) error {
+	for off := start; off <= end; {
+		idx := off / s.chunkSize
+		if err := s.ensureChunk(ctx, client, idx); err != nil {
+			return err
+		}
+		chunkEnd := min((idx+1)*s.chunkSize-1, end)
+		if _, err := io.Copy(w, io.NewSectionReader(s.data, off, chunkEnd-off+1)); err != nil {
+			return err
+		}
+		off = chunkEnd + 1
+	}
+	return nil
+}
+
+func fetchRange(client *http.Client, url string, headers http.Header, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create origin request")
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "origin request failed")
+	}
+	if res.StatusCode >= 400 {
+		res.Body.Close()
+		return nil, errors.Errorf("origin returned status %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+// parseContentRangeSize returns the complete length from a Content-Range
+// header like "bytes 0-1023/4096".
+func parseContentRangeSize(header string) (int64, error) {
+	_, size, ok := strings.Cut(header, "/")
+	if !ok || size == "*" {
+		return 0, errors.Errorf("unknown content size in %q", header)
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid content range %q", header)
+	}
+	return n, nil
+}
@@ -0,0 +1,417 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestOrigin serves content with range support and counts bytes sent.
+func newTestOrigin(t *testing.T, content []byte) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var sent atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w, n: &sent}
+		http.ServeContent(cw, r, "movie.mkv", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &sent
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+func startTestInputProxy(t *testing.T, output string, chunkSize int64) *InputProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newInputProxy(ln, output, chunkSize)
+	go p.Serve()
+	t.Cleanup(p.Close)
+	return p
+}
+
+func readProxyRange(url string, rng string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if rng != "" && res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("expected 206 for range %s, got %d", rng, res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func TestInputProxyCachesRanges(t *testing.T) {
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	origin, sent := newTestOrigin(t, content)
+	output := t.TempDir()
+	p := startTestInputProxy(t, output, 1024)
+
+	url, err := p.URL(origin.URL+"/movie.mkv?token=abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(url, "/movie.mkv") {
+		t.Errorf("proxied url should keep the file name, got %s", url)
+	}
+
+	// Concurrent readers at different positions, like runs seeking
+	var wg sync.WaitGroup
+	for _, rng := range []string{"bytes=0-", "bytes=5000-", "bytes=3000-6999", "bytes=-100"} {
+		wg.Add(1)
+		go func(rng string) {
+			defer wg.Done()
+			got, err := readProxyRange(url, rng)
+			start, end, _ := parseByteRange(rng, int64(len(content)))
+			if err != nil {
+				t.Errorf("range %s: %v", rng, err)
+			} else if !bytes.Equal(got, content[start:end+1]) {
+				t.Errorf("range %s: content mismatch", rng)
+			}
+		}(rng)
+	}
+	wg.Wait()
+	if got, err := readProxyRange(url, ""); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("full read: content mismatch (%v)", err)
+	}
+	if sent.Load() != int64(len(content)) {
+		t.Errorf("origin should send each byte once, sent %d of %d", sent.Load(), len(content))
+	}
+
+	// A new process reuses the cache on disk
+	p2 := startTestInputProxy(t, output, 1024)
+	url2, err := p2.URL(origin.URL+"/movie.mkv?token=def", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readProxyRange(url2, "bytes=100-8999"); err != nil || !bytes.Equal(got, content[100:9000]) {
+		t.Errorf("restored cache: content mismatch (%v)", err)
+	}
+	if sent.Load() != int64(len(content)) {
+		t.Errorf("restored cache should not hit the origin, sent %d", sent.Load())
+	}
+}
+
+func TestInputProxyNonHTTPInput(t *testing.T) {
+	p := startTestInputProxy(t, t.TempDir(), 1024)
+	for _, in := range []string{"sim://host/movie.mkv", "/data/movie.mkv"} {
+		got, err := p.URL(in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != in {
+			t.Errorf("%s should not be proxied, got %s", in, got)
+		}
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"", 0, 999, true},
+		{"bytes=0-", 0, 999, true},
+		{"bytes=100-199", 100, 199, true},
+		{"bytes=900-2000", 900, 999, true},
+		{"bytes=-10", 990, 999, true},
+		{"bytes=0-1,5-6", 0, 999, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=200-100", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseByteRange(tt.header, 1000)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v; want %d, %d, %v",
+				tt.header, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+	if _, err := parseContentRangeSize(fmt.Sprintf("bytes 0-9/%d", 1234)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInputProxySourceHeaders(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 3000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "movie.mkv", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+	p := startTestInputProxy(t, t.TempDir(), 1024)
+
+	url, err := p.URL(origin.URL+"/movie.mkv", http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readProxyRange(url, "bytes=1000-"); err != nil || !bytes.Equal(got, content[1000:]) {
+		t.Errorf("range with source headers: content mismatch (%v)", err)
+	}
+}
+
+func TestInputProxyDirectSource(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	var origin *httptest.Server
+	// The origin ignores ranges; /redirect sends reads other than the first
+	// range request elsewhere
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" && r.Header.Get("Range") == "" {
+			http.Redirect(w, r, strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)+"/movie.mkv", http.StatusFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer origin.Close()
+	p := startTestInputProxy(t, t.TempDir(), 64)
+	policy, _ := newSourcePolicy("http", "", "localhost", false)
+	p.client = policy.httpClient(inputCacheFetchTimeout)
+
+	get := func(source string) (int, []byte) {
+		t.Helper()
+		url, err := p.URL(source, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, data
+	}
+	if code, data := get(origin.URL + "/movie.mkv"); code != http.StatusOK || !bytes.Equal(data, content) {
+		t.Errorf("direct source should be streamed through, got status %d and %d bytes", code, len(data))
+	}
+	// Redirects of the origin are checked by the source policy
+	if code, _ := get(origin.URL + "/redirect"); code != http.StatusBadGateway {
+		t.Errorf("redirect to a denied host: status = %d, want 502", code)
+	}
+}
+
+func TestInputProxyWithoutCache(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	origin, fetched := newTestOrigin(t, content)
+	output := t.TempDir()
+	p := startTestInputProxy(t, output, 64)
+	p.cache = false
+	url, err := p.URL(origin.URL+"/movie.mkv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		data, err := readProxyRange(url, "bytes=10-19")
+		if err != nil || !bytes.Equal(data, content[10:20]) {
+			t.Fatalf("range: %q, %v", data, err)
+		}
+	}
+	if got := fetched.Load(); got != 20 {
+		t.Errorf("origin served %d bytes, want every range fetched again", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(output, "*", "*", inputCacheDir)); len(matches) > 0 {
+		t.Errorf("nothing should be cached, found %v", matches)
+	}
+
+	// The policy applies to every connection
+	deny, _ := newSourcePolicy("http", "", "", true)
+	p.client = deny.httpClient(inputCacheFetchTimeout)
+	if _, err := readProxyRange(url, "bytes=10-19"); err == nil {
+		t.Error("a loopback origin should be refused")
+	}
+}
+
+func TestInputProxyRelease(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	origin, sent := newTestOrigin(t, content)
+	p := startTestInputProxy(t, t.TempDir(), 64)
+	url, err := p.URL(origin.URL+"/movie.mkv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readProxyRange(url, "bytes=0-99"); err != nil || !bytes.Equal(data, content[:100]) {
+		t.Fatalf("range: %q, %v", data, err)
+	}
+	hash := strings.Split(url, "/")[3]
+	p.mu.Lock()
+	src := p.sources[hash]
+	p.mu.Unlock()
+
+	// Files stay open while a request reads the source
+	src.addReader()
+	p.Release(hash)
+	p.mu.Lock()
+	n := len(p.sources)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d sources left after release", n)
+	}
+	if src.data == nil {
+		t.Error("cache files closed while being read")
+	}
+	src.doneReader()
+	if src.data != nil {
+		t.Error("cache files left open after the last reader")
+	}
+	if res, err := http.Get(url); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("released source: %v, %v, want 404", res, err)
+	} else {
+		res.Body.Close()
+	}
+
+	// Registered again, the source is served from the cache on disk
+	fetched := sent.Load()
+	if url, err = p.URL(origin.URL+"/movie.mkv", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readProxyRange(url, "bytes=0-99"); err != nil || !bytes.Equal(data, content[:100]) {
+		t.Fatalf("range: %q, %v", data, err)
+	}
+	if got := sent.Load(); got != fetched {
+		t.Errorf("origin served %d more bytes, want cached ranges reused", got-fetched)
+	}
+}
+
+func TestInputProxyOpenDoesNotBlockURL(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	requested := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-unblock
+		http.ServeContent(w, r, "movie.mkv", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+	t.Cleanup(func() {
+		select {
+		case <-unblock:
+		default:
+			close(unblock)
+		}
+	})
+	p := startTestInputProxy(t, t.TempDir(), 64)
+	url, err := p.URL(origin.URL+"/movie.mkv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			data, err := readProxyRange(url, "bytes=0-9")
+			if err == nil && !bytes.Equal(data, content[:10]) {
+				err = fmt.Errorf("got %q", data)
+			}
+			done <- err
+		}()
+	}
+	<-requested
+
+	// The pending origin request must not hold up other users of the source
+	registered := make(chan error, 1)
+	go func() {
+		_, err := p.URL(origin.URL+"/movie.mkv?token=new", nil)
+		registered <- err
+	}()
+	select {
+	case err := <-registered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("URL blocked by a pending open")
+	}
+	close(unblock)
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInputProxyRefusesPlaylists(t *testing.T) {
+	playlist := []byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nhttp://169.254.169.254/latest/meta-data\n#EXT-X-ENDLIST\n")
+	for _, cache := range []bool{true, false} {
+		origin, _ := newTestOrigin(t, playlist)
+		p := startTestInputProxy(t, t.TempDir(), 64)
+		p.cache = cache
+		p.refusePlaylists = true
+		url, err := p.URL(origin.URL+"/movie.m3u8", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readProxyRange(url, "bytes=0-63"); err == nil {
+			t.Errorf("cache %v: HLS source listing a denied host should be refused", cache)
+		}
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("cache %v: status = %d, want 403", cache, res.StatusCode)
+		}
+	}
+
+	media := []byte(strings.Repeat("\x1aE\xdf\xa3", 64))
+	origin, _ := newTestOrigin(t, media)
+	p := startTestInputProxy(t, t.TempDir(), 64)
+	p.refusePlaylists = true
+	url, _ := p.URL(origin.URL+"/movie.mkv", nil)
+	if data, err := readProxyRange(url, ""); err != nil || !bytes.Equal(data, media) {
+		t.Errorf("media source: %v", err)
+	}
+}
+
+func TestIsPlaylistData(t *testing.T) {
+	for data, want := range map[string]bool{
+		"#EXTM3U\n":                        true,
+		"\xef\xbb\xbf\n #EXTM3U":           true,
+		"ffconcat version 1.0\n":           true,
+		`<?xml version="1.0"?><MPD xmlns=`: true,
+		"\x1aE\xdf\xa3 matroska":           false,
+		"":                                 false,
+	} {
+		if got := isPlaylistData([]byte(data)); got != want {
+			t.Errorf("%q: got %v", data, got)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// JWT authentication: with a secret (HS256) or a JWKS file (RS256), POST
+// /session and session routes require a token in "Authorization: Bearer
+// <jwt>" or the access_token query param. Claims restrict what the subject
+// may do, sessions record the subject and are only served to it.
+
+const (
+	JWTSecretFlag   = "jwt-secret"
+	JWTJWKSFileFlag = "jwt-jwks-file"
+)
+
+const (
+	jwtQueryParam = "access_token"
+	jwtClockSkew  = 30 * time.Second
+)
+
+func RegisterJWTAuthFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   JWTSecretFlag,
+		Usage:  "secret verifying HS256 API tokens",
+		Value:  "",
+		EnvVar: "JWT_SECRET",
+	}, cli.StringFlag{
+		Name:   JWTJWKSFileFlag,
+		Usage:  "JWKS file with the RSA keys verifying RS256 API tokens",
+		Value:  "",
+		EnvVar: "JWT_JWKS_FILE",
+	})
+}
+
+// AuthClaims are the claims of API tokens. Zero limits are unlimited.
+type AuthClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	// SourceHosts are the hosts sources may be read from, "*.example.com"
+	// matches subdomains. Empty allows all hosts.
+	SourceHosts []string `json:"source_hosts,omitempty"`
+	// MaxResolution is the video height sources are scaled down to
+	MaxResolution uint `json:"max_resolution,omitempty"`
+	// MaxSessions limits the concurrent sessions of the subject
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// MaxSessionLifetime is the number of seconds sessions may live
+	MaxSessionLifetime int `json:"max_session_lifetime,omitempty"`
+}
+
+// allowsHost reports whether sources may be read from host.
+func (c *AuthClaims) allowsHost(host string) bool {
+	if len(c.SourceHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range c.SourceHosts {
+		h = strings.ToLower(h)
+		if h == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, "*"); ok && strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadline returns the time sessions created now have to be closed at,
+// zero without a lifetime limit.
+func (c *AuthClaims) deadline() time.Time {
+	if c.MaxSessionLifetime <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(c.MaxSessionLifetime) * time.Second)
+}
+
+// JWTAuth verifies API tokens. A nil JWTAuth disables authentication.
+type JWTAuth struct {
+	secret []byte
+	keys   map[string]*rsa.PublicKey // key ID → key
+}
+
+// NewJWTAuth returns nil if neither a secret nor a JWKS file is configured.
+func NewJWTAuth(c *cli.Context) (*JWTAuth, error) {
+	secret := c.String(JWTSecretFlag)
+	jwksFile := c.String(JWTJWKSFileFlag)
+	if secret == "" && jwksFile == "" {
+		return nil, nil
+	}
+	a := &JWTAuth{secret: []byte(secret)}
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read jwks file")
+		}
+		a.keys, err = parseJWKS(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse jwks file %s", jwksFile)
+		}
+	}
+	return a, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseJWKS returns the RSA signing keys of a JWKS document.
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modulus of key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.Errorf("invalid exponent of key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+	return keys, nil
+}
+
+// parse verifies a token and returns its claims.
+func (a *JWTAuth) parse(token string) (*AuthClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	enc := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if len(a.secret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("invalid token signature")
+		}
+	case "RS256":
+		key, err := a.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, errors.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	var claims AuthClaims
+	data, err = enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.Add(-jwtClockSkew).Unix() > claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtClockSkew).Unix() < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token without subject")
+	}
+	return &claims, nil
+}
+
+// key returns the RSA key with the given ID, or the only one if the token
+// names none.
+func (a *JWTAuth) key(kid string) (*rsa.PublicKey, error) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, k := range a.keys {
+			return k, nil
+		}
+	}
+	k, ok := a.keys[kid]
+	if !ok {
+		return nil, errors.Errorf("unknown token key %q", kid)
+	}
+	return k, nil
+}
+
+// authenticate returns the claims of the request's token, nil if
+// authentication is disabled.
+func (a *JWTAuth) authenticate(r *http.Request) (*AuthClaims, error) {
+	if a == nil {
+		return nil, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get(jwtQueryParam)
+	}
+	if token == "" {
+		return nil, errors.New("missing token")
+	}
+	return a.parse(token)
+}
+
+// writeAuthError answers 401 with the reason authentication failed.
+func writeAuthError(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT returns a token of claims signed with alg, using secret for
+// HS256 and key for RS256.
+func testJWT(t *testing.T, alg string, kid string, claims any, secret []byte, key *rsa.PrivateKey) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sum := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestJWTAuthParse(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"EC","kid":"ec"},{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q}]}`,
+		enc.EncodeToString(key.N.Bytes()), enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	keys, err := parseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	auth := &JWTAuth{secret: secret, keys: keys}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := AuthClaims{Subject: "alice", ExpiresAt: exp, MaxSessions: 2}
+	for _, token := range []string{
+		testJWT(t, "HS256", "", valid, secret, nil),
+		testJWT(t, "RS256", "k1", valid, nil, key),
+		testJWT(t, "RS256", "", valid, nil, key),
+	} {
+		claims, err := auth.parse(token)
+		if err != nil || claims.Subject != "alice" || claims.MaxSessions != 2 {
+			t.Errorf("got %+v, %v", claims, err)
+		}
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for name, token := range map[string]string{
+		"expired":      testJWT(t, "HS256", "", AuthClaims{Subject: "alice", ExpiresAt: time.Now().Add(-time.Hour).Unix()}, secret, nil),
+		"without exp":  testJWT(t, "HS256", "", AuthClaims{Subject: "alice"}, secret, nil),
+		"not yet":      testJWT(t, "HS256", "", AuthClaims{Subject: "alice", ExpiresAt: exp, NotBefore: exp}, secret, nil),
+		"without sub":  testJWT(t, "HS256", "", AuthClaims{ExpiresAt: exp}, secret, nil),
+		"wrong secret": testJWT(t, "HS256", "", valid, []byte("other"), nil),
+		"wrong key":    testJWT(t, "RS256", "k1", valid, nil, other),
+		"unknown kid":  testJWT(t, "RS256", "k2", valid, nil, key),
+		"alg none":     testJWT(t, "none", "", valid, nil, nil),
+		"malformed":    "abc.def",
+	} {
+		if _, err := auth.parse(token); err == nil {
+			t.Errorf("%s token should be rejected", name)
+		}
+	}
+	if _, err := (&JWTAuth{keys: keys}).parse(testJWT(t, "HS256", "", valid, nil, nil)); err == nil {
+		t.Error("HS256 tokens should be rejected without a secret")
+	}
+	if _, err := parseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"ec"}]}`)); err == nil {
+		t.Error("jwks without RSA keys should be rejected")
+	}
+
+	var none *JWTAuth
+	if claims, err := none.authenticate(httptest.NewRequest(http.MethodPost, "/session", nil)); claims != nil || err != nil {
+		t.Errorf("disabled auth: got %+v, %v", claims, err)
+	}
+}
+
+func TestAuthClaimsAllowsHost(t *testing.T) {
+	c := &AuthClaims{SourceHosts: []string{"media.example.com", "*.cdn.example.com"}}
+	for host, want := range map[string]bool{
+		"media.example.com":   true,
+		"MEDIA.example.com":   true,
+		"a.cdn.example.com":   true,
+		"cdn.example.com":     false,
+		"evilcdn.example.com": false,
+		"example.com":         false,
+	} {
+		if got := c.allowsHost(host); got != want {
+			t.Errorf("%s: got %v, want %v", host, got, want)
+		}
+	}
+	if !(&AuthClaims{}).allowsHost("any.host") {
+		t.Error("claims without hosts should allow all hosts")
+	}
+}
+
+func TestWebJWTAuth(t *testing.T) {
+	web := newSimulatedWeb(t)
+	secret := []byte("secret")
+	web.auth = &JWTAuth{secret: secret}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := func(claims AuthClaims) string {
+		claims.ExpiresAt = exp
+		return testJWT(t, "HS256", "", claims, secret, nil)
+	}
+	alice := token(AuthClaims{Subject: "alice", SourceHosts: []string{"host"}, MaxResolution: 480, MaxSessions: 1, MaxSessionLifetime: 3600})
+	serve := func(method string, path string, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		web.handler.ServeHTTP(w, r)
+		return w
+	}
+	create := "/session?source_url=" + url.QueryEscape("sim://host/movie.mkv?duration=20")
+
+	if w := serve(http.MethodPost, create, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want 401", w.Code)
+	}
+	if w := serve(http.MethodPost, "/session?source_url="+url.QueryEscape("sim://other/movie.mkv?duration=20"), alice); w.Code != http.StatusForbidden {
+		t.Errorf("source host not allowed: status = %d, want 403", w.Code)
+	}
+	w := serve(http.MethodPost, create, alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(http.MethodPost, create, alice); w.Code != http.StatusTooManyRequests {
+		t.Errorf("beyond max sessions: status = %d, want 429", w.Code)
+	}
+
+	sess := web.sessionManager.Get(resp.ID)
+	if sess.Subject() != "alice" || sess.deadline.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("subject = %q, deadline = %v", sess.Subject(), sess.deadline)
+	}
+	// Scaled down output is kept apart from the source resolution
+	if !strings.HasSuffix(sess.hashDir, "-h480") {
+		t.Errorf("hash dir %s should be specific to the height limit", sess.hashDir)
+	}
+
+	base := "/session/" + resp.ID + "/"
+	if w := serve(http.MethodGet, base+"index.m3u8", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("session without token: status = %d, want 401", w.Code)
+	}
+	if w := serve(http.MethodGet, base+"index.m3u8", token(AuthClaims{Subject: "bob"})); w.Code != http.StatusForbidden {
+		t.Errorf("session of another subject: status = %d, want 403", w.Code)
+	}
+	w = serve(http.MethodGet, base+"index.m3u8?"+jwtQueryParam+"="+alice, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("master: status = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	sess.deadline = time.Now().Add(-time.Second)
+	if w := serve(http.MethodGet, base+"seek", alice); w.Code != http.StatusGone {
+		t.Errorf("past lifetime: status = %d, want 410", w.Code)
+	}
+	if web.sessionManager.Get(resp.ID) != nil {
+		t.Error("session past its lifetime should be closed")
+	}
+}
+
+func TestWebJWTAuthSignedMedia(t *testing.T) {
+	web := newSimulatedWeb(t)
+	secret := []byte("secret")
+	web.auth = &JWTAuth{secret: secret}
+	web.signer = &URLSigner{secret: []byte("url-secret"), ttl: time.Hour}
+	alice := testJWT(t, "HS256", "", AuthClaims{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()}, secret, nil)
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20")+"&"+jwtQueryParam+"="+alice)
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	base := "/session/" + resp.ID + "/"
+	w = serveTestRequest(web, http.MethodGet, base+"index.m3u8?"+resp.Query+"&"+jwtQueryParam+"="+alice)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), jwtQueryParam) {
+		t.Fatalf("master: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	// Signed references are served without the token
+	variant := playlistRef(t, w.Body.String(), "v0-720.m3u8")
+	if w := serveTestRequest(web, http.MethodGet, base+variant); w.Code != http.StatusOK {
+		t.Errorf("signed variant without token: status = %d", w.Code)
+	}
+	if w := serveTestRequest(web, http.MethodPost, base+"seek?t=0&"+resp.Query); w.Code != http.StatusUnauthorized {
+		t.Errorf("seek without token: status = %d, want 401", w.Code)
+	}
+}
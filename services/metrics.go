@@ -0,0 +1,160 @@
+package services
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics of the prom port. Counters and
+// histograms are updated where things happen; session and run gauges are
+// read from the managers on scrape by the collector RegisterMetrics adds.
+
+const metricsNamespace = "content_transcoder"
+
+const (
+	runModeCopy      = "copy"
+	runModeTranscode = "transcode"
+)
+
+// Failure classes of runs
+const (
+	runFailureStart = "start" // the transcoder failed to start
+	runFailureExit  = "exit"  // FFmpeg exited with an error without being stopped
+)
+
+// Results of waits for playlists and segments
+const (
+	waitReady    = "ready"
+	waitTimeout  = "timeout"
+	waitExited   = "exited" // FFmpeg stopped before the file was ready
+	waitCanceled = "canceled"
+)
+
+// waitBuckets cover segments already on disk up to the 5 minute wait limit.
+var waitBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	runStarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_starts_total",
+		Help:      "Runs started, by mode.",
+	}, []string{"mode"})
+	runRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_restarts_total",
+		Help:      "Stopped runs started again, by mode.",
+	}, []string{"mode"})
+	runFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_failures_total",
+		Help:      "Runs failed, by class.",
+	}, []string{"class"})
+	runReuses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_reuses_total",
+		Help:      "Runs acquired that existed already, by whether they were running or stopped with their output kept.",
+	}, []string{"state"})
+	sessionSeeks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "seeks_total",
+		Help:      "Session seeks.",
+	})
+	segmentWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "segment_wait_seconds",
+		Help:      "Time segment requests waited for the segment, by result.",
+		Buckets:   waitBuckets,
+	}, []string{"result"})
+	playlistWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "playlist_wait_seconds",
+		Help:      "Time playlist requests waited for the playlist, by result.",
+		Buckets:   waitBuckets,
+	}, []string{"result"})
+	seekFirstSegment = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "seek_first_segment_seconds",
+		Help:      "Time from a session start or seek until the first segment of its position is ready.",
+		Buckets:   waitBuckets,
+	})
+)
+
+// runMode returns the metrics mode of runs of h.
+func runMode(h *HLS) string {
+	if isVideoCopy(h) {
+		return runModeCopy
+	}
+	return runModeTranscode
+}
+
+// observeWait records a wait for a playlist or segment that started at
+// start.
+func observeWait(h *prometheus.HistogramVec, result string, start time.Time) {
+	h.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+var (
+	sessionsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "sessions"),
+		"Sessions held by this node.", nil, nil)
+	activeSessionsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "active_sessions"),
+		"Sessions accessed within their inactivity release period.", nil, nil)
+	runsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "runs"),
+		"Runs known to this node, running or with their output kept.", nil, nil)
+	runningRunsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "running_runs"),
+		"Runs with a running transcoder, by mode.", []string{"mode"}, nil)
+	speculativeRunsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "speculative_runs"),
+		"Running speculative runs.", nil, nil)
+	prewarmStartedDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "prewarm_started_total"),
+		"Speculative runs started.", nil, nil)
+	prewarmHitsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "prewarm_hits_total"),
+		"Speculative runs later acquired by a session.", nil, nil)
+	prewarmReclaimedDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "prewarm_reclaimed_total"),
+		"Speculative runs stopped to make room.", nil, nil)
+)
+
+// metricsCollector reads session and run gauges on scrape.
+type metricsCollector struct {
+	runManager     *RunManager
+	sessionManager *SessionManager
+}
+
+// RegisterMetrics registers the session and run gauges with the default
+// registry.
+func RegisterMetrics(runManager *RunManager, sessionManager *SessionManager) error {
+	return prometheus.Register(&metricsCollector{
+		runManager:     runManager,
+		sessionManager: sessionManager,
+	})
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- activeSessionsDesc
+	ch <- runsDesc
+	ch <- runningRunsDesc
+	ch <- speculativeRunsDesc
+	ch <- prewarmStartedDesc
+	ch <- prewarmHitsDesc
+	ch <- prewarmReclaimedDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v int, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+	counter := func(d *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v))
+	}
+	gauge(sessionsDesc, len(c.sessionManager.Sessions()))
+	gauge(activeSessionsDesc, c.sessionManager.ActiveSessions())
+	st := c.runManager.Stats()
+	gauge(runsDesc, st.Runs)
+	gauge(runningRunsDesc, st.Copy, runModeCopy)
+	gauge(runningRunsDesc, st.Running-st.Copy, runModeTranscode)
+	gauge(speculativeRunsDesc, st.Speculative)
+	counter(prewarmStartedDesc, st.PrewarmStarted)
+	counter(prewarmHitsDesc, st.PrewarmHits)
+	counter(prewarmReclaimedDesc, st.PrewarmReclaimed)
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValue sums the values of the metrics of a family that have the
+// given label pairs, counting samples of histograms.
+func metricValue(t *testing.T, g prometheus.Gatherer, name string, labels ...string) float64 {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := 0.0
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for i := 0; i+1 < len(labels); i += 2 {
+				found := false
+				for _, l := range m.GetLabel() {
+					if l.GetName() == labels[i] && l.GetValue() == labels[i+1] {
+						found = true
+					}
+				}
+				if !found {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				sum += m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				sum += m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				sum += float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return sum
+}
+
+func TestMetricsSession(t *testing.T) {
+	web := newSimulatedWeb(t)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&metricsCollector{runManager: web.sessionManager.runMgr, sessionManager: web.sessionManager})
+	g := prometheus.DefaultGatherer
+	delta := func(name string, labels ...string) func() float64 {
+		before := metricValue(t, g, name, labels...)
+		return func() float64 { return metricValue(t, g, name, labels...) - before }
+	}
+	starts := delta("content_transcoder_run_starts_total")
+	reuses := delta("content_transcoder_run_reuses_total", "state", "running")
+	seeks := delta("content_transcoder_seeks_total")
+	playlistWaits := delta("content_transcoder_playlist_wait_seconds", "result", waitReady)
+	segmentWaits := delta("content_transcoder_segment_wait_seconds", "result", waitReady)
+	firstSegments := delta("content_transcoder_seek_first_segment_seconds")
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	base := "/session/" + resp.ID + "/"
+	if w := serveTestRequest(web, http.MethodGet, base+"v0-720.m3u8"); w.Code != http.StatusOK {
+		t.Fatalf("variant: status = %d", w.Code)
+	}
+	if w := serveTestRequest(web, http.MethodGet, base+"v0-720-1.ts"); w.Code != http.StatusOK {
+		t.Fatalf("segment: status = %d", w.Code)
+	}
+	if got := firstSegments(); got != 1 {
+		t.Errorf("first segments after start = %v, want 1", got)
+	}
+
+	if w := serveTestRequest(web, http.MethodPost, base+"seek?t=60"); w.Code != http.StatusOK {
+		t.Fatalf("seek: status = %d", w.Code)
+	}
+	for range 2 {
+		if w := serveTestRequest(web, http.MethodGet, base+"v0-720-0.ts"); w.Code != http.StatusOK {
+			t.Fatalf("segment after seek: status = %d", w.Code)
+		}
+	}
+	// A second session shares the run at the start
+	if w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200")); w.Code != http.StatusOK {
+		t.Fatalf("second create: status = %d", w.Code)
+	}
+
+	for name, tt := range map[string]struct {
+		got  float64
+		want float64
+	}{
+		"run starts":            {starts(), 2},
+		"running run reuses":    {reuses(), 1},
+		"seeks":                 {seeks(), 1},
+		"playlist waits":        {playlistWaits(), 1},
+		"segment waits":         {segmentWaits(), 3},
+		"first segments":        {firstSegments(), 2},
+		"sessions":              {metricValue(t, reg, "content_transcoder_sessions"), 2},
+		"active sessions":       {metricValue(t, reg, "content_transcoder_active_sessions"), 2},
+		"runs":                  {metricValue(t, reg, "content_transcoder_runs"), 2},
+		"prewarm started total": {metricValue(t, reg, "content_transcoder_prewarm_started_total"), 0},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", name, tt.got, tt.want)
+		}
+	}
+	running := metricValue(t, reg, "content_transcoder_running_runs")
+	copies := metricValue(t, reg, "content_transcoder_running_runs", "mode", runModeCopy)
+	if running < 1 || running > 2 || copies > running {
+		t.Errorf("running runs = %v, copying = %v", running, copies)
+	}
+}
+
+// failingTranscoder fails to start every run.
+type failingTranscoder struct{}
+
+func (failingTranscoder) Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error) {
+	return nil, errors.New("no transcoder")
+}
+
+func TestMetricsRunFailures(t *testing.T) {
+	rm := NewRunManager(RunManagerConfig{Transcoder: failingTranscoder{}})
+	defer rm.CloseAll()
+	before := metricValue(t, prometheus.DefaultGatherer, "content_transcoder_run_failures_total", "class", runFailureStart)
+	if _, err := rm.Acquire(t.TempDir(), 0, "sim://host/movie.mkv", nil); err == nil {
+		t.Fatal("acquire should fail")
+	}
+	if got := metricValue(t, prometheus.DefaultGatherer, "content_transcoder_run_failures_total", "class", runFailureStart) - before; got != 1 {
+		t.Errorf("start failures = %v, want 1", got)
+	}
+}
+
+func TestMetricsSeekFirstSegmentOfCurrentRun(t *testing.T) {
+	m, _, h := newTestPrewarmManager(t, RunManagerConfig{})
+	firstSegments := func() float64 {
+		return metricValue(t, prometheus.DefaultGatherer, "content_transcoder_seek_first_segment_seconds")
+	}
+	s, err := m.Create(SessionConfig{SourceURL: "sim://host/movie.mkv", HashDir: t.TempDir(), HLS: h, Duration: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	old := s.currentRun()
+	if err := s.Seek(60); err != nil {
+		t.Fatal(err)
+	}
+	before := firstSegments()
+	// A segment of the run before the seek
+	s.segmentReady(time.Now(), old)
+	if got := firstSegments() - before; got != 0 {
+		t.Errorf("segment of the previous run observed %v times", got)
+	}
+	s.segmentReady(time.Now(), s.currentRun())
+	s.segmentReady(time.Now(), s.currentRun())
+	if got := firstSegments() - before; got != 1 {
+		t.Errorf("segments of the current run observed %v times, want once", got)
+	}
+}
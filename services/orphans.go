@@ -0,0 +1,113 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// FFmpeg runs in its own process group, so it outlives a crashed server.
+// Every FFmpeg started on this node records itself in {runDir}/ffmpeg.pid;
+// the file is removed once the process has exited. On startup, processes
+// still recorded under the output root are terminated before serving.
+
+const ffmpegPidFile = "ffmpeg.pid"
+
+type ffmpegPid struct {
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+	Host      string `json:"host"`
+}
+
+// writeFFmpegPid records a started FFmpeg process group in its run dir.
+func writeFFmpegPid(dir string, pid int) error {
+	_, startTime, err := processStat(pid)
+	if err != nil {
+		return errors.Wrap(err, "failed to read process start time")
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(&ffmpegPid{Pid: pid, StartTime: startTime, Host: host})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ffmpegPidFile), data, 0644)
+}
+
+func removeFFmpegPid(dir string) {
+	_ = os.Remove(filepath.Join(dir, ffmpegPidFile))
+}
+
+// ReapOrphans terminates FFmpeg process groups left running in run dirs
+// under the output root by a previous process on this host. A process is
+// only terminated if its pid, start time and command line still match the
+// run, so reused pids and runs of other nodes sharing the storage are safe.
+func ReapOrphans(output string) error {
+	dirs, err := filepath.Glob(output)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	reaped := 0
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*", "runs", "seek-*", ffmpegPidFile))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			runDir := filepath.Dir(f)
+			logger := log.WithField("dir", runDir)
+			data, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			var p ffmpegPid
+			if err := json.Unmarshal(data, &p); err != nil || p.Pid <= 0 {
+				logger.Warn("orphanReaper: removing invalid pid file")
+				_ = os.Remove(f)
+				continue
+			}
+			if p.Host != host {
+				continue
+			}
+			if processAlive(p.Pid, p.StartTime) && processCmdlineContains(p.Pid, runDir) {
+				logger.WithField("pid", p.Pid).Warn("orphanReaper: terminating stale ffmpeg")
+				terminateProcessGroup(p.Pid, p.StartTime)
+				reaped++
+			}
+			_ = os.Remove(f)
+		}
+	}
+	if reaped > 0 {
+		log.WithField("processes", reaped).Info("orphanReaper: terminated stale ffmpeg processes")
+	}
+	return nil
+}
+
+func processCmdlineContains(pid int, s string) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), s)
+}
+
+// terminateProcessGroup sends SIGTERM to the process group and escalates to
+// SIGKILL after runGracefulStopTimeout.
+func terminateProcessGroup(pid int, startTime uint64) {
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+	deadline := time.Now().Add(runGracefulStopTimeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid, startTime) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	_ = syscall.Kill(-pid, syscall.SIGKILL)
+}
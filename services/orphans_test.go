@@ -0,0 +1,76 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startOrphan starts a process group whose command line mentions arg, like
+// FFmpeg mentions its run dir.
+func startOrphan(t *testing.T, arg string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", "sleep 30", arg)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skip("sh not available")
+	}
+	go cmd.Wait()
+	t.Cleanup(func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	if _, _, err := processStat(cmd.Process.Pid); err != nil {
+		t.Skip("no /proc")
+	}
+	return cmd
+}
+
+func waitProcessGone(pid int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid, 0) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReapOrphans(t *testing.T) {
+	output := t.TempDir()
+	runDir := filepath.Join(output, "abc", "runs", "seek-0.000")
+	otherDir := filepath.Join(output, "def", "runs", "seek-30.000")
+	for _, dir := range []string{runDir, otherDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphan := startOrphan(t, runDir)
+	if err := writeFFmpegPid(runDir, orphan.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	// Recorded for another run dir, e.g. a reused pid
+	unrelated := startOrphan(t, "unrelated")
+	if err := writeFFmpegPid(otherDir, unrelated.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReapOrphans(output); err != nil {
+		t.Fatal(err)
+	}
+	if !waitProcessGone(orphan.Process.Pid) {
+		t.Error("orphaned process group should be terminated")
+	}
+	if !processAlive(unrelated.Process.Pid, 0) {
+		t.Error("process not running for the run dir must be kept")
+	}
+	for _, dir := range []string{runDir, otherDir} {
+		if _, err := os.Stat(filepath.Join(dir, ffmpegPidFile)); !os.IsNotExist(err) {
+			t.Errorf("pid file in %s should be removed", dir)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/urfave/cli"
+	cs "github.com/webtor-io/common-services"
+)
+
+// Resume positions: players report the position of a session with
+// POST /session/{id}/position, it is stored per content and viewer, and
+// POST /session?resume=true starts a new session of the same viewer there.
+
+const (
+	PositionStoreFlag = "position-store"
+)
+
+const (
+	positionStoreMemory    = "memory"
+	positionStoreRedis     = "redis"
+	positionStoreKeyPrefix = "content-transcoder:position:"
+	positionStoreTimeout   = 2 * time.Second
+	// positionExpiry is how long a position is kept without heartbeats.
+	positionExpiry = 30 * 24 * time.Hour
+	// positionFinishedMargin is the distance to the end from which content
+	// counts as watched, resuming it starts over.
+	positionFinishedMargin = 60.0 // seconds
+
+	viewerIDHeader    = "X-Viewer-Id"
+	viewerIDParam     = "viewer_id"
+	viewerIDMaxLength = 128
+)
+
+func RegisterPositionStoreFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   PositionStoreFlag,
+		Usage:  "store resume positions of viewers (memory, redis), redis uses the redis client flags, empty disables positions",
+		Value:  "",
+		EnvVar: "POSITION_STORE",
+	})
+}
+
+// PositionStore keeps the last position of a viewer per content. Positions
+// expire after positionExpiry unless saved again.
+type PositionStore interface {
+	Save(ctx context.Context, key string, position float64) error
+	// Load returns false if no position is stored.
+	Load(ctx context.Context, key string) (float64, bool, error)
+	Close()
+}
+
+// NewPositionStore returns the configured position store, or nil if
+// positions are disabled.
+func NewPositionStore(c *cli.Context) (PositionStore, error) {
+	switch c.String(PositionStoreFlag) {
+	case "":
+		return nil, nil
+	case positionStoreMemory:
+		return newMemoryPositionStore(), nil
+	case positionStoreRedis:
+		return newRedisPositionStore(cs.NewRedisClient(c)), nil
+	default:
+		return nil, errors.Errorf("unknown position store %q", c.String(PositionStoreFlag))
+	}
+}
+
+// positionKey returns the store key of a viewer's position in content.
+func positionKey(hash string, viewerID string) string {
+	return hash + ":" + viewerID
+}
+
+// getViewerID returns the viewer ID of a request, "" if it has none.
+func getViewerID(r *http.Request) (string, error) {
+	id := r.Header.Get(viewerIDHeader)
+	if id == "" {
+		id = r.URL.Query().Get(viewerIDParam)
+	}
+	if len(id) > viewerIDMaxLength {
+		return "", errors.Errorf("viewer id is longer than %d characters", viewerIDMaxLength)
+	}
+	return id, nil
+}
+
+// resumePosition returns the seek time a session resumes at, 0 if content
+// was watched to its end.
+func resumePosition(position float64, duration float64) float64 {
+	if position < 0 || (duration > 0 && position >= duration-positionFinishedMargin) {
+		return 0
+	}
+	return position
+}
+
+type redisPositionStore struct {
+	cl *cs.RedisClient
+}
+
+func newRedisPositionStore(cl *cs.RedisClient) *redisPositionStore {
+	return &redisPositionStore{cl: cl}
+}
+
+func (s *redisPositionStore) Save(ctx context.Context, key string, position float64) error {
+	return s.cl.Get().Set(ctx, positionStoreKeyPrefix+key, strconv.FormatFloat(position, 'f', 3, 64), positionExpiry).Err()
+}
+
+func (s *redisPositionStore) Load(ctx context.Context, key string) (float64, bool, error) {
+	position, err := s.cl.Get().Get(ctx, positionStoreKeyPrefix+key).Float64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return position, true, nil
+}
+
+func (s *redisPositionStore) Close() {
+	s.cl.Close()
+}
+
+// memoryPositionStore keeps positions in memory of this node, they are lost
+// on restart.
+type memoryPositionStore struct {
+	mu        sync.Mutex
+	positions map[string]storedPosition
+	pruned    time.Time
+}
+
+type storedPosition struct {
+	position float64
+	saved    time.Time
+}
+
+func newMemoryPositionStore() *memoryPositionStore {
+	return &memoryPositionStore{positions: make(map[string]storedPosition)}
+}
+
+func (s *memoryPositionStore) Save(_ context.Context, key string, position float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.pruned) > time.Hour {
+		for k, p := range s.positions {
+			if now.Sub(p.saved) > positionExpiry {
+				delete(s.positions, k)
+			}
+		}
+		s.pruned = now
+	}
+	s.positions[key] = storedPosition{position: position, saved: now}
+	return nil
+}
+
+func (s *memoryPositionStore) Load(_ context.Context, key string) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.positions[key]
+	if !ok || time.Since(p.saved) > positionExpiry {
+		return 0, false, nil
+	}
+	return p.position, true, nil
+}
+
+func (s *memoryPositionStore) Close() {}
+
+// resumeSeekTime returns the stored position of the session's viewer, 0 if
+// there is none.
+func (s *Web) resumeSeekTime(sess *Session) float64 {
+	if s.positions == nil || sess.positionKey == "" {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), positionStoreTimeout)
+	defer cancel()
+	position, ok, err := s.positions.Load(ctx, sess.positionKey)
+	if err != nil {
+		sess.logger.WithError(err).Warn("session: failed to load resume position")
+		return 0
+	}
+	if !ok {
+		return 0
+	}
+	return resumePosition(position, sess.duration)
+}
+
+// sessionPositionHandler handles POST /session/{id}/position?t=...
+// @Summary Report playback position
+// @Description Stores the viewer's playback position in movie time, a session created with resume=true by the same viewer starts there. Players send it periodically, it also keeps the session alive.
+// @Tags session
+// @Produce json
+// @Param sessionId path string true "Session ID"
+// @Param t query number true "Playback position in seconds"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
+// @Success 200 {object} map[string]bool
+// @Failure 400 {string} string "Missing or invalid t parameter, or session without viewer ID"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
+// @Failure 404 {string} string "Session not found or positions disabled"
+// @Failure 410 {string} string "Session lifetime exceeded"
+// @Failure 500 {string} string "Failed to save position"
+// @Router /session/{sessionId}/position [post]
+func (s *Web) sessionPositionHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
+	if s.positions == nil {
+		http.Error(w, "positions are disabled", http.StatusNotFound)
+		return
+	}
+	if sess.positionKey == "" {
+		http.Error(w, "session has no viewer id", http.StatusBadRequest)
+		return
+	}
+	t, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || t < 0 || (sess.duration > 0 && t > sess.duration) {
+		http.Error(w, "missing or invalid t parameter", http.StatusBadRequest)
+		return
+	}
+	sess.Touch()
+
+	ctx, cancel := context.WithTimeout(r.Context(), positionStoreTimeout)
+	defer cancel()
+	if err := s.positions.Save(ctx, sess.positionKey, t); err != nil {
+		sess.logger.WithError(err).Warn("session: failed to save position")
+		http.Error(w, "failed to save position", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestWebResumePosition(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.positions = newMemoryPositionStore()
+
+	src := url.QueryEscape("sim://host/movie.mkv?duration=600")
+	create := func(query string) sessionCreateResponse {
+		t.Helper()
+		w := serveTestRequest(web, http.MethodPost, "/session?source_url="+src+query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+		}
+		var resp sessionCreateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := create("&viewer_id=alice")
+	if first.Offset != 0 {
+		t.Fatalf("new viewer: offset = %v", first.Offset)
+	}
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+first.ID+"/position?t=135.5"); w.Code != http.StatusOK {
+		t.Fatalf("position: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+first.ID+"/position?t=601"); w.Code != http.StatusBadRequest {
+		t.Errorf("position beyond duration: status = %d", w.Code)
+	}
+
+	if resp := create("&viewer_id=alice&resume=true"); resp.Offset != 120 {
+		t.Errorf("resumed: offset = %v, want 120", resp.Offset)
+	}
+	if resp := create("&viewer_id=bob&resume=true"); resp.Offset != 0 {
+		t.Errorf("other viewer: offset = %v, want 0", resp.Offset)
+	}
+	if resp := create("&viewer_id=alice"); resp.Offset != 0 {
+		t.Errorf("without resume: offset = %v, want 0", resp.Offset)
+	}
+
+	// Content watched to its end starts over
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+first.ID+"/position?t=590"); w.Code != http.StatusOK {
+		t.Fatalf("position: status = %d", w.Code)
+	}
+	if resp := create("&viewer_id=alice&resume=true"); resp.Offset != 0 {
+		t.Errorf("watched: offset = %v, want 0", resp.Offset)
+	}
+
+	anonymous := create("")
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+anonymous.ID+"/position?t=10"); w.Code != http.StatusBadRequest {
+		t.Errorf("position without viewer: status = %d", w.Code)
+	}
+
+	web.positions = nil
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+first.ID+"/position?t=10"); w.Code != http.StatusNotFound {
+		t.Errorf("positions disabled: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Speculative prewarming starts runs at positions a session is likely to
+// need next, so the seek does not pay FFmpeg startup latency:
+//
+//   - the session keeps seeking forward by the same step → seekTime + step
+//   - the playhead nears the start of a later run for the same content that
+//     is not running → that run, so it is producing when the stitch happens
+//
+// Speculative runs have no references, run at low CPU priority, are limited
+// in number and only started while the node is below its load limit. When a
+// session's run needs room, speculative runs are stopped first.
+
+const (
+	prewarmSeekHistory = 3               // seeks remembered per session
+	prewarmMaxStep     = 4               // larger forward steps, in seek quanta, are not followed
+	prewarmLead        = 2               // playhead distance to the next run start, in seek quanta
+	prewarmExpiry      = 2 * time.Minute // unused speculative runs are cleaned up after
+	prewarmNiceness    = 10              // CPU niceness of speculative FFmpeg runs
+)
+
+// RunStats is a snapshot of RunManager counters. Speculative runs are
+// counted separately from runs used by sessions.
+type RunStats struct {
+	Runs             int // runs known to the manager
+	Running          int // runs with a running transcoder, speculative included
+	Copy             int // running runs copying the video stream
+	Speculative      int // running speculative runs
+	PrewarmStarted   int // speculative runs started
+	PrewarmHits      int // speculative runs later acquired by a session
+	PrewarmReclaimed int // speculative runs stopped to make room
+}
+
+// recordSeekLocked remembers the quantized seek time for pattern detection.
+func (s *Session) recordSeekLocked(seekTime float64) {
+	s.seekHistory = append(s.seekHistory, seekTime)
+	if len(s.seekHistory) > prewarmSeekHistory {
+		s.seekHistory = s.seekHistory[len(s.seekHistory)-prewarmSeekHistory:]
+	}
+}
+
+// ReportSegment updates the playhead from a requested segment number.
+func (s *Session) ReportSegment(segNum int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.playhead = s.seekTime + float64(segNum*s.timings.SegmentDuration)
+}
+
+// prewarmTarget returns the seek time the session is likely to need next.
+func (s *Session) prewarmTarget(m *RunManager) (float64, bool) {
+	s.mu.Lock()
+	seekTime := s.seekTime
+	playhead := max(s.playhead, seekTime)
+	history := append([]float64(nil), s.seekHistory...)
+	s.mu.Unlock()
+
+	// Repeated forward seeks by the same step
+	if n := len(history); n >= 3 {
+		step := history[n-1] - history[n-2]
+		if step > 0 && step <= float64(prewarmMaxStep*s.timings.SeekQuantum) && step == history[n-2]-history[n-3] {
+			target := seekTime + step
+			if s.duration == 0 || target < s.duration {
+				return target, true
+			}
+		}
+	}
+
+	// Playhead nearing the start of the next run for the same content
+	if next, ok := m.nextIdleRun(s.hashDir, seekTime); ok && next-playhead <= float64(prewarmLead*s.timings.SeekQuantum) {
+		return next, true
+	}
+	return 0, false
+}
+
+// Prewarm starts a speculative run for the session's likely next position.
+func (m *SessionManager) Prewarm(s *Session) {
+	if !m.runMgr.cfg.Prewarm || s.IsClosed() {
+		return
+	}
+	target, ok := s.prewarmTarget(m.runMgr)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	if s.prewarmed == target {
+		s.mu.Unlock()
+		return
+	}
+	s.prewarmed = target
+	s.mu.Unlock()
+	m.runMgr.Prewarm(s.hashDir, target, s.sourceURL, s.h)
+}
+
+// nextIdleRun returns the seek time of the first run for the content after
+// seekTime if it is not running and can still be started.
+func (m *RunManager) nextIdleRun(hashDir string, seekTime float64) (float64, bool) {
+	m.mu.Lock()
+	var next *TranscodeRun
+	for _, mr := range m.runs {
+		r := mr.run
+		if r.hashDir == hashDir && r.seekTime > seekTime && (next == nil || r.seekTime < next.seekTime) {
+			next = r
+		}
+	}
+	m.mu.Unlock()
+	if next == nil || next.IsRunning() {
+		return 0, false
+	}
+	next.mu.Lock()
+	done := next.complete || next.stitch != nil
+	next.mu.Unlock()
+	return next.seekTime, !done
+}
+
+// prewarmMaxLoad returns how many runs may be running before speculative
+// runs are refused and reclaimed.
+func (m *RunManager) prewarmMaxLoad() int {
+	if m.cfg.PrewarmMaxLoad > 0 {
+		return m.cfg.PrewarmMaxLoad
+	}
+	return runtime.NumCPU()
+}
+
+// runningLocked returns the number of running runs and the running
+// speculative ones, oldest first.
+func (m *RunManager) runningLocked() (int, []*managedRun) {
+	running := 0
+	var speculative []*managedRun
+	for _, mr := range m.runs {
+		if !mr.run.IsRunning() {
+			continue
+		}
+		running++
+		if mr.speculative {
+			speculative = append(speculative, mr)
+		}
+	}
+	sort.Slice(speculative, func(i, j int) bool {
+		return speculative[i].idleSince.Before(speculative[j].idleSince)
+	})
+	return running, speculative
+}
+
+// Prewarm speculatively starts a low-priority run at seekTime. Nothing is
+// done if the run is already running or finished, the speculative run limit
+// is reached or the node is at its load limit.
+func (m *RunManager) Prewarm(hashDir string, seekTime float64, sourceURL string, h *HLS) {
+	if !m.cfg.Prewarm {
+		return
+	}
+	key := runKey(hashDir, seekTime)
+	logger := log.WithField("runKey", key)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	running, speculative := m.runningLocked()
+	if len(speculative) >= m.cfg.PrewarmMaxRuns || running >= m.prewarmMaxLoad() {
+		m.mu.Unlock()
+		logger.Debug("runManager: not prewarming, at capacity")
+		return
+	}
+	mr, ok := m.runs[key]
+	if ok {
+		if mr.run.RefCount() > 0 || mr.run.IsRunning() || mr.run.NeedsResume() {
+			m.mu.Unlock()
+			return
+		}
+	} else {
+		mr = &managedRun{run: m.newRun(key, hashDir, seekTime, sourceURL, h)}
+		m.runs[key] = mr
+	}
+	mr.speculative = true
+	mr.idleSince = time.Now()
+	m.mu.Unlock()
+
+	mr.run.setLowPriority(true)
+	if err := mr.run.Start(); err != nil {
+		logger.WithError(err).Warn("runManager: failed to prewarm run")
+		return
+	}
+	if !mr.run.IsRunning() {
+		// Already complete, nothing to prewarm
+		m.mu.Lock()
+		mr.speculative = false
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Lock()
+	m.stats.PrewarmStarted++
+	m.mu.Unlock()
+	logger.WithField("seekTime", fmt.Sprintf("%.3f", seekTime)).Info("runManager: prewarming run")
+}
+
+// promoteLocked turns a speculative run acquired by a session into a
+// regular one.
+func (m *RunManager) promoteLocked(mr *managedRun) {
+	if !mr.speculative {
+		return
+	}
+	mr.speculative = false
+	m.stats.PrewarmHits++
+	mr.run.setLowPriority(false)
+	log.WithField("runKey", mr.run.key).Info("runManager: prewarmed run acquired")
+}
+
+// reclaimSpeculative stops speculative runs, oldest first, until a new run
+// fits within the load limit.
+func (m *RunManager) reclaimSpeculative() {
+	m.mu.Lock()
+	running, speculative := m.runningLocked()
+	var toStop []*TranscodeRun
+	for _, mr := range speculative {
+		if running < m.prewarmMaxLoad() {
+			break
+		}
+		mr.speculative = false
+		toStop = append(toStop, mr.run)
+		running--
+		m.stats.PrewarmReclaimed++
+	}
+	m.mu.Unlock()
+
+	for _, run := range toStop {
+		log.WithField("runKey", run.key).Info("runManager: reclaiming speculative run")
+		run.Stop()
+	}
+}
+
+// Stats returns a snapshot of the run counters.
+func (m *RunManager) Stats() RunStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.stats
+	running, speculative := m.runningLocked()
+	st.Runs = len(m.runs)
+	st.Running = running
+	st.Speculative = len(speculative)
+	for _, mr := range m.runs {
+		if mr.run.IsRunning() && runMode(mr.run.h) == runModeCopy {
+			st.Copy++
+		}
+	}
+	return st
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Flags registered by common-services RegisterProbeFlags.
+const (
+	probeHostFlag = "probe-host"
+	probePortFlag = "probe-port"
+	probeUseFlag  = "use-probe"
+)
+
+// Probe serves Kubernetes liveness and readiness checks. Unlike the common
+// probe, readiness fails while the node drains, and POST /drain enters
+// drain mode.
+type Probe struct {
+	host    string
+	port    int
+	ln      net.Listener
+	drainer *Drainer
+}
+
+func NewProbe(c *cli.Context, drainer *Drainer) *Probe {
+	if !c.BoolT(probeUseFlag) {
+		return nil
+	}
+	return &Probe{
+		host:    c.String(probeHostFlag),
+		port:    c.Int(probePortFlag),
+		drainer: drainer,
+	}
+}
+
+func (s *Probe) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readiness", func(w http.ResponseWriter, r *http.Request) {
+		if s.drainer.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.drainer == nil {
+			http.Error(w, "drain mode is disabled", http.StatusNotImplemented)
+			return
+		}
+		s.drainer.Drain()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
+
+func (s *Probe) Serve() error {
+	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	ln, err := listen(listenerProbe, addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to probe listen to tcp connection")
+	}
+	s.ln = ln
+	log.Infof("serving probe at %v", addr)
+	return http.Serve(ln, s.handler())
+}
+
+func (s *Probe) handoverListener() (string, net.Listener) {
+	if s == nil {
+		return listenerProbe, nil
+	}
+	return listenerProbe, s.ln
+}
+
+func (s *Probe) Close() {
+	if s.ln != nil {
+		_ = s.ln.Close()
+	}
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Flags registered by common-services RegisterPromFlags.
+const (
+	promHostFlag = "prom-host"
+	promPortFlag = "prom-port"
+	promUseFlag  = "use-prom"
+)
+
+// Prom serves Prometheus metrics. Unlike the common one, its socket is
+// passed on hand-over, so metrics stay available across deploys.
+type Prom struct {
+	host string
+	port int
+	ln   net.Listener
+}
+
+func NewProm(c *cli.Context) *Prom {
+	if !c.BoolT(promUseFlag) {
+		return nil
+	}
+	return &Prom{
+		host: c.String(promHostFlag),
+		port: c.Int(promPortFlag),
+	}
+}
+
+func (s *Prom) Serve() error {
+	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	ln, err := listen(listenerProm, addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen to tcp connection")
+	}
+	s.ln = ln
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("serving Prometheus metrics at %v", addr)
+	return http.Serve(ln, mux)
+}
+
+func (s *Prom) handoverListener() (string, net.Listener) {
+	if s == nil {
+		return listenerProm, nil
+	}
+	return listenerProm, s.ln
+}
+
+func (s *Prom) Close() {
+	if s.ln != nil {
+		_ = s.ln.Close()
+	}
+}
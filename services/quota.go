@@ -0,0 +1,260 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	QuotaSessionsFlag    = "quota-sessions"
+	QuotaRunsFlag        = "quota-runs"
+	QuotaPolicyFlag      = "quota-policy"
+	quotaTokenSecretFlag = "quota-token-secret"
+)
+
+const (
+	quotaPolicyReject      = "reject"
+	quotaPolicyEvictOldest = "evict-oldest"
+	quotaTokenParam        = "token"
+	quotaTokenHeader       = "X-Token"
+)
+
+func RegisterQuotaFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.IntFlag{
+			Name:   QuotaSessionsFlag,
+			Usage:  "maximum concurrent sessions per viewer (JWT subject, verified token or client IP), 0 is unlimited",
+			Value:  0,
+			EnvVar: "QUOTA_SESSIONS",
+		},
+		cli.IntFlag{
+			Name:   QuotaRunsFlag,
+			Usage:  "maximum concurrent distinct runs held by the sessions of a viewer, 0 is unlimited",
+			Value:  0,
+			EnvVar: "QUOTA_RUNS",
+		},
+		cli.StringFlag{
+			Name:   QuotaPolicyFlag,
+			Usage:  "what a viewer creating a session beyond the session quota gets (reject, evict-oldest)",
+			Value:  quotaPolicyReject,
+			EnvVar: "QUOTA_POLICY",
+		},
+		cli.StringFlag{
+			Name:   quotaTokenSecretFlag,
+			Usage:  "secret verifying viewer tokens of the form <viewer>.<hex HMAC-SHA256 of viewer>, without it tokens are ignored and viewers are counted by client IP",
+			EnvVar: "QUOTA_TOKEN_SECRET",
+		},
+	)
+}
+
+// QuotaError is returned if a viewer exceeds a quota.
+type QuotaError struct {
+	Resource string // sessions or runs
+	Max      int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: at most %d concurrent %s allowed", e.Max, e.Resource)
+}
+
+// identity returns the viewer a request is counted for: the viewer of its
+// token if the token secret verifies it, or the client IP. Clients could
+// pick a fresh token or viewer ID for every session, so unverified ones do
+// not identify viewers for quotas.
+func (q *Quota) identity(r *http.Request) string {
+	t := r.URL.Query().Get(quotaTokenParam)
+	if t == "" {
+		t = r.Header.Get(quotaTokenHeader)
+	}
+	if viewer, ok := q.verifyToken(t); ok {
+		return "token:" + viewer
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// verifyToken returns the viewer of a token signed with the token secret.
+func (q *Quota) verifyToken(token string) (string, bool) {
+	if q == nil || len(q.tokenSecret) == 0 {
+		return "", false
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 {
+		return "", false
+	}
+	sig, err := hex.DecodeString(token[i+1:])
+	if err != nil {
+		return "", false
+	}
+	viewer := token[:i]
+	mac := hmac.New(sha256.New, q.tokenSecret)
+	mac.Write([]byte(viewer))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return viewer, true
+}
+
+// Quota limits concurrent sessions and the distinct runs they hold per
+// viewer on this node. Sessions report the runs they acquire, so checks
+// never lock sessions.
+type Quota struct {
+	maxSessions int
+	maxRuns     int
+	evictOldest bool
+	tokenSecret []byte // verifies viewer tokens, nil ignores them
+
+	mu      sync.Mutex
+	viewers map[string]map[string]*quotaSession // identity → session ID
+}
+
+type quotaSession struct {
+	created time.Time
+	runKey  string // "" without a run
+}
+
+// NewQuota returns nil if no quota is configured.
+func NewQuota(c *cli.Context) (*Quota, error) {
+	policy := c.String(QuotaPolicyFlag)
+	if policy != quotaPolicyReject && policy != quotaPolicyEvictOldest {
+		return nil, errors.Errorf("unknown quota policy %q", policy)
+	}
+	if c.Int(QuotaSessionsFlag) <= 0 && c.Int(QuotaRunsFlag) <= 0 {
+		return nil, nil
+	}
+	q := newQuota(c.Int(QuotaSessionsFlag), c.Int(QuotaRunsFlag), policy == quotaPolicyEvictOldest)
+	if secret := c.String(quotaTokenSecretFlag); secret != "" {
+		q.tokenSecret = []byte(secret)
+	}
+	return q, nil
+}
+
+func newQuota(maxSessions int, maxRuns int, evictOldest bool) *Quota {
+	return &Quota{
+		maxSessions: maxSessions,
+		maxRuns:     maxRuns,
+		evictOldest: evictOldest,
+		viewers:     make(map[string]map[string]*quotaSession),
+	}
+}
+
+// addSession counts a new session of a viewer. Beyond the session quota it
+// fails, or with evict-oldest returns the IDs of the viewer's oldest
+// sessions the caller has to close.
+func (q *Quota) addSession(identity string, id string) (evict []string, err error) {
+	if q == nil || identity == "" {
+		return nil, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sessions := q.viewers[identity]
+	if sessions == nil {
+		sessions = make(map[string]*quotaSession)
+		q.viewers[identity] = sessions
+	}
+	if q.maxSessions > 0 && len(sessions) >= q.maxSessions {
+		if !q.evictOldest {
+			return nil, &QuotaError{Resource: "sessions", Max: q.maxSessions}
+		}
+		ids := make([]string, 0, len(sessions))
+		for sid := range sessions {
+			ids = append(ids, sid)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return sessions[ids[i]].created.Before(sessions[ids[j]].created)
+		})
+		evict = ids[:len(sessions)-q.maxSessions+1]
+		for _, sid := range evict {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = &quotaSession{created: time.Now()}
+	return evict, nil
+}
+
+// removeSession stops counting a session.
+func (q *Quota) removeSession(identity string, id string) {
+	if q == nil || identity == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if sessions, ok := q.viewers[identity]; ok {
+		delete(sessions, id)
+		if len(sessions) == 0 {
+			delete(q.viewers, identity)
+		}
+	}
+}
+
+// admitRun fails if the session acquiring the run with the given key would
+// make its viewer hold more distinct runs than allowed. The run the
+// session holds is not counted, it is replaced.
+func (q *Quota) admitRun(identity string, id string, key string) error {
+	if q == nil || identity == "" || q.maxRuns <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	runs := map[string]bool{key: true}
+	for sid, s := range q.viewers[identity] {
+		if sid != id && s.runKey != "" {
+			runs[s.runKey] = true
+		}
+	}
+	if len(runs) > q.maxRuns {
+		return &QuotaError{Resource: "runs", Max: q.maxRuns}
+	}
+	return nil
+}
+
+// setRun records the run a session holds, "" after releasing it.
+func (q *Quota) setRun(identity string, id string, key string) {
+	if q == nil || identity == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s, ok := q.viewers[identity][id]; ok {
+		s.runKey = key
+	}
+}
+
+// adopt counts a session taken over from another process without checks.
+func (q *Quota) adopt(identity string, id string, key string) {
+	if q == nil || identity == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.viewers[identity] == nil {
+		q.viewers[identity] = make(map[string]*quotaSession)
+	}
+	q.viewers[identity][id] = &quotaSession{created: time.Now(), runKey: key}
+}
+
+// writeQuotaError answers 429 if err is a QuotaError and returns true.
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	log.WithError(err).Info("session: quota exceeded")
+	http.Error(w, qe.Error(), http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testQuotaToken(secret string, viewer string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(viewer))
+	return viewer + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestQuotaIdentity(t *testing.T) {
+	q := newQuota(1, 0, false)
+	req := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/session", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set(quotaTokenHeader, token)
+		return r
+	}
+	signed := testQuotaToken("quota-secret", "viewer.1")
+	if got := q.identity(req(signed)); got != "ip:192.0.2.1" {
+		t.Errorf("token without secret: identity = %q, want the client IP", got)
+	}
+	q.tokenSecret = []byte("quota-secret")
+	for token, want := range map[string]string{
+		signed:           "token:viewer.1",
+		"viewer.1":       "ip:192.0.2.1",
+		"viewer.1.zz":    "ip:192.0.2.1",
+		signed + "00":    "ip:192.0.2.1",
+		"." + signed[9:]: "ip:192.0.2.1",
+		"":               "ip:192.0.2.1",
+	} {
+		if got := q.identity(req(token)); got != want {
+			t.Errorf("token %q: identity = %q, want %q", token, got, want)
+		}
+	}
+	var nilQuota *Quota
+	if got := nilQuota.identity(req(signed)); got != "ip:192.0.2.1" {
+		t.Errorf("without quota: identity = %q", got)
+	}
+}
+
+func TestQuotaRuns(t *testing.T) {
+	q := newQuota(0, 2, false)
+	for _, id := range []string{"s1", "s2", "s3"} {
+		if _, err := q.addSession("ip:a", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.setRun("ip:a", "s1", "run-0")
+	q.setRun("ip:a", "s2", "run-60")
+
+	if err := q.admitRun("ip:a", "s3", "run-0"); err != nil {
+		t.Errorf("shared run should be admitted: %v", err)
+	}
+	if err := q.admitRun("ip:a", "s3", "run-120"); err == nil {
+		t.Error("third distinct run should be rejected")
+	}
+	// The run a session holds is replaced by a seek
+	if err := q.admitRun("ip:a", "s2", "run-120"); err != nil {
+		t.Errorf("seek replacing the session's run should be admitted: %v", err)
+	}
+	if err := q.admitRun("ip:b", "s4", "run-120"); err != nil {
+		t.Errorf("other viewer should be admitted: %v", err)
+	}
+	q.removeSession("ip:a", "s2")
+	if err := q.admitRun("ip:a", "s3", "run-120"); err != nil {
+		t.Errorf("run of a closed session should not count: %v", err)
+	}
+}
+
+func TestWebSessionQuota(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.sessionManager.quota = newQuota(2, 1, false)
+	web.sessionManager.quota.tokenSecret = []byte("quota-secret")
+
+	create := func(query string) (*http.Response, sessionCreateResponse) {
+		t.Helper()
+		w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200")+query)
+		var resp sessionCreateResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Result(), resp
+	}
+
+	_, first := create("")
+	res, _ := create("")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("second session sharing the run: status = %d", res.StatusCode)
+	}
+	if res, _ := create(""); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("third session: status = %d, want 429", res.StatusCode)
+	}
+	// Tokens the secret does not verify count as the client IP
+	for _, token := range []string{"other", "other.abcd", testQuotaToken("wrong", "other")} {
+		if res, _ := create("&token=" + url.QueryEscape(token)); res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("session with unverified token %q: status = %d, want 429", token, res.StatusCode)
+		}
+	}
+	if res, _ := create("&token=" + url.QueryEscape(testQuotaToken("quota-secret", "other"))); res.StatusCode != http.StatusOK {
+		t.Errorf("session of another viewer: status = %d", res.StatusCode)
+	}
+
+	// A seek to another position would hold a second run
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+first.ID+"/seek?t=65"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("seek beyond run quota: status = %d, want 429", w.Code)
+	}
+	if web.sessionManager.Get(first.ID).SeekTime() != 0 {
+		t.Error("rejected seek should keep the session's position")
+	}
+
+	// Closing a session frees its quota
+	if w := serveTestRequest(web, http.MethodDelete, "/session/"+first.ID); w.Code != http.StatusOK {
+		t.Fatalf("close: status = %d", w.Code)
+	}
+	if res, _ := create(""); res.StatusCode != http.StatusOK {
+		t.Errorf("session after close: status = %d", res.StatusCode)
+	}
+}
+
+func TestWebSessionQuotaEvictOldest(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.sessionManager.quota = newQuota(1, 0, true)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("create: status = %d", w.Code)
+		}
+		var resp sessionCreateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.ID)
+	}
+	if web.sessionManager.Get(ids[0]) != nil {
+		t.Error("oldest session should be evicted")
+	}
+	if web.sessionManager.Get(ids[1]) == nil {
+		t.Error("new session should be created")
+	}
+}
+
+func TestSessionQuotaEvictsOnlyAdmitted(t *testing.T) {
+	rm := NewRunManager(RunManagerConfig{})
+	m := NewSessionManager(rm, nil, newQuota(1, 0, true))
+	t.Cleanup(func() {
+		m.CloseAll()
+		rm.CloseAll()
+	})
+	if _, err := m.Create(SessionConfig{ID: "a", HashDir: t.TempDir(), QuotaID: "ip:a", Subject: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(SessionConfig{ID: "b", HashDir: t.TempDir(), QuotaID: "ip:b", Subject: "bob", MaxSessions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected by the subject limit, so the viewer keeps its session
+	if _, err := m.Create(SessionConfig{ID: "c", HashDir: t.TempDir(), QuotaID: "ip:a", Subject: "bob", MaxSessions: 1}); err == nil {
+		t.Fatal("subject over its session limit should be rejected")
+	}
+	if m.Get("a") == nil {
+		t.Error("session of a rejected viewer should not be evicted")
+	}
+	if _, err := m.Create(SessionConfig{ID: "d", HashDir: t.TempDir(), QuotaID: "ip:a", Subject: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get("a") != nil || m.Get("d") == nil {
+		t.Error("admitted session should evict the viewer's oldest session")
+	}
+}
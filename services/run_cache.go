@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// NeedsResume returns true if the run is stopped but has already produced
+// segments that should be continued rather than transcoded again.
+func (r *TranscodeRun) NeedsResume() bool {
+	if r.IsRunning() {
+		return false
+	}
+	r.mu.Lock()
+	skip := r.complete || r.stitch != nil
+	r.mu.Unlock()
+	if skip {
+		return false
+	}
+	return r.ProducedDuration() > 0
+}
+
+// resume continues a partially transcoded run from its last finished segment
+// by stitching it to a new run starting where its output ends.
+func (m *RunManager) resume(run *TranscodeRun, sourceURL string, h *HLS) error {
+	seekTime := run.seekTime + run.ProducedDuration()
+	next, err := m.Acquire(run.hashDir, seekTime, sourceURL, h)
+	if err != nil {
+		return errors.Wrap(err, "failed to resume run")
+	}
+	if !run.StitchTo(next) {
+		m.Release(next)
+	}
+	log.WithFields(log.Fields{
+		"runKey":     run.key,
+		"nextRunKey": next.key,
+	}).Info("runManager: resumed run")
+	return nil
+}
+
+// Restore scans the output location for runs left by a previous process and
+// registers them as idle runs. Segments referenced by FFmpeg playlists are
+// validated; runs without any usable segment are removed.
+func (m *RunManager) Restore(output string) error {
+	dirs, err := filepath.Glob(output)
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			// Same form as GetDir so run keys match new sessions
+			hashDir := dir + string(os.PathSeparator) + entry.Name()
+			runDirs, err := filepath.Glob(filepath.Join(hashDir, "runs", "seek-*"))
+			if err != nil {
+				continue
+			}
+			for _, runDir := range runDirs {
+				run, err := restoreRun(hashDir, runDir)
+				if err != nil {
+					log.WithError(err).WithField("dir", runDir).Warn("runManager: removing unusable run")
+					_ = os.RemoveAll(runDir)
+					continue
+				}
+				run.transcoder = m.cfg.Transcoder
+				m.mu.Lock()
+				if _, ok := m.runs[run.key]; !ok {
+					m.runs[run.key] = &managedRun{run: run, idleSince: time.Now()}
+					restored++
+				}
+				m.mu.Unlock()
+			}
+		}
+	}
+	log.WithField("runs", restored).Info("runManager: restored runs from disk")
+	return nil
+}
+
+// restoreRun rebuilds a TranscodeRun from its output directory. Playlists are
+// truncated at the first missing or empty segment.
+func restoreRun(hashDir string, runDir string) (*TranscodeRun, error) {
+	var seekTime float64
+	if _, err := fmt.Sscanf(filepath.Base(runDir), "seek-%f", &seekTime); err != nil {
+		return nil, errors.Wrap(err, "failed to parse seek time")
+	}
+	run := newTranscodeRun(runKey(hashDir, seekTime), hashDir, seekTime, "", nil)
+	if run.outputDir != runDir {
+		return nil, errors.Errorf("unexpected run dir name %s", filepath.Base(runDir))
+	}
+
+	files, err := filepath.Glob(filepath.Join(runDir, "*.m3u8.ffmpeg"))
+	if err != nil {
+		return nil, err
+	}
+	complete := true
+	usable := false
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".ffmpeg")
+		p, err := run.readRunPlaylist(name)
+		if err != nil {
+			return nil, err
+		}
+		valid := 0
+		for _, seg := range p.segments {
+			info, err := os.Stat(filepath.Join(runDir, seg.uri))
+			if err != nil || info.Size() == 0 {
+				break
+			}
+			valid++
+		}
+		if valid < len(p.segments) {
+			p.segments = p.segments[:valid]
+			p.ended = false
+			if err := os.WriteFile(f, p.Bytes(), 0644); err != nil {
+				return nil, err
+			}
+		}
+		if isSubtitlePlaylist(name) {
+			continue
+		}
+		if valid > 0 {
+			usable = true
+		}
+		if !p.ended {
+			complete = false
+		}
+	}
+	if !usable {
+		return nil, errors.New("no finished segments")
+	}
+	run.complete = complete
+	return run, nil
+}
@@ -2,36 +2,114 @@ package services
 
 import (
 	"fmt"
+	"net/url"
+	"sort"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
 const (
-	runGracePeriod      = 30 * time.Second // keep idle run alive for reuse
-	runReaperInterval   = 10 * time.Second
+	runGracePeriod    = 30 * time.Second // default for keeping idle runs alive for reuse
+	runReaperInterval = 10 * time.Second
+	runStitchInterval = 2 * time.Second
 )
 
+const (
+	RunCacheExpireFlag    = "run-cache-expire"
+	runPrewarmFlag        = "prewarm"
+	runPrewarmMaxRunsFlag = "prewarm-max-runs"
+	runPrewarmMaxLoadFlag = "prewarm-max-load"
+)
+
+func RegisterRunManagerFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.IntFlag{
+		Name:   RunCacheExpireFlag,
+		Usage:  "keep segments of idle runs on disk for reuse and restore them on startup, in seconds (0 disables)",
+		Value:  0,
+		EnvVar: "RUN_CACHE_EXPIRE",
+	}, cli.BoolFlag{
+		Name:   runPrewarmFlag,
+		Usage:  "speculatively start runs at positions sessions are likely to seek to",
+		EnvVar: "PREWARM",
+	}, cli.IntFlag{
+		Name:   runPrewarmMaxRunsFlag,
+		Usage:  "max concurrent speculative runs",
+		Value:  2,
+		EnvVar: "PREWARM_MAX_RUNS",
+	}, cli.IntFlag{
+		Name:   runPrewarmMaxLoadFlag,
+		Usage:  "running runs above which speculative runs are refused and reclaimed (0 uses the number of CPUs)",
+		Value:  0,
+		EnvVar: "PREWARM_MAX_LOAD",
+	})
+}
+
+// RunManagerConfig holds parameters for creating a RunManager.
+type RunManagerConfig struct {
+	// CacheExpire is how long stopped idle runs keep their segments on disk
+	// for reuse. Zero removes runs as soon as the grace period ends.
+	CacheExpire time.Duration
+	// Transcoder is the backend used to start runs. Defaults to FFmpeg.
+	Transcoder Transcoder
+	// InputProxy, if set, drops the cached source of content once its last
+	// run is removed.
+	InputProxy *InputProxy
+	// GracePeriod is how long idle runs are kept alive for reuse unless
+	// released with another grace period. Defaults to runGracePeriod.
+	GracePeriod time.Duration
+	// Prewarm enables speculative runs, see prewarm.go.
+	Prewarm        bool
+	PrewarmMaxRuns int
+	PrewarmMaxLoad int // zero uses the number of CPUs
+}
+
+func NewRunManagerConfig(c *cli.Context) RunManagerConfig {
+	return RunManagerConfig{
+		CacheExpire:    time.Duration(c.Int(RunCacheExpireFlag)) * time.Second,
+		GracePeriod:    time.Duration(c.Int(RunGracePeriodFlag)) * time.Second,
+		Prewarm:        c.Bool(runPrewarmFlag),
+		PrewarmMaxRuns: c.Int(runPrewarmMaxRunsFlag),
+		PrewarmMaxLoad: c.Int(runPrewarmMaxLoadFlag),
+	}
+}
+
 // RunManager manages shared TranscodeRun instances.
 // Runs are keyed by (hashDir, seekTime) — sessions with the same source
-// and seek position share a single FFmpeg process.
+// and seek position share a single FFmpeg process. When a run catches up with
+// the start of a later run for the same content, it is stopped and stitched
+// to the later run so the same footage is not transcoded twice.
 type RunManager struct {
-	mu   sync.Mutex
-	runs map[string]*managedRun
-	done chan struct{}
+	mu     sync.Mutex
+	runs   map[string]*managedRun
+	done   chan struct{}
 	closed bool
+	cfg    RunManagerConfig
+	stats  RunStats
+	// detached is set while runs are handed over to a new process
+	detached bool
 }
 
 type managedRun struct {
-	run       *TranscodeRun
-	idleSince time.Time // set when refCount drops to 0
+	run         *TranscodeRun
+	idleSince   time.Time     // set when refCount drops to 0
+	grace       time.Duration // grace period of the last release, zero uses the default
+	speculative bool          // started by Prewarm, not acquired by a session yet
 }
 
-func NewRunManager() *RunManager {
+func NewRunManager(cfg RunManagerConfig) *RunManager {
+	if cfg.Transcoder == nil {
+		cfg.Transcoder = &FFmpegTranscoder{}
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = runGracePeriod
+	}
 	m := &RunManager{
 		runs: make(map[string]*managedRun),
 		done: make(chan struct{}),
+		cfg:  cfg,
 	}
 	go m.reaper()
 	return m
@@ -51,11 +129,25 @@ func (m *RunManager) Acquire(hashDir string, seekTime float64, sourceURL string,
 	if mr, ok := m.runs[key]; ok {
 		mr.run.AddRef()
 		mr.idleSince = time.Time{} // no longer idle
+		m.promoteLocked(mr)
 		m.mu.Unlock()
 
-		// Ensure FFmpeg is running (may have been stopped by inactivity)
-		if !mr.run.IsRunning() {
-			if err := mr.run.Start(); err != nil {
+		// Ensure FFmpeg is running (may have been stopped by inactivity).
+		// Partially transcoded runs continue from their last finished segment.
+		if mr.run.IsRunning() {
+			runReuses.WithLabelValues("running").Inc()
+		} else {
+			runReuses.WithLabelValues("stopped").Inc()
+			if m.cfg.Prewarm {
+				m.reclaimSpeculative()
+			}
+			var err error
+			if mr.run.NeedsResume() {
+				err = m.resume(mr.run, sourceURL, h)
+			} else {
+				err = mr.run.Start()
+			}
+			if err != nil {
 				m.Release(mr.run)
 				return nil, err
 			}
@@ -69,14 +161,18 @@ func (m *RunManager) Acquire(hashDir string, seekTime float64, sourceURL string,
 	}
 
 	// Create new run
-	run := newTranscodeRun(key, hashDir, seekTime, sourceURL, h)
+	run := m.newRun(key, hashDir, seekTime, sourceURL, h)
 	run.AddRef()
 	m.runs[key] = &managedRun{run: run}
 	m.mu.Unlock()
 
+	if m.cfg.Prewarm {
+		m.reclaimSpeculative()
+	}
 	if err := run.Start(); err != nil {
 		m.mu.Lock()
 		delete(m.runs, key)
+		m.releaseInputLocked(run)
 		m.mu.Unlock()
 		return nil, err
 	}
@@ -87,16 +183,29 @@ func (m *RunManager) Acquire(hashDir string, seekTime float64, sourceURL string,
 	return run, nil
 }
 
+func (m *RunManager) newRun(key, hashDir string, seekTime float64, sourceURL string, h *HLS) *TranscodeRun {
+	run := newTranscodeRun(key, hashDir, seekTime, sourceURL, h)
+	run.transcoder = m.cfg.Transcoder
+	return run
+}
+
 // Release decrements the run's refCount. When it reaches 0, a grace period
 // starts. If no new session acquires the run within the grace period, it is
 // cleaned up by the reaper.
 func (m *RunManager) Release(run *TranscodeRun) {
+	m.ReleaseWithGrace(run, 0)
+}
+
+// ReleaseWithGrace is Release with the grace period of the releasing
+// session, zero uses the default.
+func (m *RunManager) ReleaseWithGrace(run *TranscodeRun, grace time.Duration) {
 	n := run.Release()
 
 	if n <= 0 {
 		m.mu.Lock()
 		if mr, ok := m.runs[run.key]; ok && mr.run == run {
 			mr.idleSince = time.Now()
+			mr.grace = grace
 		}
 		m.mu.Unlock()
 
@@ -115,6 +224,12 @@ func (m *RunManager) CloseAll() {
 	}
 	m.closed = true
 	close(m.done)
+	if m.detached {
+		// Runs belong to the process that took over
+		m.mu.Unlock()
+		log.Info("runManager: closed, runs handed over")
+		return
+	}
 
 	runs := make(map[string]*managedRun, len(m.runs))
 	for k, v := range m.runs {
@@ -133,30 +248,154 @@ func (m *RunManager) CloseAll() {
 func (m *RunManager) reaper() {
 	ticker := time.NewTicker(runReaperInterval)
 	defer ticker.Stop()
+	stitchTicker := time.NewTicker(runStitchInterval)
+	defer stitchTicker.Stop()
 
 	for {
 		select {
 		case <-m.done:
 			return
 		case <-ticker.C:
-			m.cleanupIdleRuns()
+			if !m.isDetached() {
+				m.cleanupIdleRuns()
+			}
+		case <-stitchTicker.C:
+			if !m.isDetached() {
+				m.checkStitches()
+			}
 		}
 	}
 }
 
+// checkStitches finds running runs whose produced media time has reached the
+// seek time of the next run for the same content and stitches them together.
+func (m *RunManager) checkStitches() {
+	type stitchPair struct {
+		run  *TranscodeRun
+		next *TranscodeRun
+	}
+	m.mu.Lock()
+	byHash := make(map[string][]*TranscodeRun)
+	for _, mr := range m.runs {
+		byHash[mr.run.hashDir] = append(byHash[mr.run.hashDir], mr.run)
+	}
+	var pairs []stitchPair
+	for _, runs := range byHash {
+		sort.Slice(runs, func(i, j int) bool {
+			return runs[i].seekTime < runs[j].seekTime
+		})
+		for i := 0; i < len(runs)-1; i++ {
+			pairs = append(pairs, stitchPair{run: runs[i], next: runs[i+1]})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, p := range pairs {
+		if p.run.stitched() != nil || !p.run.IsRunning() {
+			continue
+		}
+		if p.run.seekTime+p.run.ProducedDuration() < p.next.seekTime {
+			continue
+		}
+		m.stitch(p.run, p.next)
+	}
+}
+
+// stitch hands run over to next. The stitched run holds a reference on next
+// until it is cleaned up.
+func (m *RunManager) stitch(run *TranscodeRun, next *TranscodeRun) {
+	m.mu.Lock()
+	mr, ok := m.runs[next.key]
+	if !ok || mr.run != next {
+		m.mu.Unlock()
+		return
+	}
+	next.AddRef()
+	mr.idleSince = time.Time{}
+	m.mu.Unlock()
+
+	if !run.StitchTo(next) {
+		m.Release(next)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"runKey":     run.key,
+		"nextRunKey": next.key,
+	}).Info("runManager: stitched run to next run")
+}
+
+// releaseInputLocked drops the input proxy source of a removed run unless
+// another run reads the same content. Holding the lock keeps new runs from
+// registering the source in between.
+func (m *RunManager) releaseInputLocked(run *TranscodeRun) {
+	if m.cfg.InputProxy == nil {
+		return
+	}
+	hash, ok := runInputHash(run)
+	if !ok {
+		return
+	}
+	for _, mr := range m.runs {
+		if h, _ := runInputHash(mr.run); h == hash {
+			return
+		}
+	}
+	m.cfg.InputProxy.Release(hash)
+}
+
+func runInputHash(run *TranscodeRun) (string, bool) {
+	parsed, err := url.Parse(run.sourceURL)
+	if err != nil {
+		return "", false
+	}
+	return inputSourceHash(parsed)
+}
+
 func (m *RunManager) cleanupIdleRuns() {
 	m.mu.Lock()
 	var toCleanup []*TranscodeRun
+	var toStop []*TranscodeRun
 	for key, mr := range m.runs {
-		if mr.run.RefCount() <= 0 && !mr.idleSince.IsZero() && time.Since(mr.idleSince) > runGracePeriod {
-			toCleanup = append(toCleanup, mr.run)
-			delete(m.runs, key)
+		if mr.run.RefCount() > 0 || mr.idleSince.IsZero() {
+			continue
+		}
+		idle := time.Since(mr.idleSince)
+		grace := mr.grace
+		if grace == 0 {
+			grace = m.cfg.GracePeriod
+		}
+		if mr.speculative {
+			grace = prewarmExpiry
 		}
+		if idle <= grace {
+			continue
+		}
+		// Keep segments on disk for reuse, only stop FFmpeg
+		if idle <= m.cfg.CacheExpire {
+			toStop = append(toStop, mr.run)
+			continue
+		}
+		toCleanup = append(toCleanup, mr.run)
+		delete(m.runs, key)
+	}
+	for _, run := range toCleanup {
+		m.releaseInputLocked(run)
 	}
 	m.mu.Unlock()
 
+	for _, run := range toStop {
+		if run.IsRunning() {
+			log.WithField("runKey", run.key).Info("runManager: stopping idle run, keeping segments")
+			run.Stop()
+		}
+	}
+
 	for _, run := range toCleanup {
 		log.WithField("runKey", run.key).Info("runManager: cleaning up idle run")
 		run.Cleanup()
+		if st := run.stitched(); st != nil {
+			m.Release(st.next)
+		}
 	}
 }
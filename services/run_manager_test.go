@@ -1,8 +1,15 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestRunKey(t *testing.T) {
@@ -14,7 +21,7 @@ func TestRunKey(t *testing.T) {
 }
 
 func TestRunManagerAcquireRelease(t *testing.T) {
-	rm := NewRunManager()
+	rm := NewRunManager(RunManagerConfig{})
 	defer rm.CloseAll()
 
 	dir := t.TempDir()
@@ -43,7 +50,7 @@ func TestRunManagerAcquireRelease(t *testing.T) {
 }
 
 func TestRunManagerCloseAll(t *testing.T) {
-	rm := NewRunManager()
+	rm := NewRunManager(RunManagerConfig{})
 
 	// Just verify CloseAll doesn't panic
 	rm.CloseAll()
@@ -53,7 +60,7 @@ func TestRunManagerCloseAll(t *testing.T) {
 }
 
 func TestRunManagerConcurrentOperations(t *testing.T) {
-	rm := NewRunManager()
+	rm := NewRunManager(RunManagerConfig{})
 	defer rm.CloseAll()
 
 	dir := t.TempDir()
@@ -97,3 +104,305 @@ func TestInjectSeekParamsInRun(t *testing.T) {
 		}
 	}
 }
+
+func writeRunPlaylist(t *testing.T, run *TranscodeRun, name string, n int, ended bool) {
+	t.Helper()
+	if err := os.MkdirAll(run.OutputDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	prefix := strings.TrimSuffix(name, ".m3u8")
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:4\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "#EXTINF:4.000000,\n%s-%d.ts\n", prefix, i)
+	}
+	if ended {
+		sb.WriteString("#EXT-X-ENDLIST\n")
+	}
+	if err := os.WriteFile(filepath.Join(run.OutputDir(), name+".ffmpeg"), []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTranscodeRunProducedDuration(t *testing.T) {
+	dir := t.TempDir()
+	run := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	if got := run.ProducedDuration(); got != 0 {
+		t.Errorf("ProducedDuration without playlists: got %.1f, want 0", got)
+	}
+	writeRunPlaylist(t, run, "v0-720.m3u8", 10, false)
+	writeRunPlaylist(t, run, "a0.m3u8", 8, false)
+	writeRunPlaylist(t, run, "s0.m3u8", 1, false)
+	if got := run.ProducedDuration(); got != 32 {
+		t.Errorf("ProducedDuration: got %.1f, want 32 (min over audio/video)", got)
+	}
+}
+
+func TestTranscodeRunStitch(t *testing.T) {
+	dir := t.TempDir()
+	run := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	next := newTranscodeRun(runKey(dir, 30), dir, 30, "", nil)
+
+	// run produced 0..36s, next produced 30..50s
+	writeRunPlaylist(t, run, "v0-720.m3u8", 9, true)
+	writeRunPlaylist(t, next, "v0-720.m3u8", 5, false)
+
+	if !run.StitchTo(next) {
+		t.Fatal("StitchTo should succeed")
+	}
+	if run.StitchTo(next) {
+		t.Error("second StitchTo should be a no-op")
+	}
+
+	data, err := run.Playlist("v0-720.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	if strings.Count(got, "#EXT-X-DISCONTINUITY") != 1 {
+		t.Errorf("should contain one discontinuity, got:\n%s", got)
+	}
+	if strings.Contains(got, "#EXT-X-ENDLIST") {
+		t.Errorf("should not end while next run is still producing, got:\n%s", got)
+	}
+	// next segments 0 (30-34) and 1 (34-38) → 1 ends after 36, so skip=1:
+	// next segments 1..4 become 9..12
+	if !strings.Contains(got, "#EXT-X-DISCONTINUITY\n#EXTINF:4.000000,\nv0-720-9.ts\n") {
+		t.Errorf("discontinuity should precede v0-720-9.ts, got:\n%s", got)
+	}
+	if !strings.Contains(got, "v0-720-12.ts") || strings.Contains(got, "v0-720-13.ts") {
+		t.Errorf("should contain renumbered segments up to 12, got:\n%s", got)
+	}
+
+	if p := run.SegmentPath("v0-720-8.ts"); p != filepath.Join(run.OutputDir(), "v0-720-8.ts") {
+		t.Errorf("own segment path: got %q", p)
+	}
+	if p := run.SegmentPath("v0-720-9.ts"); p != filepath.Join(next.OutputDir(), "v0-720-1.ts") {
+		t.Errorf("stitched segment path: got %q", p)
+	}
+	if p := run.SegmentPath("v0-720-12.ts"); p != filepath.Join(next.OutputDir(), "v0-720-4.ts") {
+		t.Errorf("stitched segment path: got %q", p)
+	}
+}
+
+func TestTranscodeRunStitchUnparseableSegment(t *testing.T) {
+	dir := t.TempDir()
+	run := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	next := newTranscodeRun(runKey(dir, 30), dir, 30, "", nil)
+	writeRunPlaylist(t, run, "v0-720.m3u8", 9, true)
+	writeRunPlaylist(t, next, "v0-720.m3u8", 5, false)
+
+	// The first segment after the skipped one has a name that can not be
+	// renumbered
+	name := filepath.Join(next.OutputDir(), "v0-720.m3u8.ffmpeg")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "v0-720-1.ts", "bogus.ts", 1))
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !run.StitchTo(next) {
+		t.Fatal("StitchTo should succeed")
+	}
+
+	data, err = run.Playlist("v0-720.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	if !strings.Contains(got, "#EXT-X-DISCONTINUITY\n#EXTINF:4.000000,\nv0-720-9.ts\n") {
+		t.Errorf("discontinuity should precede v0-720-9.ts, got:\n%s", got)
+	}
+	if strings.Contains(got, "bogus") || !strings.Contains(got, "v0-720-11.ts") || strings.Contains(got, "v0-720-12.ts") {
+		t.Errorf("should contain renumbered segments up to 11 without gaps, got:\n%s", got)
+	}
+	// Playlist entries and segment paths agree
+	for num, want := range map[int]int{9: 2, 10: 3, 11: 4} {
+		p := run.SegmentPath(fmt.Sprintf("v0-720-%d.ts", num))
+		if want := filepath.Join(next.OutputDir(), fmt.Sprintf("v0-720-%d.ts", want)); p != want {
+			t.Errorf("segment %d path: got %q, want %q", num, p, want)
+		}
+	}
+}
+
+// blockingTranscoder starts processes whose Stop blocks until released.
+type blockingTranscoder struct {
+	stopping chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingTranscoder) Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error) {
+	return &blockingProcess{t: b, exited: make(chan struct{})}, nil
+}
+
+type blockingProcess struct {
+	t      *blockingTranscoder
+	exited chan struct{}
+	once   sync.Once
+}
+
+func (p *blockingProcess) Pid() int { return 0 }
+
+func (p *blockingProcess) Wait() error {
+	<-p.exited
+	return errors.New("stopped")
+}
+
+func (p *blockingProcess) Stop() {
+	p.once.Do(func() {
+		close(p.t.stopping)
+		<-p.t.release
+		close(p.exited)
+	})
+	<-p.exited
+}
+
+func TestTranscodeRunConcurrentStitch(t *testing.T) {
+	dir := t.TempDir()
+	tr := &blockingTranscoder{stopping: make(chan struct{}), release: make(chan struct{})}
+	run := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	run.transcoder = tr
+	next := newTranscodeRun(runKey(dir, 30), dir, 30, "", nil)
+	if err := run.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan bool)
+	go func() {
+		first <- run.StitchTo(next)
+	}()
+	// The first caller waits for FFmpeg to stop without holding the lock
+	<-tr.stopping
+	second := make(chan bool)
+	go func() {
+		second <- run.StitchTo(next)
+	}()
+	select {
+	case ok := <-second:
+		if ok {
+			t.Error("StitchTo while another one is stopping FFmpeg should fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("StitchTo while another one is stopping FFmpeg should not wait for it")
+	}
+	close(tr.release)
+	if !<-first {
+		t.Error("first StitchTo should succeed")
+	}
+	if run.stitched() == nil {
+		t.Error("run should be stitched")
+	}
+}
+
+func writeRunSegments(t *testing.T, run *TranscodeRun, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		name := filepath.Join(run.OutputDir(), fmt.Sprintf("%s-%d.ts", prefix, i))
+		if err := os.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunManagerRestore(t *testing.T) {
+	output := t.TempDir()
+	hashDir := output + string(os.PathSeparator) + "abc"
+
+	// Complete run at 0
+	complete := newTranscodeRun(runKey(hashDir, 0), hashDir, 0, "", nil)
+	writeRunPlaylist(t, complete, "v0.m3u8", 3, true)
+	writeRunSegments(t, complete, "v0", 3)
+
+	// Partial run at 480 with a missing last segment
+	partial := newTranscodeRun(runKey(hashDir, 480), hashDir, 480, "", nil)
+	writeRunPlaylist(t, partial, "v0.m3u8", 4, false)
+	writeRunSegments(t, partial, "v0", 3)
+
+	// Run without any finished segment
+	empty := newTranscodeRun(runKey(hashDir, 990), hashDir, 990, "", nil)
+	writeRunPlaylist(t, empty, "v0.m3u8", 2, false)
+
+	rm := NewRunManager(RunManagerConfig{CacheExpire: time.Hour})
+	defer rm.CloseAll()
+	if err := rm.Restore(output); err != nil {
+		t.Fatal(err)
+	}
+
+	rm.mu.Lock()
+	restoredComplete := rm.runs[runKey(hashDir, 0)]
+	restoredPartial := rm.runs[runKey(hashDir, 480)]
+	_, hasEmpty := rm.runs[runKey(hashDir, 990)]
+	rm.mu.Unlock()
+
+	if restoredComplete == nil || restoredPartial == nil {
+		t.Fatal("complete and partial runs should be restored")
+	}
+	if hasEmpty {
+		t.Error("run without segments should not be restored")
+	}
+	if _, err := os.Stat(empty.OutputDir()); !os.IsNotExist(err) {
+		t.Error("run dir without segments should be removed")
+	}
+	if restoredComplete.idleSince.IsZero() || restoredComplete.run.RefCount() != 0 {
+		t.Error("restored runs should be idle")
+	}
+
+	if restoredComplete.run.NeedsResume() {
+		t.Error("complete run should not need resume")
+	}
+	if !restoredPartial.run.NeedsResume() {
+		t.Error("partial run should need resume")
+	}
+	if got := restoredPartial.run.ProducedDuration(); got != 12 {
+		t.Errorf("partial run should be truncated to 3 segments, got %.1f", got)
+	}
+	// Starting a complete run is a no-op (no FFmpeg needed)
+	if err := restoredComplete.run.Start(); err != nil {
+		t.Errorf("Start on complete run: %v", err)
+	}
+}
+
+func TestRunManagerReleasesInputSource(t *testing.T) {
+	p := startTestInputProxy(t, t.TempDir(), 64)
+	rm := NewRunManager(RunManagerConfig{InputProxy: p})
+	t.Cleanup(rm.CloseAll)
+	dir := t.TempDir()
+	source := "http://example.com/v.mkv"
+	if _, err := p.URL(source, nil); err != nil {
+		t.Fatal(err)
+	}
+	sources := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.sources)
+	}
+
+	short := newTranscodeRun(runKey(dir, 0), dir, 0, source, nil)
+	long := newTranscodeRun(runKey(dir, 30), dir, 30, source, nil)
+	for _, run := range []*TranscodeRun{short, long} {
+		run.AddRef()
+		rm.runs[run.key] = &managedRun{run: run}
+	}
+	rm.ReleaseWithGrace(short, time.Second)
+	rm.ReleaseWithGrace(long, time.Hour)
+	age := func(d time.Duration) {
+		rm.mu.Lock()
+		for _, mr := range rm.runs {
+			mr.idleSince = mr.idleSince.Add(-d)
+		}
+		rm.mu.Unlock()
+	}
+
+	age(2 * time.Second)
+	rm.cleanupIdleRuns()
+	if sources() != 1 {
+		t.Error("source should be kept while a run of the content remains")
+	}
+	age(2 * time.Hour)
+	rm.cleanupIdleRuns()
+	if sources() != 0 {
+		t.Error("source should be released with the last run of the content")
+	}
+}
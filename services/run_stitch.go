@@ -0,0 +1,340 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runStitch records that a run was stopped once its output reached the start
+// of a later run for the same content. The stopped run keeps serving its own
+// segments and continues with the later run's segments after an
+// #EXT-X-DISCONTINUITY, renumbered so that segment names stay contiguous.
+type runStitch struct {
+	next *TranscodeRun
+	// end is the movie time at which this run's own output ends.
+	end float64
+}
+
+// playlistSegment is a single media segment entry of an HLS playlist.
+type playlistSegment struct {
+	tags     []string // tag lines preceding the URI (#EXTINF, #EXT-X-DISCONTINUITY, ...)
+	duration float64
+	uri      string
+}
+
+// mediaPlaylist is a parsed FFmpeg-generated HLS media playlist.
+type mediaPlaylist struct {
+	header   []string
+	segments []playlistSegment
+	ended    bool
+}
+
+func parseMediaPlaylist(data []byte) *mediaPlaylist {
+	p := &mediaPlaylist{}
+	var tags []string
+	var duration float64
+	inHeader := true
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == "#EXT-X-ENDLIST":
+			p.ended = true
+		case strings.HasPrefix(line, "#EXTINF:"):
+			inHeader = false
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(v, ","); i >= 0 {
+				v = v[:i]
+			}
+			duration, _ = strconv.ParseFloat(v, 64)
+			tags = append(tags, line)
+		case strings.HasPrefix(line, "#"):
+			if inHeader {
+				p.header = append(p.header, line)
+			} else {
+				tags = append(tags, line)
+			}
+		default:
+			inHeader = false
+			p.segments = append(p.segments, playlistSegment{
+				tags:     tags,
+				duration: duration,
+				uri:      line,
+			})
+			tags = nil
+			duration = 0
+		}
+	}
+	return p
+}
+
+// Duration returns the total duration of all segments.
+func (p *mediaPlaylist) Duration() float64 {
+	var d float64
+	for _, seg := range p.segments {
+		d += seg.duration
+	}
+	return d
+}
+
+func (p *mediaPlaylist) targetDuration() int {
+	for _, l := range p.header {
+		if strings.HasPrefix(l, "#EXT-X-TARGETDURATION:") {
+			n, _ := strconv.Atoi(strings.TrimPrefix(l, "#EXT-X-TARGETDURATION:"))
+			return n
+		}
+	}
+	return 0
+}
+
+// Bytes renders the playlist back to its textual form.
+func (p *mediaPlaylist) Bytes() []byte {
+	var sb strings.Builder
+	for _, l := range p.header {
+		sb.WriteString(l)
+		sb.WriteRune('\n')
+	}
+	for _, seg := range p.segments {
+		for _, t := range seg.tags {
+			sb.WriteString(t)
+			sb.WriteRune('\n')
+		}
+		sb.WriteString(seg.uri)
+		sb.WriteRune('\n')
+	}
+	if p.ended {
+		sb.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(sb.String())
+}
+
+// renumberSegment returns the segment filename with its number replaced,
+// e.g. ("v0-720-5.ts", 12) → "v0-720-12.ts".
+func renumberSegment(name string, num int) (string, bool) {
+	m := segPrefixPattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s-%d.%s", m[1], num, m[3]), true
+}
+
+// stitchSkip returns how many leading segments of the next run are already
+// covered by this run's output ending at movie time end.
+func stitchSkip(next *mediaPlaylist, nextSeekTime, end float64) int {
+	t := nextSeekTime
+	for i, seg := range next.segments {
+		t += seg.duration
+		if t > end+0.001 {
+			return i
+		}
+	}
+	return len(next.segments)
+}
+
+// readRunPlaylist reads the raw FFmpeg playlist for a stream from the run dir.
+func (r *TranscodeRun) readRunPlaylist(name string) (*mediaPlaylist, error) {
+	data, err := os.ReadFile(filepath.Join(r.outputDir, name) + ".ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+	return parseMediaPlaylist(data), nil
+}
+
+// Playlist returns the media playlist for a stream, including segments of
+// stitched runs.
+func (r *TranscodeRun) Playlist(name string) ([]byte, error) {
+	if r.stitched() == nil {
+		return os.ReadFile(filepath.Join(r.outputDir, name) + ".ffmpeg")
+	}
+	p, err := r.mediaPlaylist(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.Bytes(), nil
+}
+
+// playlistFiles returns the FFmpeg playlist files a stream's playlist is
+// built from, following stitched runs.
+func (r *TranscodeRun) playlistFiles(name string) []string {
+	files := []string{filepath.Join(r.outputDir, name) + ".ffmpeg"}
+	if st := r.stitched(); st != nil {
+		files = append(files, st.next.playlistFiles(name)...)
+	}
+	return files
+}
+
+func (r *TranscodeRun) mediaPlaylist(name string) (*mediaPlaylist, error) {
+	p, err := r.readRunPlaylist(name)
+	if err != nil {
+		return nil, err
+	}
+	st := r.stitched()
+	if st == nil {
+		return p, nil
+	}
+	np, err := st.next.mediaPlaylist(name)
+	if err != nil {
+		// Later run has not produced this stream yet
+		p.ended = false
+		return p, nil
+	}
+	kept := len(p.segments)
+	skip := stitchSkip(np, st.next.seekTime, st.end)
+	p.ended = np.ended
+	if td := np.targetDuration(); td > p.targetDuration() {
+		for i, l := range p.header {
+			if strings.HasPrefix(l, "#EXT-X-TARGETDURATION:") {
+				p.header[i] = fmt.Sprintf("#EXT-X-TARGETDURATION:%d", td)
+			}
+		}
+	}
+	for _, seg := range stitchSegments(np, skip, kept) {
+		p.segments = append(p.segments, seg.playlistSegment)
+	}
+	return p, nil
+}
+
+// stitchedSegment is a segment of the next run continuing a stitched run.
+type stitchedSegment struct {
+	playlistSegment        // renumbered to continue the stitched run
+	next            string // name of the segment in the next run
+}
+
+// stitchSegments returns the segments of the next run's playlist following
+// the kept segments of a stitched run, numbered from kept on. Segments
+// whose names can not be renumbered are left out without leaving a gap, the
+// first segment returned carries the discontinuity.
+func stitchSegments(np *mediaPlaylist, skip int, kept int) []stitchedSegment {
+	var segs []stitchedSegment
+	for _, seg := range np.segments[skip:] {
+		uri, ok := renumberSegment(seg.uri, kept+len(segs))
+		if !ok {
+			continue
+		}
+		tags := seg.tags
+		if len(segs) == 0 {
+			tags = append([]string{"#EXT-X-DISCONTINUITY"}, tags...)
+		}
+		segs = append(segs, stitchedSegment{
+			playlistSegment: playlistSegment{
+				tags:     tags,
+				duration: seg.duration,
+				uri:      uri,
+			},
+			next: seg.uri,
+		})
+	}
+	return segs
+}
+
+// SegmentPath returns the full path to a segment file, resolving segment
+// numbers beyond this run's own output to the stitched run's directory.
+func (r *TranscodeRun) SegmentPath(filename string) string {
+	st := r.stitched()
+	if st == nil {
+		return filepath.Join(r.outputDir, filename)
+	}
+	m := segPrefixPattern.FindStringSubmatch(filename)
+	if m == nil {
+		return filepath.Join(r.outputDir, filename)
+	}
+	num, _ := strconv.Atoi(m[2])
+	name := m[1] + ".m3u8"
+	p, err := r.readRunPlaylist(name)
+	if err != nil || num < len(p.segments) {
+		return filepath.Join(r.outputDir, filename)
+	}
+	np, err := st.next.mediaPlaylist(name)
+	if err != nil {
+		return filepath.Join(r.outputDir, filename)
+	}
+	skip := stitchSkip(np, st.next.seekTime, st.end)
+	segs := stitchSegments(np, skip, len(p.segments))
+	i := num - len(p.segments)
+	if i >= len(segs) {
+		// Not produced yet, named like the next run would name it
+		nextName, _ := renumberSegment(filename, len(np.segments)+i-len(segs))
+		return st.next.SegmentPath(nextName)
+	}
+	return st.next.SegmentPath(segs[i].next)
+}
+
+// SegmentFinalized returns true if the segment is listed in the stream's
+// playlist, including segments of stitched runs.
+func (r *TranscodeRun) SegmentFinalized(filename string) bool {
+	m := segPrefixPattern.FindStringSubmatch(filename)
+	if m == nil {
+		return false
+	}
+	p, err := r.mediaPlaylist(m[1] + ".m3u8")
+	if err != nil {
+		return false
+	}
+	for _, seg := range p.segments {
+		if seg.uri == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// ProducedDuration returns the media time produced so far, as the minimum
+// over all non-subtitle streams (subtitle streams are often sparse).
+func (r *TranscodeRun) ProducedDuration() float64 {
+	files, err := filepath.Glob(filepath.Join(r.outputDir, "*.m3u8.ffmpeg"))
+	if err != nil || len(files) == 0 {
+		return 0
+	}
+	produced := math.Inf(1)
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".ffmpeg")
+		if isSubtitlePlaylist(name) {
+			continue
+		}
+		p, err := r.readRunPlaylist(name)
+		if err != nil {
+			return 0
+		}
+		produced = math.Min(produced, p.Duration())
+	}
+	if math.IsInf(produced, 1) {
+		return 0
+	}
+	return produced
+}
+
+func (r *TranscodeRun) stitched() *runStitch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stitch
+}
+
+// StitchTo stops FFmpeg and continues this run's output with the segments
+// of next. The caller must hold a reference on next for as long as this run
+// is alive. Returns false if the run was already stitched or is being
+// stitched.
+func (r *TranscodeRun) StitchTo(next *TranscodeRun) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stitch != nil || r.stitching {
+		return false
+	}
+	// stopLocked releases the lock while FFmpeg exits
+	r.stitching = true
+	r.stopLocked()
+	r.stitching = false
+	r.stitch = &runStitch{
+		next: next,
+		end:  r.seekTime + r.ProducedDuration(),
+	}
+	r.logger.WithField("nextRunKey", next.key).Info("run: stitched to next run")
+	return true
+}
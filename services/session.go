@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,23 +17,24 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Defaults of the session timings, see session_timings.go.
 const (
-	sessionSegDuration = 4
+	sessionSegDuration = 4 // seconds
 	// seekQuantum defines the granularity of seek positions. Seek times are
 	// rounded down to the nearest multiple of this value. This ensures that
 	// viewers seeking to nearby positions share the same TranscodeRun (same
 	// FFmpeg process, same segments on disk). 30s means max imprecision of
 	// ~30s + keyframe gap, which is imperceptible in practice.
-	seekQuantum = 30.0 // seconds
+	seekQuantum = 30 // seconds
 )
 
-// quantizeSeekTime rounds seek time down to the nearest seekQuantum boundary.
+// quantizeSeekTime rounds seek time down to the nearest quantum boundary.
 // seekTime=0 is never quantized (always starts from the beginning).
-func quantizeSeekTime(t float64) float64 {
+func quantizeSeekTime(t float64, quantum float64) float64 {
 	if t <= 0 {
 		return 0
 	}
-	return float64(int(t/seekQuantum)) * seekQuantum
+	return float64(int(t/quantum)) * quantum
 }
 
 // segPrefixPattern extracts the prefix and number from a segment filename.
@@ -69,10 +71,42 @@ type Session struct {
 	seekTime  float64
 	lastAccess time.Time
 
+	// Prewarming hints, see prewarm.go
+	seekHistory []float64
+	playhead    float64
+	prewarmed   float64
+
+	// Time of the last start or seek until a segment of the run acquired
+	// for it is ready, see metrics.go
+	seekedAt time.Time
+
 	// Shared FFmpeg run
 	run    *TranscodeRun
 	runMgr *RunManager
 
+	// Session store, see session_store.go
+	stored time.Time // lastAccess when last saved or touched
+	synced time.Time // last reread from the store
+
+	// Resume position of the viewer, "" without a viewer, see position_store.go
+	positionKey string
+
+	// Viewer quota, see quota.go
+	quota   *Quota
+	quotaID string
+
+	// Lifecycle timings, see session_timings.go
+	timings SessionTimings
+
+	// Authenticated subject and the time the session has to be closed at,
+	// zero without a lifetime limit, see jwt_auth.go
+	subject  string
+	deadline time.Time
+
+	// Session events, see events.go
+	events       eventHub
+	warnedAccess time.Time // lastAccess when the expiry warning was published
+
 	// Lifecycle
 	closed bool
 	logger *log.Entry
@@ -86,10 +120,31 @@ type SessionConfig struct {
 	HLS       *HLS
 	Duration  float64
 	RunMgr    *RunManager
+	// PositionKey identifies the viewer's resume position, see position_store.go
+	PositionKey string
+	// QuotaID identifies the viewer quotas are counted for, see quota.go
+	QuotaID string
+	Quota   *Quota
+	// Timings are the session's lifecycle timings, zero fields use the
+	// defaults, see session_timings.go
+	Timings SessionTimings
+	// Subject is the authenticated subject the session is served to, ""
+	// without authentication, see jwt_auth.go
+	Subject string
+	// MaxSessions limits the concurrent sessions of the subject
+	MaxSessions int
+	// Deadline is the time the session is closed at, zero is unlimited
+	Deadline time.Time
 }
 
 func NewSession(cfg SessionConfig) *Session {
 	outputDir := filepath.Join(cfg.HashDir, "sessions", cfg.ID)
+	fields := log.Fields{
+		"sessionID": cfg.ID,
+	}
+	if cfg.Subject != "" {
+		fields["subject"] = cfg.Subject
+	}
 	return &Session{
 		id:         cfg.ID,
 		sourceURL:  cfg.SourceURL,
@@ -99,9 +154,14 @@ func NewSession(cfg SessionConfig) *Session {
 		duration:   cfg.Duration,
 		lastAccess: time.Now(),
 		runMgr:     cfg.RunMgr,
-		logger: log.WithFields(log.Fields{
-			"sessionID": cfg.ID,
-		}),
+		logger:     log.WithFields(fields),
+
+		positionKey: cfg.PositionKey,
+		quota:       cfg.Quota,
+		quotaID:     cfg.QuotaID,
+		timings:     cfg.Timings.withDefaults(),
+		subject:     cfg.Subject,
+		deadline:    cfg.Deadline,
 	}
 }
 
@@ -114,25 +174,36 @@ func (s *Session) Start(seekTime float64) error {
 		return errors.New("session is closed")
 	}
 
-	s.seekTime = quantizeSeekTime(seekTime)
-	return s.acquireRunLocked()
+	s.seekTime = s.timings.quantize(seekTime)
+	s.playhead = s.seekTime
+	s.recordSeekLocked(s.seekTime)
+	if err := s.acquireRunLocked(); err != nil {
+		return err
+	}
+	s.seekedAt = time.Now()
+	return nil
 }
 
 // acquireRunLocked acquires a shared TranscodeRun for the current seekTime.
 func (s *Session) acquireRunLocked() error {
+	if err := s.quota.admitRun(s.quotaID, s.id, runKey(s.hashDir, s.seekTime)); err != nil {
+		return err
+	}
 	run, err := s.runMgr.Acquire(s.hashDir, s.seekTime, s.sourceURL, s.h)
 	if err != nil {
 		return err
 	}
 	s.run = run
+	s.quota.setRun(s.quotaID, s.id, run.key)
 	return nil
 }
 
 // releaseRunLocked releases the current run if any.
 func (s *Session) releaseRunLocked() {
 	if s.run != nil {
-		s.runMgr.Release(s.run)
+		s.runMgr.ReleaseWithGrace(s.run, s.timings.runGrace())
 		s.run = nil
+		s.quota.setRun(s.quotaID, s.id, "")
 	}
 }
 
@@ -145,8 +216,9 @@ func (s *Session) Seek(seekTime float64) error {
 		return errors.New("session is closed")
 	}
 
-	seekTime = quantizeSeekTime(seekTime)
+	seekTime = s.timings.quantize(seekTime)
 	s.logger.WithField("seekTime", fmt.Sprintf("%.3f", seekTime)).Info("session: seeking")
+	seekedAt := time.Now()
 
 	oldRun := s.run
 	oldSeekTime := s.seekTime
@@ -163,8 +235,13 @@ func (s *Session) Seek(seekTime float64) error {
 
 	// Release old run only after successful acquire
 	if oldRun != nil {
-		s.runMgr.Release(oldRun)
+		s.runMgr.ReleaseWithGrace(oldRun, s.timings.runGrace())
 	}
+	s.playhead = seekTime
+	s.seekedAt = seekedAt
+	sessionSeeks.Inc()
+	s.recordSeekLocked(seekTime)
+	s.events.publish(eventSeek, seekEvent{SeekTime: seekTime})
 	return nil
 }
 
@@ -177,6 +254,12 @@ func (s *Session) Stop() {
 
 // Close releases the run and removes the session's master playlist directory.
 func (s *Session) Close() {
+	s.close(true)
+}
+
+// close releases the run. The master playlist directory is kept if the
+// session may still be served by another replica.
+func (s *Session) close(removeDir bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -186,15 +269,39 @@ func (s *Session) Close() {
 	s.closed = true
 
 	s.releaseRunLocked()
+	s.quota.removeSession(s.quotaID, s.id)
 
 	// Remove session directory (master playlist only)
-	if err := os.RemoveAll(s.outputDir); err != nil {
-		s.logger.WithError(err).Warn("session: failed to remove session dir")
+	if removeDir {
+		if err := os.RemoveAll(s.outputDir); err != nil {
+			s.logger.WithError(err).Warn("session: failed to remove session dir")
+		}
 	}
 
+	s.events.publish(eventClosed, struct{}{})
 	s.logger.Info("session: closed")
 }
 
+// record returns the state stored in the session store.
+func (s *Session) record() *sessionRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &sessionRecord{
+		ID:        s.id,
+		SourceURL: s.sourceURL,
+		HashDir:   s.hashDir,
+		Job:       hlsJob(s.h),
+		Duration:  s.duration,
+		SeekTime:  s.seekTime,
+
+		PositionKey: s.positionKey,
+		QuotaID:     s.quotaID,
+		Timings:     s.timings,
+		Subject:     s.subject,
+		Deadline:    s.deadline,
+	}
+}
+
 // Touch updates the last access timestamp.
 func (s *Session) Touch() {
 	s.mu.Lock()
@@ -202,6 +309,18 @@ func (s *Session) Touch() {
 	s.mu.Unlock()
 }
 
+// warnExpiry publishes an expiry warning once per period of inactivity.
+func (s *Session) warnExpiry(lastAccess time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.warnedAccess.Equal(lastAccess) {
+		return
+	}
+	s.warnedAccess = lastAccess
+	expiresIn := time.Until(lastAccess.Add(s.timings.expireAfter()))
+	s.events.publish(eventExpiring, expiringEvent{ExpiresIn: math.Round(expiresIn.Seconds())})
+}
+
 // IsRunning returns true if the shared FFmpeg run is currently running.
 func (s *Session) IsRunning() bool {
 	s.mu.Lock()
@@ -233,6 +352,17 @@ func (s *Session) LastAccess() time.Time {
 	return s.lastAccess
 }
 
+// Subject returns the authenticated subject, "" without authentication.
+// It never changes.
+func (s *Session) Subject() string {
+	return s.subject
+}
+
+// pastDeadline returns true if the session outlived its lifetime limit.
+func (s *Session) pastDeadline() bool {
+	return !s.deadline.IsZero() && time.Now().After(s.deadline)
+}
+
 // EnsureRunning re-acquires the FFmpeg run if it's not currently running.
 // Used by playlist handlers to restart after inactivity-based release.
 func (s *Session) EnsureRunning() error {
@@ -279,25 +409,23 @@ func (s *Session) RestartForSegment(segNum int) error {
 	return s.acquireRunLocked()
 }
 
-// runOutputDir returns the output directory of the current run, or empty string.
-func (s *Session) runOutputDir() string {
-	if s.run != nil {
-		return s.run.OutputDir()
-	}
-	return ""
+// currentRun returns the current run, or nil.
+func (s *Session) currentRun() *TranscodeRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run
 }
 
 // PlaylistForStream reads and cleans the FFmpeg-generated playlist for a stream.
+// If the run was stitched to a later run, the playlist continues with the
+// later run's segments after an #EXT-X-DISCONTINUITY.
 func (s *Session) PlaylistForStream(name string) ([]byte, error) {
-	dir := s.runOutputDir()
-	if dir == "" {
+	run := s.currentRun()
+	if run == nil {
 		return nil, errors.New("no active run")
 	}
 
-	playlistPath := filepath.Join(dir, name)
-	ffmpegPath := playlistPath + ".ffmpeg"
-
-	data, err := os.ReadFile(ffmpegPath)
+	data, err := run.Playlist(name)
 	if err != nil {
 		return nil, err
 	}
@@ -319,7 +447,7 @@ func (s *Session) PlaylistForStream(name string) ([]byte, error) {
 
 	// Movie-time offset of segment 0 in this variant. Downstream proxies
 	// use this to compute movie_time per segment (offset + Σ EXTINF) without
-	// querying session state. Quantized to seekQuantum (see Session.Start).
+	// querying session state. Quantized to the session's seek quantum (see Session.Start).
 	// Players ignore unknown #EXT-X-* tags per HLS spec (RFC 8216 §3.1).
 	if !strings.Contains(content, "#EXT-X-SESSION-OFFSET:") {
 		content = strings.Replace(content, "#EXTM3U\n",
@@ -331,24 +459,55 @@ func (s *Session) PlaylistForStream(name string) ([]byte, error) {
 
 // SegmentPath returns the full path to a segment file in the shared run dir.
 func (s *Session) SegmentPath(filename string) string {
-	dir := s.runOutputDir()
-	if dir == "" {
+	run := s.currentRun()
+	if run == nil {
 		return ""
 	}
-	return filepath.Join(dir, filename)
+	return run.SegmentPath(filename)
+}
+
+// watchPlaylist subscribes to updates of a stream's playlist.
+func (s *Session) watchPlaylist(name string) *fileSubscription {
+	run := s.currentRun()
+	if run == nil {
+		return watchFiles()
+	}
+	return watchFiles(run.playlistFiles(name)...)
+}
+
+// watchSegment subscribes to updates of the playlist listing a segment and,
+// if file is set, to writes of the segment file itself.
+func (s *Session) watchSegment(filename string, file bool) *fileSubscription {
+	run := s.currentRun()
+	if run == nil {
+		return watchFiles()
+	}
+	var files []string
+	if file {
+		files = append(files, run.SegmentPath(filename))
+	}
+	if m := segPrefixPattern.FindStringSubmatch(filename); m != nil {
+		files = append(files, run.playlistFiles(m[1]+".m3u8")...)
+	}
+	return watchFiles(files...)
 }
 
-// WaitForPlaylist polls until the playlist file appears (max timeout).
-// Returns early if the FFmpeg run is no longer active.
+// WaitForPlaylist waits until the playlist file appears (max timeout),
+// woken by playlist updates. Returns early if the FFmpeg run is no longer
+// active.
 func (s *Session) WaitForPlaylist(ctx context.Context, name string, timeout time.Duration) ([]byte, error) {
+	start := time.Now()
+	sub := s.watchPlaylist(name)
+	defer sub.Close()
 	deadline := time.After(timeout)
-	ticker := time.NewTicker(500 * time.Millisecond)
+	ticker := time.NewTicker(sub.pollInterval(500 * time.Millisecond))
 	defer ticker.Stop()
 
 	for {
 		data, err := s.PlaylistForStream(name)
 		if err == nil && len(data) > 0 {
 			if isValidSessionPlaylist(data) {
+				observeWait(playlistWait, waitReady, start)
 				return data, nil
 			}
 		}
@@ -358,16 +517,21 @@ func (s *Session) WaitForPlaylist(ctx context.Context, name string, timeout time
 			// One last check — file may have been written right before exit
 			data, err := s.PlaylistForStream(name)
 			if err == nil && len(data) > 0 && isValidSessionPlaylist(data) {
+				observeWait(playlistWait, waitReady, start)
 				return data, nil
 			}
+			observeWait(playlistWait, waitExited, start)
 			return nil, errors.New("ffmpeg is not running and playlist not available")
 		}
 
 		select {
+		case <-sub.C:
 		case <-ticker.C:
 		case <-deadline:
+			observeWait(playlistWait, waitTimeout, start)
 			return nil, errors.New("timeout waiting for playlist")
 		case <-ctx.Done():
+			observeWait(playlistWait, waitCanceled, start)
 			return nil, ctx.Err()
 		}
 	}
@@ -386,36 +550,91 @@ func isValidSessionPlaylist(data []byte) bool {
 	return lines >= 4
 }
 
-// WaitForSegment polls until a segment file appears on disk with non-zero size.
-// Returns early if the FFmpeg run is no longer active.
+// SegmentFinalized returns true once FFmpeg listed the segment in its
+// playlist, i.e. closed the segment file.
+func (s *Session) SegmentFinalized(filename string) bool {
+	run := s.currentRun()
+	if run == nil {
+		return false
+	}
+	return run.SegmentFinalized(filename)
+}
+
+// WaitForSegment waits until the segment is finalized, woken by playlist
+// updates. Returns early if the FFmpeg run is no longer active.
 func (s *Session) WaitForSegment(ctx context.Context, filename string, timeout time.Duration) error {
-	filePath := s.SegmentPath(filename)
-	if filePath == "" {
+	return s.waitForSegment(ctx, filename, timeout, false, s.SegmentFinalized)
+}
+
+// WaitForSegmentFile waits until a segment file appears on disk with
+// non-zero size, finalized or not. Returns early if the FFmpeg run is no
+// longer active.
+func (s *Session) WaitForSegmentFile(ctx context.Context, filename string, timeout time.Duration) error {
+	return s.waitForSegment(ctx, filename, timeout, true, func(filename string) bool {
+		filePath := s.SegmentPath(filename)
+		if filePath == "" {
+			return false
+		}
+		info, err := os.Stat(filePath)
+		return err == nil && info.Size() > 0
+	})
+}
+
+func (s *Session) waitForSegment(ctx context.Context, filename string, timeout time.Duration, file bool, ready func(filename string) bool) error {
+	start := time.Now()
+	if s.currentRun() == nil {
+		observeWait(segmentWait, waitExited, start)
 		return errors.New("no active run")
 	}
+	sub := s.watchSegment(filename, file)
+	defer sub.Close()
 	deadline := time.After(timeout)
-	ticker := time.NewTicker(200 * time.Millisecond)
+	ticker := time.NewTicker(sub.pollInterval(200 * time.Millisecond))
 	defer ticker.Stop()
 
 	for {
-		if info, err := os.Stat(filePath); err == nil && info.Size() > 0 {
+		run := s.currentRun()
+		if ready(filename) {
+			s.segmentReady(start, run)
 			return nil
 		}
 
 		// Don't wait forever if FFmpeg exited
 		if !s.IsRunning() {
-			if info, err := os.Stat(filePath); err == nil && info.Size() > 0 {
+			if ready(filename) {
+				s.segmentReady(start, run)
 				return nil
 			}
+			observeWait(segmentWait, waitExited, start)
 			return errors.Errorf("ffmpeg exited, segment %s not available", filename)
 		}
 
 		select {
+		case <-sub.C:
 		case <-ticker.C:
 		case <-deadline:
+			observeWait(segmentWait, waitTimeout, start)
 			return errors.Errorf("timeout waiting for segment %s", filename)
 		case <-ctx.Done():
+			observeWait(segmentWait, waitCanceled, start)
 			return ctx.Err()
 		}
 	}
 }
+
+// segmentReady records a segment wait that started at start, and the time
+// to the first segment after a start or seek if the segment is of the run
+// acquired for it. Segments of a previous run do not end the wait.
+func (s *Session) segmentReady(start time.Time, run *TranscodeRun) {
+	observeWait(segmentWait, waitReady, start)
+	s.mu.Lock()
+	seekedAt := s.seekedAt
+	current := run != nil && run == s.run
+	if current {
+		s.seekedAt = time.Time{}
+	}
+	s.mu.Unlock()
+	if current && !seekedAt.IsZero() {
+		seekFirstSegment.Observe(time.Since(seekedAt).Seconds())
+	}
+}
@@ -1,14 +1,19 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Defaults of the session timings, see session_timings.go.
 const (
 	sessionInactivityRelease = 60 * time.Second // release run after 60s inactivity
 	sessionInactivityExpiry  = 10 * time.Minute  // remove session after 10min inactivity
@@ -22,40 +27,83 @@ type SessionManager struct {
 	runMgr   *RunManager
 	done     chan struct{}
 	closed   bool
+	// detached is set while sessions are handed over to a new process
+	detached bool
+
+	// store persists sessions for other replicas, nil keeps them local
+	store SessionStore
+	// loads are the store loads in flight by session ID
+	loadMu sync.Mutex
+	loads  map[string]*sessionLoad
+
+	// quota limits sessions and runs per viewer, nil is unlimited
+	quota *Quota
 }
 
-func NewSessionManager(runMgr *RunManager) *SessionManager {
+func NewSessionManager(runMgr *RunManager, store SessionStore, quota *Quota) *SessionManager {
 	m := &SessionManager{
 		sessions: make(map[string]*Session),
 		runMgr:   runMgr,
 		done:     make(chan struct{}),
+		store:    store,
+		loads:    make(map[string]*sessionLoad),
+		quota:    quota,
 	}
 	go m.reaper()
 	return m
 }
 
-// Create creates a new session and returns it.
-func (m *SessionManager) Create(cfg SessionConfig) *Session {
+// Create creates a new session and returns it. It fails with a QuotaError
+// if the viewer has too many sessions, unless the quota policy evicts the
+// viewer's oldest sessions, or if the subject has cfg.MaxSessions.
+func (m *SessionManager) Create(cfg SessionConfig) (*Session, error) {
 	if cfg.ID == "" {
 		b := make([]byte, 16)
 		_, _ = rand.Read(b)
 		cfg.ID = hex.EncodeToString(b)
 	}
 	cfg.RunMgr = m.runMgr
+	cfg.Quota = m.quota
 
 	s := NewSession(cfg)
 
 	m.mu.Lock()
+	if cfg.MaxSessions > 0 && m.subjectSessionsLocked(cfg.Subject) >= cfg.MaxSessions {
+		m.mu.Unlock()
+		return nil, &QuotaError{Resource: "sessions", Max: cfg.MaxSessions}
+	}
+	// Viewer sessions are evicted only once the session is admitted
+	evict, err := m.quota.addSession(cfg.QuotaID, cfg.ID)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
 	m.sessions[s.id] = s
 	m.mu.Unlock()
 
+	for _, id := range evict {
+		log.WithField("sessionID", id).Info("sessionManager: evicting oldest session of viewer over quota")
+		m.Close(id)
+	}
+
 	log.WithFields(log.Fields{
 		"sessionID": s.id,
 		"sourceURL": s.sourceURL,
 		"duration":  s.duration,
 	}).Info("sessionManager: created session")
 
-	return s
+	return s, nil
+}
+
+// subjectSessionsLocked returns the number of sessions of a subject.
+func (m *SessionManager) subjectSessionsLocked(subject string) int {
+	n := 0
+	for _, s := range m.sessions {
+		if s.subject == subject {
+			n++
+		}
+	}
+	return n
 }
 
 // Get returns a session by ID, or nil if not found.
@@ -65,6 +113,226 @@ func (m *SessionManager) Get(id string) *Session {
 	return m.sessions[id]
 }
 
+// Lookup returns a session by ID, or nil if not found. With a session store,
+// sessions created on other replicas are loaded and sessions held here
+// follow changes made elsewhere, e.g. seeks.
+func (m *SessionManager) Lookup(ctx context.Context, id string) *Session {
+	s := m.Get(id)
+	if m.store == nil {
+		return s
+	}
+	if s != nil {
+		s.mu.Lock()
+		synced := time.Since(s.synced) < sessionStoreSyncInterval
+		s.mu.Unlock()
+		if synced {
+			return s
+		}
+	}
+
+	m.loadMu.Lock()
+	if l, ok := m.loads[id]; ok {
+		m.loadMu.Unlock()
+		if s != nil {
+			// Served as it is while another request resyncs it
+			return s
+		}
+		select {
+		case <-l.done:
+			return l.s
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	l := &sessionLoad{done: make(chan struct{})}
+	m.loads[id] = l
+	m.loadMu.Unlock()
+	defer func() {
+		m.loadMu.Lock()
+		delete(m.loads, id)
+		m.loadMu.Unlock()
+		close(l.done)
+	}()
+
+	if s == nil {
+		// Loaded by a concurrent request meanwhile
+		s = m.Get(id)
+	}
+	// Shared with concurrent lookups, so not ended by this request
+	l.s = m.load(context.WithoutCancel(ctx), id, s)
+	return l.s
+}
+
+// sessionLoad is a session store load shared by concurrent lookups.
+type sessionLoad struct {
+	done chan struct{}
+	s    *Session
+}
+
+// load reads a session from the store, rehydrating it if it is not held
+// here, or resyncing s.
+func (m *SessionManager) load(ctx context.Context, id string, s *Session) *Session {
+	ctx, cancel := context.WithTimeout(ctx, sessionStoreTimeout)
+	defer cancel()
+	rec, err := m.store.Load(ctx, id)
+	if err != nil {
+		log.WithError(err).WithField("sessionID", id).Warn("sessionManager: failed to load session")
+		return s
+	}
+	if rec == nil {
+		if s != nil {
+			// Closed on another replica
+			m.drop(id)
+		}
+		return nil
+	}
+	if s == nil {
+		s, err = m.rehydrate(rec)
+		if err != nil {
+			log.WithError(err).WithField("sessionID", id).Error("sessionManager: failed to rehydrate session")
+			return nil
+		}
+		return s
+	}
+	if s.timings.quantize(rec.SeekTime) != s.SeekTime() {
+		if err := s.Seek(rec.SeekTime); err != nil {
+			s.logger.WithError(err).Warn("sessionManager: failed to follow stored seek")
+		}
+	}
+	s.mu.Lock()
+	s.synced = time.Now()
+	s.mu.Unlock()
+	return s
+}
+
+// rehydrate creates a session from its stored record and acquires a run at
+// its seek position.
+func (m *SessionManager) rehydrate(rec *sessionRecord) (*Session, error) {
+	h := rec.Job.handoverHLS()
+	if h == nil {
+		return nil, errors.New("stored session has no HLS layout")
+	}
+	s := NewSession(SessionConfig{
+		ID:        rec.ID,
+		SourceURL: rec.SourceURL,
+		HashDir:   rec.HashDir,
+		HLS:       h,
+		Duration:  rec.Duration,
+		RunMgr:    m.runMgr,
+
+		PositionKey: rec.PositionKey,
+		QuotaID:     rec.QuotaID,
+		Quota:       m.quota,
+		Timings:     rec.Timings,
+		Subject:     rec.Subject,
+		Deadline:    rec.Deadline,
+	})
+	// The master playlist is missing unless the output is shared
+	if _, err := os.Stat(filepath.Join(s.outputDir, "index.m3u8")); err != nil {
+		if err := os.MkdirAll(s.outputDir, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create session dir")
+		}
+		if err := h.MakeMasterPlaylist(s.outputDir); err != nil {
+			return nil, errors.Wrap(err, "failed to create master playlist")
+		}
+	}
+	// Counted without checks, the session was admitted when it was created
+	m.quota.adopt(s.quotaID, s.id, "")
+	if err := s.Start(rec.SeekTime); err != nil {
+		m.quota.removeSession(s.quotaID, s.id)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.stored = s.lastAccess
+	s.synced = time.Now()
+	s.mu.Unlock()
+
+	m.mu.Lock()
+	m.sessions[s.id] = s
+	m.mu.Unlock()
+
+	s.logger.WithField("seekTime", rec.SeekTime).Info("sessionManager: rehydrated session")
+	return s, nil
+}
+
+// Save writes the session to the session store, if any.
+func (m *SessionManager) Save(s *Session) {
+	if m.store == nil {
+		return
+	}
+	s.mu.Lock()
+	access := s.lastAccess
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	if err := m.store.Save(ctx, s.record()); err != nil {
+		s.logger.WithError(err).Warn("sessionManager: failed to save session")
+		return
+	}
+	s.mu.Lock()
+	s.stored = access
+	s.synced = time.Now()
+	s.mu.Unlock()
+}
+
+// touchAccessed extends the expiry of stored sessions accessed since they
+// were last saved. Records are not rewritten, so a seek made on another
+// replica is not overwritten.
+func (m *SessionManager) touchAccessed() {
+	if m.store == nil {
+		return
+	}
+	m.mu.Lock()
+	var toTouch []*Session
+	for _, s := range m.sessions {
+		s.mu.Lock()
+		if s.lastAccess.After(s.stored) {
+			toTouch = append(toTouch, s)
+		}
+		s.mu.Unlock()
+	}
+	m.mu.Unlock()
+
+	for _, s := range toTouch {
+		m.touch(s)
+	}
+}
+
+func (m *SessionManager) touch(s *Session) {
+	s.mu.Lock()
+	access := s.lastAccess
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	ok, err := m.store.Touch(ctx, s.id, s.timings.expireAfter())
+	if err != nil {
+		s.logger.WithError(err).Warn("sessionManager: failed to touch stored session")
+		return
+	}
+	if !ok {
+		// Expired in the store while idle, e.g. saving failed before
+		m.Save(s)
+		return
+	}
+	s.mu.Lock()
+	s.stored = access
+	s.mu.Unlock()
+}
+
+// ActiveSessions returns the number of sessions accessed within their
+// inactivity release period, i.e. sessions that are still playing.
+func (m *SessionManager) ActiveSessions() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, s := range m.sessions {
+		if time.Since(s.LastAccess()) <= s.timings.releaseAfter() {
+			n++
+		}
+	}
+	return n
+}
+
 // Close removes and cleans up a specific session.
 func (m *SessionManager) Close(id string) {
 	m.mu.Lock()
@@ -78,6 +346,30 @@ func (m *SessionManager) Close(id string) {
 		s.Close()
 		log.WithField("sessionID", id).Info("sessionManager: closed session")
 	}
+
+	if m.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+		defer cancel()
+		if err := m.store.Delete(ctx, id); err != nil {
+			log.WithError(err).WithField("sessionID", id).Warn("sessionManager: failed to delete stored session")
+		}
+	}
+}
+
+// drop removes a session from this node only. It stays in the session
+// store, together with its master playlist, for other replicas.
+func (m *SessionManager) drop(id string) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	if ok {
+		delete(m.sessions, id)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		s.close(false)
+		log.WithField("sessionID", id).Info("sessionManager: dropped session")
+	}
 }
 
 // CloseAll stops all sessions and the reaper.
@@ -89,6 +381,12 @@ func (m *SessionManager) CloseAll() {
 	}
 	m.closed = true
 	close(m.done)
+	if m.detached {
+		// Sessions belong to the process that took over
+		m.mu.Unlock()
+		log.Info("sessionManager: closed, sessions handed over")
+		return
+	}
 
 	sessions := make(map[string]*Session, len(m.sessions))
 	for k, v := range m.sessions {
@@ -97,8 +395,9 @@ func (m *SessionManager) CloseAll() {
 	m.sessions = make(map[string]*Session)
 	m.mu.Unlock()
 
+	// Stored sessions outlive this process
 	for _, s := range sessions {
-		s.Close()
+		s.close(m.store == nil)
 	}
 
 	log.Info("sessionManager: closed all sessions")
@@ -114,7 +413,10 @@ func (m *SessionManager) reaper() {
 		case <-m.done:
 			return
 		case <-ticker.C:
-			m.checkInactivity()
+			if !m.isDetached() {
+				m.checkInactivity()
+				m.touchAccessed()
+			}
 		}
 	}
 }
@@ -124,16 +426,27 @@ func (m *SessionManager) checkInactivity() {
 	m.mu.Lock()
 	var toRelease []*Session
 	var toRemove []string
+	var toClose []string
 	for id, s := range m.sessions {
+		// Closed everywhere, the lifetime limit holds on all replicas
+		if s.pastDeadline() {
+			toClose = append(toClose, id)
+			continue
+		}
+
 		lastAccess := s.LastAccess()
 		idle := time.Since(lastAccess)
 
-		if idle > sessionInactivityExpiry {
+		if idle > s.timings.expireAfter() {
 			toRemove = append(toRemove, id)
 			continue
 		}
 
-		if idle > sessionInactivityRelease && s.IsRunning() {
+		if idle > s.timings.expireAfter()-s.timings.expiryWarning() {
+			s.warnExpiry(lastAccess)
+		}
+
+		if idle > s.timings.releaseAfter() && s.IsRunning() {
 			toRelease = append(toRelease, s)
 		}
 	}
@@ -144,7 +457,18 @@ func (m *SessionManager) checkInactivity() {
 		s.Stop()
 	}
 
-	for _, id := range toRemove {
+	for _, id := range toClose {
+		log.WithField("sessionID", id).Info("sessionManager: closing session past its lifetime")
 		m.Close(id)
 	}
+
+	// Stored sessions may be played on another replica, the store expires
+	// them
+	for _, id := range toRemove {
+		if m.store != nil {
+			m.drop(id)
+		} else {
+			m.Close(id)
+		}
+	}
 }
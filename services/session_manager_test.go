@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -8,8 +9,8 @@ import (
 
 func newTestManager(t *testing.T) (*SessionManager, *RunManager) {
 	t.Helper()
-	rm := NewRunManager()
-	sm := NewSessionManager(rm)
+	rm := NewRunManager(RunManagerConfig{})
+	sm := NewSessionManager(rm, nil, nil)
 	t.Cleanup(func() {
 		sm.CloseAll()
 		rm.CloseAll()
@@ -21,7 +22,7 @@ func TestSessionManagerCreateAndGet(t *testing.T) {
 	m, _ := newTestManager(t)
 
 	dir := t.TempDir()
-	s := m.Create(SessionConfig{
+	s, _ := m.Create(SessionConfig{
 		ID:        "sess-1",
 		SourceURL: "http://example.com/v.mkv",
 		HashDir:   dir,
@@ -49,7 +50,7 @@ func TestSessionManagerAutoID(t *testing.T) {
 	m, _ := newTestManager(t)
 
 	dir := t.TempDir()
-	s := m.Create(SessionConfig{
+	s, _ := m.Create(SessionConfig{
 		SourceURL: "http://example.com/v.mkv",
 		HashDir:   dir,
 	})
@@ -66,7 +67,7 @@ func TestSessionManagerClose(t *testing.T) {
 	m, _ := newTestManager(t)
 
 	dir := t.TempDir()
-	s := m.Create(SessionConfig{ID: "sess-close", HashDir: dir})
+	s, _ := m.Create(SessionConfig{ID: "sess-close", HashDir: dir})
 
 	m.Close("sess-close")
 
@@ -82,13 +83,13 @@ func TestSessionManagerClose(t *testing.T) {
 }
 
 func TestSessionManagerCloseAll(t *testing.T) {
-	rm := NewRunManager()
-	m := NewSessionManager(rm)
+	rm := NewRunManager(RunManagerConfig{})
+	m := NewSessionManager(rm, nil, nil)
 
 	dir := t.TempDir()
-	s1 := m.Create(SessionConfig{ID: "s1", HashDir: dir})
-	s2 := m.Create(SessionConfig{ID: "s2", HashDir: dir})
-	s3 := m.Create(SessionConfig{ID: "s3", HashDir: dir})
+	s1, _ := m.Create(SessionConfig{ID: "s1", HashDir: dir})
+	s2, _ := m.Create(SessionConfig{ID: "s2", HashDir: dir})
+	s3, _ := m.Create(SessionConfig{ID: "s3", HashDir: dir})
 
 	m.CloseAll()
 	rm.CloseAll()
@@ -113,7 +114,7 @@ func TestSessionManagerConcurrentCreate(t *testing.T) {
 		wg.Add(1)
 		go func(idx int) {
 			defer wg.Done()
-			sessions[idx] = m.Create(SessionConfig{
+			sessions[idx], _ = m.Create(SessionConfig{
 				SourceURL: "http://example.com/v.mkv",
 				HashDir:   dir,
 			})
@@ -148,7 +149,7 @@ func TestSessionManagerConcurrentCreateAndClose(t *testing.T) {
 		wg.Add(1)
 		go func(idx int) {
 			defer wg.Done()
-			sessions[idx] = m.Create(SessionConfig{HashDir: dir})
+			sessions[idx], _ = m.Create(SessionConfig{HashDir: dir})
 		}(i)
 	}
 	wg.Wait()
@@ -182,15 +183,15 @@ func TestSessionManagerConcurrentCreateAndClose(t *testing.T) {
 }
 
 func TestSessionManagerManySessionsStress(t *testing.T) {
-	rm := NewRunManager()
-	m := NewSessionManager(rm)
+	rm := NewRunManager(RunManagerConfig{})
+	m := NewSessionManager(rm, nil, nil)
 
 	dir := t.TempDir()
 	const n = 100
 	sessions := make([]*Session, n)
 
 	for i := 0; i < n; i++ {
-		sessions[i] = m.Create(SessionConfig{HashDir: dir})
+		sessions[i], _ = m.Create(SessionConfig{HashDir: dir})
 	}
 
 	for i, s := range sessions {
@@ -211,7 +212,7 @@ func TestSessionManagerManySessionsStress(t *testing.T) {
 
 func TestSessionTouchAndLastAccess(t *testing.T) {
 	dir := t.TempDir()
-	rm := NewRunManager()
+	rm := NewRunManager(RunManagerConfig{})
 	defer rm.CloseAll()
 
 	s := NewSession(SessionConfig{ID: "test-touch", HashDir: dir, RunMgr: rm})
@@ -225,3 +226,83 @@ func TestSessionTouchAndLastAccess(t *testing.T) {
 		t.Error("Touch should update lastAccess")
 	}
 }
+
+func newTestPrewarmManager(t *testing.T, cfg RunManagerConfig) (*SessionManager, *RunManager, *HLS) {
+	t.Helper()
+	cfg.Prewarm = true
+	cfg.Transcoder = &SimulatedTranscoder{SegmentInterval: 50 * time.Millisecond}
+	rm := NewRunManager(cfg)
+	sm := NewSessionManager(rm, nil, nil)
+	t.Cleanup(func() {
+		sm.CloseAll()
+		rm.CloseAll()
+	})
+	pr, err := (&SimulatedProber{}).Probe(context.Background(), "sim://host/movie.mkv?duration=600", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm, rm, NewHLS("sim://host/movie.mkv", pr, &HLSConfig{aacCodec: "aac"})
+}
+
+func TestSessionManagerPrewarmForwardSeeks(t *testing.T) {
+	m, rm, h := newTestPrewarmManager(t, RunManagerConfig{PrewarmMaxRuns: 1, PrewarmMaxLoad: 4})
+	dir := t.TempDir()
+	s, _ := m.Create(SessionConfig{SourceURL: "sim://host/movie.mkv", HashDir: dir, HLS: h, Duration: 600})
+
+	if err := s.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	for _, seek := range []float64{30, 60} {
+		if err := s.Seek(seek); err != nil {
+			t.Fatal(err)
+		}
+		m.Prewarm(s)
+	}
+	st := rm.Stats()
+	if st.PrewarmStarted != 1 || st.Speculative != 1 {
+		t.Fatalf("expected one speculative run after seeking in 30s steps, got %+v", st)
+	}
+	if _, ok := rm.runs[runKey(dir, 90)]; !ok {
+		t.Fatal("speculative run should start at the next step")
+	}
+
+	if err := s.Seek(90); err != nil {
+		t.Fatal(err)
+	}
+	if st := rm.Stats(); st.PrewarmHits != 1 {
+		t.Errorf("seeking to the prewarmed position should reuse it, got %+v", st)
+	}
+}
+
+func TestSessionManagerPrewarmReclaim(t *testing.T) {
+	m, rm, h := newTestPrewarmManager(t, RunManagerConfig{PrewarmMaxRuns: 1, PrewarmMaxLoad: 2})
+	dir := t.TempDir()
+	s, _ := m.Create(SessionConfig{SourceURL: "sim://host/movie.mkv", HashDir: dir, HLS: h, Duration: 600})
+	if err := s.Start(300); err != nil {
+		t.Fatal(err)
+	}
+
+	// Playhead nearing a later idle run of the same content
+	next, err := rm.Acquire(dir, 360, "sim://host/movie.mkv", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Stop()
+	rm.Release(next)
+	s.ReportSegment(8)
+	m.Prewarm(s)
+	if st := rm.Stats(); st.Speculative != 1 || !next.IsRunning() {
+		t.Fatalf("next run should be prewarmed, got %+v", st)
+	}
+
+	// A session's run at the load limit reclaims the speculative run
+	other, err := rm.Acquire(dir, 0, "sim://host/movie.mkv", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Release(other)
+	st := rm.Stats()
+	if st.PrewarmReclaimed != 1 || st.Speculative != 0 || next.IsRunning() {
+		t.Errorf("speculative run should be reclaimed first, got %+v", st)
+	}
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/urfave/cli"
+	cs "github.com/webtor-io/common-services"
+)
+
+const (
+	SessionStoreFlag       = "session-store"
+	SessionStoreSecretFlag = "session-store-secret"
+)
+
+const (
+	sessionStoreRedis     = "redis"
+	sessionStoreKeyPrefix = "content-transcoder:session:"
+	sessionStoreTimeout   = 2 * time.Second
+	// sessionStoreSyncInterval limits how often a replica rereads a session
+	// it already holds, e.g. to follow a seek made on another replica.
+	sessionStoreSyncInterval = time.Second
+)
+
+func RegisterSessionStoreFlags(f []cli.Flag) []cli.Flag {
+	f = append(f, cli.StringFlag{
+		Name:   SessionStoreFlag,
+		Usage:  "persist sessions so any replica can serve them (redis), empty keeps sessions in memory of the node that created them",
+		Value:  "",
+		EnvVar: "SESSION_STORE",
+	}, cli.StringFlag{
+		Name:   SessionStoreSecretFlag,
+		Usage:  "secret encrypting source headers in the session store, empty keeps them out of the store",
+		Value:  "",
+		EnvVar: "SESSION_STORE_SECRET",
+	})
+	return cs.RegisterRedisClientFlags(f)
+}
+
+// sessionRecord is the state any replica needs to serve a session. The HLS
+// layout (probe, stream mode, source headers) is stored instead of the
+// selected streams, it rebuilds them deterministically. Source headers are
+// not stored in the clear, see sealSessionRecord.
+type sessionRecord struct {
+	ID        string     `json:"id"`
+	SourceURL string     `json:"source_url"`
+	HashDir   string     `json:"hash_dir"`
+	Job       *workerJob `json:"job,omitempty"`
+	Duration  float64    `json:"duration"`
+	SeekTime  float64    `json:"seek_time"`
+
+	PositionKey string         `json:"position_key,omitempty"`
+	QuotaID     string         `json:"quota_id,omitempty"`
+	Timings     SessionTimings `json:"timings"`
+	Subject     string         `json:"subject,omitempty"`
+	Deadline    time.Time      `json:"deadline,omitzero"`
+
+	// SealedHeaders are the source headers encrypted with the store secret
+	SealedHeaders string `json:"sealed_headers,omitempty"`
+	// HeadersOmitted is set if the session has source headers that were
+	// not stored for lack of a secret
+	HeadersOmitted bool `json:"headers_omitted,omitempty"`
+}
+
+// sealSessionRecord encodes rec with its source headers encrypted with
+// secret, or left out without a secret.
+func sealSessionRecord(rec *sessionRecord, secret []byte) ([]byte, error) {
+	if rec.Job != nil && len(rec.Job.SourceHeaders) > 0 {
+		headers := rec.Job.SourceHeaders
+		job := *rec.Job
+		job.SourceHeaders = nil
+		sealed := *rec
+		sealed.Job = &job
+		if len(secret) == 0 {
+			sealed.HeadersOmitted = true
+		} else {
+			var err error
+			if sealed.SealedHeaders, err = sealHeaders(secret, rec.ID, headers); err != nil {
+				return nil, err
+			}
+		}
+		rec = &sealed
+	}
+	return json.Marshal(rec)
+}
+
+// openSessionRecord decodes a record encoded by sealSessionRecord.
+func openSessionRecord(data []byte, secret []byte) (*sessionRecord, error) {
+	rec := &sessionRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, errors.Wrap(err, "failed to decode session")
+	}
+	if rec.HeadersOmitted {
+		return nil, errors.Errorf("source headers of the session are not stored without --%s", SessionStoreSecretFlag)
+	}
+	if rec.SealedHeaders != "" && rec.Job != nil {
+		headers, err := openHeaders(secret, rec.ID, rec.SealedHeaders)
+		if err != nil {
+			return nil, err
+		}
+		rec.Job.SourceHeaders = headers
+		rec.SealedHeaders = ""
+	}
+	return rec, nil
+}
+
+func sessionStoreCipher(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealHeaders encrypts headers bound to the session ID.
+func sealHeaders(secret []byte, id string, headers http.Header) (string, error) {
+	aead, err := sessionStoreCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(headers)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(id))), nil
+}
+
+func openHeaders(secret []byte, id string, sealed string) (http.Header, error) {
+	if len(secret) == 0 {
+		return nil, errors.Errorf("source headers of the session are encrypted, --%s is not set", SessionStoreSecretFlag)
+	}
+	aead, err := sessionStoreCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errors.New("malformed source headers")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, errors.New("failed to decrypt source headers")
+	}
+	var headers http.Header
+	if err := json.Unmarshal(plain, &headers); err != nil {
+		return nil, errors.Wrap(err, "malformed source headers")
+	}
+	return headers, nil
+}
+
+// SessionStore persists sessions beyond the node that created them.
+// Records expire after the session's inactivity expiry unless saved again.
+type SessionStore interface {
+	Save(ctx context.Context, rec *sessionRecord) error
+	// Load returns nil if the session is not stored.
+	Load(ctx context.Context, id string) (*sessionRecord, error)
+	// Touch extends the expiry of a stored session, returns false if the
+	// session is not stored.
+	Touch(ctx context.Context, id string, expiry time.Duration) (bool, error)
+	Delete(ctx context.Context, id string) error
+	Close()
+}
+
+// NewSessionStore returns the configured session store, or nil if sessions
+// are kept in memory only.
+func NewSessionStore(c *cli.Context) (SessionStore, error) {
+	switch c.String(SessionStoreFlag) {
+	case "":
+		return nil, nil
+	case sessionStoreRedis:
+		return newRedisSessionStore(cs.NewRedisClient(c), []byte(c.String(SessionStoreSecretFlag))), nil
+	default:
+		return nil, errors.Errorf("unknown session store %q", c.String(SessionStoreFlag))
+	}
+}
+
+type redisSessionStore struct {
+	cl     *cs.RedisClient
+	secret []byte
+}
+
+func newRedisSessionStore(cl *cs.RedisClient, secret []byte) *redisSessionStore {
+	return &redisSessionStore{cl: cl, secret: secret}
+}
+
+func (s *redisSessionStore) Save(ctx context.Context, rec *sessionRecord) error {
+	data, err := sealSessionRecord(rec, s.secret)
+	if err != nil {
+		return err
+	}
+	return s.cl.Get().Set(ctx, sessionStoreKeyPrefix+rec.ID, data, rec.Timings.withDefaults().expireAfter()).Err()
+}
+
+func (s *redisSessionStore) Load(ctx context.Context, id string) (*sessionRecord, error) {
+	data, err := s.cl.Get().Get(ctx, sessionStoreKeyPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openSessionRecord(data, s.secret)
+}
+
+func (s *redisSessionStore) Touch(ctx context.Context, id string, expiry time.Duration) (bool, error) {
+	return s.cl.Get().Expire(ctx, sessionStoreKeyPrefix+id, expiry).Result()
+}
+
+func (s *redisSessionStore) Delete(ctx context.Context, id string) error {
+	return s.cl.Get().Del(ctx, sessionStoreKeyPrefix+id).Err()
+}
+
+func (s *redisSessionStore) Close() {
+	s.cl.Close()
+}
+
+// memorySessionStore keeps records in memory. It stands in for Redis in
+// tests, replicas sharing it share sessions.
+type memorySessionStore struct {
+	mu      sync.Mutex
+	records map[string][]byte
+	secret  []byte
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{records: make(map[string][]byte)}
+}
+
+func (s *memorySessionStore) Save(_ context.Context, rec *sessionRecord) error {
+	data, err := sealSessionRecord(rec, s.secret)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.ID] = data
+	return nil
+}
+
+func (s *memorySessionStore) Load(_ context.Context, id string) (*sessionRecord, error) {
+	s.mu.Lock()
+	data, ok := s.records[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return openSessionRecord(data, s.secret)
+}
+
+func (s *memorySessionStore) Touch(_ context.Context, id string, _ time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.records[id]
+	return ok, nil
+}
+
+func (s *memorySessionStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+func (s *memorySessionStore) Close() {}
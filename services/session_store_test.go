@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveTestRequest(web *Web, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	web.handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestWebSessionStoreReplicas(t *testing.T) {
+	store := newMemorySessionStore()
+	a := newSimulatedWebWithStore(t, store)
+	b := newSimulatedWebWithStore(t, store)
+
+	w := serveTestRequest(a, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=200"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica b rehydrates the session created on a
+	w = serveTestRequest(b, http.MethodGet, "/session/"+resp.ID+"/v0-720.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720-0.ts") {
+		t.Fatalf("variant on other replica: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	sb := b.sessionManager.Get(resp.ID)
+	if sb == nil || sb.sourceURL != "sim://host/movie.mkv?duration=200" || len(sb.h.Streams()) == 0 {
+		t.Fatal("rehydrated session should have source URL and streams")
+	}
+
+	// Master playlist is recreated if the output is not shared
+	if err := os.RemoveAll(sb.outputDir); err != nil {
+		t.Fatal(err)
+	}
+	b.sessionManager.drop(resp.ID)
+	w = serveTestRequest(b, http.MethodGet, "/session/"+resp.ID+"/index.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720.m3u8") {
+		t.Fatalf("master on other replica: status = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	// A seek on b is followed by a
+	w = serveTestRequest(b, http.MethodPost, "/session/"+resp.ID+"/seek?t=65")
+	if w.Code != http.StatusOK {
+		t.Fatalf("seek: status = %d", w.Code)
+	}
+	sa := a.sessionManager.Get(resp.ID)
+	sa.mu.Lock()
+	sa.synced = sa.synced.Add(-sessionStoreSyncInterval)
+	sa.mu.Unlock()
+	w = serveTestRequest(a, http.MethodGet, "/session/"+resp.ID+"/seek")
+	if !strings.Contains(w.Body.String(), `"offset":60.000`) {
+		t.Errorf("seek on other replica should be followed, got %s", w.Body.String())
+	}
+
+	// Shutting a replica down keeps stored sessions
+	a.sessionManager.CloseAll()
+	if _, err := os.Stat(filepath.Join(sa.outputDir, "index.m3u8")); err != nil {
+		t.Error("master playlist of a stored session should be kept")
+	}
+	if rec, _ := store.Load(context.Background(), resp.ID); rec == nil || rec.SeekTime != 60 {
+		t.Fatalf("stored session should survive shutdown, got %+v", rec)
+	}
+
+	// Closing on b removes the session everywhere
+	w = serveTestRequest(b, http.MethodDelete, "/session/"+resp.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("close: status = %d", w.Code)
+	}
+	c := newSimulatedWebWithStore(t, store)
+	if w := serveTestRequest(c, http.MethodGet, "/session/"+resp.ID+"/index.m3u8"); w.Code != http.StatusNotFound {
+		t.Errorf("closed session: status = %d, want 404", w.Code)
+	}
+}
+
+func TestSessionManagerExpiryKeepsStoredSession(t *testing.T) {
+	store := newMemorySessionStore()
+	rm := NewRunManager(RunManagerConfig{})
+	m := NewSessionManager(rm, store, nil)
+	t.Cleanup(func() {
+		m.CloseAll()
+		rm.CloseAll()
+	})
+
+	s, _ := m.Create(SessionConfig{ID: "s1", HashDir: t.TempDir()})
+	m.Save(s)
+	s.mu.Lock()
+	s.lastAccess = s.lastAccess.Add(-2 * sessionInactivityExpiry)
+	s.mu.Unlock()
+	m.checkInactivity()
+
+	if m.Get("s1") != nil {
+		t.Error("expired session should be dropped from the node")
+	}
+	// May still play on another replica, the store expires it
+	if rec, _ := store.Load(context.Background(), "s1"); rec == nil {
+		t.Error("expired session should stay in the store")
+	}
+}
+
+func TestSessionRecordSourceHeaders(t *testing.T) {
+	rec := &sessionRecord{
+		ID:  "s1",
+		Job: &workerJob{SourceURL: "http://host/movie.mkv", SourceHeaders: http.Header{"Authorization": {"Bearer secret"}}},
+	}
+	secret := []byte("store-secret")
+	data, err := sealSessionRecord(rec, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Bearer secret") {
+		t.Errorf("stored record leaks source headers: %s", data)
+	}
+	if rec.Job.SourceHeaders == nil {
+		t.Error("sealing should not change the session's record")
+	}
+	got, err := openSessionRecord(data, secret)
+	if err != nil || got.Job.SourceHeaders.Get("Authorization") != "Bearer secret" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if _, err := openSessionRecord(data, []byte("other")); err == nil {
+		t.Error("record should not open with another secret")
+	}
+	// Sealed headers are bound to the session
+	var moved sessionRecord
+	_ = json.Unmarshal(data, &moved)
+	moved.ID = "s2"
+	movedData, _ := json.Marshal(moved)
+	if _, err := openSessionRecord(movedData, secret); err == nil {
+		t.Error("headers of another session should not open")
+	}
+
+	data, err = sealSessionRecord(rec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Bearer secret") {
+		t.Errorf("record without secret leaks source headers: %s", data)
+	}
+	if _, err := openSessionRecord(data, nil); err == nil {
+		t.Error("record without its source headers should not be served")
+	}
+}
+
+// blockingSessionStore blocks loads until unblocked.
+type blockingSessionStore struct {
+	*memorySessionStore
+	block chan struct{}
+	loads atomic.Int32
+}
+
+func (s *blockingSessionStore) Load(ctx context.Context, id string) (*sessionRecord, error) {
+	s.loads.Add(1)
+	<-s.block
+	return s.memorySessionStore.Load(ctx, id)
+}
+
+func TestSessionManagerLookupDoesNotBlockOnLoads(t *testing.T) {
+	store := &blockingSessionStore{memorySessionStore: newMemorySessionStore(), block: make(chan struct{})}
+	rm := NewRunManager(RunManagerConfig{})
+	m := NewSessionManager(rm, store, nil)
+	t.Cleanup(func() {
+		m.CloseAll()
+		rm.CloseAll()
+	})
+	s, _ := m.Create(SessionConfig{ID: "s1", HashDir: t.TempDir()})
+	m.Save(s)
+	s.mu.Lock()
+	s.synced = time.Time{}
+	s.mu.Unlock()
+
+	// A resync of s1 waiting for the store
+	done := make(chan *Session)
+	go func() {
+		done <- m.Lookup(context.Background(), "s1")
+	}()
+	for store.loads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	lookup := make(chan *Session)
+	go func() {
+		lookup <- m.Lookup(context.Background(), "s1")
+	}()
+	select {
+	case got := <-lookup:
+		if got != s {
+			t.Errorf("got %v, want the held session", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup of a held session should not wait for a load in flight")
+	}
+
+	// Loads of a session not held here are shared
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go m.Lookup(context.Background(), "s2")
+	for store.loads.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := m.Lookup(ctx, "s2"); got != nil || store.loads.Load() != 2 {
+		t.Errorf("lookup waiting for a shared load: got %v, %d loads", got, store.loads.Load())
+	}
+
+	close(store.block)
+	if got := <-done; got != s {
+		t.Errorf("resync: got %v, want the held session", got)
+	}
+}
@@ -25,7 +25,7 @@ func TestQuantizeSeekTime(t *testing.T) {
 		{3292.87, 3270},   // near end of 55min video
 	}
 	for _, tt := range tests {
-		got := quantizeSeekTime(tt.input)
+		got := quantizeSeekTime(tt.input, seekQuantum)
 		if got != tt.want {
 			t.Errorf("quantizeSeekTime(%.1f): got %.1f, want %.1f", tt.input, got, tt.want)
 		}
@@ -141,7 +141,7 @@ func TestRemoveParam(t *testing.T) {
 
 func TestSessionLifecycle(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	s := NewSession(SessionConfig{
@@ -189,7 +189,7 @@ func TestSessionLifecycle(t *testing.T) {
 
 func TestPlaylistForStream(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	s := NewSession(SessionConfig{
@@ -233,7 +233,7 @@ func TestPlaylistForStream(t *testing.T) {
 
 func TestPlaylistForStream_SessionOffset(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	s := NewSession(SessionConfig{ID: "test-offset", HashDir: dir, RunMgr: runMgr})
@@ -264,7 +264,7 @@ func TestPlaylistForStream_SessionOffset(t *testing.T) {
 
 func TestPlaylistForStream_AlreadyHasType(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	s := NewSession(SessionConfig{ID: "test-playlist-type", HashDir: dir, RunMgr: runMgr})
@@ -338,7 +338,7 @@ func TestParseSegmentNumber(t *testing.T) {
 
 func TestSessionClosedOperations(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	s := NewSession(SessionConfig{ID: "test-closed-ops", HashDir: dir, RunMgr: runMgr})
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Session timings: the inactivity periods, run grace period, seek quantum
+// and segment duration have node-wide defaults. Sessions may override them
+// at creation within bounds set by the admin, e.g. mobile clients that
+// background the app for minutes ask for a longer inactivity expiry.
+
+const (
+	SessionInactivityReleaseFlag = "session-inactivity-release"
+	SessionInactivityExpiryFlag  = "session-inactivity-expiry"
+	RunGracePeriodFlag           = "run-grace-period"
+	SeekQuantumFlag              = "seek-quantum"
+	SegmentDurationFlag          = "segment-duration"
+	sessionTimingBoundsSuffix    = "-bounds"
+)
+
+// sessionTimingParams are the create request params and flags of the
+// timings sessions may override, in the order of SessionTimings.
+var sessionTimingParams = []struct {
+	param string
+	flag  string
+	env   string
+	usage string
+	value int
+}{
+	{"inactivity_release", SessionInactivityReleaseFlag, "SESSION_INACTIVITY_RELEASE", "release the run of a session after inactivity, in seconds", int(sessionInactivityRelease / time.Second)},
+	{"inactivity_expiry", SessionInactivityExpiryFlag, "SESSION_INACTIVITY_EXPIRY", "remove a session after inactivity, in seconds", int(sessionInactivityExpiry / time.Second)},
+	{"run_grace_period", RunGracePeriodFlag, "RUN_GRACE_PERIOD", "keep a run no session uses alive for reuse, in seconds", int(runGracePeriod / time.Second)},
+	{"seek_quantum", SeekQuantumFlag, "SEEK_QUANTUM", "granularity seek positions are rounded down to, in seconds", seekQuantum},
+	{"segment_duration", SegmentDurationFlag, "SEGMENT_DURATION", "duration of HLS segments, in seconds", sessionSegDuration},
+}
+
+func RegisterSessionTimingFlags(f []cli.Flag) []cli.Flag {
+	for _, p := range sessionTimingParams {
+		f = append(f, cli.IntFlag{
+			Name:   p.flag,
+			Usage:  p.usage,
+			Value:  p.value,
+			EnvVar: p.env,
+		}, cli.StringFlag{
+			Name:   p.flag + sessionTimingBoundsSuffix,
+			Usage:  fmt.Sprintf("range MIN-MAX in seconds sessions may set %s to on creation, empty disallows overrides", p.param),
+			Value:  "",
+			EnvVar: p.env + "_BOUNDS",
+		})
+	}
+	return f
+}
+
+// SessionTimings are the lifecycle timings of a session in seconds. Zero
+// fields use the built-in defaults.
+type SessionTimings struct {
+	InactivityRelease int `json:"inactivity_release"`
+	InactivityExpiry  int `json:"inactivity_expiry"`
+	RunGracePeriod    int `json:"run_grace_period"`
+	SeekQuantum       int `json:"seek_quantum"`
+	SegmentDuration   int `json:"segment_duration"`
+}
+
+func (t *SessionTimings) fields() []*int {
+	return []*int{&t.InactivityRelease, &t.InactivityExpiry, &t.RunGracePeriod, &t.SeekQuantum, &t.SegmentDuration}
+}
+
+// withDefaults fills zero fields with the built-in defaults.
+func (t SessionTimings) withDefaults() SessionTimings {
+	for i, f := range t.fields() {
+		if *f <= 0 {
+			*f = sessionTimingParams[i].value
+		}
+	}
+	return t
+}
+
+func (t SessionTimings) validate() error {
+	if t.InactivityExpiry <= t.InactivityRelease {
+		return errors.New("inactivity_expiry must be longer than inactivity_release")
+	}
+	return nil
+}
+
+func (t SessionTimings) releaseAfter() time.Duration {
+	return time.Duration(t.InactivityRelease) * time.Second
+}
+
+func (t SessionTimings) expireAfter() time.Duration {
+	return time.Duration(t.InactivityExpiry) * time.Second
+}
+
+// expiryWarning returns how long before expiry sessions are warned,
+// shortened for sessions expiring early.
+func (t SessionTimings) expiryWarning() time.Duration {
+	return min(sessionExpiryWarning, t.expireAfter()/2)
+}
+
+func (t SessionTimings) runGrace() time.Duration {
+	return time.Duration(t.RunGracePeriod) * time.Second
+}
+
+// quantize rounds seek time down to the nearest seek quantum boundary.
+func (t SessionTimings) quantize(seekTime float64) float64 {
+	return quantizeSeekTime(seekTime, float64(t.SeekQuantum))
+}
+
+type timingBounds struct {
+	min int
+	max int
+}
+
+func parseTimingBounds(s string) (*timingBounds, error) {
+	if s == "" {
+		return nil, nil
+	}
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, errors.Errorf("bounds %q are not MIN-MAX", s)
+	}
+	b := &timingBounds{}
+	var err error
+	if b.min, err = strconv.Atoi(lo); err != nil {
+		return nil, errors.Wrapf(err, "invalid bounds %q", s)
+	}
+	if b.max, err = strconv.Atoi(hi); err != nil {
+		return nil, errors.Wrapf(err, "invalid bounds %q", s)
+	}
+	if b.min <= 0 || b.min > b.max {
+		return nil, errors.Errorf("invalid bounds %q", s)
+	}
+	return b, nil
+}
+
+// SessionTimingConfig holds the default session timings and the bounds
+// sessions may override them within.
+type SessionTimingConfig struct {
+	Defaults SessionTimings
+	bounds   []*timingBounds // nil entries can not be overridden
+}
+
+func NewSessionTimingConfig(c *cli.Context) (*SessionTimingConfig, error) {
+	cfg := &SessionTimingConfig{}
+	for i, f := range cfg.Defaults.fields() {
+		p := sessionTimingParams[i]
+		*f = c.Int(p.flag)
+		if *f <= 0 {
+			return nil, errors.Errorf("%s must be positive", p.flag)
+		}
+		b, err := parseTimingBounds(c.String(p.flag + sessionTimingBoundsSuffix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", p.flag+sessionTimingBoundsSuffix)
+		}
+		cfg.bounds = append(cfg.bounds, b)
+	}
+	if err := cfg.Defaults.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// fromRequest returns the timings of a session created by the request: the
+// defaults with overrides from query params. Without config the built-in
+// defaults are used and nothing can be overridden.
+func (c *SessionTimingConfig) fromRequest(r *http.Request) (SessionTimings, error) {
+	var t SessionTimings
+	var bounds []*timingBounds
+	if c != nil {
+		t = c.Defaults
+		bounds = c.bounds
+	}
+	t = t.withDefaults()
+	q := r.URL.Query()
+	for i, f := range t.fields() {
+		p := sessionTimingParams[i]
+		v := q.Get(p.param)
+		if v == "" {
+			continue
+		}
+		if i >= len(bounds) || bounds[i] == nil {
+			return t, errors.Errorf("%s can not be overridden", p.param)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < bounds[i].min || n > bounds[i].max {
+			return t, errors.Errorf("%s must be between %d and %d", p.param, bounds[i].min, bounds[i].max)
+		}
+		*f = n
+	}
+	return t, t.validate()
+}
+
+// layoutDir returns the output dir of content transcoded into segments of
+// the given duration and scaled down to a height limit, if any. The
+// built-in layout is kept in the content's dir, others in sibling dirs, so
+// runs and their cached output are only shared by sessions with the same
+// layout.
+func layoutDir(hashDir string, segDuration int, heightLimit uint) string {
+	dir := hashDir
+	if segDuration != sessionSegDuration {
+		dir += fmt.Sprintf("-seg%d", segDuration)
+	}
+	if heightLimit > 0 {
+		dir += fmt.Sprintf("-h%d", heightLimit)
+	}
+	return dir
+}
+
+// layoutContentDir returns the content dir a layout dir belongs to.
+func layoutContentDir(dir string) string {
+	base := filepath.Base(dir)
+	if i := strings.IndexByte(base, '-'); i > 0 {
+		return filepath.Join(filepath.Dir(dir), base[:i])
+	}
+	return dir
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTimingsFromRequest(t *testing.T) {
+	cfg := &SessionTimingConfig{Defaults: SessionTimings{}.withDefaults()}
+	for _, b := range []string{"30-300", "600-3600", "", "", "2-10"} {
+		bounds, err := parseTimingBounds(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.bounds = append(cfg.bounds, bounds)
+	}
+
+	get := func(query string) (SessionTimings, error) {
+		return cfg.fromRequest(httptest.NewRequest(http.MethodPost, "/session?"+query, nil))
+	}
+	tm, err := get("inactivity_expiry=1800&segment_duration=6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SessionTimings{InactivityRelease: 60, InactivityExpiry: 1800, RunGracePeriod: 30, SeekQuantum: 30, SegmentDuration: 6}
+	if tm != want {
+		t.Errorf("got %+v, want %+v", tm, want)
+	}
+	for _, query := range []string{
+		"inactivity_expiry=7200", // above bounds
+		"segment_duration=1",     // below bounds
+		"seek_quantum=60",        // not overridable
+		"inactivity_release=abc", // not a number
+		"inactivity_release=300&inactivity_expiry=600&segment_duration=4&run_grace_period=", // valid
+	} {
+		_, err := get(query)
+		if valid := strings.HasSuffix(query, "="); (err == nil) != valid {
+			t.Errorf("%s: err = %v", query, err)
+		}
+	}
+
+	var none *SessionTimingConfig
+	if tm, err := none.fromRequest(httptest.NewRequest(http.MethodPost, "/session", nil)); err != nil || tm.SeekQuantum != seekQuantum {
+		t.Errorf("built-in defaults: got %+v, %v", tm, err)
+	}
+	for _, b := range []string{"10", "0-10", "20-10", "a-b"} {
+		if _, err := parseTimingBounds(b); err == nil {
+			t.Errorf("bounds %q should be rejected", b)
+		}
+	}
+}
+
+func TestWebSessionTimings(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.timings = &SessionTimingConfig{Defaults: SessionTimings{}.withDefaults()}
+	for _, b := range []string{"30-300", "60-3600", "10-60", "10-60", "2-10"} {
+		bounds, _ := parseTimingBounds(b)
+		web.timings.bounds = append(web.timings.bounds, bounds)
+	}
+
+	src := url.QueryEscape("sim://host/movie.mkv?duration=200")
+	w := serveTestRequest(web, http.MethodPost, "/session?seek_quantum=20&segment_duration=5&inactivity_expiry=120&source_url="+src)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := SessionTimings{InactivityRelease: 60, InactivityExpiry: 120, RunGracePeriod: 30, SeekQuantum: 20, SegmentDuration: 5}
+	if resp.Timings != want {
+		t.Errorf("timings: got %+v, want %+v", resp.Timings, want)
+	}
+
+	if w := serveTestRequest(web, http.MethodPost, "/session/"+resp.ID+"/seek?t=45"); w.Code != http.StatusOK {
+		t.Fatalf("seek: status = %d", w.Code)
+	}
+	sess := web.sessionManager.Get(resp.ID)
+	if sess.SeekTime() != 40 {
+		t.Errorf("seek time = %v, want 40", sess.SeekTime())
+	}
+	// Runs of other segment durations are not shared
+	if !strings.HasSuffix(sess.hashDir, "-seg5") {
+		t.Errorf("hash dir %s should be specific to the segment duration", sess.hashDir)
+	}
+	w = serveTestRequest(web, http.MethodGet, "/session/"+resp.ID+"/v0-720.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#EXTINF:5.0") {
+		t.Errorf("variant: status = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	if w := serveTestRequest(web, http.MethodPost, "/session?inactivity_expiry=7200&source_url="+src); w.Code != http.StatusBadRequest {
+		t.Errorf("out of bounds: status = %d, want 400", w.Code)
+	}
+
+	// The session expires after its own inactivity expiry
+	sess.mu.Lock()
+	sess.lastAccess = time.Now().Add(-130 * time.Second)
+	sess.mu.Unlock()
+	web.sessionManager.checkInactivity()
+	if web.sessionManager.Get(resp.ID) != nil {
+		t.Error("session should expire after its inactivity expiry")
+	}
+}
+
+func TestRunManagerReleaseWithGrace(t *testing.T) {
+	rm := NewRunManager(RunManagerConfig{})
+	t.Cleanup(rm.CloseAll)
+	dir := t.TempDir()
+
+	short := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	long := newTranscodeRun(runKey(dir, 30), dir, 30, "", nil)
+	for _, run := range []*TranscodeRun{short, long} {
+		run.AddRef()
+		rm.runs[run.key] = &managedRun{run: run}
+	}
+	rm.ReleaseWithGrace(short, time.Second)
+	rm.ReleaseWithGrace(long, time.Hour)
+
+	rm.mu.Lock()
+	for _, mr := range rm.runs {
+		mr.idleSince = mr.idleSince.Add(-2 * time.Second)
+	}
+	rm.mu.Unlock()
+	rm.cleanupIdleRuns()
+
+	if _, ok := rm.runs[short.key]; ok {
+		t.Error("run released with a short grace period should be cleaned up")
+	}
+	if _, ok := rm.runs[long.key]; !ok {
+		t.Error("run released with a long grace period should be kept")
+	}
+}
+
+func TestLayoutContentDir(t *testing.T) {
+	for _, dir := range []string{
+		"/data/out-1/abc",
+		"/data/out-1/abc-seg6",
+		"/data/out-1/abc-h720",
+		"/data/out-1/abc-seg6-h720",
+	} {
+		if got := layoutContentDir(dir); got != "/data/out-1/abc" {
+			t.Errorf("layoutContentDir(%q) = %q", dir, got)
+		}
+	}
+}
+
+func TestWebTouchesContentDir(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.timings = &SessionTimingConfig{Defaults: SessionTimings{}.withDefaults()}
+	for _, b := range []string{"30-300", "60-3600", "10-60", "10-60", "2-10"} {
+		bounds, _ := parseTimingBounds(b)
+		web.timings.bounds = append(web.timings.bounds, bounds)
+	}
+	src := url.QueryEscape("sim://host/movie.mkv?duration=200")
+	w := serveTestRequest(web, http.MethodPost, "/session?segment_duration=6&source_url="+src)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	sess := web.sessionManager.Get(resp.ID)
+	contentDir := layoutContentDir(sess.hashDir)
+	if contentDir == sess.hashDir {
+		t.Fatalf("hash dir %s should be a layout dir", sess.hashDir)
+	}
+
+	// Session requests keep both the layout and the content dir
+	web.touchMap = NewTouchMap()
+	for _, dir := range []string{contentDir, sess.hashDir} {
+		if err := os.Remove(dir + ".touch"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serveTestRequest(web, http.MethodGet, "/session/"+resp.ID+"/index.m3u8")
+	for _, dir := range []string{contentDir, sess.hashDir} {
+		if _, err := os.Stat(dir + ".touch"); err != nil {
+			t.Errorf("%s should be touched: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Source request headers (Authorization, Cookie, User-Agent, Referer, ...)
+// are passed to POST /session as repeated "X-Source-Header: Name: value"
+// headers. They are kept server-side with the session's HLS layout and
+// applied to probing, every FFmpeg run and the input proxy. They never
+// appear in playlists or logs.
+
+const sourceHeaderHeader = "X-Source-Header"
+
+// reservedSourceHeaders are managed by the HTTP clients reading the source.
+var reservedSourceHeaders = map[string]bool{
+	"Host":           true,
+	"Range":          true,
+	"Content-Length": true,
+	"Connection":     true,
+}
+
+// parseSourceHeaders parses "Name: value" lines into a header set.
+func parseSourceHeaders(lines []string) (http.Header, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	res := http.Header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !ok || name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, errors.Errorf("invalid source header %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.Errorf("invalid value of source header %s", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if reservedSourceHeaders[name] {
+			return nil, errors.Errorf("source header %s is not allowed", name)
+		}
+		res.Add(name, value)
+	}
+	return res, nil
+}
+
+// formatFFmpegHeaders formats headers for the FFmpeg/ffprobe -headers
+// option, in a stable order.
+func formatFFmpegHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		for _, v := range h[name] {
+			sb.WriteString(name)
+			sb.WriteString(": ")
+			sb.WriteString(v)
+			sb.WriteString("\r\n")
+		}
+	}
+	return sb.String()
+}
+
+// redactParams returns a copy of command line params safe for logging.
+func redactParams(params []string) []string {
+	res := make([]string, len(params))
+	copy(res, params)
+	for i := 0; i < len(res)-1; i++ {
+		if res[i] == "-headers" {
+			res[i+1] = "<redacted>"
+		}
+	}
+	return res
+}
@@ -0,0 +1,365 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	u "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Source policy: sources are only read with allowed schemes from allowed
+// hosts. Host rules are hostnames, "*.example.com" matching subdomains, IPs
+// or CIDRs; IP rules and the private range check apply to the addresses
+// hostnames resolve to. The input proxy checks the addresses it connects
+// to, so DNS answers changing after the check are caught too. With host
+// restrictions FFmpeg and ffprobe read http(s) sources through the proxy
+// only, which refuses playlists listing URLs of their own; other sources
+// are limited to the protocols of the allowed schemes.
+
+const (
+	SourceSchemesFlag     = "source-schemes"
+	SourceAllowHostsFlag  = "source-allow-hosts"
+	SourceDenyHostsFlag   = "source-deny-hosts"
+	SourceDenyPrivateFlag = "source-deny-private"
+)
+
+const (
+	sourceResolveTimeout = 5 * time.Second
+)
+
+// sourceProtocols are the FFmpeg protocols needed to read a scheme, schemes
+// not listed need the protocol of their name.
+var sourceProtocols = map[string][]string{
+	"http":  {"http", "tcp"},
+	"https": {"https", "tls", "tcp", "http"},
+}
+
+// privateNets are ranges not covered by the net.IP predicates.
+var privateNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15")
+
+func RegisterSourcePolicyFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   SourceSchemesFlag,
+		Usage:  "comma-separated URL schemes sources may use",
+		Value:  "http,https",
+		EnvVar: "SOURCE_SCHEMES",
+	}, cli.StringFlag{
+		Name:   SourceAllowHostsFlag,
+		Usage:  "comma-separated hosts sources may be read from (hostnames, *.domain, IPs or CIDRs), empty allows all",
+		Value:  "",
+		EnvVar: "SOURCE_ALLOW_HOSTS",
+	}, cli.StringFlag{
+		Name:   SourceDenyHostsFlag,
+		Usage:  "comma-separated hosts sources must not be read from (hostnames, *.domain, IPs or CIDRs)",
+		Value:  "",
+		EnvVar: "SOURCE_DENY_HOSTS",
+	}, cli.BoolTFlag{
+		Name:   SourceDenyPrivateFlag,
+		Usage:  "reject sources resolving to loopback, private, link-local and other non-public addresses unless explicitly allowed",
+		EnvVar: "SOURCE_DENY_PRIVATE",
+	})
+}
+
+// hostRules match hosts by name and addresses by network.
+type hostRules struct {
+	names    []string // exact names, or ".example.com" for subdomains
+	networks []*net.IPNet
+}
+
+func parseHostRules(s string) (*hostRules, error) {
+	r := &hostRules{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		switch {
+		case v == "":
+		case strings.Contains(v, "/"):
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid host rule %q", v)
+			}
+			r.networks = append(r.networks, n)
+		case net.ParseIP(v) != nil:
+			ip := net.ParseIP(v)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.networks = append(r.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(v, "*."):
+			r.names = append(r.names, v[1:])
+		default:
+			r.names = append(r.names, v)
+		}
+	}
+	return r, nil
+}
+
+func (r *hostRules) empty() bool {
+	return len(r.names) == 0 && len(r.networks) == 0
+}
+
+func (r *hostRules) matchName(host string) bool {
+	for _, n := range r.names {
+		if n == host || (strings.HasPrefix(n, ".") && strings.HasSuffix(host, n)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *hostRules) matchIP(ip net.IP) bool {
+	for _, n := range r.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// isPrivateIP returns true for addresses that are not publicly routable.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourcePolicy restricts the sources read. A nil SourcePolicy allows all.
+type SourcePolicy struct {
+	schemes     map[string]bool
+	allow       *hostRules
+	deny        *hostRules
+	denyPrivate bool
+	resolver    *net.Resolver
+}
+
+// NewSourcePolicy returns nil for the simulated transcoder, which reads no
+// sources.
+func NewSourcePolicy(c *cli.Context) (*SourcePolicy, error) {
+	if c.String(TranscoderFlag) == TranscoderSimulated {
+		return nil, nil
+	}
+	return newSourcePolicy(c.String(SourceSchemesFlag), c.String(SourceAllowHostsFlag), c.String(SourceDenyHostsFlag), c.BoolT(SourceDenyPrivateFlag))
+}
+
+func newSourcePolicy(schemes string, allow string, deny string, denyPrivate bool) (*SourcePolicy, error) {
+	p := &SourcePolicy{
+		schemes:     map[string]bool{},
+		denyPrivate: denyPrivate,
+		resolver:    net.DefaultResolver,
+	}
+	for _, s := range strings.Split(schemes, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			p.schemes[s] = true
+		}
+	}
+	if len(p.schemes) == 0 {
+		return nil, errors.Errorf("--%s must not be empty", SourceSchemesFlag)
+	}
+	var err error
+	if p.allow, err = parseHostRules(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseHostRules(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check returns an error if the source must not be read. Hostnames are
+// resolved if addresses have to be checked.
+func (p *SourcePolicy) Check(ctx context.Context, sourceURL string) error {
+	if p == nil {
+		return nil
+	}
+	parsed, err := u.Parse(sourceURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid source url")
+	}
+	if !p.schemes[strings.ToLower(parsed.Scheme)] {
+		return errors.Errorf("scheme %q not allowed", parsed.Scheme)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		// e.g. file: sources, only read if their scheme is allowed
+		if !p.allow.empty() {
+			return errors.New("source without host not allowed")
+		}
+		return nil
+	}
+	_, err = p.resolve(ctx, host)
+	return err
+}
+
+// restrictsHosts reports whether sources are restricted by host or address,
+// so their connections and redirects have to be checked.
+func (p *SourcePolicy) restrictsHosts() bool {
+	return p != nil && (p.denyPrivate || !p.allow.empty() || !p.deny.empty())
+}
+
+// resolve checks a host and returns the addresses it may be read from.
+func (p *SourcePolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if p.deny.matchName(host) {
+		return nil, errors.Errorf("host %q denied", host)
+	}
+	allowed := p.allow.matchName(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, p.checkIP(host, ip, allowed)
+	}
+	if !allowed && !p.allow.empty() && len(p.allow.networks) == 0 {
+		return nil, errors.Errorf("host %q not allowed", host)
+	}
+	// Addresses only need checking for address rules and private ranges
+	if len(p.deny.networks) == 0 && (allowed || (len(p.allow.networks) == 0 && !p.denyPrivate)) {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, sourceResolveTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve host %q", host)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if err := p.checkIP(host, a.IP, allowed); err != nil {
+			return nil, err
+		}
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+// checkIP checks an address of host. allowed is set if host is allowed by
+// name.
+func (p *SourcePolicy) checkIP(host string, ip net.IP, allowed bool) error {
+	if p.deny.matchIP(ip) {
+		return errors.Errorf("address %v of host %q denied", ip, host)
+	}
+	if allowed || p.allow.matchIP(ip) {
+		return nil
+	}
+	if !p.allow.empty() {
+		return errors.Errorf("host %q not allowed", host)
+	}
+	if p.denyPrivate && isPrivateIP(ip) {
+		return errors.Errorf("private address %v of host %q denied", ip, host)
+	}
+	return nil
+}
+
+// dialContext connects to the checked addresses of a host only, so DNS
+// answers can not change between the check and the connection.
+func (p *SourcePolicy) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var d net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolve(ctx, strings.ToLower(host))
+	if err != nil {
+		return nil, errors.Wrap(err, "source not allowed")
+	}
+	if len(ips) == 0 {
+		// Allowed without checking addresses
+		return d.DialContext(ctx, network, addr)
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// httpClient returns a client connecting to allowed sources only, also
+// after redirects.
+func (p *SourcePolicy) httpClient(timeout time.Duration) *http.Client {
+	if p == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = p.dialContext
+	// A proxy would connect on our behalf without checks
+	tr.Proxy = nil
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !p.schemes[req.URL.Scheme] {
+				return errors.Errorf("redirect to scheme %q not allowed", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// protocolWhitelist returns the FFmpeg protocols needed to read allowed
+// sources, or only the proxy if proxied, so sources can not make FFmpeg
+// open other URLs around the proxy's checks.
+func (p *SourcePolicy) protocolWhitelist(proxied bool) string {
+	if proxied {
+		return strings.Join(sourceProtocols["http"], ",")
+	}
+	seen := map[string]bool{}
+	var res []string
+	add := func(protocols ...string) {
+		for _, pr := range protocols {
+			if !seen[pr] {
+				seen[pr] = true
+				res = append(res, pr)
+			}
+		}
+	}
+	for s := range p.schemes {
+		if protocols, ok := sourceProtocols[s]; ok {
+			add(protocols...)
+		} else {
+			add(s)
+		}
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// checkSource answers 403 and returns false if the source policy does not
+// allow the source.
+func (s *Web) checkSource(w http.ResponseWriter, r *http.Request, sourceURL string) bool {
+	if err := s.sourcePolicy.Check(r.Context(), sourceURL); err != nil {
+		log.WithError(err).WithField("sourceURL", sourceURL).Warn("sourcePolicy: source not allowed")
+		http.Error(w, "source not allowed: "+err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSourcePolicyCheck(t *testing.T) {
+	deny, err := newSourcePolicy("http,https", "", "10.0.0.0/8,bad.example.com,*.evil.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, err := newSourcePolicy("http,https", "media.example.com,192.168.1.0/24,*.cdn.example.com", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		policy  *SourcePolicy
+		source  string
+		allowed bool
+	}{
+		{deny, "http://8.8.8.8/movie.mkv", true},
+		{deny, "HTTPS://8.8.8.8/movie.mkv", true},
+		{deny, "file:///etc/passwd", false},
+		{deny, "gopher://8.8.8.8/", false},
+		{deny, "http://169.254.169.254/latest/meta-data", false},
+		{deny, "http://127.0.0.1:8080/", false},
+		{deny, "http://[::1]/", false},
+		{deny, "http://[::ffff:127.0.0.1]/", false},
+		{deny, "http://100.64.0.1/", false},
+		{deny, "http://localhost/", false},
+		{deny, "http://10.1.2.3/", false},
+		{deny, "http://bad.example.com/", false},
+		{deny, "http://a.b.evil.com/", false},
+		{allow, "http://media.example.com/movie.mkv", true},
+		{allow, "http://a.cdn.example.com/movie.mkv", true},
+		{allow, "http://192.168.1.5/movie.mkv", true},
+		{allow, "http://192.168.2.5/movie.mkv", false},
+		{allow, "http://8.8.8.8/movie.mkv", false},
+		{nil, "file:///etc/passwd", true},
+	} {
+		err := tt.policy.Check(context.Background(), tt.source)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: err = %v, want allowed = %v", tt.source, err, tt.allowed)
+		}
+	}
+
+	for _, rules := range []string{"10.0.0.0/33", "a/b"} {
+		if _, err := newSourcePolicy("http", rules, "", false); err == nil {
+			t.Errorf("host rules %q should be rejected", rules)
+		}
+	}
+	if _, err := newSourcePolicy(" , ", "", "", false); err == nil {
+		t.Error("empty schemes should be rejected")
+	}
+}
+
+func TestSourcePolicyRestrictsHosts(t *testing.T) {
+	for _, tt := range []struct {
+		allow, deny string
+		denyPrivate bool
+		restricts   bool
+	}{
+		{"", "", false, false},
+		{"", "", true, true},
+		{"media.example.com", "", false, true},
+		{"", "10.0.0.0/8", false, true},
+	} {
+		p, _ := newSourcePolicy("http", tt.allow, tt.deny, tt.denyPrivate)
+		if got := p.restrictsHosts(); got != tt.restricts {
+			t.Errorf("%+v: got %v", tt, got)
+		}
+	}
+	if (*SourcePolicy)(nil).restrictsHosts() {
+		t.Error("nil policy should not restrict hosts")
+	}
+}
+
+func TestSourcePolicyProtocolWhitelist(t *testing.T) {
+	p, _ := newSourcePolicy("https,rtmp", "", "", false)
+	if got := p.protocolWhitelist(false); got != "http,https,rtmp,tcp,tls" {
+		t.Errorf("got %q", got)
+	}
+	p, _ = newSourcePolicy("ftp", "", "", false)
+	if got := p.protocolWhitelist(true); got != "http,tcp" {
+		t.Errorf("proxied: got %q", got)
+	}
+}
+
+func TestSourcePolicyHTTPClient(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer origin.Close()
+
+	deny, _ := newSourcePolicy("http", "", "", true)
+	if _, err := deny.httpClient(0).Get(origin.URL); err == nil {
+		t.Error("connection to a loopback origin should be refused")
+	}
+	allow, _ := newSourcePolicy("http", "127.0.0.0/8", "", true)
+	res, err := allow.httpClient(0).Get(origin.URL)
+	if err != nil {
+		t.Fatalf("explicitly allowed origin: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestWebSourcePolicy(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.contentSecret = []byte("secret")
+	web.sourcePolicy, _ = newSourcePolicy("sim", "", "blocked.example.com", false)
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/session?source_url=" + url.QueryEscape("sim://host/movie.mkv?duration=20"), http.StatusOK},
+		{"/session?source_url=" + url.QueryEscape("sim://blocked.example.com/movie.mkv"), http.StatusForbidden},
+		{"/session?source_url=" + url.QueryEscape("file:///etc/passwd"), http.StatusForbidden},
+		{"/content?source_url=" + url.QueryEscape("http://host/movie.mkv"), http.StatusForbidden},
+	} {
+		if w := serveTestRequest(web, http.MethodPost, tt.path); w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d, body=%s", tt.path, w.Code, tt.code, w.Body.String())
+		}
+	}
+}
@@ -4,11 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -22,20 +19,30 @@ const (
 // TranscodeRun represents a single shared FFmpeg process transcoding a source
 // from a specific seek position. Multiple sessions can share a run.
 type TranscodeRun struct {
-	key       string  // identity: hashDir + ":seek:" + seekTime
+	key       string // identity: hashDir + ":seek:" + seekTime
 	hashDir   string
 	seekTime  float64
 	outputDir string // {hashDir}/runs/seek-{seekTime}/
 	sourceURL string
 	h         *HLS
 
+	transcoder Transcoder
+
 	mu       sync.Mutex
 	refCount int
-	cmd      *exec.Cmd
+	proc     TranscodeProcess
 	ctx      context.Context
 	cancel   context.CancelFunc
 	done     chan struct{}
 	running  bool
+	complete bool // FFmpeg finished the whole source
+	starts   int  // transcoder starts, later ones restart a stopped run
+	stitch   *runStitch
+	// stitching is set while StitchTo stops FFmpeg, before stitch is set
+	stitching bool
+	// lowPriority is set while the run is speculative
+	lowPriority bool
+	events      eventHub
 
 	// lifecycle
 	runCtx    context.Context
@@ -55,8 +62,10 @@ func newTranscodeRun(key, hashDir string, seekTime float64, sourceURL string, h
 		outputDir: outputDir,
 		sourceURL: sourceURL,
 		h:         h,
-		runCtx:    runCtx,
-		runCancel: runCancel,
+		// RunManager replaces this with its configured backend
+		transcoder: &FFmpegTranscoder{},
+		runCtx:     runCtx,
+		runCancel:  runCancel,
 		logger: log.WithFields(log.Fields{
 			"runKey": key,
 		}),
@@ -86,94 +95,110 @@ func (r *TranscodeRun) RefCount() int {
 	return r.refCount
 }
 
-// Start starts FFmpeg if not already running.
+// Start starts FFmpeg if not already running. A stitched run starts the run
+// it was stitched to instead.
 func (r *TranscodeRun) Start() error {
 	r.mu.Lock()
+	if r.stitch != nil {
+		next := r.stitch.next
+		r.mu.Unlock()
+		return next.Start()
+	}
 	defer r.mu.Unlock()
 	return r.startLocked()
 }
 
 func (r *TranscodeRun) startLocked() error {
-	if r.running {
+	if r.running || r.complete {
 		return nil
 	}
 
-	ffmpegPath, err := exec.LookPath("ffmpeg")
-	if err != nil {
-		return errors.Wrap(err, "ffmpeg not found")
-	}
-
 	if err := os.MkdirAll(r.outputDir, 0755); err != nil {
 		return errors.Wrap(err, "failed to create run dir")
 	}
 
-	params, err := r.h.GetFFmpegParams(r.outputDir)
-	if err != nil {
-		return errors.Wrap(err, "failed to get ffmpeg params")
-	}
-
-	params = redirectSegmentListParams(params)
-
-	if r.seekTime > 0 {
-		params = injectSeekParams(params, r.seekTime, r.isVideoCopy())
-		// Remove -xerror when seeking: AVI and other containers may produce
-		// non-fatal errors during seek that -xerror would treat as fatal.
-		params = removeParam(params, "-xerror")
-	}
-
 	r.ctx, r.cancel = context.WithCancel(r.runCtx)
 	r.done = make(chan struct{})
 
-	r.logger.WithFields(log.Fields{
-		"seekTime": fmt.Sprintf("%.3f", r.seekTime),
-		"params":   strings.Join(params, " "),
-	}).Info("run: starting ffmpeg")
-
-	r.cmd = exec.CommandContext(r.ctx, ffmpegPath, params...)
-	r.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	proc, err := r.transcoder.Transcode(r.ctx, &TranscodeJob{
+		HLS:       r.h,
+		OutputDir: r.outputDir,
+		SeekTime:  r.seekTime,
+		Logger:    r.logger,
 
-	outLog, err := os.Create(filepath.Join(r.outputDir, "ffmpeg.out"))
+		LowPriority: r.lowPriority,
+	})
 	if err != nil {
+		r.cancel()
 		close(r.done)
-		return errors.Wrap(err, "failed to create ffmpeg stdout log")
-	}
-	errLog, err := os.Create(filepath.Join(r.outputDir, "ffmpeg.err"))
-	if err != nil {
-		outLog.Close()
-		close(r.done)
-		return errors.Wrap(err, "failed to create ffmpeg stderr log")
-	}
-	r.cmd.Stdout = outLog
-	r.cmd.Stderr = errLog
-
-	if err := r.cmd.Start(); err != nil {
-		outLog.Close()
-		errLog.Close()
-		close(r.done)
-		return errors.Wrap(err, "failed to start ffmpeg")
+		runFailures.WithLabelValues(runFailureStart).Inc()
+		r.events.publish(eventRunError, runEvent{RunKey: r.key, SeekTime: r.seekTime, Error: err.Error()})
+		return err
 	}
 
+	r.proc = proc
 	r.running = true
+	if r.starts == 0 {
+		runStarts.WithLabelValues(runMode(r.h)).Inc()
+	} else {
+		runRestarts.WithLabelValues(runMode(r.h)).Inc()
+	}
+	r.starts++
 	r.logger.WithFields(log.Fields{
-		"pid":      r.cmd.Process.Pid,
+		"pid":      proc.Pid(),
 		"seekTime": fmt.Sprintf("%.3f", r.seekTime),
 	}).Info("run: ffmpeg started")
+	r.events.publish(eventRunStarted, runEvent{RunKey: r.key, SeekTime: r.seekTime, Pid: proc.Pid()})
 
-	go func() {
-		defer outLog.Close()
-		defer errLog.Close()
-		defer close(r.done)
-		waitErr := r.cmd.Wait()
-		if waitErr != nil {
-			r.logger.WithError(waitErr).Debug("run: ffmpeg exited with error")
-		} else {
-			r.logger.Info("run: ffmpeg finished normally")
-		}
-	}()
+	go r.wait(r.ctx, proc)
 
 	return nil
 }
 
+// wait marks the run complete if proc transcoded the whole source. ctx is
+// the context proc was started with, canceled if it was stopped on purpose.
+func (r *TranscodeRun) wait(ctx context.Context, proc TranscodeProcess) {
+	defer close(r.done)
+	waitErr := proc.Wait()
+	ev := runEvent{RunKey: r.key, SeekTime: r.seekTime}
+	if waitErr != nil {
+		r.logger.WithError(waitErr).Debug("run: ffmpeg exited with error")
+		if ctx.Err() == nil {
+			runFailures.WithLabelValues(runFailureExit).Inc()
+			ev.Error = waitErr.Error()
+			r.events.publish(eventRunError, ev)
+		}
+	} else {
+		r.mu.Lock()
+		r.complete = true
+		r.mu.Unlock()
+		r.logger.Info("run: ffmpeg finished normally")
+		ev.Complete = true
+	}
+	r.events.publish(eventRunStopped, ev)
+}
+
+// setLowPriority changes the CPU priority of the run, including a process
+// that is already running.
+func (r *TranscodeRun) setLowPriority(low bool) {
+	r.mu.Lock()
+	if r.lowPriority == low {
+		r.mu.Unlock()
+		return
+	}
+	r.lowPriority = low
+	proc, running := r.proc, r.running
+	r.mu.Unlock()
+	if !running {
+		return
+	}
+	if p, ok := proc.(prioritizedProcess); ok {
+		if err := p.SetLowPriority(low); err != nil {
+			r.logger.WithError(err).Debug("run: failed to change ffmpeg priority")
+		}
+	}
+}
+
 // Stop stops FFmpeg.
 func (r *TranscodeRun) Stop() {
 	r.mu.Lock()
@@ -187,34 +212,20 @@ func (r *TranscodeRun) stopLocked() {
 	}
 
 	// Check if already exited
-	if r.done != nil {
-		select {
-		case <-r.done:
-			r.running = false
-			return
-		default:
-		}
+	select {
+	case <-r.done:
+		r.running = false
+		return
+	default:
 	}
 
 	r.cancel()
 
-	if r.cmd != nil && r.cmd.Process != nil {
-		pid := r.cmd.Process.Pid
-		_ = syscall.Kill(-pid, syscall.SIGTERM)
-
-		r.mu.Unlock()
-		select {
-		case <-r.done:
-		case <-time.After(runGracefulStopTimeout):
-			_ = syscall.Kill(-pid, syscall.SIGKILL)
-			<-r.done
-		}
-		r.mu.Lock()
-	} else if r.done != nil {
-		r.mu.Unlock()
-		<-r.done
-		r.mu.Lock()
-	}
+	proc := r.proc
+	r.mu.Unlock()
+	proc.Stop()
+	<-r.done
+	r.mu.Lock()
 
 	r.running = false
 }
@@ -232,9 +243,15 @@ func (r *TranscodeRun) Cleanup() {
 	r.logger.Info("run: cleaned up")
 }
 
-// IsRunning returns true if FFmpeg is currently running.
+// IsRunning returns true if FFmpeg is currently running. For a stitched run
+// this reports the state of the run it was stitched to.
 func (r *TranscodeRun) IsRunning() bool {
 	r.mu.Lock()
+	if r.stitch != nil {
+		next := r.stitch.next
+		r.mu.Unlock()
+		return next.IsRunning()
+	}
 	defer r.mu.Unlock()
 	if r.running && r.done != nil {
 		select {
@@ -250,55 +267,3 @@ func (r *TranscodeRun) IsRunning() bool {
 func (r *TranscodeRun) OutputDir() string {
 	return r.outputDir
 }
-
-// isVideoCopy returns true if the primary video stream uses copy mode.
-func (r *TranscodeRun) isVideoCopy() bool {
-	if r.h == nil {
-		return false
-	}
-	for _, s := range r.h.primary {
-		if s.st == Video && s.IsCopy() {
-			return true
-		}
-	}
-	return false
-}
-
-// removeParam removes all occurrences of a flag from the params list.
-func removeParam(params []string, flag string) []string {
-	result := make([]string, 0, len(params))
-	for _, p := range params {
-		if p != flag {
-			result = append(result, p)
-		}
-	}
-	return result
-}
-
-// injectSeekParams adds -ss before -i (input-level seek).
-//
-// For copy-mode video: adds -noaccurate_seek so both video (copy) and audio
-// (re-encode) start from the same keyframe → A/V sync.
-//
-// For re-encode mode: just -ss (accurate seek). FFmpeg decodes from the nearest
-// keyframe and discards frames before the target, then starts encoding.
-// Both streams start from the exact position → perfect sync.
-//
-// Input-level -ss is always used because output-level -ss (after -i) causes
-// video segments to appear much later than audio when re-encoding.
-func injectSeekParams(params []string, seekSec float64, videoCopy bool) []string {
-	result := make([]string, 0, len(params)+4)
-	seekStr := fmt.Sprintf("%.3f", seekSec)
-
-	for i := 0; i < len(params); i++ {
-		if params[i] == "-i" {
-			result = append(result, "-ss", seekStr)
-			if videoCopy {
-				result = append(result, "-noaccurate_seek")
-			}
-		}
-		result = append(result, params[i])
-	}
-
-	return result
-}
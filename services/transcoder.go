@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	TranscoderFlag = "transcoder"
+)
+
+const (
+	TranscoderFFmpeg    = "ffmpeg"
+	TranscoderSimulated = "simulated"
+)
+
+func RegisterTranscoderFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   TranscoderFlag,
+		Usage:  "transcoder backend (ffmpeg, simulated)",
+		Value:  TranscoderFFmpeg,
+		EnvVar: "TRANSCODER",
+	})
+}
+
+// TranscodeJob describes the output a Transcoder should produce for a run.
+type TranscodeJob struct {
+	HLS       *HLS
+	OutputDir string
+	SeekTime  float64
+	Logger    *log.Entry
+	// LowPriority is set for speculative runs.
+	LowPriority bool
+}
+
+// Transcoder starts transcoding processes writing HLS segments and
+// FFmpeg-style playlists ({stream}.m3u8.ffmpeg) into the job's output dir.
+type Transcoder interface {
+	Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error)
+}
+
+// TranscodeProcess is a single running transcoding process.
+type TranscodeProcess interface {
+	// Pid returns the OS process id, or 0 if the process is not an OS process.
+	Pid() int
+	// Wait blocks until the process exits. A nil error means the whole
+	// source was transcoded.
+	Wait() error
+	// Stop asks the process to exit and blocks until it has exited.
+	Stop()
+}
+
+// prioritizedProcess is implemented by processes whose CPU priority can be
+// changed while running.
+type prioritizedProcess interface {
+	SetLowPriority(low bool) error
+}
+
+func NewTranscoder(c *cli.Context, inputProxy *InputProxy, policy *SourcePolicy) (Transcoder, error) {
+	switch c.String(TranscoderFlag) {
+	case TranscoderFFmpeg:
+		return &FFmpegTranscoder{InputProxy: inputProxy, Policy: policy}, nil
+	case TranscoderSimulated:
+		return &SimulatedTranscoder{}, nil
+	default:
+		return nil, errors.Errorf("unknown transcoder %s", c.String(TranscoderFlag))
+	}
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// FFmpegTranscoder runs the ffmpeg CLI in its own process group.
+type FFmpegTranscoder struct {
+	// InputProxy, if set, is the range-caching proxy FFmpeg reads through.
+	InputProxy *InputProxy
+	// Policy, if set, restricts the sources and protocols FFmpeg reads.
+	Policy *SourcePolicy
+}
+
+type ffmpegProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+func (t *FFmpegTranscoder) Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error) {
+	if job.HLS == nil {
+		return nil, errors.New("no streams to transcode")
+	}
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.Wrap(err, "ffmpeg not found")
+	}
+
+	h := job.HLS
+	proxied := false
+	if t.InputProxy != nil {
+		in, err := t.InputProxy.URL(h.in, h.headers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to proxy input")
+		}
+		proxied = in != h.in
+		h = h.WithInput(in)
+	}
+	if !proxied {
+		// Checked again, DNS answers may have changed since the session
+		// was created
+		if err := t.Policy.Check(ctx, h.in); err != nil {
+			return nil, errors.Wrap(err, "source not allowed")
+		}
+	}
+
+	params, err := h.GetFFmpegParams(job.OutputDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get ffmpeg params")
+	}
+
+	params = redirectSegmentListParams(params)
+
+	if t.Policy != nil {
+		params = injectInputParams(params, "-protocol_whitelist", t.Policy.protocolWhitelist(proxied))
+	}
+
+	if proxied {
+		// The proxy connection is dropped when the proxy restarts, e.g. on
+		// hand-over. FFmpeg continues with a range request from its offset.
+		params = injectInputParams(params, "-reconnect", "1")
+	}
+
+	if job.SeekTime > 0 {
+		params = injectSeekParams(params, job.SeekTime, isVideoCopy(job.HLS))
+		// Remove -xerror when seeking: AVI and other containers may produce
+		// non-fatal errors during seek that -xerror would treat as fatal.
+		params = removeParam(params, "-xerror")
+	}
+
+	job.Logger.WithFields(log.Fields{
+		"seekTime": fmt.Sprintf("%.3f", job.SeekTime),
+		"params":   strings.Join(redactParams(params), " "),
+	}).Info("run: starting ffmpeg")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, params...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	outLog, err := os.Create(filepath.Join(job.OutputDir, "ffmpeg.out"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ffmpeg stdout log")
+	}
+	errLog, err := os.Create(filepath.Join(job.OutputDir, "ffmpeg.err"))
+	if err != nil {
+		outLog.Close()
+		return nil, errors.Wrap(err, "failed to create ffmpeg stderr log")
+	}
+	cmd.Stdout = outLog
+	cmd.Stderr = errLog
+
+	if err := cmd.Start(); err != nil {
+		outLog.Close()
+		errLog.Close()
+		return nil, errors.Wrap(err, "failed to start ffmpeg")
+	}
+
+	// Recorded so a restarted server can terminate it, see orphans.go
+	if err := writeFFmpegPid(job.OutputDir, cmd.Process.Pid); err != nil {
+		job.Logger.WithError(err).Warn("run: failed to record ffmpeg pid")
+	}
+
+	p := &ffmpegProcess{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	if job.LowPriority {
+		if err := p.SetLowPriority(true); err != nil {
+			job.Logger.WithError(err).Warn("run: failed to lower ffmpeg priority")
+		}
+	}
+	go func() {
+		defer close(p.done)
+		defer outLog.Close()
+		defer errLog.Close()
+		p.err = cmd.Wait()
+		removeFFmpegPid(job.OutputDir)
+	}()
+	return p, nil
+}
+
+func (p *ffmpegProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *ffmpegProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// SetLowPriority changes the niceness of the process group. Restoring the
+// normal priority needs CAP_SYS_NICE.
+func (p *ffmpegProcess) SetLowPriority(low bool) error {
+	nice := 0
+	if low {
+		nice = prewarmNiceness
+	}
+	return syscall.Setpriority(syscall.PRIO_PGRP, p.cmd.Process.Pid, nice)
+}
+
+// Stop sends SIGTERM to the process group and escalates to SIGKILL after
+// runGracefulStopTimeout.
+func (p *ffmpegProcess) Stop() {
+	pid := p.cmd.Process.Pid
+	_ = syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(runGracefulStopTimeout):
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// isVideoCopy returns true if the primary video stream uses copy mode.
+func isVideoCopy(h *HLS) bool {
+	if h == nil {
+		return false
+	}
+	for _, s := range h.primary {
+		if s.st == Video && s.IsCopy() {
+			return true
+		}
+	}
+	return false
+}
+
+// removeParam removes all occurrences of a flag from the params list.
+func removeParam(params []string, flag string) []string {
+	result := make([]string, 0, len(params))
+	for _, p := range params {
+		if p != flag {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// injectInputParams adds input options before -i.
+func injectInputParams(params []string, opts ...string) []string {
+	result := make([]string, 0, len(params)+len(opts))
+	for _, p := range params {
+		if p == "-i" {
+			result = append(result, opts...)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// injectSeekParams adds -ss before -i (input-level seek).
+//
+// For copy-mode video: adds -noaccurate_seek so both video (copy) and audio
+// (re-encode) start from the same keyframe → A/V sync.
+//
+// For re-encode mode: just -ss (accurate seek). FFmpeg decodes from the nearest
+// keyframe and discards frames before the target, then starts encoding.
+// Both streams start from the exact position → perfect sync.
+//
+// Input-level -ss is always used because output-level -ss (after -i) causes
+// video segments to appear much later than audio when re-encoding.
+func injectSeekParams(params []string, seekSec float64, videoCopy bool) []string {
+	result := make([]string, 0, len(params)+4)
+	seekStr := fmt.Sprintf("%.3f", seekSec)
+
+	for i := 0; i < len(params); i++ {
+		if params[i] == "-i" {
+			result = append(result, "-ss", seekStr)
+			if videoCopy {
+				result = append(result, "-noaccurate_seek")
+			}
+		}
+		result = append(result, params[i])
+	}
+
+	return result
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	u "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	cp "github.com/webtor-io/content-prober/content-prober"
+)
+
+const (
+	simulatedDefaultDuration        = 600.0 // seconds
+	simulatedDefaultHeight          = 720
+	simulatedDefaultSegmentInterval = 100 * time.Millisecond
+)
+
+// SimulatedTranscoder writes synthetic segments and FFmpeg-style playlists
+// in-process. It lets the session/run/web stack run without FFmpeg.
+type SimulatedTranscoder struct {
+	// SegmentInterval is the wall time spent producing each segment.
+	SegmentInterval time.Duration
+}
+
+type simulatedProcess struct {
+	done     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+func (t *SimulatedTranscoder) Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error) {
+	if job.HLS == nil || len(job.HLS.Streams()) == 0 {
+		return nil, errors.New("no streams to transcode")
+	}
+	interval := t.SegmentInterval
+	if interval == 0 {
+		interval = simulatedDefaultSegmentInterval
+	}
+	job.Logger.WithField("seekTime", fmt.Sprintf("%.3f", job.SeekTime)).
+		Info("run: starting simulated transcoder")
+	p := &simulatedProcess{
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		p.err = p.run(ctx, job, interval)
+	}()
+	return p, nil
+}
+
+func (p *simulatedProcess) run(ctx context.Context, job *TranscodeJob, interval time.Duration) error {
+	streams := job.HLS.Streams()
+	remaining := simulatedDuration(job.HLS) - job.SeekTime
+	segDuration := job.HLS.SegmentDuration()
+	playlists := make([]bytes.Buffer, len(streams))
+	for i := range playlists {
+		playlists[i].WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-ALLOW-CACHE:YES\n")
+		fmt.Fprintf(&playlists[i], "#EXT-X-TARGETDURATION:%d\n", segDuration)
+	}
+	for num := 0; remaining > 0; num++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.stop:
+			return errors.New("stopped")
+		case <-time.After(interval):
+		}
+		d := math.Min(remaining, float64(segDuration))
+		remaining -= d
+		for i, s := range streams {
+			name := s.GetSegmentName(num)
+			if err := os.WriteFile(filepath.Join(job.OutputDir, name), simulatedSegment(s), 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(&playlists[i], "#EXTINF:%f,\n%s\n", d, name)
+			if remaining <= 0 {
+				playlists[i].WriteString("#EXT-X-ENDLIST\n")
+			}
+			if err := writeFileAtomic(filepath.Join(job.OutputDir, s.GetPlaylistName()+".ffmpeg"), playlists[i].Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *simulatedProcess) Pid() int {
+	return 0
+}
+
+func (p *simulatedProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *simulatedProcess) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+}
+
+// simulatedDuration returns the longest stream duration of the source.
+func simulatedDuration(h *HLS) float64 {
+	var d float64
+	for _, s := range h.Streams() {
+		if sd, err := strconv.ParseFloat(s.s.GetDuration(), 64); err == nil {
+			d = math.Max(d, sd)
+		}
+	}
+	if d == 0 {
+		return simulatedDefaultDuration
+	}
+	return d
+}
+
+// simulatedSegment returns segment payload: MPEG-TS null packets for media
+// segments, an empty cue file for subtitles.
+func simulatedSegment(s *HLSStream) []byte {
+	if s.st == Subtitle {
+		return []byte("WEBVTT\n\n")
+	}
+	packet := make([]byte, 188)
+	packet[0], packet[1], packet[2], packet[3] = 0x47, 0x1f, 0xff, 0x10
+	for i := 4; i < len(packet); i++ {
+		packet[i] = 0xff
+	}
+	return bytes.Repeat(packet, 16)
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// SimulatedProber returns a synthetic probe result with one h264 video and
+// one aac audio stream. The source URL may set "duration" (seconds) and
+// "height" query parameters.
+type SimulatedProber struct{}
+
+func (s *SimulatedProber) Probe(ctx context.Context, input string, headers http.Header) (*cp.ProbeReply, error) {
+	parsedURL, err := u.Parse(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse url")
+	}
+	duration := simulatedDefaultDuration
+	if v := parsedURL.Query().Get("duration"); v != "" {
+		if duration, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid duration")
+		}
+	}
+	height := int32(simulatedDefaultHeight)
+	if v := parsedURL.Query().Get("height"); v != "" {
+		h, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid height")
+		}
+		height = int32(h)
+	}
+	d := strconv.FormatFloat(duration, 'f', 3, 64)
+	log.WithField("input", input).Info("simulated probing")
+	return &cp.ProbeReply{
+		Format: &cp.Format{
+			FormatName: "simulated",
+			Duration:   d,
+		},
+		Streams: []*cp.Stream{
+			{
+				Index:     0,
+				CodecName: "h264",
+				CodecType: "video",
+				Width:     height * 16 / 9,
+				Height:    height,
+				Duration:  d,
+			},
+			{
+				Index:         1,
+				CodecName:     "aac",
+				CodecType:     "audio",
+				Channels:      2,
+				ChannelLayout: "stereo",
+				SampleRate:    "48000",
+				Duration:      d,
+				Tags:          map[string]string{"language": "eng"},
+			},
+		},
+	}, nil
+}
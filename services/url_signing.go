@@ -0,0 +1,186 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Signed session URLs: with a signing secret, session routes require
+// expires and signature query params, the signature being an HMAC of a
+// scope and the expiry. A scope is either the request path or the session
+// prefix /session/{id}/. Clients get a signature of the session prefix
+// with the session and renew it with POST /session/{id}/sign; playlists
+// sign each file they reference on its own, so URLs leaked from them stop
+// working after the TTL and only give access to a single file.
+
+const (
+	URLSigningSecretFlag = "url-signing-secret"
+	URLSigningTTLFlag    = "url-signing-ttl"
+)
+
+const (
+	urlExpiresParam   = "expires"
+	urlSignatureParam = "signature"
+	// urlExpiryStep rounds expiries up, so playlists served within a step
+	// are identical and keep their ETag
+	urlExpiryStep = time.Minute
+)
+
+func RegisterURLSigningFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   URLSigningSecretFlag,
+		Usage:  "secret signing session URLs, empty disables signature checks",
+		Value:  "",
+		EnvVar: "URL_SIGNING_SECRET",
+	}, cli.IntFlag{
+		Name:   URLSigningTTLFlag,
+		Usage:  "seconds signed session URLs are valid for",
+		Value:  3600,
+		EnvVar: "URL_SIGNING_TTL",
+	})
+}
+
+// URLSigner signs and verifies session URLs. A nil URLSigner signs nothing
+// and accepts every request.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewURLSigner(c *cli.Context) (*URLSigner, error) {
+	secret := c.String(URLSigningSecretFlag)
+	if secret == "" {
+		return nil, nil
+	}
+	ttl := c.Int(URLSigningTTLFlag)
+	if ttl <= 0 {
+		return nil, errors.Errorf("invalid %s %d", URLSigningTTLFlag, ttl)
+	}
+	return &URLSigner{
+		secret: []byte(secret),
+		ttl:    time.Duration(ttl) * time.Second,
+	}, nil
+}
+
+// sessionScope returns the scope signing all URLs of a session.
+func sessionScope(id string) string {
+	return "/session/" + id + "/"
+}
+
+func (s *URLSigner) signature(scope string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", scope, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the query params signing scope for the TTL and their expiry
+// as unix time. Both are empty without signing.
+func (s *URLSigner) sign(scope string) (string, int64) {
+	if s == nil {
+		return "", 0
+	}
+	step := int64(urlExpiryStep / time.Second)
+	expires := time.Now().Add(s.ttl).Unix()
+	expires += (step - expires%step) % step
+	return urlExpiresParam + "=" + strconv.FormatInt(expires, 10) +
+		"&" + urlSignatureParam + "=" + s.signature(scope, expires), expires
+}
+
+// verify checks that the query of r signs one of scopes and has not expired.
+func (s *URLSigner) verify(r *http.Request, scopes ...string) error {
+	if s == nil {
+		return nil
+	}
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get(urlExpiresParam), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid url expiry")
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("url expired")
+	}
+	sig := []byte(q.Get(urlSignatureParam))
+	for _, scope := range scopes {
+		if hmac.Equal(sig, []byte(s.signature(scope, expires))) {
+			return nil
+		}
+	}
+	return errors.New("invalid url signature")
+}
+
+// enrichPlaylist appends the request's query params to the file references
+// of a playlist. With URL signing, the request's signature is replaced by
+// a fresh one for each referenced file and the API token is left out, the
+// signature grants access instead. Without signing, media requests need
+// the token, so it is kept for players that can not set headers. Content
+// URLs carry their token only, they are the same for every viewer.
+func (s *Web) enrichPlaylist(r *http.Request, data []byte) []byte {
+	if contentRequest(r) {
+		return enrichPlaylistData(data, stripQueryParam(r.URL.RawQuery, jwtQueryParam))
+	}
+	if s.signer == nil {
+		return enrichPlaylistData(data, r.URL.RawQuery)
+	}
+	q := r.URL.Query()
+	q.Del(urlExpiresParam)
+	q.Del(urlSignatureParam)
+	q.Del(jwtQueryParam)
+	query := q.Encode()
+	if query != "" {
+		query += "&"
+	}
+	dir := path.Dir(r.URL.Path)
+	return rewritePlaylistRefs(data, func(name string) string {
+		signed, _ := s.signer.sign(dir + "/" + name)
+		return name + "?" + query + signed
+	})
+}
+
+type signedQueryResponse struct {
+	Query   string `json:"query"`   // expires and signature params for session URLs
+	Expires int64  `json:"expires"` // unix time the query expires at
+}
+
+// sessionSignHandler handles POST /session/{id}/sign
+// @Summary Renew session URL signature
+// @Description Returns a fresh signature of all URLs of the session. Clients renew it before the one they use expires.
+// @Tags session
+// @Produce json
+// @Param sessionId path string true "Session ID"
+// @Param expires query int true "Expiry of the current signature"
+// @Param signature query string true "Current signature of the session"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
+// @Success 200 {object} signedQueryResponse
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired signature, or session of another subject"
+// @Failure 404 {string} string "Session not found or URL signing disabled"
+// @Failure 410 {string} string "Session lifetime exceeded"
+// @Router /session/{sessionId}/sign [post]
+func (s *Web) sessionSignHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
+	if s.signer == nil {
+		http.Error(w, "url signing is disabled", http.StatusNotFound)
+		return
+	}
+	sess.Touch()
+	query, expires := s.signer.sign(sessionScope(sess.id))
+	resp, err := json.Marshal(signedQueryResponse{
+		Query:   query,
+		Expires: expires,
+	})
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
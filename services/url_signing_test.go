@@ -0,0 +1,117 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := &URLSigner{secret: []byte("secret"), ttl: time.Hour}
+	query, expires := signer.sign("/session/abc/")
+	if expires < time.Now().Add(time.Hour).Unix() || expires%60 != 0 {
+		t.Errorf("unexpected expiry %d", expires)
+	}
+	verify := func(path string, query string) error {
+		return signer.verify(httptest.NewRequest(http.MethodGet, path+"?"+query, nil), path, "/session/abc/")
+	}
+	if err := verify("/session/abc/v0-720.m3u8", query); err != nil {
+		t.Errorf("session signature: %v", err)
+	}
+	fileQuery, _ := signer.sign("/session/abc/v0-720-1.ts")
+	if err := verify("/session/abc/v0-720-1.ts", fileQuery); err != nil {
+		t.Errorf("file signature: %v", err)
+	}
+	expired, _ := (&URLSigner{secret: []byte("secret"), ttl: -2 * time.Minute}).sign("/session/abc/")
+	forged, _ := (&URLSigner{secret: []byte("other"), ttl: time.Hour}).sign("/session/abc/")
+	tampered := strings.Replace(query, "expires=", "expires=1", 1)
+	for _, q := range []string{"", expired, forged, tampered, "expires=abc"} {
+		if err := verify("/session/abc/v0-720.m3u8", q); err == nil {
+			t.Errorf("query %q should be rejected", q)
+		}
+	}
+	if err := verify("/session/abc/v0-720-2.ts", fileQuery); err == nil {
+		t.Error("file signature should not sign other files")
+	}
+
+	var none *URLSigner
+	if q, _ := none.sign("/session/abc/"); q != "" {
+		t.Errorf("nil signer should not sign, got %q", q)
+	}
+	if err := none.verify(httptest.NewRequest(http.MethodGet, "/session/abc/index.m3u8", nil)); err != nil {
+		t.Errorf("nil signer should accept requests: %v", err)
+	}
+}
+
+// playlistRef returns the reference of a playlist starting with name.
+func playlistRef(t *testing.T, data string, name string) string {
+	t.Helper()
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.Index(line, name+"?"); i >= 0 {
+			return strings.TrimSuffix(line[i:], `"`)
+		}
+	}
+	t.Fatalf("no reference to %s in playlist %s", name, data)
+	return ""
+}
+
+func TestWebSignedURLs(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.signer = &URLSigner{secret: []byte("secret"), ttl: time.Hour}
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20"))
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Query == "" || resp.QueryExpires == 0 {
+		t.Fatalf("create response should carry a signed query: %s", w.Body.String())
+	}
+	base := "/session/" + resp.ID + "/"
+	if w := serveTestRequest(web, http.MethodGet, base+"index.m3u8"); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned: status = %d, want 403", w.Code)
+	}
+
+	// Playlists sign each reference on its own, keeping other params
+	w = serveTestRequest(web, http.MethodGet, base+"index.m3u8?api-key=k&"+resp.Query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("master: status = %d", w.Code)
+	}
+	variant := playlistRef(t, w.Body.String(), "v0-720.m3u8")
+	if !strings.Contains(variant, "api-key=k") || strings.Contains(variant, resp.Query) {
+		t.Errorf("variant reference %s should keep params and get its own signature", variant)
+	}
+	w = serveTestRequest(web, http.MethodGet, base+variant)
+	if w.Code != http.StatusOK {
+		t.Fatalf("variant: status = %d", w.Code)
+	}
+	segment := playlistRef(t, w.Body.String(), "v0-720-0.ts")
+	if w := serveTestRequest(web, http.MethodGet, base+segment); w.Code != http.StatusOK {
+		t.Errorf("segment: status = %d", w.Code)
+	}
+	_, query, _ := strings.Cut(segment, "?")
+	if w := serveTestRequest(web, http.MethodGet, base+"v0-720-1.ts?"+query); w.Code != http.StatusForbidden {
+		t.Errorf("segment signature reused for another segment: status = %d, want 403", w.Code)
+	}
+	if w := serveTestRequest(web, http.MethodPost, base+"seek?t=0&"+query); w.Code != http.StatusForbidden {
+		t.Errorf("segment signature reused for seek: status = %d, want 403", w.Code)
+	}
+
+	// Signatures are renewed with a valid one
+	w = serveTestRequest(web, http.MethodPost, base+"sign?"+resp.Query)
+	var renewed signedQueryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &renewed); err != nil || renewed.Query == "" {
+		t.Fatalf("sign: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	if w := serveTestRequest(web, http.MethodGet, base+"seek?"+renewed.Query); w.Code != http.StatusOK {
+		t.Errorf("renewed: status = %d", w.Code)
+	}
+	expired, _ := (&URLSigner{secret: web.signer.secret, ttl: -2 * time.Minute}).sign(sessionScope(resp.ID))
+	if w := serveTestRequest(web, http.MethodPost, base+"sign?"+expired); w.Code != http.StatusForbidden {
+		t.Errorf("expired: status = %d, want 403", w.Code)
+	}
+}
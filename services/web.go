@@ -3,19 +3,21 @@ package services
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,9 +30,18 @@ import (
 )
 
 const (
-	webHostFlag   = "host"
-	webPortFlag   = "port"
-	webPlayerFlag = "player"
+	webHostFlag           = "host"
+	webPortFlag           = "port"
+	webPlayerFlag         = "player"
+	webChunkedSegmentFlag = "chunked-segments"
+	webAdminTokenFlag     = "admin-token"
+	webCORSOriginsFlag    = "cors-origins"
+)
+
+const (
+	segmentPollInterval = 100 * time.Millisecond
+	segmentStallTimeout = 30 * time.Second // end a growing segment without progress
+	mediaWaitTimeout    = 5 * time.Minute  // wait for a variant playlist or segment
 )
 
 func RegisterWebFlags(f []cli.Flag) []cli.Flag {
@@ -48,6 +59,18 @@ func RegisterWebFlags(f []cli.Flag) []cli.Flag {
 		Name:   webPlayerFlag,
 		Usage:  "player",
 		EnvVar: "PLAYER",
+	}, cli.BoolFlag{
+		Name:   webChunkedSegmentFlag,
+		Usage:  "stream segments FFmpeg is still writing with chunked transfer encoding instead of waiting until they are finalized",
+		EnvVar: "CHUNKED_SEGMENTS",
+	}, cli.StringFlag{
+		Name:   webAdminTokenFlag,
+		Usage:  "token for the admin API (GET /sessions, /session/{id}, /runs), empty disables it",
+		EnvVar: "ADMIN_TOKEN",
+	}, cli.StringFlag{
+		Name:   webCORSOriginsFlag,
+		Usage:  "comma-separated origins browsers may call the API from, empty allows all origins without JWT authentication and none with it",
+		EnvVar: "CORS_ORIGINS",
 	})
 }
 
@@ -55,27 +78,70 @@ type Web struct {
 	host           string
 	port           int
 	player         bool
+	chunked        bool
+	adminToken     string
 	output         string
 	handler        http.Handler
+	srv            *http.Server
 	ln             net.Listener
 	contentProbe   *ContentProbe
 	hlsBuilder     *HLSBuilder
 	sessionManager *SessionManager
 	touchMap       *TouchMap
+	drainer        *Drainer
+	handover       *Handover
+	cluster        *Cluster
+	positions      PositionStore
+	// contentSecret signs stateless /content URLs, empty disables them
+	contentSecret []byte
+	// timings are the session timing defaults and bounds, nil uses the
+	// built-in defaults
+	timings *SessionTimingConfig
+	// signer signs and verifies session URLs, nil disables signing
+	signer *URLSigner
+	// auth verifies API tokens, nil leaves the API open
+	auth *JWTAuth
+	// sourcePolicy restricts the sources sessions read, nil allows all
+	sourcePolicy *SourcePolicy
+	// corsOrigins are the origins browsers may call the API from, empty
+	// allows all origins unless auth is enabled
+	corsOrigins []string
+	// streamsDone ends event streams when the server shuts down
+	streamsDone chan struct{}
 }
 
-func NewWeb(c *cli.Context, contentProbe *ContentProbe, hlsBuilder *HLSBuilder, sessionManager *SessionManager, touchMap *TouchMap) *Web {
+func NewWeb(c *cli.Context, contentProbe *ContentProbe, hlsBuilder *HLSBuilder, sessionManager *SessionManager, touchMap *TouchMap, drainer *Drainer, handover *Handover, cluster *Cluster, positions PositionStore, timings *SessionTimingConfig, signer *URLSigner, auth *JWTAuth, sourcePolicy *SourcePolicy) *Web {
 	we := &Web{
 		host:           c.String(webHostFlag),
 		port:           c.Int(webPortFlag),
 		player:         c.Bool(webPlayerFlag),
+		chunked:        c.Bool(webChunkedSegmentFlag),
+		adminToken:     c.String(webAdminTokenFlag),
+		contentSecret:  []byte(c.String(ContentSecretFlag)),
 		output:         c.String(OutputFlag),
 		contentProbe:   contentProbe,
 		hlsBuilder:     hlsBuilder,
 		sessionManager: sessionManager,
 		touchMap:       touchMap,
+		drainer:        drainer,
+		handover:       handover,
+		cluster:        cluster,
+		positions:      positions,
+		timings:        timings,
+		signer:         signer,
+		auth:           auth,
+		sourcePolicy:   sourcePolicy,
+		corsOrigins:    parseCORSOrigins(c.String(webCORSOriginsFlag)),
 	}
 	we.buildHandler()
+	we.srv = &http.Server{Handler: we.handler}
+	we.streamsDone = make(chan struct{})
+	var once sync.Once
+	we.srv.RegisterOnShutdown(func() {
+		once.Do(func() {
+			close(we.streamsDone)
+		})
+	})
 	return we
 }
 
@@ -136,6 +202,16 @@ func (s *Web) buildHandler() {
 	mux.HandleFunc("/session", s.sessionCreateHandler)
 	mux.HandleFunc("/session/", s.sessionRouter)
 
+	// Stateless playback routes
+	mux.HandleFunc("/content", s.contentCreateHandler)
+	mux.HandleFunc("/content/", s.contentHandler)
+
+	// Admin API
+	if s.adminToken != "" {
+		mux.HandleFunc("/sessions", s.adminSessionsHandler)
+		mux.HandleFunc("/runs", s.adminRunsHandler)
+	}
+
 	// Swagger UI at /swagger/
 	mux.Handle("/swagger/", httpSwagger.WrapHandler)
 
@@ -154,7 +230,7 @@ func parseSegmentNumber(urlPath string) (int, error) {
 
 func (s *Web) Serve() error {
 	addr := fmt.Sprintf("%s:%d", s.host, s.port)
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listen(listenerWeb, addr)
 	if err != nil {
 		return errors.Wrap(err, "failed to bind address")
 	}
@@ -163,7 +239,29 @@ func (s *Web) Serve() error {
 	if s.player {
 		log.Info(fmt.Sprintf("player available at http://%v/player/", addr))
 	}
-	return http.Serve(ln, s.handler)
+	err = s.srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Web) handoverListener() (string, net.Listener) {
+	return listenerWeb, s.ln
+}
+
+// shutdown stops accepting connections and waits for in-flight requests.
+func (s *Web) shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// touchContent updates the .touch files of a layout dir and of its content
+// dir, which holds the probe result and input cache shared by all layouts.
+func (s *Web) touchContent(hashDir string) {
+	_, _ = s.touchMap.Touch(hashDir)
+	if dir := layoutContentDir(hashDir); dir != hashDir {
+		_, _ = s.touchMap.Touch(dir)
+	}
 }
 
 func (s *Web) Close() {
@@ -172,6 +270,7 @@ func (s *Web) Close() {
 		log.Info("Web closed")
 	}()
 	s.sessionManager.CloseAll()
+	_ = s.srv.Close()
 	if s.ln != nil {
 		_ = s.ln.Close()
 	}
@@ -180,58 +279,141 @@ func (s *Web) Close() {
 // --- Session API handlers ---
 
 type sessionCreateResponse struct {
-	ID       string  `json:"id"`
-	Duration float64 `json:"duration"`
+	ID       string         `json:"id"`
+	Duration float64        `json:"duration"`
+	Offset   float64        `json:"offset"` // quantized seek position the session starts at
+	Timings  SessionTimings `json:"timings"`
+	// Query signs all URLs of the session until QueryExpires, empty
+	// without URL signing
+	Query        string `json:"query,omitempty"`
+	QueryExpires int64  `json:"query_expires,omitempty"`
 }
 
 // sessionCreateHandler handles POST /session?source_url=...
 // @Summary Create transcoding session
-// @Description Creates a new session, probes media, starts FFmpeg from position 0
+// @Description Creates a new session, probes media, starts FFmpeg from position 0, or from the viewer's stored position if resume is set
 // @Tags session
 // @Produce json
 // @Param source_url query string false "Source media URL (alternative to X-Source-Url header)"
 // @Param X-Source-Url header string false "Source media URL (takes priority over query param)"
+// @Param X-Source-Header header string false "Source request header as Name: value (repeatable), e.g. Authorization, Cookie, User-Agent, Referer"
+// @Param viewer_id query string false "Viewer ID positions are stored for (alternative to X-Viewer-Id header)"
+// @Param X-Viewer-Id header string false "Viewer ID positions are stored for (takes priority over query param)"
+// @Param resume query bool false "Start at the viewer's stored position"
+// @Param token query string false "Viewer token quotas are counted for, signed with the quota token secret; the client IP without a valid one (alternative to X-Token header)"
+// @Param inactivity_release query int false "Seconds of inactivity after which the run is released, within the admin bounds"
+// @Param inactivity_expiry query int false "Seconds of inactivity after which the session is removed, within the admin bounds"
+// @Param run_grace_period query int false "Seconds a run released by the session is kept alive for reuse, within the admin bounds"
+// @Param seek_quantum query int false "Granularity seek positions are rounded down to in seconds, within the admin bounds"
+// @Param segment_duration query int false "Duration of HLS segments in seconds, within the admin bounds"
+// @Param Authorization header string false "Bearer API token, required with JWT authentication"
+// @Param access_token query string false "API token (alternative to Authorization header)"
 // @Success 200 {object} sessionCreateResponse
-// @Failure 400 {string} string "Missing or invalid source_url"
+// @Success 307 {string} string "Redirect to the cluster node owning the content"
+// @Failure 400 {string} string "Missing or invalid source_url, or timings out of bounds"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Source not allowed by the source policy or the API token"
+// @Failure 429 {string} string "Session or run quota exceeded"
 // @Failure 500 {string} string "Internal error"
+// @Failure 503 {string} string "Node is draining or handing over"
 // @Router /session [post]
 func (s *Web) sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Draining nodes keep serving existing sessions only
+	if s.drainer.Draining() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "node is draining", http.StatusServiceUnavailable)
+		return
+	}
+	if s.handover.InProgress() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "node is handing over", http.StatusServiceUnavailable)
+		return
+	}
+
+	claims, err := s.auth.authenticate(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
 	sourceURL := getSourceURL(r)
 	if sourceURL == "" {
 		http.Error(w, "missing source_url", http.StatusBadRequest)
 		return
 	}
 
+	sourceHeaders, err := parseSourceHeaders(r.Header.Values(sourceHeaderHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Compute hash dir (same sharding as before)
 	u, err := url.Parse(sourceURL)
 	if err != nil {
 		http.Error(w, "invalid source_url", http.StatusBadRequest)
 		return
 	}
-	h := sha1.New()
-	h.Write([]byte(u.Path))
-	hash := hex.EncodeToString(h.Sum(nil))
-	hashDir, err := GetDir(s.output, hash)
+	if claims != nil && !claims.allowsHost(u.Hostname()) {
+		http.Error(w, "source host not allowed", http.StatusForbidden)
+		return
+	}
+	if !s.checkSource(w, r, sourceURL) {
+		return
+	}
+	hash := contentHash(u)
+
+	// Content owned by another node is created there
+	if s.cluster.Route(w, r, clusterRouteKey(hash)) {
+		return
+	}
+
+	viewerID, err := getViewerID(r)
 	if err != nil {
-		http.Error(w, "failed to get output dir", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	posKey := ""
+	if viewerID != "" {
+		posKey = positionKey(hash, viewerID)
+	}
 
-	if err := os.MkdirAll(hashDir, 0755); err != nil {
-		http.Error(w, "failed to create output dir", http.StatusInternalServerError)
+	quotaID := s.sessionManager.quota.identity(r)
+	if claims == nil {
+		claims = &AuthClaims{}
+	} else {
+		// Authenticated subjects are the viewers quotas are counted for
+		quotaID = "sub:" + claims.Subject
+	}
+
+	timings, err := s.timings.fromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Touch hashDir so external cleanup knows it's active
-	_, _ = s.touchMap.Touch(hashDir)
+	contentDir, err := GetDir(s.output, hash)
+	if err != nil {
+		http.Error(w, "failed to get output dir", http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(contentDir, 0755); err != nil {
+		http.Error(w, "failed to create output dir", http.StatusInternalServerError)
+		return
+	}
 
-	// Probe media
-	pr, err := s.contentProbe.Get(sourceURL, hashDir)
+	// Probe media, the probe is shared by all layouts
+	pr, err := s.contentProbe.Get(sourceURL, sourceHeaders, contentDir)
 	if err != nil {
 		log.WithError(err).Error("session: failed to probe media")
 		http.Error(w, "failed to probe media", http.StatusInternalServerError)
@@ -239,15 +421,38 @@ func (s *Web) sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	duration := getDuration(pr)
-	hls := s.hlsBuilder.Build(sourceURL, pr)
+	hls := s.hlsBuilder.Build(sourceURL, sourceHeaders, pr, timings.SegmentDuration, claims.MaxResolution)
+
+	hashDir := layoutDir(contentDir, timings.SegmentDuration, hls.HeightLimit())
+	if err := os.MkdirAll(hashDir, 0755); err != nil {
+		http.Error(w, "failed to create output dir", http.StatusInternalServerError)
+		return
+	}
+
+	// Touch hashDir so external cleanup knows it's active
+	s.touchContent(hashDir)
 
 	// Create session
-	sess := s.sessionManager.Create(SessionConfig{
+	sess, err := s.sessionManager.Create(SessionConfig{
+		ID:        s.cluster.SessionID(clusterRouteKey(hash)),
 		SourceURL: sourceURL,
 		HashDir:   hashDir,
 		HLS:       hls,
 		Duration:  duration,
+
+		PositionKey: posKey,
+		QuotaID:     quotaID,
+		Timings:     timings,
+		Subject:     claims.Subject,
+		MaxSessions: claims.MaxSessions,
+		Deadline:    claims.deadline(),
 	})
+	if err != nil {
+		if !writeQuotaError(w, err) {
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+		}
+		return
+	}
 
 	// Create session directory and write master playlist
 	if err := os.MkdirAll(sess.outputDir, 0755); err != nil {
@@ -261,35 +466,54 @@ func (s *Web) sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start FFmpeg from 0
-	if err := sess.Start(0); err != nil {
+	// Start FFmpeg from 0 or the stored position
+	seekTime := 0.0
+	if r.URL.Query().Get("resume") == "true" {
+		seekTime = s.resumeSeekTime(sess)
+	}
+	if err := sess.Start(seekTime); err != nil {
 		s.sessionManager.Close(sess.id)
+		if writeQuotaError(w, err) {
+			return
+		}
 		log.WithError(err).Error("session: failed to start ffmpeg")
 		http.Error(w, "failed to start transcoding", http.StatusInternalServerError)
 		return
 	}
+	s.sessionManager.Save(sess)
 
+	query, expires := s.signer.sign(sessionScope(sess.id))
 	resp, err := json.Marshal(sessionCreateResponse{
-		ID:       sess.id,
-		Duration: duration,
+		ID:           sess.id,
+		Duration:     duration,
+		Offset:       sess.SeekTime(),
+		Timings:      sess.timings,
+		Query:        query,
+		QueryExpires: expires,
 	})
 	if err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
 	}
-	setCORSHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
 
 // sessionRouter routes /session/{id}/... requests.
 func (s *Web) sessionRouter(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+	s.setCORSHeaders(w, r)
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	// Sessions must not change while they are handed over
+	if s.handover.InProgress() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "node is handing over", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Parse path: /session/{id}/...
 	path := strings.TrimPrefix(r.URL.Path, "/session/")
 	parts := strings.SplitN(path, "/", 2)
@@ -304,14 +528,50 @@ func (s *Web) sessionRouter(w http.ResponseWriter, r *http.Request) {
 		subPath = parts[1]
 	}
 
-	sess := s.sessionManager.Get(sessionID)
+	// Session IDs carry the route key of their content
+	if key, ok := sessionRouteKey(sessionID); ok && s.cluster.Route(w, r, key) {
+		return
+	}
+
+	if subPath == "" && r.Method == http.MethodGet && s.adminToken != "" {
+		s.adminSessionHandler(w, r, sessionID)
+		return
+	}
+
+	// Checked before the lookup, so unsigned requests rehydrate nothing
+	if err := s.signer.verify(r, r.URL.Path, sessionScope(sessionID)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Playlists reference files without the API token, the URL signature
+	// of signed media requests proves access to the session instead
+	var claims *AuthClaims
+	if s.signer == nil || r.Method != http.MethodGet || !sessionMediaFile(subPath) {
+		var err error
+		if claims, err = s.auth.authenticate(r); err != nil {
+			writeAuthError(w, err)
+			return
+		}
+	}
+
+	sess := s.sessionManager.Lookup(r.Context(), sessionID)
 	if sess == nil {
 		http.Error(w, "session not found", http.StatusNotFound)
 		return
 	}
+	if claims != nil && claims.Subject != sess.Subject() {
+		http.Error(w, "session of another subject", http.StatusForbidden)
+		return
+	}
+	if sess.pastDeadline() {
+		s.sessionManager.Close(sess.id)
+		http.Error(w, "session lifetime exceeded", http.StatusGone)
+		return
+	}
 
-	// Update .touch file on hashDir so external cleanup knows content is active
-	_, _ = s.touchMap.Touch(sess.hashDir)
+	// Update .touch files so external cleanup knows content is active
+	s.touchContent(sess.hashDir)
 
 	// Sanitize subPath — use only the base filename to prevent path traversal
 	safeName := filepath.Base(subPath)
@@ -323,6 +583,12 @@ func (s *Web) sessionRouter(w http.ResponseWriter, r *http.Request) {
 		s.sessionSeekHandler(w, r, sess)
 	case subPath == "" && r.Method == http.MethodDelete:
 		s.sessionCloseHandler(w, r, sess)
+	case subPath == "position" && r.Method == http.MethodPost:
+		s.sessionPositionHandler(w, r, sess)
+	case subPath == "events" && r.Method == http.MethodGet:
+		s.sessionEventsHandler(w, r, sess)
+	case subPath == "sign" && r.Method == http.MethodPost:
+		s.sessionSignHandler(w, r, sess)
 	case strings.HasSuffix(safeName, ".m3u8"):
 		s.sessionPlaylistHandler(w, r, sess, safeName)
 	case strings.HasSuffix(safeName, ".ts") || strings.HasSuffix(safeName, ".vtt"):
@@ -339,9 +605,16 @@ func (s *Web) sessionRouter(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param sessionId path string true "Session ID"
 // @Param t query number true "Target seek time in seconds"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
 // @Success 200 {object} map[string]bool
 // @Failure 400 {string} string "Missing or invalid t parameter"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
 // @Failure 404 {string} string "Session not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
+// @Failure 429 {string} string "Run quota exceeded"
 // @Failure 500 {string} string "Seek failed"
 // @Router /session/{sessionId}/seek [post]
 func (s *Web) sessionSeekHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
@@ -357,10 +630,15 @@ func (s *Web) sessionSeekHandler(w http.ResponseWriter, r *http.Request, sess *S
 	}
 
 	if err := sess.Seek(t); err != nil {
+		if writeQuotaError(w, err) {
+			return
+		}
 		log.WithError(err).WithField("sessionID", sess.id).Error("session: seek failed")
 		http.Error(w, "seek failed", http.StatusInternalServerError)
 		return
 	}
+	s.sessionManager.Save(sess)
+	go s.sessionManager.Prewarm(sess)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"ok":true}`))
@@ -372,8 +650,14 @@ func (s *Web) sessionSeekHandler(w http.ResponseWriter, r *http.Request, sess *S
 // @Tags session
 // @Produce json
 // @Param sessionId path string true "Session ID"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
 // @Success 200 {object} map[string]float64
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
 // @Failure 404 {string} string "Session not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
 // @Router /session/{sessionId}/seek [get]
 func (s *Web) sessionSeekOffsetHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
 	sess.Touch()
@@ -387,8 +671,14 @@ func (s *Web) sessionSeekOffsetHandler(w http.ResponseWriter, r *http.Request, s
 // @Tags session
 // @Produce json
 // @Param sessionId path string true "Session ID"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication (alternative to Authorization header)"
 // @Success 200 {object} map[string]bool
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
 // @Failure 404 {string} string "Session not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
 // @Router /session/{sessionId} [delete]
 func (s *Web) sessionCloseHandler(w http.ResponseWriter, r *http.Request, sess *Session) {
 	s.sessionManager.Close(sess.id)
@@ -398,13 +688,21 @@ func (s *Web) sessionCloseHandler(w http.ResponseWriter, r *http.Request, sess *
 
 // sessionPlaylistHandler handles GET /session/{id}/{stream}.m3u8
 // @Summary Get HLS playlist
-// @Description Returns master playlist (index.m3u8) or variant EVENT playlist. Query params are appended to all file references for auth forwarding.
+// @Description Returns master playlist (index.m3u8) or variant EVENT playlist. Query params are appended to all file references for auth forwarding, with URL signing each reference gets its own signature. Playlists carry a strong ETag and must be revalidated.
 // @Tags session
 // @Produce application/vnd.apple.mpegurl
 // @Param sessionId path string true "Session ID"
 // @Param stream path string true "Playlist name (index.m3u8, v0-720.m3u8, a0.m3u8, etc.)"
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication unless the URL is signed (alternative to Authorization header)"
 // @Success 200 {string} string "HLS playlist"
+// @Success 304 {string} string "Cached copy is up to date"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
 // @Failure 404 {string} string "Session or playlist not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
 // @Failure 504 {string} string "Timeout waiting for playlist"
 // @Router /session/{sessionId}/{stream}.m3u8 [get]
 func (s *Web) sessionPlaylistHandler(w http.ResponseWriter, r *http.Request, sess *Session, name string) {
@@ -455,7 +753,7 @@ func (s *Web) sessionPlaylistHandler(w http.ResponseWriter, r *http.Request, ses
 			}
 		} else {
 			// Wait for variant playlist
-			data, err = sess.WaitForPlaylist(r.Context(), name, 5*time.Minute)
+			data, err = sess.WaitForPlaylist(r.Context(), name, mediaWaitTimeout)
 			if err != nil {
 				if r.Context().Err() != nil {
 					return
@@ -471,40 +769,60 @@ func (s *Web) sessionPlaylistHandler(w http.ResponseWriter, r *http.Request, ses
 	}
 
 	// Enrich: append query params (api-key, token, etc.) to all file
-	// references so subsequent requests carry the same auth context.
-	data = enrichPlaylistData(data, r.URL.RawQuery)
+	// references so subsequent requests carry the same auth context, and
+	// sign them when URL signing is enabled.
+	data = s.enrichPlaylist(r, data)
 
-	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	w.Write(data)
+	// Playlists grow, content URLs are cached briefly
+	cacheControl := cacheRevalidate
+	if contentRequest(r) {
+		cacheControl = cacheContentPlaylist
+	}
+	writePlaylist(w, r, data, cacheControl)
 }
 
 // sessionSegmentHandler handles GET /session/{id}/{segment}.ts|.vtt
 // @Summary Get HLS segment
-// @Description Returns a .ts or .vtt segment. Waits for file to appear if FFmpeg hasn't produced it yet. Auto-restarts FFmpeg if it was stopped.
+// @Description Returns a .ts or .vtt segment once FFmpeg finalized it. With chunked segments enabled, a segment FFmpeg is still writing is streamed with chunked transfer encoding and not cached. Auto-restarts FFmpeg if it was stopped. Segments carry a strong ETag and must be revalidated, a seek reuses their names.
 // @Tags session
 // @Produce video/mp2t
 // @Param sessionId path string true "Session ID"
 // @Param segment path string true "Segment filename (e.g., v0-720-0.ts, a0-5.ts)"
+// @Param If-None-Match header string false "ETag of a cached copy"
+// @Param expires query int false "Expiry of the URL signature as unix time, required with URL signing"
+// @Param signature query string false "URL signature, required with URL signing"
+// @Param access_token query string false "API token, required with JWT authentication unless the URL is signed (alternative to Authorization header)"
 // @Success 200 {file} binary "Segment data"
+// @Success 304 {string} string "Cached copy is up to date"
+// @Failure 401 {string} string "Missing or invalid API token"
+// @Failure 403 {string} string "Missing, invalid or expired URL signature, or session of another subject"
 // @Failure 404 {string} string "Session not found"
+// @Failure 410 {string} string "Session lifetime exceeded"
 // @Failure 504 {string} string "Timeout waiting for segment"
 // @Router /session/{sessionId}/{segment} [get]
 func (s *Web) sessionSegmentHandler(w http.ResponseWriter, r *http.Request, sess *Session, filename string) {
 	sess.Touch()
 
+	segNum, segErr := parseSegmentNumber("/" + filename)
+
 	// If FFmpeg is not running, auto-restart from the right position
-	if !sess.IsRunning() {
-		segNum, err := parseSegmentNumber("/" + filename)
-		if err == nil {
-			if err := sess.RestartForSegment(segNum); err != nil {
-				log.WithError(err).WithField("sessionID", sess.id).Error("session: failed to restart for segment")
-			}
+	if !sess.IsRunning() && segErr == nil {
+		if err := sess.RestartForSegment(segNum); err != nil {
+			log.WithError(err).WithField("sessionID", sess.id).Error("session: failed to restart for segment")
 		}
 	}
+	if segErr == nil {
+		sess.ReportSegment(segNum)
+		go s.sessionManager.Prewarm(sess)
+	}
 
-	// Wait for the segment file to appear
-	if err := sess.WaitForSegment(r.Context(), filename, 5*time.Minute); err != nil {
+	// Wait for the segment to be finalized, or to appear when growing
+	// segments are streamed
+	wait := sess.WaitForSegment
+	if s.chunked {
+		wait = sess.WaitForSegmentFile
+	}
+	if err := wait(r.Context(), filename, mediaWaitTimeout); err != nil {
 		if r.Context().Err() != nil {
 			return
 		}
@@ -517,7 +835,73 @@ func (s *Web) sessionSegmentHandler(w http.ResponseWriter, r *http.Request, sess
 	}
 
 	// Serve the file
-	http.ServeFile(w, r, sess.SegmentPath(filename))
+	if s.chunked && !sess.SegmentFinalized(filename) {
+		s.streamSegment(w, r, sess, filename)
+		return
+	}
+	serveSegmentFile(w, r, sess.SegmentPath(filename))
+}
+
+// streamSegment writes a segment FFmpeg is still writing as it grows, until
+// it is finalized or FFmpeg exits. The length is unknown, so the response
+// uses chunked transfer encoding.
+func (s *Web) streamSegment(w http.ResponseWriter, r *http.Request, sess *Session, filename string) {
+	f, err := os.Open(sess.SegmentPath(filename))
+	if err != nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	contentType := "video/mp2t"
+	if filepath.Ext(filename) == ".vtt" {
+		contentType = "text/vtt"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheNoStore)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	sub := sess.watchSegment(filename, true)
+	defer sub.Close()
+	ticker := time.NewTicker(sub.pollInterval(segmentPollInterval))
+	defer ticker.Stop()
+
+	buf := make([]byte, 64*1024)
+	lastProgress := time.Now()
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			lastProgress = time.Now()
+			continue
+		}
+		if err != nil && err != io.EOF {
+			log.WithError(err).WithField("segment", filename).Warn("session: failed to read growing segment")
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		// FFmpeg lists the segment only after closing it, the rest of the
+		// file is on disk then
+		if sess.SegmentFinalized(filename) || !sess.IsRunning() {
+			_, _ = io.Copy(w, f)
+			return
+		}
+		if time.Since(lastProgress) > segmentStallTimeout {
+			log.WithField("segment", filename).Warn("session: growing segment stalled")
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.C:
+		case <-ticker.C:
+		}
+	}
 }
 
 // playlistFilePattern matches segment and playlist references in HLS playlists.
@@ -532,11 +916,34 @@ func enrichPlaylistData(data []byte, rawQuery string) []byte {
 	if rawQuery == "" {
 		return data
 	}
+	return rewritePlaylistRefs(data, func(name string) string {
+		return name + "?" + rawQuery
+	})
+}
+
+// stripQueryParam removes all values of a param from a raw query, keeping
+// the others as they are.
+func stripQueryParam(rawQuery string, name string) string {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, p := range parts {
+		key, _, _ := strings.Cut(p, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
+}
+
+// rewritePlaylistRefs replaces all segment and playlist references in an
+// HLS playlist with the result of rewrite.
+func rewritePlaylistRefs(data []byte, rewrite func(name string) string) []byte {
 	var sb strings.Builder
 	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := scanner.Text()
-		line = playlistFilePattern.ReplaceAllString(line, "$0?"+rawQuery)
+		line = playlistFilePattern.ReplaceAllStringFunc(line, rewrite)
 		sb.WriteString(line)
 		sb.WriteRune('\n')
 	}
@@ -561,8 +968,50 @@ func isSubtitlePlaylist(name string) bool {
 	return true
 }
 
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// corsAllowHeaders are the request headers of the API browsers may send.
+var corsAllowHeaders = strings.Join([]string{
+	"Content-Type",
+	"Authorization",
+	"X-Source-Url",
+	sourceHeaderHeader,
+	viewerIDHeader,
+	quotaTokenHeader,
+}, ", ")
+
+// setCORSHeaders allows browsers to call the API from the request's origin
+// if it is one of the configured origins. Without origins, all origins are
+// allowed unless API tokens are required.
+func (s *Web) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := "*"
+	if len(s.corsOrigins) > 0 || s.auth != nil {
+		w.Header().Add("Vary", "Origin")
+		origin = r.Header.Get("Origin")
+		if origin == "" || !slices.ContainsFunc(s.corsOrigins, func(o string) bool {
+			return o == "*" || strings.EqualFold(o, origin)
+		}) {
+			return
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+}
+
+// parseCORSOrigins parses comma-separated origins like
+// https://player.example.com, "*" allows all origins.
+func parseCORSOrigins(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// sessionMediaFile reports whether a session sub path is a playlist or
+// segment.
+func sessionMediaFile(subPath string) bool {
+	name := filepath.Base(subPath)
+	return strings.HasSuffix(name, ".m3u8") || strings.HasSuffix(name, ".ts") || strings.HasSuffix(name, ".vtt")
 }
@@ -1,12 +1,21 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	cp "github.com/webtor-io/content-prober/content-prober"
+	"github.com/webtor-io/lazymap"
 )
 
 func TestEnrichPlaylistData_EmptyQuery(t *testing.T) {
@@ -95,7 +104,7 @@ func TestIsSubtitlePlaylist(t *testing.T) {
 
 func TestSessionPlaylistHandler_MasterInjectsSessionOffset(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	sess := NewSession(SessionConfig{ID: "test-master-offset", HashDir: dir, RunMgr: runMgr})
@@ -130,7 +139,7 @@ func TestSessionPlaylistHandler_MasterInjectsSessionOffset(t *testing.T) {
 
 func TestSessionPlaylistHandler_MasterIdempotent(t *testing.T) {
 	dir := t.TempDir()
-	runMgr := NewRunManager()
+	runMgr := NewRunManager(RunManagerConfig{})
 	defer runMgr.CloseAll()
 
 	sess := NewSession(SessionConfig{ID: "test-master-idemp", HashDir: dir, RunMgr: runMgr})
@@ -169,3 +178,314 @@ func TestEmptySubtitlePlaylist_IsValidHLS(t *testing.T) {
 		t.Error("must NOT contain ENDLIST — player should keep polling for segments")
 	}
 }
+
+func newSimulatedWeb(t *testing.T) *Web {
+	t.Helper()
+	return newSimulatedWebWithStore(t, nil)
+}
+
+func newSimulatedWebWithStore(t *testing.T, store SessionStore) *Web {
+	t.Helper()
+	// Created first, so it is removed after runs stopped writing to it
+	output := t.TempDir()
+	rm := NewRunManager(RunManagerConfig{
+		Transcoder: &SimulatedTranscoder{SegmentInterval: time.Millisecond},
+	})
+	sm := NewSessionManager(rm, store, nil)
+	t.Cleanup(func() {
+		sm.CloseAll()
+		rm.CloseAll()
+	})
+	web := &Web{
+		output: output,
+		contentProbe: &ContentProbe{
+			prober:  &SimulatedProber{},
+			timeout: 10,
+			LazyMap: lazymap.New[*cp.ProbeReply](&lazymap.Config{}),
+		},
+		hlsBuilder:     &HLSBuilder{aacCodec: "aac"},
+		sessionManager: sm,
+		touchMap:       NewTouchMap(),
+	}
+	web.buildHandler()
+	return web
+}
+
+func TestWebSimulatedSession(t *testing.T) {
+	web := newSimulatedWeb(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20"), nil)
+	w := httptest.NewRecorder()
+	web.handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Duration != 20 {
+		t.Errorf("duration: got %.1f, want 20", resp.Duration)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		web.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w = get("/session/" + resp.ID + "/index.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720.m3u8") {
+		t.Fatalf("master: status = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	w = get("/session/" + resp.ID + "/v0-720.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v0-720-0.ts") {
+		t.Fatalf("variant: status = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	w = get("/session/" + resp.ID + "/v0-720-4.ts")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 || w.Body.Bytes()[0] != 0x47 {
+		t.Fatalf("segment: status = %d, len=%d", w.Code, w.Body.Len())
+	}
+	w = get("/session/" + resp.ID + "/a0-4.ts")
+	if w.Code != http.StatusOK {
+		t.Fatalf("audio segment: status = %d", w.Code)
+	}
+}
+
+// headerRecordingProber records the source headers it was called with.
+type headerRecordingProber struct {
+	SimulatedProber
+	headers http.Header
+}
+
+func (p *headerRecordingProber) Probe(ctx context.Context, input string, headers http.Header) (*cp.ProbeReply, error) {
+	p.headers = headers
+	return p.SimulatedProber.Probe(ctx, input, headers)
+}
+
+func TestWebSourceHeaders(t *testing.T) {
+	web := newSimulatedWeb(t)
+	prober := &headerRecordingProber{}
+	web.contentProbe.prober = prober
+
+	r := httptest.NewRequest(http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20"), nil)
+	r.Header.Add("X-Source-Header", "Authorization: Bearer secret")
+	r.Header.Add("X-Source-Header", "cookie: a=1")
+	r.Header.Add("X-Source-Header", "Cookie: b=2")
+	w := httptest.NewRecorder()
+	web.handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	if prober.headers.Get("Authorization") != "Bearer secret" || len(prober.headers.Values("Cookie")) != 2 {
+		t.Errorf("probe should get source headers, got %v", prober.headers)
+	}
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := web.sessionManager.Get(resp.ID).h.GetFFmpegParams("/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Authorization: Bearer secret\r\nCookie: a=1\r\nCookie: b=2\r\n"
+	idx := slices.Index(params, "-headers")
+	if idx < 0 || params[idx+1] != want || !slices.Contains(params[idx:], "-i") {
+		t.Errorf("ffmpeg should get -headers before -i, got %q", params)
+	}
+	if redacted := strings.Join(redactParams(params), " "); strings.Contains(redacted, "secret") {
+		t.Errorf("redacted params leak headers: %s", redacted)
+	}
+
+	w = httptest.NewRecorder()
+	web.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/"+resp.ID+"/v0-720.m3u8", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("variant: status = %d, body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestParseSourceHeaders(t *testing.T) {
+	h, err := parseSourceHeaders([]string{"user-agent: VLC/3.0", "Referer:https://example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("User-Agent") != "VLC/3.0" || h.Get("Referer") != "https://example.com/" {
+		t.Errorf("unexpected headers %v", h)
+	}
+	for _, line := range []string{"no-colon", ": value", "Bad Name: v", "Range: bytes=0-", "Host: example.com"} {
+		if _, err := parseSourceHeaders([]string{line}); err == nil {
+			t.Errorf("%q should be rejected", line)
+		}
+	}
+}
+
+// newRunningTestSession registers a session whose run is marked running
+// without a transcoder, so tests control the files it produces.
+func newRunningTestSession(t *testing.T, web *Web) (*Session, *TranscodeRun) {
+	t.Helper()
+	dir := t.TempDir()
+	run := newTranscodeRun(runKey(dir, 0), dir, 0, "", nil)
+	run.running = true
+	run.done = make(chan struct{})
+	run.AddRef()
+	if err := os.MkdirAll(run.OutputDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSession(SessionConfig{ID: "growing", HashDir: dir, RunMgr: web.sessionManager.runMgr})
+	s.run = run
+	web.sessionManager.mu.Lock()
+	web.sessionManager.sessions[s.id] = s
+	web.sessionManager.mu.Unlock()
+	t.Cleanup(func() {
+		close(run.done)
+	})
+	return s, run
+}
+
+func TestSessionWaitForFinalizedSegment(t *testing.T) {
+	web := newSimulatedWeb(t)
+	s, run := newRunningTestSession(t, web)
+	seg := filepath.Join(run.OutputDir(), "v0-720-0.ts")
+	if err := os.WriteFile(seg, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForSegment(ctx, "v0-720-0.ts", time.Minute); err == nil {
+		t.Fatal("segment not listed in the playlist must not be served")
+	}
+	if err := s.WaitForSegmentFile(context.Background(), "v0-720-0.ts", time.Minute); err != nil {
+		t.Errorf("growing segment file should be found: %v", err)
+	}
+	writeRunPlaylist(t, run, "v0-720.m3u8", 1, false)
+	if err := s.WaitForSegment(context.Background(), "v0-720-0.ts", time.Minute); err != nil {
+		t.Errorf("listed segment should be served: %v", err)
+	}
+}
+
+func TestWebChunkedGrowingSegment(t *testing.T) {
+	web := newSimulatedWeb(t)
+	web.chunked = true
+	s, run := newRunningTestSession(t, web)
+	srv := httptest.NewServer(web.handler)
+	t.Cleanup(srv.Close)
+
+	seg := filepath.Join(run.OutputDir(), "v0-720-0.ts")
+	first := strings.Repeat("a", 1000)
+	if err := os.WriteFile(seg, []byte(first), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(srv.URL + "/session/" + s.id + "/v0-720-0.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ContentLength != -1 || !slices.Contains(res.TransferEncoding, "chunked") {
+		t.Fatalf("growing segment should be chunked, status %d, length %d", res.StatusCode, res.ContentLength)
+	}
+	buf := make([]byte, len(first))
+	if _, err := io.ReadFull(res.Body, buf); err != nil || string(buf) != first {
+		t.Fatalf("first chunk mismatch (%v)", err)
+	}
+
+	// FFmpeg finishes the segment, then lists it
+	f, err := os.OpenFile(seg, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("bbb")
+	f.Close()
+	writeRunPlaylist(t, run, "v0-720.m3u8", 1, false)
+
+	rest, err := io.ReadAll(res.Body)
+	if err != nil || string(rest) != "bbb" {
+		t.Errorf("rest of the segment: got %q (%v)", rest, err)
+	}
+}
+
+func TestStripQueryParam(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":                              "",
+		"access_token=t":                "",
+		"a=1&access_token=t&b=2":        "a=1&b=2",
+		"access%5Ftoken=t&b=%20&b=2":    "b=%20&b=2",
+		"access_tokens=t&access_token=": "access_tokens=t",
+	} {
+		if got := stripQueryParam(raw, jwtQueryParam); got != want {
+			t.Errorf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestWebCORS(t *testing.T) {
+	web := newSimulatedWeb(t)
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/session", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		web.handler.ServeHTTP(w, r)
+		return w
+	}
+	if w := preflight("https://a.example.com"); w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("open API: status = %d, origin = %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	allowed := preflight("https://a.example.com").Header().Get("Access-Control-Allow-Headers")
+	for _, h := range []string{"Authorization", "X-Source-Url", sourceHeaderHeader, viewerIDHeader, quotaTokenHeader} {
+		if !strings.Contains(allowed, h) {
+			t.Errorf("preflight should allow header %s, got %q", h, allowed)
+		}
+	}
+
+	// With API tokens only configured origins are allowed
+	web.auth = &JWTAuth{secret: []byte("secret")}
+	if w := preflight("https://a.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("origin allowed without configuration: %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	web.corsOrigins = parseCORSOrigins(" https://a.example.com/ ,https://b.example.com")
+	for origin, allowed := range map[string]bool{
+		"https://a.example.com":    true,
+		"https://B.example.com":    true,
+		"https://evil.example.com": false,
+	} {
+		w := preflight(origin)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got == origin) != allowed || w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: allowed origin = %q, vary = %q", origin, got, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestWebJWTWithoutSigningKeepsToken(t *testing.T) {
+	web := newSimulatedWeb(t)
+	secret := []byte("secret")
+	web.auth = &JWTAuth{secret: secret}
+	token := testJWT(t, "HS256", "", AuthClaims{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()}, secret, nil)
+	auth := jwtQueryParam + "=" + token
+
+	w := serveTestRequest(web, http.MethodPost, "/session?source_url="+url.QueryEscape("sim://host/movie.mkv?duration=20")+"&"+auth)
+	var resp sessionCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("create: status = %d, body=%s", w.Code, w.Body.String())
+	}
+	base := "/session/" + resp.ID + "/"
+	// Players that can not set headers follow the references only
+	w = serveTestRequest(web, http.MethodGet, base+"index.m3u8?"+auth)
+	if w.Code != http.StatusOK {
+		t.Fatalf("master: status = %d", w.Code)
+	}
+	variant := playlistRef(t, w.Body.String(), "v0-720.m3u8")
+	if !strings.Contains(variant, auth) {
+		t.Errorf("variant reference %s should carry the token", variant)
+	}
+	w = serveTestRequest(web, http.MethodGet, base+variant)
+	if w.Code != http.StatusOK {
+		t.Fatalf("variant: status = %d", w.Code)
+	}
+	segment := playlistRef(t, w.Body.String(), "v0-720-0.ts")
+	if w := serveTestRequest(web, http.MethodGet, base+segment); w.Code != http.StatusOK {
+		t.Errorf("segment: status = %d", w.Code)
+	}
+}
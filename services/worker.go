@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	WorkerModeFlag          = "worker"
+	workerHostFlag          = "worker-host"
+	workerPortFlag          = "worker-port"
+	workerCapacityFlag      = "worker-capacity"
+	workerAdvertiseAddrFlag = "worker-advertise-addr"
+	workerRegistryAddrFlag  = "worker-registry-addr"
+	workerTokenFlag         = "worker-token"
+	workerTLSCertFlag       = "worker-tls-cert"
+	workerTLSKeyFlag        = "worker-tls-key"
+	workerTLSCAFlag         = "worker-tls-ca"
+	workerInsecureFlag      = "worker-insecure"
+)
+
+const (
+	workerHeartbeatInterval = 5 * time.Second
+	workerExpiry            = 15 * time.Second // drop workers without heartbeat
+)
+
+func RegisterWorkerFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.BoolFlag{
+		Name:   WorkerModeFlag,
+		Usage:  "run as remote transcoding worker instead of serving HTTP, --output must be storage shared with the coordinator",
+		EnvVar: "WORKER",
+	}, cli.StringFlag{
+		Name:   workerHostFlag,
+		Usage:  "worker listening host",
+		Value:  "127.0.0.1",
+		EnvVar: "WORKER_HOST",
+	}, cli.IntFlag{
+		Name:   workerPortFlag,
+		Usage:  "worker listening port",
+		Value:  50052,
+		EnvVar: "WORKER_PORT",
+	}, cli.IntFlag{
+		Name:   workerCapacityFlag,
+		Usage:  "max concurrent runs on this worker",
+		Value:  4,
+		EnvVar: "WORKER_CAPACITY",
+	}, cli.StringFlag{
+		Name:   workerAdvertiseAddrFlag,
+		Usage:  "address the coordinator uses to reach this worker (default: host:port)",
+		EnvVar: "WORKER_ADVERTISE_ADDR",
+	}, cli.StringFlag{
+		Name:   workerRegistryAddrFlag,
+		Usage:  "address of the coordinator worker registry",
+		EnvVar: "WORKER_REGISTRY_ADDR",
+	}, cli.StringFlag{
+		Name:   workerTokenFlag,
+		Usage:  "shared secret authenticating workers and the worker registry to each other, required by both",
+		EnvVar: "WORKER_TOKEN",
+	}, cli.StringFlag{
+		Name:   workerTLSCertFlag,
+		Usage:  "TLS certificate presented on worker connections",
+		EnvVar: "WORKER_TLS_CERT",
+	}, cli.StringFlag{
+		Name:   workerTLSKeyFlag,
+		Usage:  "TLS key of the worker certificate",
+		EnvVar: "WORKER_TLS_KEY",
+	}, cli.StringFlag{
+		Name:   workerTLSCAFlag,
+		Usage:  "CA verifying worker connection peers, also requires peers to present a certificate (default: system roots, no client certificates)",
+		EnvVar: "WORKER_TLS_CA",
+	}, cli.BoolFlag{
+		Name:   workerInsecureFlag,
+		Usage:  "allow worker connections without TLS, sending the worker token and jobs in plaintext",
+		EnvVar: "WORKER_INSECURE",
+	})
+}
+
+// Worker serves transcoding jobs dispatched by a coordinator's WorkerPool.
+// Segments are written with the worker's local Transcoder into the job's
+// output dir, which must be on storage shared with the coordinator and
+// within the worker's output location.
+type Worker struct {
+	host          string
+	port          int
+	capacity      int
+	advertiseAddr string
+	registryAddr  string
+	token         string
+	transport     *workerTransport
+	output        string
+	transcoder    Transcoder
+
+	mu     sync.Mutex
+	active int
+	srv    *grpc.Server
+	closed bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewWorker(c *cli.Context, transcoder Transcoder) (*Worker, error) {
+	w := &Worker{
+		host:          c.String(workerHostFlag),
+		port:          c.Int(workerPortFlag),
+		capacity:      c.Int(workerCapacityFlag),
+		advertiseAddr: c.String(workerAdvertiseAddrFlag),
+		registryAddr:  c.String(workerRegistryAddrFlag),
+		token:         c.String(workerTokenFlag),
+		output:        c.String(OutputFlag),
+		transcoder:    transcoder,
+		done:          make(chan struct{}),
+	}
+	if w.token == "" {
+		return nil, errors.Errorf("--%s is required in worker mode", workerTokenFlag)
+	}
+	t, err := newWorkerTransportFromFlags(c)
+	if err != nil {
+		return nil, err
+	}
+	w.transport = t
+	if w.advertiseAddr == "" {
+		w.advertiseAddr = fmt.Sprintf("%s:%d", w.host, w.port)
+	}
+	return w, nil
+}
+
+func (s *Worker) Serve() error {
+	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind address")
+	}
+	log.Infof("serving Worker at %v", addr)
+	return s.serve(ln)
+}
+
+func (s *Worker) serve(ln net.Listener) error {
+	srv := s.transport.newServer(s.token)
+	srv.RegisterService(&workerServiceDesc, s)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.srv = srv
+	s.mu.Unlock()
+	if s.registryAddr != "" {
+		go s.heartbeat()
+	}
+	return srv.Serve(ln)
+}
+
+// heartbeat registers the worker with the coordinator periodically,
+// reporting capacity and current load.
+func (s *Worker) heartbeat() {
+	conn, err := s.transport.dial(s.registryAddr, s.token)
+	if err != nil {
+		log.WithError(err).Error("worker: failed to dial registry")
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(workerHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), workerHeartbeatInterval)
+		err := registerWorker(ctx, conn, &workerRegisterRequest{
+			Addr:     s.advertiseAddr,
+			Capacity: s.capacity,
+			Active:   s.Active(),
+		})
+		cancel()
+		if err != nil {
+			log.WithError(err).Warn("worker: failed to register")
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Active returns the number of jobs currently running on the worker.
+func (s *Worker) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *Worker) acquireSlot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active >= s.capacity {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *Worker) releaseSlot() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+// Transcode runs a single job until it exits, the client asks to stop, or
+// the stream is gone.
+func (s *Worker) Transcode(job *workerJob, stream grpc.ServerStream) error {
+	if !s.acquireSlot() {
+		return status.Error(codes.ResourceExhausted, "worker at capacity")
+	}
+	defer s.releaseSlot()
+
+	logger := log.WithFields(log.Fields{
+		"outputDir": job.OutputDir,
+		"seekTime":  fmt.Sprintf("%.3f", job.SeekTime),
+	})
+	if !withinOutput(s.output, job.OutputDir) {
+		logger.Warn("worker: output dir outside of output location")
+		return status.Error(codes.PermissionDenied, "output dir outside of output location")
+	}
+	if err := os.MkdirAll(job.OutputDir, 0755); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proc, err := s.transcoder.Transcode(ctx, &TranscodeJob{
+		HLS:       job.HLS(),
+		OutputDir: job.OutputDir,
+		SeekTime:  job.SeekTime,
+		Logger:    logger,
+
+		LowPriority: job.LowPriority,
+	})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	logger.WithField("pid", proc.Pid()).Info("worker: job started")
+	if err := stream.SendMsg(&workerEvent{Type: workerEventStarted, Pid: proc.Pid()}); err != nil {
+		proc.Stop()
+		return err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		_ = stream.RecvMsg(&workerControl{})
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- proc.Wait()
+	}()
+
+	var waitErr error
+	select {
+	case <-stop:
+		logger.Info("worker: stopping job")
+		proc.Stop()
+		waitErr = <-exited
+	case <-stream.Context().Done():
+		proc.Stop()
+		return stream.Context().Err()
+	case waitErr = <-exited:
+	}
+	ev := &workerEvent{Type: workerEventExited}
+	if waitErr != nil {
+		ev.Error = waitErr.Error()
+	}
+	logger.WithField("error", ev.Error).Info("worker: job exited")
+	return stream.SendMsg(ev)
+}
+
+func (s *Worker) Close() {
+	log.Info("closing Worker")
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.mu.Lock()
+	s.closed = true
+	srv := s.srv
+	s.mu.Unlock()
+	if srv != nil {
+		srv.Stop()
+	}
+}
+
+// withinOutput reports whether dir is below the output location, a path or
+// a "prefix*" pattern of output roots as taken by GetDir.
+func withinOutput(location string, dir string) bool {
+	if location == "" {
+		return false
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	prefix, glob := strings.CutSuffix(location, "*")
+	root, err := filepath.Abs(prefix)
+	if err != nil {
+		return false
+	}
+	if glob && !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		// Roots are siblings named prefix..., e.g. /data/out1 for /data/out*
+		parent, name := filepath.Split(root)
+		rel, err := filepath.Rel(parent, dir)
+		if err != nil {
+			return false
+		}
+		first, rest, _ := strings.Cut(rel, string(os.PathSeparator))
+		return strings.HasPrefix(first, name) && first != ".." && rest != ""
+	}
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
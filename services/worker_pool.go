@@ -0,0 +1,318 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+)
+
+const (
+	workerRegistryHostFlag  = "worker-registry-host"
+	workerRegistryPortFlag  = "worker-registry-port"
+	workerLocalFallbackFlag = "worker-local-fallback"
+)
+
+func RegisterWorkerPoolFlags(f []cli.Flag) []cli.Flag {
+	return append(f, cli.StringFlag{
+		Name:   workerRegistryHostFlag,
+		Usage:  "worker registry listening host",
+		Value:  "",
+		EnvVar: "WORKER_REGISTRY_HOST",
+	}, cli.IntFlag{
+		Name:   workerRegistryPortFlag,
+		Usage:  "worker registry listening port, enables dispatching runs to remote workers, which write to --output so it must be storage shared with them (0 disables)",
+		Value:  0,
+		EnvVar: "WORKER_REGISTRY_PORT",
+	}, cli.BoolTFlag{
+		Name:   workerLocalFallbackFlag,
+		Usage:  "transcode locally when no remote worker has free capacity",
+		EnvVar: "WORKER_LOCAL_FALLBACK",
+	})
+}
+
+// WorkerPool is a Transcoder that dispatches runs to remote workers.
+// Workers register themselves through the registry service with periodic
+// heartbeats; runs are placed on the healthy worker with the most free
+// capacity.
+type WorkerPool struct {
+	host      string
+	port      int
+	token     string
+	transport *workerTransport
+	local     Transcoder // used when no worker has capacity, may be nil
+
+	mu      sync.Mutex
+	workers map[string]*remoteWorker
+	srv     *grpc.Server
+	ln      net.Listener
+	closed  bool
+}
+
+type remoteWorker struct {
+	addr     string
+	capacity int
+	active   int // reported by the last heartbeat
+	running  int // jobs placed by this pool that are still running
+	lastSeen time.Time
+	conn     *grpc.ClientConn
+}
+
+func (w *remoteWorker) free() int {
+	return w.capacity - max(w.active, w.running)
+}
+
+func NewWorkerPool(c *cli.Context, local Transcoder) (*WorkerPool, error) {
+	if c.Int(workerRegistryPortFlag) == 0 {
+		return nil, nil
+	}
+	p := &WorkerPool{
+		host:    c.String(workerRegistryHostFlag),
+		port:    c.Int(workerRegistryPortFlag),
+		token:   c.String(workerTokenFlag),
+		workers: make(map[string]*remoteWorker),
+	}
+	if p.token == "" {
+		return nil, errors.Errorf("--%s is required with the worker registry", workerTokenFlag)
+	}
+	t, err := newWorkerTransportFromFlags(c)
+	if err != nil {
+		return nil, err
+	}
+	p.transport = t
+	if c.BoolT(workerLocalFallbackFlag) {
+		p.local = local
+	}
+	return p, nil
+}
+
+func (s *WorkerPool) Serve() error {
+	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	ln, err := listen(listenerWorkerRegistry, addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind address")
+	}
+	log.Infof("serving WorkerPool registry at %v", addr)
+	return s.serve(ln)
+}
+
+func (s *WorkerPool) handoverListener() (string, net.Listener) {
+	if s == nil {
+		return listenerWorkerRegistry, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listenerWorkerRegistry, s.ln
+}
+
+func (s *WorkerPool) serve(ln net.Listener) error {
+	srv := s.transport.newServer(s.token)
+	srv.RegisterService(&workerRegistryServiceDesc, s)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.ln = ln
+	s.srv = srv
+	s.mu.Unlock()
+	return srv.Serve(ln)
+}
+
+func (s *WorkerPool) Close() {
+	log.Info("closing WorkerPool")
+	s.mu.Lock()
+	s.closed = true
+	srv := s.srv
+	s.mu.Unlock()
+	// Stop waits for registry handlers, which take the lock
+	if srv != nil {
+		srv.Stop()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, w := range s.workers {
+		_ = w.conn.Close()
+		delete(s.workers, addr)
+	}
+}
+
+// Register handles worker heartbeats.
+func (s *WorkerPool) Register(ctx context.Context, req *workerRegisterRequest) (*workerRegisterReply, error) {
+	if req.Addr == "" {
+		return nil, errors.New("missing worker address")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.workers[req.Addr]
+	if !ok {
+		conn, err := s.transport.dial(req.Addr, s.token)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to dial worker")
+		}
+		w = &remoteWorker{addr: req.Addr, conn: conn}
+		s.workers[req.Addr] = w
+		log.WithFields(log.Fields{
+			"worker":   req.Addr,
+			"capacity": req.Capacity,
+		}).Info("workerPool: worker registered")
+	}
+	w.capacity = req.Capacity
+	w.active = req.Active
+	w.lastSeen = time.Now()
+	return &workerRegisterReply{}, nil
+}
+
+// candidates returns healthy workers with free capacity, most free first.
+// Workers without a recent heartbeat are dropped.
+func (s *WorkerPool) candidates() []*remoteWorker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*remoteWorker
+	for addr, w := range s.workers {
+		if time.Since(w.lastSeen) > workerExpiry {
+			log.WithField("worker", addr).Warn("workerPool: worker expired")
+			_ = w.conn.Close()
+			delete(s.workers, addr)
+			continue
+		}
+		if w.free() > 0 {
+			res = append(res, w)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].free() != res[j].free() {
+			return res[i].free() > res[j].free()
+		}
+		return res[i].addr < res[j].addr
+	})
+	return res
+}
+
+func (s *WorkerPool) Transcode(ctx context.Context, job *TranscodeJob) (TranscodeProcess, error) {
+	if job.HLS == nil {
+		return nil, errors.New("no streams to transcode")
+	}
+	for _, w := range s.candidates() {
+		s.mu.Lock()
+		w.running++
+		s.mu.Unlock()
+		p, err := s.transcodeRemote(ctx, w, job)
+		if err == nil {
+			return p, nil
+		}
+		s.mu.Lock()
+		w.running--
+		s.mu.Unlock()
+		job.Logger.WithError(err).WithField("worker", w.addr).Warn("workerPool: failed to start run on worker")
+	}
+	if s.local != nil {
+		job.Logger.Info("workerPool: no remote capacity, transcoding locally")
+		return s.local.Transcode(ctx, job)
+	}
+	return nil, errors.New("no transcoding worker available")
+}
+
+func (s *WorkerPool) transcodeRemote(ctx context.Context, w *remoteWorker, job *TranscodeJob) (TranscodeProcess, error) {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream, err := openWorkerTranscodeStream(streamCtx, w.conn)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.SendMsg(newWorkerJob(job)); err != nil {
+		cancel()
+		return nil, err
+	}
+	ev := &workerEvent{}
+	if err := stream.RecvMsg(ev); err != nil {
+		cancel()
+		return nil, err
+	}
+	if ev.Type != workerEventStarted {
+		cancel()
+		return nil, errors.Errorf("unexpected worker event %s", ev.Type)
+	}
+	job.Logger.WithFields(log.Fields{
+		"worker":    w.addr,
+		"workerPid": ev.Pid,
+	}).Info("workerPool: run started on worker")
+
+	p := &remoteProcess{
+		stream: stream,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		defer func() {
+			s.mu.Lock()
+			w.running--
+			s.mu.Unlock()
+		}()
+		for {
+			ev := &workerEvent{}
+			if err := stream.RecvMsg(ev); err != nil {
+				p.err = errors.Wrap(err, "worker stream failed")
+				return
+			}
+			if ev.Type == workerEventExited {
+				if ev.Error != "" {
+					p.err = errors.New(ev.Error)
+				}
+				return
+			}
+		}
+	}()
+	// Mirror exec.CommandContext: the run context ending stops the process
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-p.done:
+		}
+	}()
+	return p, nil
+}
+
+// remoteProcess is a run executing on a remote worker.
+type remoteProcess struct {
+	stream   grpc.ClientStream
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+	stopOnce sync.Once
+}
+
+// Pid returns 0: the process does not run on this host.
+func (p *remoteProcess) Pid() int {
+	return 0
+}
+
+func (p *remoteProcess) Wait() error {
+	<-p.done
+	p.cancel()
+	return p.err
+}
+
+// Stop asks the worker to stop the process gracefully and waits for it to
+// report the exit, dropping the stream if the worker does not answer.
+func (p *remoteProcess) Stop() {
+	p.stopOnce.Do(func() {
+		_ = p.stream.SendMsg(&workerControl{Stop: true})
+		select {
+		case <-p.done:
+		case <-time.After(2 * runGracefulStopTimeout):
+			p.cancel()
+			<-p.done
+		}
+	})
+	<-p.done
+}
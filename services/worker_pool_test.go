@@ -0,0 +1,325 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func startTestWorkerPool(t *testing.T, transport *workerTransport) (*WorkerPool, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &WorkerPool{token: testWorkerToken, transport: transport, workers: make(map[string]*remoteWorker)}
+	go p.serve(ln)
+	t.Cleanup(p.Close)
+	return p, ln.Addr().String()
+}
+
+const testWorkerToken = "worker-secret"
+
+var insecureWorkerTransport = &workerTransport{}
+
+// startTestWorker starts a worker writing below output.
+func startTestWorker(t *testing.T, transport *workerTransport, registryAddr string, output string, capacity int) *Worker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		capacity:      capacity,
+		advertiseAddr: ln.Addr().String(),
+		registryAddr:  registryAddr,
+		token:         testWorkerToken,
+		transport:     transport,
+		output:        output,
+		transcoder:    &SimulatedTranscoder{SegmentInterval: 20 * time.Millisecond},
+		done:          make(chan struct{}),
+	}
+	go w.serve(ln)
+	t.Cleanup(w.Close)
+	return w
+}
+
+func waitForWorkers(t *testing.T, p *WorkerPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		got := len(p.workers)
+		p.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d workers to register", n)
+}
+
+func newTestTranscodeJob(t *testing.T, dir string, duration string) *TranscodeJob {
+	t.Helper()
+	pr, err := (&SimulatedProber{}).Probe(context.Background(), "sim://host/movie.mkv?duration="+duration, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &TranscodeJob{
+		HLS:       NewHLS("sim://host/movie.mkv", pr, &HLSConfig{aacCodec: "aac"}),
+		OutputDir: dir,
+		Logger:    log.WithField("test", t.Name()),
+	}
+}
+
+func TestWorkerPoolPlacement(t *testing.T) {
+	pool, registryAddr := startTestWorkerPool(t, insecureWorkerTransport)
+	dir := t.TempDir()
+	w1 := startTestWorker(t, insecureWorkerTransport, registryAddr, dir, 1)
+	w2 := startTestWorker(t, insecureWorkerTransport, registryAddr, dir, 1)
+	waitForWorkers(t, pool, 2)
+
+	p1, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, filepath.Join(dir, "1"), "600"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, filepath.Join(dir, "2"), "600"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1.Active() != 1 || w2.Active() != 1 {
+		t.Errorf("runs should be spread over workers, got active %d and %d", w1.Active(), w2.Active())
+	}
+
+	// Both workers are full and there is no local fallback
+	if _, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, filepath.Join(dir, "3"), "600")); err == nil {
+		t.Error("expected error when no worker has capacity")
+	}
+
+	p1.Stop()
+	if err := p1.Wait(); err == nil {
+		t.Error("stopped run should report an error")
+	}
+	p2.Stop()
+	// Slots are released right after the exit event is sent
+	deadline := time.Now().Add(time.Second)
+	for (w1.Active() != 0 || w2.Active() != 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w1.Active() != 0 || w2.Active() != 0 {
+		t.Errorf("workers should be idle after stop, got active %d and %d", w1.Active(), w2.Active())
+	}
+
+	// Freed capacity is reused
+	p3, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, filepath.Join(dir, "3"), "8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p3.Wait(); err != nil {
+		t.Errorf("finished run should not report an error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "3", "v0-720.m3u8.ffmpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := parseMediaPlaylist(data); !p.ended || len(p.segments) != 2 {
+		t.Errorf("worker should write a complete playlist to shared storage, got:\n%s", data)
+	}
+}
+
+func TestWorkerPoolLocalFallback(t *testing.T) {
+	pool, _ := startTestWorkerPool(t, insecureWorkerTransport)
+	pool.local = &SimulatedTranscoder{SegmentInterval: time.Millisecond}
+
+	p, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, t.TempDir(), "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("local run: %v", err)
+	}
+}
+
+func TestWorkerAuthentication(t *testing.T) {
+	pool, registryAddr := startTestWorkerPool(t, insecureWorkerTransport)
+	w := startTestWorker(t, insecureWorkerTransport, registryAddr, t.TempDir(), 1)
+	waitForWorkers(t, pool, 1)
+
+	for _, token := range []string{"", "other"} {
+		conn, err := insecureWorkerTransport.dial(registryAddr, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = registerWorker(context.Background(), conn, &workerRegisterRequest{Addr: "127.0.0.1:1", Capacity: 1})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("register with token %q: got %v, want Unauthenticated", token, err)
+		}
+		conn.Close()
+
+		conn, err = insecureWorkerTransport.dial(w.advertiseAddr, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := openWorkerTranscodeStream(context.Background(), conn)
+		if err == nil {
+			_ = stream.SendMsg(&workerJob{OutputDir: t.TempDir()})
+			err = stream.RecvMsg(&workerEvent{})
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("transcode with token %q: got %v, want Unauthenticated", token, err)
+		}
+		conn.Close()
+	}
+
+	// Jobs may only write below the worker's output location
+	if _, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, t.TempDir(), "4")); err == nil {
+		t.Error("job outside of the worker output should be rejected")
+	}
+}
+
+// writeTestWorkerCerts writes a CA and a certificate for 127.0.0.1 signed
+// by it, returning the cert, key and CA file names.
+func writeTestWorkerCerts(t *testing.T) (string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name string, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test worker CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "worker"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return write("worker.crt", "CERTIFICATE", der), write("worker.key", "EC PRIVATE KEY", keyDER), write("ca.crt", "CERTIFICATE", caDER)
+}
+
+func TestWorkerTLS(t *testing.T) {
+	if _, err := newWorkerTransport("", "", "", false); err == nil {
+		t.Error("plaintext transport without --worker-insecure should be refused")
+	}
+	cert, key, ca := writeTestWorkerCerts(t)
+	if _, err := newWorkerTransport("", "", ca, false); err == nil {
+		t.Error("CA without a certificate should be refused")
+	}
+	transport, err := newWorkerTransport(cert, key, ca, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, registryAddr := startTestWorkerPool(t, transport)
+	dir := t.TempDir()
+	startTestWorker(t, transport, registryAddr, dir, 1)
+	waitForWorkers(t, pool, 1)
+	p, err := pool.Transcode(context.Background(), newTestTranscodeJob(t, filepath.Join(dir, "a"), "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("run over TLS: %v", err)
+	}
+
+	// Neither plaintext clients nor clients without a certificate get in
+	serverOnly, err := newWorkerTransport(cert, key, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverOnly.tls.RootCAs = transport.tls.RootCAs
+	serverOnly.tls.Certificates = nil
+	for name, tr := range map[string]*workerTransport{
+		"plaintext":      insecureWorkerTransport,
+		"no certificate": serverOnly,
+	} {
+		conn, err := tr.dial(registryAddr, testWorkerToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = registerWorker(ctx, conn, &workerRegisterRequest{Addr: "127.0.0.1:1", Capacity: 1})
+		cancel()
+		if err == nil {
+			t.Errorf("register over %v connection should fail", name)
+		}
+		conn.Close()
+	}
+}
+
+func TestWithinOutput(t *testing.T) {
+	for _, tt := range []struct {
+		location string
+		dir      string
+		want     bool
+	}{
+		{"/data/out", "/data/out/abc/runs/seek-0.000", true},
+		{"/data/out", "/data/out", false},
+		{"/data/out", "/data/out/../etc", false},
+		{"/data/out", "/data/outside/abc", false},
+		{"/data/out", "/etc", false},
+		{"/data/out*", "/data/out1/abc", true},
+		{"/data/out*", "/data/out1", false},
+		{"/data/out*", "/data/other/abc", false},
+		{"/data/out*", "/data/out1/../../etc/abc", false},
+		{"/data/*", "/data/1/abc", true},
+		{"", "/data/out/abc", false},
+	} {
+		if got := withinOutput(tt.location, tt.dir); got != tt.want {
+			t.Errorf("withinOutput(%q, %q) = %v, want %v", tt.location, tt.dir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	cp "github.com/webtor-io/content-prober/content-prober"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Worker protocol. Messages are plain Go structs encoded as JSON over gRPC,
+// so no generated code is needed. Two services are defined:
+//
+//	TranscodeWorker/Transcode          (bidi stream, served by workers)
+//	TranscodeWorkerRegistry/Register   (unary, served by the coordinator)
+//
+// Transcode: the client sends a workerJob, the worker replies with a
+// "started" event, then an "exited" event once the process ends. Sending a
+// workerControl asks the worker to stop the process gracefully.
+//
+// Both services require the shared worker token in the "authorization"
+// metadata of every call. Connections use TLS unless both sides are started
+// with --worker-insecure.
+
+const (
+	workerEventStarted = "started"
+	workerEventExited  = "exited"
+)
+
+// workerJob is everything a worker needs to rebuild the HLS layout and
+// transcode a run into shared storage.
+type workerJob struct {
+	SourceURL               string         `json:"source_url"`
+	SourceHeaders           http.Header    `json:"source_headers,omitempty"`
+	Probe                   *cp.ProbeReply `json:"probe"`
+	StreamMode              StreamMode     `json:"stream_mode"`
+	AACCodec                string         `json:"aac_codec"`
+	DisableVideoTranscoding bool           `json:"disable_video_transcoding"`
+	SegmentDuration         int            `json:"segment_duration,omitempty"`
+	MaxHeight               uint           `json:"max_height,omitempty"`
+	OutputDir               string         `json:"output_dir"`
+	SeekTime                float64        `json:"seek_time"`
+	LowPriority             bool           `json:"low_priority,omitempty"`
+}
+
+type workerEvent struct {
+	Type  string `json:"type"`
+	Pid   int    `json:"pid,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type workerControl struct {
+	Stop bool `json:"stop"`
+}
+
+type workerRegisterRequest struct {
+	Addr     string `json:"addr"`
+	Capacity int    `json:"capacity"`
+	Active   int    `json:"active"`
+}
+
+type workerRegisterReply struct{}
+
+func newWorkerJob(job *TranscodeJob) *workerJob {
+	h := job.HLS
+	return &workerJob{
+		SourceURL:               h.in,
+		SourceHeaders:           h.headers,
+		Probe:                   h.probe,
+		StreamMode:              h.cfg.sm,
+		AACCodec:                h.cfg.aacCodec,
+		DisableVideoTranscoding: h.cfg.disableVideoTranscoding,
+		SegmentDuration:         h.cfg.segDuration,
+		MaxHeight:               h.cfg.maxHeight,
+		OutputDir:               job.OutputDir,
+		SeekTime:                job.SeekTime,
+		LowPriority:             job.LowPriority,
+	}
+}
+
+func (j *workerJob) HLS() *HLS {
+	h := NewHLS(j.SourceURL, j.Probe, &HLSConfig{
+		sm:                      j.StreamMode,
+		aacCodec:                j.AACCodec,
+		disableVideoTranscoding: j.DisableVideoTranscoding,
+		segDuration:             j.SegmentDuration,
+		maxHeight:               j.MaxHeight,
+	})
+	h.headers = j.SourceHeaders
+	return h
+}
+
+type workerCodec struct{}
+
+func (workerCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (workerCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (workerCodec) Name() string {
+	return "json"
+}
+
+const workerAuthKey = "authorization"
+
+// workerTokenCredentials sends the shared worker token with every call.
+type workerTokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c workerTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{workerAuthKey: "Bearer " + c.token}, nil
+}
+
+func (c workerTokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// checkWorkerToken returns an error unless the call carries token.
+func checkWorkerToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(workerAuthKey) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid worker token")
+}
+
+// workerTransport holds the transport credentials of worker connections.
+// Both the coordinator and workers serve and dial, so each side presents
+// its certificate as server and, if the peer asks for it, as client.
+type workerTransport struct {
+	tls *tls.Config // nil for plaintext
+}
+
+// newWorkerTransport loads the TLS certificate, key and optional CA. With
+// a CA, peers must present a certificate signed by it; without one, system
+// roots verify servers. Plaintext is only used if allowInsecure is set.
+func newWorkerTransport(certFile, keyFile, caFile string, allowInsecure bool) (*workerTransport, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		if !allowInsecure {
+			return nil, errors.Errorf("--%s and --%s are required unless --%s is set", workerTLSCertFlag, workerTLSKeyFlag, workerInsecureFlag)
+		}
+		return &workerTransport{}, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.Errorf("both --%s and --%s are required", workerTLSCertFlag, workerTLSKeyFlag)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load worker certificate")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read worker CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %v", caFile)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &workerTransport{tls: cfg}, nil
+}
+
+func newWorkerTransportFromFlags(c *cli.Context) (*workerTransport, error) {
+	return newWorkerTransport(c.String(workerTLSCertFlag), c.String(workerTLSKeyFlag),
+		c.String(workerTLSCAFlag), c.Bool(workerInsecureFlag))
+}
+
+func (t *workerTransport) credentials() credentials.TransportCredentials {
+	if t.tls == nil {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(t.tls)
+}
+
+func (t *workerTransport) dial(addr string, token string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(t.credentials()),
+		grpc.WithPerRPCCredentials(workerTokenCredentials{token: token, secure: t.tls != nil}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(workerCodec{})),
+	)
+}
+
+// newServer returns a server only accepting calls with token.
+func (t *workerTransport) newServer(token string) *grpc.Server {
+	return grpc.NewServer(
+		grpc.Creds(t.credentials()),
+		grpc.ForceServerCodec(workerCodec{}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkWorkerToken(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkWorkerToken(ss.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+}
+
+type workerService interface {
+	Transcode(job *workerJob, stream grpc.ServerStream) error
+}
+
+type workerRegistryService interface {
+	Register(ctx context.Context, req *workerRegisterRequest) (*workerRegisterReply, error)
+}
+
+func workerTranscodeHandler(srv any, stream grpc.ServerStream) error {
+	job := &workerJob{}
+	if err := stream.RecvMsg(job); err != nil {
+		return err
+	}
+	return srv.(workerService).Transcode(job, stream)
+}
+
+func workerRegisterHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := &workerRegisterRequest{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(workerRegistryService).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TranscodeWorkerRegistry/Register",
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(workerRegistryService).Register(ctx, req.(*workerRegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var workerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "TranscodeWorker",
+	HandlerType: (*workerService)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Transcode",
+			Handler:       workerTranscodeHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+var workerRegistryServiceDesc = grpc.ServiceDesc{
+	ServiceName: "TranscodeWorkerRegistry",
+	HandlerType: (*workerRegistryService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    workerRegisterHandler,
+		},
+	},
+}
+
+func registerWorker(ctx context.Context, conn *grpc.ClientConn, req *workerRegisterRequest) error {
+	return conn.Invoke(ctx, "/TranscodeWorkerRegistry/Register", req, &workerRegisterReply{})
+}
+
+func openWorkerTranscodeStream(ctx context.Context, conn *grpc.ClientConn) (grpc.ClientStream, error) {
+	return conn.NewStream(ctx, &workerServiceDesc.Streams[0], "/TranscodeWorker/Transcode")
+}